@@ -3,214 +3,258 @@
 
 package main
 
-// import (
-// 	"encoding/json"
-// 	"os"
-// 	"time"
-
-// 	"github.com/ngaut/zkhelper"
-// 	"github.com/ledisdb/xcodis/models"
-
-// 	"sync/atomic"
-
-// 	stdlog "log"
-
-// 	"github.com/codegangsta/martini-contrib/binding"
-// 	"github.com/codegangsta/martini-contrib/render"
-// 	"github.com/docopt/docopt-go"
-// 	"github.com/go-martini/martini"
-// 	"github.com/martini-contrib/cors"
-
-// 	log "github.com/ngaut/logging"
-// )
-
-// func cmdDashboard(argv []string) (err error) {
-// 	usage := `usage: cconfig dashboard [--addr=<address>] [--http-log=<log_file>]
-
-// options:
-// 	--addr	listen ip:port, e.g. localhost:12345, :8086, [default: :8086]
-// 	--http-log	http request log [default: request.log ]
-// `
-
-// 	args, err := docopt.Parse(usage, argv, true, "", false)
-// 	if err != nil {
-// 		log.Error(err)
-// 		return err
-// 	}
-// 	log.Debug(args)
-
-// 	logFileName := "request.log"
-// 	if args["--http-log"] != nil {
-// 		logFileName = args["--http-log"].(string)
-// 	}
-
-// 	if args["--addr"] != nil {
-// 		runDashboard(args["--addr"].(string), logFileName)
-// 	} else {
-// 		runDashboard(":8086", logFileName)
-// 	}
-// 	return nil
-// }
-
-// var proxiesSpeed int64
-
-// func CreateZkConn() zkhelper.Conn {
-// 	conn, _ := zkhelper.ConnectToZk(zkAddr)
-// 	return conn
-// }
-
-// func jsonRet(output map[string]interface{}) (int, string) {
-// 	b, err := json.Marshal(output)
-// 	if err != nil {
-// 		log.Warning(err)
-// 	}
-// 	return 200, string(b)
-// }
-
-// func jsonRetFail(errCode int, msg string) (int, string) {
-// 	return jsonRet(map[string]interface{}{
-// 		"ret": errCode,
-// 		"msg": msg,
-// 	})
-// }
-
-// func jsonRetSucc() (int, string) {
-// 	return jsonRet(map[string]interface{}{
-// 		"ret": 0,
-// 		"msg": "OK",
-// 	})
-// }
-
-// func getAllProxyOps() int64 {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-// 	proxies, err := models.ProxyList(conn, productName, nil)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return -1
-// 	}
-
-// 	var total int64
-// 	for _, p := range proxies {
-// 		i, err := p.Ops()
-// 		if err != nil {
-// 			log.Warning(err)
-// 		}
-// 		total += i
-// 	}
-// 	return total
-// }
-
-// // for debug
-// func getAllProxyDebugVars() map[string]map[string]interface{} {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-// 	proxies, err := models.ProxyList(conn, productName, nil)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return nil
-// 	}
-
-// 	ret := make(map[string]map[string]interface{})
-// 	for _, p := range proxies {
-// 		m, err := p.DebugVars()
-// 		if err != nil {
-// 			log.Warning(err)
-// 		}
-// 		ret[p.Id] = m
-// 	}
-// 	return ret
-// }
-
-// func getProxySpeedChan() <-chan int64 {
-// 	c := make(chan int64)
-// 	go func(c chan int64) {
-// 		var lastCnt int64 = 0
-// 		for {
-// 			cnt := getAllProxyOps()
-// 			if lastCnt > 0 {
-// 				c <- cnt - lastCnt
-// 			}
-// 			lastCnt = cnt
-// 			time.Sleep(1 * time.Second)
-// 		}
-// 	}(c)
-// 	return c
-// }
-// func pageSlots(r render.Render) {
-// 	r.HTML(200, "slots", nil)
-// }
-
-// func runDashboard(addr string, httpLogFile string) {
-// 	log.Info("dashboard start listen in addr:", addr)
-// 	m := martini.Classic()
-// 	f, err := os.OpenFile(httpLogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-// 	if err != nil {
-// 		log.Fatalf("error opening file: %v", err)
-// 	}
-// 	defer f.Close()
-// 	m.Map(stdlog.New(f, "[martini]", stdlog.LstdFlags))
-
-// 	m.Use(martini.Static("assets/statics"))
-// 	m.Use(render.Renderer(render.Options{
-// 		Directory:  "assets/template",
-// 		Extensions: []string{".tmpl", ".html"},
-// 		Charset:    "UTF-8",
-// 		IndentJSON: true,
-// 	}))
-
-// 	m.Use(cors.Allow(&cors.Options{
-// 		AllowOrigins:     []string{"*"},
-// 		AllowMethods:     []string{"POST", "GET", "DELETE", "PUT"},
-// 		AllowHeaders:     []string{"Origin", "x-requested-with", "Content-Type", "Content-Range", "Content-Disposition", "Content-Description"},
-// 		ExposeHeaders:    []string{"Content-Length"},
-// 		AllowCredentials: false,
-// 	}))
-
-// 	m.Get("/api/server_groups", apiGetServerGroupList)
-// 	m.Get("/api/overview", apiOverview)
-
-// 	m.Get("/api/redis/:addr/stat", apiRedisStat)
-// 	m.Get("/api/redis/:addr/:id/slotinfo", apiGetRedisSlotInfo)
-// 	m.Get("/api/redis/group/:group_id/:slot_id/slotinfo", apiGetRedisSlotInfoFromGroupId)
-
-// 	m.Put("/api/server_groups", binding.Json(models.ServerGroup{}), apiAddServerGroup)
-// 	m.Put("/api/server_group/(?P<id>[0-9]+)/addServer", binding.Json(models.Server{}), apiAddServerToGroup)
-// 	m.Delete("/api/server_group/(?P<id>[0-9]+)", apiRemoveServerGroup)
-
-// 	m.Put("/api/server_group/(?P<id>[0-9]+)/removeServer", binding.Json(models.Server{}), apiRemoveServerFromGroup)
-// 	m.Get("/api/server_group/(?P<id>[0-9]+)", apiGetServerGroup)
-// 	m.Post("/api/server_group/(?P<id>[0-9]+)/promote", binding.Json(models.Server{}), apiPromoteServer)
-
-// 	m.Get("/api/migrate/status", apiMigrateStatus)
-// 	m.Get("/api/migrate/tasks", apiGetMigrateTasks)
-// 	m.Delete("/api/migrate/pending_task/:id/remove", apiRemovePendingMigrateTask)
-// 	m.Delete("/api/migrate/task/:id/stop", apiStopMigratingTask)
-// 	m.Post("/api/migrate", binding.Json(MigrateTaskForm{}), apiDoMigrate)
-
-// 	m.Post("/api/rebalance", apiRebalance)
-// 	m.Get("/api/rebalance/status", apiRebalanceStatus)
-
-// 	m.Get("/api/slot/list", apiGetSlots)
-// 	m.Get("/api/slots", apiGetSlots)
-// 	m.Post("/api/slot", binding.Json(RangeSetTask{}), apiSlotRangeSet)
-// 	m.Get("/api/proxy/list", apiGetProxyList)
-// 	m.Get("/api/proxy/debug/vars", apiGetProxyDebugVars)
-// 	m.Post("/api/proxy", binding.Json(models.ProxyInfo{}), apiSetProxyStatus)
-
-// 	m.Get("/slots", pageSlots)
-// 	m.Get("/", func(r render.Render) {
-// 		r.Redirect("/admin")
-// 	})
-
-// 	go func() {
-// 		c := getProxySpeedChan()
-// 		for {
-// 			atomic.StoreInt64(&proxiesSpeed, <-c)
-// 		}
-// 	}()
-
-// 	go migrateTaskWorker()
-
-// 	m.RunOnAddr(addr)
-// }
+import (
+	"crypto/subtle"
+	"encoding/json"
+	stdlog "log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+
+	"github.com/docopt/docopt-go"
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
+)
+
+func cmdDashboard(argv []string) (err error) {
+	usage := `usage: cconfig dashboard [--addr=<address>] [--http-log=<log_file>]
+
+options:
+   --addr=<address>  listen ip:port, e.g. localhost:12345, :8086 [default: :8086]
+   --http-log=<log_file>  http request log [default: request.log]
+
+requests need "Authorization: Bearer <dashboard_token>" if dashboard_token is set
+in the config file. SIGHUP reloads dashboard_token and the default migrate rates.
+`
+
+	args, err := docopt.Parse(usage, argv, true, "", false)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Debug(args)
+
+	return runDashboard(args["--addr"].(string), args["--http-log"].(string))
+}
+
+var proxiesSpeed int64
+
+//response of requests changing nothing but failed or of actions
+type apiResult struct {
+	Ret int    `json:"ret"` //0 if succeeded
+	Msg string `json:"msg"`
+}
+
+var apiSucc = &apiResult{Ret: 0, Msg: "OK"}
+
+//an api returns the value sent as json or an error
+type apiFunc func(r *http.Request) (interface{}, error)
+
+func jsonRet(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.MarshalIndent(v, " ", "  ")
+	if err != nil {
+		log.Warning(err)
+		code, b = http.StatusInternalServerError, []byte(`{"ret": -1, "msg": "encode response failed"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func jsonRetFail(w http.ResponseWriter, code int, msg string) {
+	jsonRet(w, code, &apiResult{Ret: -1, Msg: msg})
+}
+
+func errorCode(err error) int {
+	switch {
+	case errors.IsNotFound(err):
+		return http.StatusNotFound
+	case errors.IsNotValid(err):
+		return http.StatusBadRequest
+	case errors.IsAlreadyExists(err):
+		return http.StatusConflict
+	case errors.IsUnauthorized(err):
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+func (f apiFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v, err := f(r)
+	if err != nil {
+		log.Warning(errors.ErrorStack(err))
+		jsonRetFail(w, errorCode(errors.Cause(err)), err.Error())
+		return
+	}
+	jsonRet(w, http.StatusOK, v)
+}
+
+//checks the token of the config and logs every request
+type dashboardHandler struct {
+	router *mux.Router
+	logger *stdlog.Logger
+}
+
+func (h *dashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if want := getConf().String("dashboard_token"); len(want) > 0 {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			jsonRetFail(w, http.StatusUnauthorized, "invalid token")
+			h.logger.Printf("%s %s %s unauthorized", r.RemoteAddr, r.Method, r.URL)
+			return
+		}
+	}
+
+	h.router.ServeHTTP(w, r)
+	h.logger.Printf("%s %s %s %v", r.RemoteAddr, r.Method, r.URL, time.Since(start))
+}
+
+func getAllProxyOps() int64 {
+	proxies, err := models.ProxyList(zkConn, productName, nil)
+	if err != nil {
+		log.Warning(err)
+		return -1
+	}
+
+	var total int64
+	for _, p := range proxies {
+		i, err := p.Ops()
+		if err != nil {
+			log.Warning(err)
+		}
+		total += i
+	}
+	return total
+}
+
+// for debug
+func getAllProxyDebugVars() (map[string]map[string]interface{}, error) {
+	proxies, err := models.ProxyList(zkConn, productName, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ret := make(map[string]map[string]interface{})
+	for _, p := range proxies {
+		m, err := p.DebugVars()
+		if err != nil {
+			log.Warning(err)
+		}
+		ret[p.Id] = m
+	}
+	return ret, nil
+}
+
+func getProxySpeedChan() <-chan int64 {
+	c := make(chan int64)
+	go func(c chan int64) {
+		var lastCnt int64 = 0
+		for {
+			cnt := getAllProxyOps()
+			if lastCnt > 0 {
+				c <- cnt - lastCnt
+			}
+			lastCnt = cnt
+			time.Sleep(1 * time.Second)
+		}
+	}(c)
+	return c
+}
+
+func newDashboardRouter() *mux.Router {
+	m := mux.NewRouter()
+	m.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonRetFail(w, http.StatusNotFound, "no such api "+r.URL.Path)
+	})
+
+	api := func(method string, path string, f apiFunc) {
+		m.Handle(path, f).Methods(method)
+	}
+
+	api("GET", "/api/server_groups", apiGetServerGroupList)
+	api("GET", "/api/overview", apiOverview)
+
+	api("GET", "/api/redis/{addr}/stat", apiRedisStat)
+	api("GET", "/api/redis/{addr}/{id:[0-9]+}/slotinfo", apiGetRedisSlotInfo)
+	api("GET", "/api/redis/group/{group_id:[0-9]+}/{slot_id:[0-9]+}/slotinfo", apiGetRedisSlotInfoFromGroupId)
+
+	api("PUT", "/api/server_groups", apiAddServerGroup)
+	api("PUT", "/api/server_group/{id:[0-9]+}/addServer", apiAddServerToGroup)
+	api("DELETE", "/api/server_group/{id:[0-9]+}", apiRemoveServerGroup)
+
+	api("PUT", "/api/server_group/{id:[0-9]+}/removeServer", apiRemoveServerFromGroup)
+	api("GET", "/api/server_group/{id:[0-9]+}", apiGetServerGroup)
+	api("POST", "/api/server_group/{id:[0-9]+}/promote", apiPromoteServer)
+
+	api("GET", "/api/migrate/status", apiMigrateStatus)
+	api("GET", "/api/migrate/tasks", apiGetMigrateTasks)
+	api("DELETE", "/api/migrate/pending_task/{id}/remove", apiRemovePendingMigrateTask)
+	api("DELETE", "/api/migrate/task/{id}/stop", migrateRequestApi(models.MIGRATE_REQUEST_PAUSE))
+	api("POST", "/api/migrate/task/{id}/pause", migrateRequestApi(models.MIGRATE_REQUEST_PAUSE))
+	api("POST", "/api/migrate/task/{id}/resume", migrateRequestApi(""))
+	api("POST", "/api/migrate/task/{id}/cancel", migrateRequestApi(models.MIGRATE_REQUEST_CANCEL))
+	api("POST", "/api/migrate/task/{id}/limit", apiSetMigrateLimit)
+	api("POST", "/api/migrate", apiDoMigrate)
+
+	api("POST", "/api/rebalance", apiRebalance)
+	api("GET", "/api/rebalance/status", apiRebalanceStatus)
+	api("GET", "/api/rebalance/plan", apiRebalancePlan)
+
+	api("GET", "/api/slot/list", apiGetSlots)
+	api("GET", "/api/slots", apiGetSlots)
+	api("POST", "/api/slot", apiSlotRangeSet)
+	api("GET", "/api/proxy/list", apiGetProxyList)
+	api("GET", "/api/proxy/debug/vars", apiGetProxyDebugVars)
+	api("POST", "/api/proxy", apiSetProxyStatus)
+
+	return m
+}
+
+func runDashboard(addr string, httpLogFile string) error {
+	log.Info("dashboard start listen in addr:", addr)
+	f, err := os.OpenFile(httpLogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	if len(getConf().String("dashboard_token")) == 0 {
+		log.Warning("dashboard_token is not set, the dashboard api is open to anyone")
+	}
+
+	h := &dashboardHandler{
+		router: newDashboardRouter(),
+		logger: stdlog.New(f, "[dashboard]", stdlog.LstdFlags),
+	}
+
+	//an invalid file is not applied, the running config is kept
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			if err := reloadConf(); err != nil {
+				log.Errorf("reload config %s failed, %v", configFile, err)
+			}
+		}
+	}()
+
+	go func() {
+		c := getProxySpeedChan()
+		for {
+			atomic.StoreInt64(&proxiesSpeed, <-c)
+		}
+	}()
+
+	go migrateTaskWorker()
+
+	return errors.Trace(http.ListenAndServe(addr, h))
+}
@@ -3,507 +3,507 @@
 
 package main
 
-// import (
-// 	"encoding/json"
-// 	"fmt"
-// 	"strconv"
-// 	"sync"
-// 	"time"
-
-// 	"github.com/ledisdb/xcodis/models"
-// 	"github.com/ledisdb/xcodis/utils"
-
-// 	"github.com/go-martini/martini"
-// 	"github.com/nu7hatch/gouuid"
-
-// 	log "github.com/ngaut/logging"
-// )
-
-// type RangeSetTask struct {
-// 	FromSlot   int `json:"from"`
-// 	ToSlot     int `json:"to"`
-// 	NewGroupId int `json:"new_group"`
-// }
-
-// func apiGetProxyDebugVars() (int, string) {
-// 	m := getAllProxyDebugVars()
-// 	if m == nil {
-// 		return 500, "get proxy debug var error"
-// 	}
-
-// 	b, err := json.MarshalIndent(m, " ", "  ")
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-
-// 	return 200, string(b)
-// }
-
-// func apiOverview() (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	// get all server groups
-// 	groups, err := models.ServerGroups(conn, productName)
-// 	if err != nil {
-// 		log.Warning("get server groups error, maybe there is no any server groups? err:", err)
-// 		return 500, err.Error()
-// 	}
-
-// 	var instances []string
-
-// 	for _, group := range groups {
-// 		for _, srv := range group.Servers {
-// 			if srv.Type == "master" {
-// 				instances = append(instances, srv.Addr)
-// 			}
-// 		}
-// 	}
-
-// 	var info map[string]interface{} = make(map[string]interface{})
-// 	info["product"] = productName
-// 	info["ops"] = proxiesSpeed
-
-// 	var redisInfos []map[string]string = make([]map[string]string, 0)
-
-// 	if len(instances) > 0 {
-// 		for _, instance := range instances {
-// 			info, err := utils.GetRedisStat(instance)
-// 			if err != nil {
-// 				log.Error(err)
-// 			}
-// 			redisInfos = append(redisInfos, info)
-// 		}
-// 	}
-// 	info["redis_infos"] = redisInfos
-
-// 	b, err := json.MarshalIndent(info, " ", "  ")
-// 	return 200, string(b)
-// }
-
-// func apiGetServerGroupList() (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-// 	groups, err := models.ServerGroups(conn, productName)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	b, err := json.MarshalIndent(groups, " ", "  ")
-// 	return 200, string(b)
-// }
-
-// func apiRedisStat(param martini.Params) (int, string) {
-// 	addr := param["addr"]
-// 	info, err := utils.GetRedisStat(addr)
-// 	if err != nil {
-// 		return 500, err.Error()
-// 	}
-// 	b, _ := json.MarshalIndent(info, " ", "  ")
-// 	return 200, string(b)
-// }
-
-// func apiDoMigrate(taskForm MigrateTaskForm, param martini.Params) (int, string) {
-// 	// do migrate async
-// 	taskForm.Percent = 0
-// 	taskForm.Status = "pending"
-// 	taskForm.CreateAt = strconv.FormatInt(time.Now().Unix(), 10)
-// 	u, err := uuid.NewV4()
-// 	if err != nil {
-// 		return 500, err.Error()
-// 	}
-// 	taskForm.Id = u.String()
-// 	task := &MigrateTask{
-// 		MigrateTaskForm: taskForm,
-// 		stopChan:        make(chan struct{}),
-// 	}
-
-// 	lck.Lock()
-// 	pendingMigrateTask.PushBack(task)
-// 	lck.Unlock()
-
-// 	return jsonRetSucc()
-// }
-
-// var isRebalancing bool
-// var rebalanceLck = sync.Mutex{}
-
-// func changeRebalanceStat(b bool) {
-// 	rebalanceLck.Lock()
-// 	defer rebalanceLck.Unlock()
-// 	isRebalancing = b
-// }
-
-// func isOnRebalancing() bool {
-// 	rebalanceLck.Lock()
-// 	defer rebalanceLck.Unlock()
-// 	return isRebalancing
-// }
-
-// func apiRebalanceStatus(param martini.Params) (int, string) {
-// 	ret := map[string]interface{}{
-// 		"is_rebalancing": isRebalancing,
-// 	}
-// 	b, _ := json.MarshalIndent(ret, " ", "  ")
-// 	return 200, string(b)
-// }
-
-// func apiRebalance(param martini.Params) (int, string) {
-// 	if isOnRebalancing() {
-// 		return 500, "rebalancing..."
-// 	}
-
-// 	go func() {
-// 		changeRebalanceStat(true)
-// 		defer changeRebalanceStat(false)
-
-// 		conn := CreateZkConn()
-// 		defer conn.Close()
-
-// 		if err := Rebalance(conn, 0); err != nil {
-// 			log.Warning(err.Error())
-// 		}
-// 	}()
-
-// 	return jsonRetSucc()
-// }
-
-// func apiGetMigrateTasks() (int, string) {
-// 	lck.RLock()
-// 	defer lck.RUnlock()
-
-// 	var tasks []*MigrateTask
-// 	for e := pendingMigrateTask.Front(); e != nil; e = e.Next() {
-// 		tasks = append(tasks, e.Value.(*MigrateTask))
-// 	}
-
-// 	b, _ := json.MarshalIndent(tasks, " ", "  ")
-
-// 	return 200, string(b)
-// }
-
-// func apiRemovePendingMigrateTask(param martini.Params) (int, string) {
-// 	lck.Lock()
-// 	defer lck.Unlock()
-// 	id := param["id"]
-// 	if removePendingMigrateTask(id) == true {
-// 		return jsonRetSucc()
-// 	}
-// 	return 500, "remove task error"
-// }
-
-// func apiStopMigratingTask(param martini.Params) (int, string) {
-// 	lck.RLock()
-// 	defer lck.RUnlock()
-// 	if curMigrateTask != nil {
-// 		curMigrateTask.Status = "stopping"
-// 		curMigrateTask.stopChan <- struct{}{}
-// 	}
-// 	return jsonRetSucc()
-// }
-
-// func apiGetServerGroup(param martini.Params) (int, string) {
-// 	id := param["id"]
-// 	groupId, err := strconv.Atoi(id)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-// 	group, err := models.GetGroup(conn, productName, groupId)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	b, err := json.MarshalIndent(group, " ", "  ")
-// 	return 200, string(b)
-// }
-
-// func apiMigrateStatus() (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	migrateSlots, err := models.GetMigratingSlots(conn, productName)
-// 	if err != nil {
-// 		log.Warning("get slots info error, maybe init slots first? err: ", err)
-// 		return 500, err.Error()
-// 	}
-
-// 	b, err := json.MarshalIndent(map[string]interface{}{
-// 		"migrate_slots": migrateSlots,
-// 		"migrate_task":  curMigrateTask,
-// 	}, " ", "  ")
-// 	return 200, string(b)
-// }
-
-// func apiGetRedisSlotInfo(param martini.Params) (int, string) {
-// 	addr := param["addr"]
-// 	slotId, err := strconv.Atoi(param["id"])
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	slotInfo, err := utils.SlotsInfo(addr, slotId, slotId)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	out, _ := json.MarshalIndent(map[string]interface{}{
-// 		"keys":    slotInfo[slotId],
-// 		"slot_id": slotId,
-// 	}, " ", "  ")
-// 	return 200, string(out)
-// }
-
-// func apiGetRedisSlotInfoFromGroupId(param martini.Params) (int, string) {
-// 	groupId, err := strconv.Atoi(param["group_id"])
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	slotId, err := strconv.Atoi(param["slot_id"])
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	g, err := models.GetGroup(conn, productName, groupId)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-
-// 	s, err := g.Master(conn)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-
-// 	if s == nil {
-// 		log.Warning("this group has no master server")
-// 		return 500, "this group has no master server"
-// 	}
-
-// 	slotInfo, err := utils.SlotsInfo(s.Addr, slotId, slotId)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-
-// 	out, _ := json.MarshalIndent(map[string]interface{}{
-// 		"keys":     slotInfo[slotId],
-// 		"slot_id":  slotId,
-// 		"group_id": groupId,
-// 		"addr":     s.Addr,
-// 	}, " ", "  ")
-// 	return 200, string(out)
-
-// }
-
-// func apiRemoveServerGroup(param martini.Params) (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	lock := utils.GetZkLock(conn, productName)
-// 	lock.Lock(fmt.Sprintf("remove group %s", param["id"]))
-
-// 	defer func() {
-// 		err := lock.Unlock()
-// 		if err != nil {
-// 			log.Warning(err)
-// 		}
-// 	}()
-
-// 	groupId, _ := strconv.Atoi(param["id"])
-// 	serverGroup := models.NewServerGroup(productName, groupId)
-// 	if err := serverGroup.Remove(conn); err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-
-// 	return jsonRetSucc()
-// }
-
-// // create new server group
-// func apiAddServerGroup(newGroup models.ServerGroup) (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	lock := utils.GetZkLock(conn, productName)
-// 	lock.Lock(fmt.Sprintf("add group %+v", newGroup))
-
-// 	defer func() {
-// 		err := lock.Unlock()
-// 		if err != nil {
-// 			log.Warning(err)
-// 		}
-// 	}()
-
-// 	newGroup.ProductName = productName
-
-// 	exists, err := newGroup.Exists(conn)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	if exists {
-// 		return jsonRet(map[string]interface{}{
-// 			"ret": 0,
-// 			"msg": "group already exists",
-// 		})
-// 	}
-// 	err = newGroup.Create(conn)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	return jsonRetSucc()
-// }
-
-// // add redis server to exist server group
-// func apiAddServerToGroup(server models.Server, param martini.Params) (int, string) {
-// 	groupId, _ := strconv.Atoi(param["id"])
-
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	lock := utils.GetZkLock(conn, productName)
-// 	lock.Lock(fmt.Sprintf("add server to group,  %+v", server))
-// 	defer func() {
-// 		err := lock.Unlock()
-// 		if err != nil {
-// 			log.Warning(err)
-// 		}
-// 	}()
-// 	// check group exists first
-// 	serverGroup := models.NewServerGroup(productName, groupId)
-
-// 	exists, err := serverGroup.Exists(conn)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	if !exists {
-// 		return jsonRetFail(-1, "group not exists")
-// 	}
-
-// 	if err := serverGroup.AddServer(conn, &server); err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-
-// 	return jsonRetSucc()
-// }
-
-// func apiPromoteServer(server models.Server, param martini.Params) (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	lock := utils.GetZkLock(conn, productName)
-// 	lock.Lock(fmt.Sprintf("promote server %+v", server))
-// 	defer func() {
-// 		err := lock.Unlock()
-// 		if err != nil {
-// 			log.Warning(err)
-// 		}
-// 	}()
-
-// 	group, err := models.GetGroup(conn, productName, server.GroupId)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	err = group.Promote(conn, server.Addr)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-
-// 	return jsonRetSucc()
-// }
-
-// func apiRemoveServerFromGroup(server models.Server, param martini.Params) (int, string) {
-// 	groupId, _ := strconv.Atoi(param["id"])
-
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	lock := utils.GetZkLock(conn, productName)
-// 	lock.Lock(fmt.Sprintf("remove server from group, %+v", server))
-// 	defer func() {
-// 		err := lock.Unlock()
-// 		if err != nil {
-// 			log.Warning(err)
-// 		}
-// 	}()
-
-// 	serverGroup := models.NewServerGroup(productName, groupId)
-// 	err := serverGroup.RemoveServer(conn, server)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	return jsonRetSucc()
-// }
-
-// func apiSetProxyStatus(proxy models.ProxyInfo, param martini.Params) (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-// 	err := models.SetProxyStatus(conn, productName, proxy.Id, proxy.State)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	return jsonRetSucc()
-// }
-
-// func apiGetProxyList(param martini.Params) (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-
-// 	proxies, err := models.ProxyList(conn, productName, nil)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-// 	b, err := json.MarshalIndent(proxies, " ", "  ")
-// 	return 200, string(b)
-// }
-
-// func apiGetSlots() (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-// 	slots, err := models.Slots(conn, productName)
-// 	if err != nil {
-// 		log.Warning("get slot info error, maybe init slots first? err:", err)
-// 		return 500, err.Error()
-// 	}
-// 	b, err := json.MarshalIndent(slots, " ", "  ")
-// 	return 200, string(b)
-// }
-
-// func apiSlotRangeSet(task RangeSetTask) (int, string) {
-// 	conn := CreateZkConn()
-// 	defer conn.Close()
-// 	lock := utils.GetZkLock(conn, productName)
-// 	lock.Lock(fmt.Sprintf("set slot range, %+v", task))
-// 	defer func() {
-// 		err := lock.Unlock()
-// 		if err != nil {
-// 			log.Warning(err)
-// 		}
-// 	}()
-
-// 	err := models.SetSlotRange(conn, productName, task.FromSlot, task.ToSlot, task.NewGroupId, models.SLOT_STATUS_ONLINE)
-
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return 500, err.Error()
-// 	}
-
-// 	return jsonRetSucc()
-// }
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ledisdb/xcodis/models"
+	"github.com/ledisdb/xcodis/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	log "github.com/ngaut/logging"
+	"github.com/ngaut/zkhelper"
+)
+
+type RangeSetTask struct {
+	FromSlot   int    `json:"from"`
+	ToSlot     int    `json:"to"`
+	NewGroupId int    `json:"new_group"`
+	Status     string `json:"status"` //online if empty
+}
+
+func intVar(r *http.Request, name string) (int, error) {
+	v := mux.Vars(r)[name]
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.NotValidf("%s %q", name, v)
+	}
+	return n, nil
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errors.NewNotValid(err, "invalid request body")
+	}
+	return nil
+}
+
+//run f holding the topology lock, like the cconfig commands
+func withLock(desc string, f func() error) error {
+	lock := models.GetZkLock(zkConn, productName)
+	if err := lock.Lock(desc); err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		err := lock.Unlock()
+		if err != nil {
+			log.Warning(err)
+		}
+	}()
+
+	return errors.Trace(f())
+}
+
+func apiGetProxyDebugVars(r *http.Request) (interface{}, error) {
+	return getAllProxyDebugVars()
+}
+
+func apiOverview(r *http.Request) (interface{}, error) {
+	// get all server groups
+	groups, err := models.ServerGroups(zkConn, productName)
+	if err != nil {
+		return nil, errors.Annotate(err, "get server groups error, maybe there is no any server groups?")
+	}
+
+	var instances []string
+
+	for _, group := range groups {
+		for _, srv := range group.Servers {
+			if srv.Type == models.SERVER_TYPE_MASTER {
+				instances = append(instances, srv.Addr)
+			}
+		}
+	}
+
+	var info map[string]interface{} = make(map[string]interface{})
+	info["product"] = productName
+	info["ops"] = atomic.LoadInt64(&proxiesSpeed)
+
+	var redisInfos []map[string]string = make([]map[string]string, 0)
+
+	for _, instance := range instances {
+		stat, err := utils.GetRedisStat(instance)
+		if err != nil {
+			log.Error(err)
+		}
+		redisInfos = append(redisInfos, stat)
+	}
+	info["redis_infos"] = redisInfos
+
+	return info, nil
+}
+
+func apiGetServerGroupList(r *http.Request) (interface{}, error) {
+	return models.ServerGroups(zkConn, productName)
+}
+
+func apiRedisStat(r *http.Request) (interface{}, error) {
+	return utils.GetRedisStat(mux.Vars(r)["addr"])
+}
+
+//queued in zk, run by migrateTaskWorker
+func apiDoMigrate(r *http.Request) (interface{}, error) {
+	form := models.MigrateTask{MigrateLimit: defaultMigrateLimit()}
+	if err := decodeBody(r, &form); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	task := models.NewMigrateTask(productName, form.FromSlot, form.ToSlot, form.NewGroupId, form.Delay)
+	task.Replace = form.Replace
+	task.Verify, task.VerifyAlert = form.Verify, form.VerifyAlert
+	task.MigrateLimit = form.MigrateLimit
+	if err := checkMigrateLimit(task.MigrateLimit); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := task.Create(zkConn); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return task, nil
+}
+
+var isRebalancing bool
+var rebalanceLck = sync.Mutex{}
+
+func changeRebalanceStat(b bool) {
+	rebalanceLck.Lock()
+	defer rebalanceLck.Unlock()
+	isRebalancing = b
+}
+
+func isOnRebalancing() bool {
+	rebalanceLck.Lock()
+	defer rebalanceLck.Unlock()
+	return isRebalancing
+}
+
+func apiRebalanceStatus(r *http.Request) (interface{}, error) {
+	return map[string]interface{}{
+		"is_rebalancing": isOnRebalancing(),
+	}, nil
+}
+
+// plan of ?strategy=, balancing slot count by default, traffic is watched
+// for ?window= seconds
+func planRebalanceApi(r *http.Request) (*RebalancePlan, error) {
+	strategy := r.URL.Query().Get("strategy")
+	if len(strategy) == 0 {
+		strategy = REBALANCE_COUNT
+	}
+	window := defaultRebalanceWindow
+	if v := r.URL.Query().Get("window"); len(v) > 0 {
+		var err error
+		if window, err = strconv.Atoi(v); err != nil {
+			return nil, errors.NewNotValid(err, "window")
+		}
+	}
+	return PlanRebalance(strategy, window)
+}
+
+func apiRebalancePlan(r *http.Request) (interface{}, error) {
+	p, err := planRebalanceApi(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return p, nil
+}
+
+// plans and returns the moves, which are migrated in the background
+func apiRebalance(r *http.Request) (interface{}, error) {
+	rebalanceLck.Lock()
+	defer rebalanceLck.Unlock()
+	if isRebalancing {
+		return nil, errors.AlreadyExistsf("rebalance task")
+	}
+
+	p, err := planRebalanceApi(r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	isRebalancing = true
+
+	go func() {
+		defer changeRebalanceStat(false)
+
+		if err := p.Execute(0); err != nil {
+			log.Warning(errors.ErrorStack(err))
+		}
+	}()
+
+	return p, nil
+}
+
+func apiGetMigrateTasks(r *http.Request) (interface{}, error) {
+	tasks, err := models.MigrateTasks(zkConn, productName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if tasks == nil {
+		tasks = []*models.MigrateTask{}
+	}
+	return tasks, nil
+}
+
+func apiRemovePendingMigrateTask(r *http.Request) (interface{}, error) {
+	id := mux.Vars(r)["id"]
+	err := withLock(fmt.Sprintf("remove migrate task %s", id), func() error {
+		t, err := models.GetMigrateTask(zkConn, productName, id)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		//claimed so no cconfig starts it while it is removed
+		if err := t.Claim(zkConn, taskOwner()); err != nil {
+			if zkhelper.ZkErrorEqual(errors.Cause(err), zk.ErrNodeExists) {
+				return errors.NotFoundf("pending migrate task %s", id)
+			}
+			return errors.Trace(err)
+		}
+		if t.Status != models.MIGRATE_TASK_PENDING {
+			if err := t.Release(zkConn); err != nil {
+				log.Warning(err)
+			}
+			return errors.NotFoundf("pending migrate task %s", id)
+		}
+		if err := t.Remove(zkConn); err != nil {
+			t.Release(zkConn)
+			return errors.Trace(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiSucc, nil
+}
+
+//rates not in the body are kept, applied within a second if the task runs
+func apiSetMigrateLimit(r *http.Request) (interface{}, error) {
+	t, err := models.GetMigrateTask(zkConn, productName, mux.Vars(r)["id"])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if t.Done() {
+		return nil, errors.NotValidf("migrate task %s %s, limit", t.Id, t.Status)
+	}
+
+	l := t.MigrateLimit
+	if err := decodeBody(r, &l); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := checkMigrateLimit(l); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := t.SetLimit(zkConn, l); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return t, nil
+}
+
+//the running cconfig or the next one claiming the task acts on the request
+func migrateRequestApi(req string) apiFunc {
+	return func(r *http.Request) (interface{}, error) {
+		request := req
+		if req == models.MIGRATE_REQUEST_CANCEL && r.URL.Query().Get("rollback") == "true" {
+			request = models.MIGRATE_REQUEST_ROLLBACK
+		}
+		if err := sendMigrateRequest(mux.Vars(r)["id"], request); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return apiSucc, nil
+	}
+}
+
+func apiGetServerGroup(r *http.Request) (interface{}, error) {
+	groupId, err := intVar(r, "id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return models.GetGroup(zkConn, productName, groupId)
+}
+
+func apiMigrateStatus(r *http.Request) (interface{}, error) {
+	migrateSlots, err := models.GetMigratingSlots(zkConn, productName)
+	if err != nil {
+		return nil, errors.Annotate(err, "get slots info error, maybe init slots first?")
+	}
+
+	task, err := models.NextMigrateTask(zkConn, productName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return map[string]interface{}{
+		"migrate_slots": migrateSlots,
+		"migrate_task":  task,
+	}, nil
+}
+
+func apiGetRedisSlotInfo(r *http.Request) (interface{}, error) {
+	addr := mux.Vars(r)["addr"]
+	slotId, err := intVar(r, "id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	slotInfo, err := utils.SlotsInfo(addr, slotId, slotId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return map[string]interface{}{
+		"keys":    slotInfo[slotId],
+		"slot_id": slotId,
+	}, nil
+}
+
+func apiGetRedisSlotInfoFromGroupId(r *http.Request) (interface{}, error) {
+	groupId, err := intVar(r, "group_id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	slotId, err := intVar(r, "slot_id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	g, err := models.GetGroup(zkConn, productName, groupId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s, err := g.Master(zkConn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if s == nil {
+		return nil, errors.NotFoundf("master of group %d", groupId)
+	}
+
+	slotInfo, err := utils.SlotsInfo(s.Addr, slotId, slotId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return map[string]interface{}{
+		"keys":     slotInfo[slotId],
+		"slot_id":  slotId,
+		"group_id": groupId,
+		"addr":     s.Addr,
+	}, nil
+}
+
+func apiRemoveServerGroup(r *http.Request) (interface{}, error) {
+	groupId, err := intVar(r, "id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = withLock(fmt.Sprintf("remove group %d", groupId), func() error {
+		serverGroup := models.NewServerGroup(productName, groupId)
+		return serverGroup.Remove(zkConn)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiSucc, nil
+}
+
+// create new server group
+func apiAddServerGroup(r *http.Request) (interface{}, error) {
+	var newGroup models.ServerGroup
+	if err := decodeBody(r, &newGroup); err != nil {
+		return nil, errors.Trace(err)
+	}
+	newGroup.ProductName = productName
+
+	err := withLock(fmt.Sprintf("add group %+v", newGroup), func() error {
+		exists, err := newGroup.Exists(zkConn)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if exists {
+			return errors.AlreadyExistsf("group %d", newGroup.Id)
+		}
+		return newGroup.Create(zkConn)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiSucc, nil
+}
+
+// add redis server to exist server group
+func apiAddServerToGroup(r *http.Request) (interface{}, error) {
+	groupId, err := intVar(r, "id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var server models.Server
+	if err := decodeBody(r, &server); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = withLock(fmt.Sprintf("add server to group, %+v", server), func() error {
+		// check group exists first
+		serverGroup, err := models.GetGroup(zkConn, productName, groupId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return serverGroup.AddServer(zkConn, &server)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiSucc, nil
+}
+
+func apiPromoteServer(r *http.Request) (interface{}, error) {
+	groupId, err := intVar(r, "id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var server models.Server
+	if err := decodeBody(r, &server); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = withLock(fmt.Sprintf("promote server %+v", server), func() error {
+		group, err := models.GetGroup(zkConn, productName, groupId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return group.Promote(zkConn, server.Addr)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiSucc, nil
+}
+
+func apiRemoveServerFromGroup(r *http.Request) (interface{}, error) {
+	groupId, err := intVar(r, "id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var server models.Server
+	if err := decodeBody(r, &server); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = withLock(fmt.Sprintf("remove server from group, %+v", server), func() error {
+		serverGroup, err := models.GetGroup(zkConn, productName, groupId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return serverGroup.RemoveServer(zkConn, server)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiSucc, nil
+}
+
+func apiSetProxyStatus(r *http.Request) (interface{}, error) {
+	var proxy models.ProxyInfo
+	if err := decodeBody(r, &proxy); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err := models.SetProxyStatus(zkConn, productName, proxy.Id, proxy.State)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiSucc, nil
+}
+
+func apiGetProxyList(r *http.Request) (interface{}, error) {
+	return models.ProxyList(zkConn, productName, nil)
+}
+
+func apiGetSlots(r *http.Request) (interface{}, error) {
+	slots, err := models.Slots(zkConn, productName)
+	if err != nil {
+		return nil, errors.Annotate(err, "get slot info error, maybe init slots first?")
+	}
+	return slots, nil
+}
+
+func apiSlotRangeSet(r *http.Request) (interface{}, error) {
+	var task RangeSetTask
+	if err := decodeBody(r, &task); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(task.Status) == 0 {
+		task.Status = string(models.SLOT_STATUS_ONLINE)
+	}
+
+	err := withLock(fmt.Sprintf("set slot range, %+v", task), func() error {
+		return models.SetSlotRange(zkConn, productName, task.FromSlot, task.ToSlot, task.NewGroupId, models.SlotStatus(task.Status))
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return apiSucc, nil
+}
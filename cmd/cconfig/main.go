@@ -10,16 +10,18 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"sync/atomic"
 	"syscall"
 
-	"github.com/ledisdb/xcodis/utils"
+	"github.com/ledisdb/xcodis/config"
+	"github.com/ledisdb/xcodis/coordinator"
+	"github.com/ledisdb/xcodis/models"
 	"github.com/ngaut/go-zookeeper/zk"
 	"github.com/ngaut/zkhelper"
 
 	"net/http"
 	_ "net/http/pprof"
 
-	"github.com/c4pt0r/cfg"
 	docopt "github.com/docopt/docopt-go"
 	"github.com/juju/errors"
 	log "github.com/ngaut/logging"
@@ -29,13 +31,16 @@ import (
 var (
 	zkConn      zkhelper.Conn
 	zkAddr      string
+	coord       string //coordinator kind
+	zkAuth      string //user:password, empty if auth disabled
 	productName string
 	configFile  string
-	config      *cfg.Cfg
+	confValue   atomic.Value //*config.Config, reloaded by the dashboard on SIGHUP
 	zkLock      zkhelper.ZLocker
 	livingNode  string
 	broker      = "ledisdb"
 	slot_num    = 16
+	db_num      = 16
 )
 
 const LedisBroker = "ledisdb"
@@ -51,8 +56,10 @@ type Command struct {
 
 var usage = `usage: cconfig  [-c <config_file>] [-L <log_file>] [--log-level=<loglevel>]
 		<command> [<args>...]
+       cconfig  [-c <config_file>] --check-config
 options:
-   -c	set config file
+   -c <config_file>  set config file, $CODIS_CONF or config.ini if not set
+   --check-config  validate the config file and exit
    -L	set output log file, default is stdout
    --log-level=<loglevel>	set log level: info, warn, error, debug [default: info]
 
@@ -61,6 +68,8 @@ commands:
 	slot
 	action
 	proxy
+	user
+	dashboard
 `
 
 func Fatal(msg interface{}) {
@@ -79,8 +88,8 @@ func Fatal(msg interface{}) {
 }
 
 func removeOrphanLocks() error {
-	nodeDir := fmt.Sprintf("/zk/codis/db_%s/living-codis-config", productName)
-	lockDir := fmt.Sprintf("/zk/codis/db_%s/LOCK", productName)
+	nodeDir := models.GetProductPath(productName) + "/living-codis-config"
+	lockDir := models.GetLockPath(productName)
 
 	livingCfgNodes, _, err := zkConn.Children(nodeDir)
 	if err != nil {
@@ -119,7 +128,7 @@ func removeOrphanLocks() error {
 }
 
 func registerConfigNode() error {
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/living-codis-config", productName)
+	zkPath := models.GetProductPath(productName) + "/living-codis-config"
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -167,12 +176,51 @@ func runCommand(cmd string, args []string) (err error) {
 		return cmdProxy(argv)
 	case "slot":
 		return cmdSlot(argv)
+	case "user":
+		return cmdUser(argv)
+	case "dashboard":
+		return cmdDashboard(argv)
 	}
 	return fmt.Errorf("%s is not a valid command. See 'cconfig -h'", cmd)
 }
 
+func getConf() *config.Config {
+	return confValue.Load().(*config.Config)
+}
+
+//re-read the config file, only reloadable options are read after start
+func reloadConf() error {
+	conf, err := config.Xcodis.Load(configFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := checkConf(conf); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, key := range conf.Changed(getConf()) {
+		if !conf.Reloadable(key) {
+			log.Warningf("config %s changed, restart to apply it", key)
+		}
+	}
+	confValue.Store(conf)
+	log.Infof("config %s reloaded", configFile)
+	return nil
+}
+
+//options the broker can not apply
+func checkConf(conf *config.Config) error {
+	if len(conf.String("product")) == 0 {
+		return errors.NotValidf("config without product")
+	}
+	if conf.String("broker") == LedisBroker && conf.Size("migrate_bytes_per_sec") > 0 {
+		return errors.NotValidf("migrate_bytes_per_sec on broker %s", LedisBroker)
+	}
+	return nil
+}
+
 func CreateZkConn() zkhelper.Conn {
-	conn, _ := zkhelper.ConnectToZk(zkAddr)
+	conn, _ := coordinator.Connect(coord, zkAuth, zkAddr)
 	return conn
 }
 
@@ -187,25 +235,35 @@ func main() {
 		Fatal("ctrl-c or SIGTERM found, exit")
 	}()
 
-	//	productName, _ = config.ReadString("product", "test")
 	args, err := docopt.Parse(usage, nil, true, "codis config v0.1", true)
 	if err != nil {
 		log.Error(err)
 	}
 
 	// set config file
+	configFile = os.Getenv("CODIS_CONF")
+	if len(configFile) == 0 {
+		configFile = "config.ini"
+	}
 	if args["-c"] != nil {
 		configFile = args["-c"].(string)
-		config, err = utils.InitConfigFromFile(configFile)
-		if err != nil {
-			Fatal(err)
-		}
-	} else {
-		config, err = utils.InitConfig()
+	}
+	conf, err := config.Xcodis.Load(configFile)
+	if err == nil {
+		err = checkConf(conf)
+	}
+	if args["--check-config"].(bool) {
 		if err != nil {
-			Fatal(err)
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		fmt.Printf("%s is valid\n", configFile)
+		return
 	}
+	if err != nil {
+		Fatal(err)
+	}
+	confValue.Store(conf)
 
 	// set output log file
 	if args["-L"] != nil {
@@ -217,16 +275,29 @@ func main() {
 		log.SetLevelByString(args["--log-level"].(string))
 	}
 
-	productName, _ = config.ReadString("product", "test")
-	zkAddr, _ = config.ReadString("zk", "localhost:2181")
-	zkConn, _ = zkhelper.ConnectToZk(zkAddr)
-	zkLock = utils.GetZkLock(zkConn, productName)
+	productName = conf.String("product")
+	zkAddr = conf.String("zk")
+	coord = conf.String("coordinator")
+	zkAuth = conf.String("zk_auth")
+	zkConn, err = coordinator.Connect(coord, zkAuth, zkAddr)
+	if err != nil {
+		Fatal(err)
+	}
 
-	broker, _ = config.ReadString("broker", "ledisdb")
-	slot_num, _ = config.ReadInt("slot_num", 16)
+	if err := models.SetRootPath(conf.String("zk_root")); err != nil {
+		Fatal(err)
+	}
+	zkLock = models.GetZkLock(zkConn, productName)
+
+	broker = conf.String("broker")
+	slot_num = conf.Int("slot_num")
+	db_num = conf.Int("db_num")
+	if db_num == 0 {
+		db_num = slot_num
+	}
 
 	log.Debugf("product: %s", productName)
-	log.Debugf("zk: %s", zkAddr)
+	log.Debugf("%s: %s", coord, zkAddr)
 	log.Debugf("broker: %s", broker)
 
 	if err := registerConfigNode(); err != nil {
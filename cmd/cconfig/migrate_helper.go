@@ -5,6 +5,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -19,6 +20,11 @@ import (
 
 const (
 	MIGRATE_TIMEOUT = 30000
+
+	//full scans of a slot on redis before giving up on keys that keep coming
+	maxMigratePasses = 5
+	//conflicting keys shown in the error
+	maxReportedConflicts = 10
 )
 
 var ErrGroupMasterNotFound = errors.New("group master not found")
@@ -26,6 +32,53 @@ var ErrInvalidAddr = errors.New("invalid addr")
 
 type migrater struct {
 	group string
+
+	//set if several virtual slots share the database, only keys of the slot are moved
+	meta   *models.SlotMeta
+	cursor string
+
+	batch int //keys to move at once
+	//moved by the last command, bytes are counted on redis only if sizes is set
+	keys      int
+	bytes     int64
+	sizes     bool
+	sizeError bool
+
+	//redis: keys of the slot found by the last SCAN, migrated with the next one
+	pending []string
+	//the SCAN of this pass returned cursor 0
+	passEnd bool
+	//keys of the slot found in this pass, a pass finding none ends the migration
+	passKeys int
+	passes   int
+	//overwrite keys existing in the target, else they are conflicts
+	replace   bool
+	conflicts map[string]bool
+}
+
+// size of keys in bytes for the byte rate limit, 0 if unknown
+func (m *migrater) keySizes(c redis.Conn, keys []string) int64 {
+	if !m.sizes || m.sizeError || len(keys) == 0 {
+		return 0
+	}
+
+	for _, key := range keys {
+		c.Send("memory", "usage", key, "samples", 0)
+	}
+	if err := c.Flush(); err != nil {
+		return 0
+	}
+
+	var total int64
+	for range keys {
+		n, err := redis.Int64(c.Receive())
+		if err != nil && err != redis.ErrNil && !m.sizeError {
+			log.Warning("byte rate limit not applied, memory usage failed:", err)
+			m.sizeError = true
+		}
+		total += n
+	}
+	return total
 }
 
 func (m *migrater) nextGroup() {
@@ -43,35 +96,134 @@ func (m *migrater) nextGroup() {
 	}
 }
 
-// return: success_count, remain_count, error
-// slotsmgrt host port timeout slotnum count
+func isBusyKey(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "BUSYKEY")
+}
+
+// migrate the keys found by the last SCAN with one MIGRATE ... KEYS pipelined
+// with the next SCAN, returns true if not finished. Passes over the database
+// are repeated until one finds no key of the slot, which confirms the source
+// has none left.
 func (m *migrater) sendRedisMigrateCmd(c redis.Conn, slotId int, toAddr string) (bool, error) {
 	addrParts := strings.Split(toAddr, ":")
 	if len(addrParts) != 2 {
 		return false, ErrInvalidAddr
 	}
 
-	//use scan and migrate
-	reply, err := redis.MultiBulk(c.Do("scan", 0))
-	if err != nil {
+	db := m.meta.DB(slotId)
+	keys := m.pending
+	m.pending = nil
+	m.keys, m.bytes = 0, m.keySizes(c, keys)
+
+	if len(keys) > 0 {
+		args := []interface{}{addrParts[0], addrParts[1], "", db, MIGRATE_TIMEOUT}
+		if m.replace {
+			args = append(args, "replace")
+		}
+		args = append(args, "keys")
+		for _, key := range keys {
+			args = append(args, key)
+		}
+		c.Send("migrate", args...)
+	}
+	if !m.passEnd {
+		c.Send("scan", m.cursor, "count", m.batch)
+	}
+	if err := c.Flush(); err != nil {
 		return false, err
 	}
 
-	var next string
-	var keys []interface{}
+	//read both replies before handling errors to keep the connection usable
+	var migrateErr, scanErr error
+	var reply []interface{}
+	if len(keys) > 0 {
+		_, migrateErr = c.Receive()
+	}
+	if !m.passEnd {
+		reply, scanErr = redis.Values(c.Receive())
+	}
 
-	if _, err := redis.Scan(reply, &next, &keys); err != nil {
-		return false, err
+	if isBusyKey(migrateErr) {
+		//keys before the busy one are moved, find the others one by one
+		migrateErr = m.migrateEach(c, addrParts[0], addrParts[1], db, keys)
+	}
+	if migrateErr != nil {
+		return false, migrateErr
+	}
+	m.keys = len(keys)
+	if scanErr != nil {
+		return false, scanErr
 	}
 
-	for _, key := range keys {
-		if _, err := c.Do("migrate", addrParts[0], addrParts[1], key, slotId, MIGRATE_TIMEOUT); err != nil {
-			//todo, try del if key exists
+	if !m.passEnd {
+		var next string
+		var found []string
+		if _, err := redis.Scan(reply, &next, &found); err != nil {
 			return false, err
 		}
+		for _, key := range found {
+			if !m.meta.Virtual() || models.MapKey2Slot([]byte(key), m.meta.SlotNum) == slotId {
+				m.pending = append(m.pending, key)
+			}
+		}
+		m.passKeys += len(m.pending)
+		m.cursor = next
+		m.passEnd = next == "0"
 	}
 
-	return next != "0", nil
+	if !m.passEnd || len(m.pending) > 0 {
+		return true, nil
+	}
+	return m.endPass(slotId)
+}
+
+// migrate keys one by one after a BUSYKEY, keys existing in the target are
+// left in the source as conflicts
+func (m *migrater) migrateEach(c redis.Conn, host, port string, db int, keys []string) error {
+	for _, key := range keys {
+		_, err := c.Do("migrate", host, port, key, db, MIGRATE_TIMEOUT)
+		if isBusyKey(err) {
+			if m.conflicts == nil {
+				m.conflicts = make(map[string]bool)
+			}
+			m.conflicts[key] = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a full scan is done, the migration is finished if it found no key,
+// another pass verifies the source otherwise
+func (m *migrater) endPass(slotId int) (bool, error) {
+	if len(m.conflicts) > 0 {
+		var keys []string
+		for key := range m.conflicts {
+			if len(keys) == maxReportedConflicts {
+				keys = append(keys, "...")
+				break
+			}
+			keys = append(keys, key)
+		}
+		return false, fmt.Errorf("%d keys of slot %d exist in the target group, migrate with replace to overwrite them: %s",
+			len(m.conflicts), slotId, strings.Join(keys, " "))
+	}
+
+	if m.passKeys == 0 {
+		log.Infof("slot %d verified, no key left in the source", slotId)
+		return false, nil
+	}
+
+	m.passes++
+	if m.passes >= maxMigratePasses {
+		return false, fmt.Errorf("slot %d still has keys in the source after %d passes", slotId, m.passes)
+	}
+	log.Infof("slot %d pass %d moved %d keys, verify the source", slotId, m.passes, m.passKeys)
+	m.cursor, m.passEnd, m.passKeys = "0", false, 0
+	return true, nil
 }
 
 func (m *migrater) sendLedisMigrateCmd(c redis.Conn, slotId int, toAddr string) (bool, error) {
@@ -80,8 +232,9 @@ func (m *migrater) sendLedisMigrateCmd(c redis.Conn, slotId int, toAddr string)
 		return false, ErrInvalidAddr
 	}
 
-	count := 10
+	count := m.batch
 	num, err := redis.Int(c.Do("xmigratedb", addrParts[0], addrParts[1], m.group, count, slotId, MIGRATE_TIMEOUT))
+	m.keys, m.bytes = num, 0
 	if err != nil {
 		return false, err
 	} else if num < count {
@@ -92,17 +245,65 @@ func (m *migrater) sendLedisMigrateCmd(c redis.Conn, slotId int, toAddr string)
 	}
 }
 
+// scan the ledisdb database and migrate keys hashed to slotId, returns true
+// if not finished
+func (m *migrater) sendScanMigrateCmd(c redis.Conn, slotId int, toAddr string) (bool, error) {
+	addrParts := strings.Split(toAddr, ":")
+	if len(addrParts) != 2 {
+		return false, ErrInvalidAddr
+	}
+
+	reply, err := redis.Values(c.Do("xscan", m.group, m.cursor, "count", m.batch))
+	if err != nil {
+		return false, err
+	}
+
+	var next string
+	var keys []string
+	if _, err := redis.Scan(reply, &next, &keys); err != nil {
+		return false, err
+	}
+
+	db := m.meta.DB(slotId)
+	m.keys, m.bytes = 0, 0
+	for _, key := range keys {
+		if models.MapKey2Slot([]byte(key), m.meta.SlotNum) != slotId {
+			continue
+		}
+
+		_, err = c.Do("xmigrate", addrParts[0], addrParts[1], m.group, key, db, MIGRATE_TIMEOUT)
+		if err != nil {
+			return false, err
+		}
+		m.keys++
+	}
+
+	m.cursor = next
+	//ledis returns an empty cursor at the end of a data type
+	if len(next) == 0 {
+		m.nextGroup()
+		return m.group != "", nil
+	}
+	return true, nil
+}
+
 func (m *migrater) sendMigrateCmd(c redis.Conn, slotId int, toAddr string) (bool, error) {
-	if broker == LedisBroker {
-		return m.sendLedisMigrateCmd(c, slotId, toAddr)
-	} else {
+	if broker != LedisBroker {
 		return m.sendRedisMigrateCmd(c, slotId, toAddr)
 	}
+
+	if m.meta.Virtual() {
+		return m.sendScanMigrateCmd(c, slotId, toAddr)
+	}
+	return m.sendLedisMigrateCmd(c, slotId, toAddr)
 }
 
 var ErrStopMigrateByUser = errors.New("migration stop by user")
 
-func MigrateSingleSlot(zkConn zkhelper.Conn, slotId, fromGroup, toGroup int, delay int, stopChan <-chan struct{}) error {
+// MigrateSingleSlot moves the keys of slotId, throttle may be nil if not
+// limited. Keys existing in the target are overwritten if replace is set.
+func MigrateSingleSlot(zkConn zkhelper.Conn, slotId, fromGroup, toGroup int, delay int, replace bool,
+	throttle *migrateThrottle, stopChan <-chan struct{}) error {
 	groupFrom, err := models.GetGroup(zkConn, productName, fromGroup)
 	if err != nil {
 		return err
@@ -133,7 +334,22 @@ func MigrateSingleSlot(zkConn zkhelper.Conn, slotId, fromGroup, toGroup int, del
 
 	defer c.Close()
 
-	if ok, err := redis.String(c.Do("select", slotId)); err != nil {
+	//pinged to back off while busy
+	var tc redis.Conn
+	if throttle != nil {
+		tc, err = redis.Dial("tcp", toMaster.Addr)
+		if err != nil {
+			return err
+		}
+		defer tc.Close()
+	}
+
+	meta, err := getSlotMeta(zkConn)
+	if err != nil {
+		return err
+	}
+
+	if ok, err := redis.String(c.Do("select", meta.DB(slotId))); err != nil {
 		return err
 	} else if ok != "OK" {
 		return errors.New(ok)
@@ -141,8 +357,26 @@ func MigrateSingleSlot(zkConn zkhelper.Conn, slotId, fromGroup, toGroup int, del
 
 	m := new(migrater)
 	m.group = "KV"
+	m.meta = meta
+	m.replace = replace
+	if broker == LedisBroker {
+		m.cursor = ""
+	} else {
+		m.cursor = "0"
+	}
+
+	send := func() (bool, error) {
+		if throttle != nil {
+			throttle.checkLatency(c, tc)
+			m.sizes = throttle.getLimit().BytesPerSec > 0
+		}
+		m.batch = throttle.batch()
+		remain, err := m.sendMigrateCmd(c, slotId, toMaster.Addr)
+		throttle.done(m.keys, m.bytes)
+		return remain, err
+	}
 
-	remain, err := m.sendMigrateCmd(c, slotId, toMaster.Addr)
+	remain, err := send()
 	if err != nil {
 		return err
 	}
@@ -159,7 +393,7 @@ func MigrateSingleSlot(zkConn zkhelper.Conn, slotId, fromGroup, toGroup int, del
 			default:
 			}
 		}
-		remain, err = m.sendMigrateCmd(c, slotId, toMaster.Addr)
+		remain, err = send()
 		if num%500 == 0 && remain {
 			log.Infof("still migrating")
 		}
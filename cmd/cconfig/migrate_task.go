@@ -5,170 +5,335 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
-	"container/list"
-
 	"github.com/ledisdb/xcodis/models"
-	"github.com/ledisdb/xcodis/utils"
+	"github.com/ngaut/go-zookeeper/zk"
+	"github.com/ngaut/zkhelper"
 
 	"github.com/juju/errors"
 
 	log "github.com/ngaut/logging"
 )
 
-var pendingMigrateTask = list.New()
-var curMigrateTask *MigrateTask
-var lck = sync.RWMutex{}
-
-const (
-	MIGRATE_TASK_PENDING   string = "pending"
-	MIGRATE_TASK_MIGRATING string = "migrating"
-	MIGRATE_TASK_FINISHED  string = "finished"
-	MIGRATE_TASK_ERR       string = "error"
-)
-
-type MigrateTaskForm struct {
-	FromSlot   int    `json:"from"`
-	ToSlot     int    `json:"to"`
-	NewGroupId int    `json:"new_group"`
-	Delay      int    `json:"delay"`
-	CreateAt   string `json:"create_at"`
-	Percent    int    `json:"percent"`
-	Status     string `json:"status"`
-	Id         string `json:"id"`
-}
+//done tasks left in zk for migrate-status and the dashboard, older ones are
+//removed when a task is done
+const keepDoneMigrateTasks = 100
 
+// MigrateTask is a queued task in zk run by this cconfig.
 type MigrateTask struct {
-	MigrateTaskForm
+	*models.MigrateTask
 
+	//closed to stop the migrating slot after the current batch of keys
 	stopChan chan struct{}
+	stopOnce sync.Once
+
+	throttle *migrateThrottle
 }
 
-func findPendingMigrateTask(id string) *MigrateTask {
-	for e := pendingMigrateTask.Front(); e != nil; e = e.Next() {
-		t := e.Value.(*MigrateTask)
-		if t.Id == id {
-			return t
-		}
+func newMigrateTask(t *models.MigrateTask) *MigrateTask {
+	return &MigrateTask{
+		MigrateTask: t,
+		stopChan:    make(chan struct{}),
+		throttle:    newMigrateThrottle(t.MigrateLimit),
 	}
-	return nil
 }
 
-func removePendingMigrateTask(id string) bool {
-	for e := pendingMigrateTask.Front(); e != nil; e = e.Next() {
-		t := e.Value.(*MigrateTask)
-		if t.Id == id && t.Status == "pending" {
-			pendingMigrateTask.Remove(e)
-			return true
+func (t *MigrateTask) stop() {
+	t.stopOnce.Do(func() {
+		close(t.stopChan)
+	})
+}
+
+//stop the migrating slot when a pause or rollback is requested, and apply
+//limit changes
+func watchMigrateRequest(task *MigrateTask, done <-chan struct{}) {
+	t := *task.MigrateTask
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(1 * time.Second):
+		}
+
+		if l, err := t.GetLimit(zkConn); err != nil {
+			log.Warning(err)
+		} else {
+			task.throttle.setLimit(l)
+		}
+
+		req, err := t.GetRequest(zkConn)
+		if err != nil {
+			log.Warning(err)
+			continue
+		}
+		if req == models.MIGRATE_REQUEST_PAUSE || req == models.MIGRATE_REQUEST_ROLLBACK {
+			log.Infof("%s migrate task %s requested", req, t.Id)
+			task.stop()
 		}
 	}
-	return false
 }
 
-// migrate multi slots
-func RunMigrateTask(task *MigrateTask) error {
-	conn := CreateZkConn()
-	defer conn.Close()
-	lock := utils.GetZkLock(conn, productName)
+//owner of tasks run by this cconfig, same as its living node
+func taskOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%v-%v", hostname, os.Getpid())
+}
 
+// migrate a single slot of the task, it is skipped if not online or already
+// in the target group
+func migrateTaskSlot(task *MigrateTask, slotId int, stopChan <-chan struct{}) error {
+	lock := models.GetZkLock(zkConn, productName)
 	to := task.NewGroupId
-	task.Status = MIGRATE_TASK_MIGRATING
-	for slotId := task.FromSlot; slotId <= task.ToSlot; slotId++ {
-		err := func() error {
-			log.Info("start migrate slot:", slotId)
-
-			lock.Lock(fmt.Sprintf("migrate %d", slotId))
-			defer func() {
-				err := lock.Unlock()
-				if err != nil {
-					log.Info(err)
-				}
-			}()
-			// set slot status
-			s, err := models.GetSlot(conn, productName, slotId)
-			if err != nil {
-				log.Error(err)
-				return err
-			}
-			if s.State.Status != models.SLOT_STATUS_ONLINE && s.State.Status != models.SLOT_STATUS_MIGRATE {
-				log.Warning("status is not online && migrate", s)
-				return nil
-			}
 
-			from := s.GroupId
-			if s.State.Status == models.SLOT_STATUS_MIGRATE {
-				from = s.State.MigrateStatus.From
-			}
+	log.Info("start migrate slot:", slotId)
 
-			// make sure from group & target group exists
-			exists, err := models.GroupExists(conn, productName, from)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			if !exists {
-				log.Errorf("src group %d not exist when migrate from %d to %d", from, from, to)
-				return errors.NotFoundf("group %d", from)
+	lock.Lock(fmt.Sprintf("migrate %d", slotId))
+	defer func() {
+		err := lock.Unlock()
+		if err != nil {
+			log.Info(err)
+		}
+	}()
+	// set slot status
+	s, err := models.GetSlot(zkConn, productName, slotId)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if s.State.Status != models.SLOT_STATUS_ONLINE && s.State.Status != models.SLOT_STATUS_MIGRATE {
+		log.Warning("status is not online && migrate", s)
+		task.SetSlotStatus(slotId, models.MIGRATE_SLOT_SKIPPED)
+		return nil
+	}
+
+	from := s.GroupId
+	if s.State.Status == models.SLOT_STATUS_MIGRATE {
+		from = s.State.MigrateStatus.From
+	}
+
+	// make sure from group & target group exists
+	exists, err := models.GroupExists(zkConn, productName, from)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !exists {
+		log.Errorf("src group %d not exist when migrate from %d to %d", from, from, to)
+		return errors.NotFoundf("group %d", from)
+	}
+	exists, err = models.GroupExists(zkConn, productName, to)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !exists {
+		return errors.NotFoundf("group %d", to)
+	}
+
+	// cannot migrate to itself
+	if from == to {
+		log.Warning("from == to, ignore", s)
+		task.SetSlotStatus(slotId, models.MIGRATE_SLOT_SKIPPED)
+		return nil
+	}
+
+	//taken while the slot is online so proxies have not moved any key yet,
+	//kept in the task, a resumed slot is verified against the same counts
+	if len(task.Verify) > 0 && task.SlotSnapshot(slotId) == nil {
+		snap, err := takeSlotSnapshot(slotId, from, to, task.Verify == models.MIGRATE_VERIFY_DIGEST)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		task.SetSlotSnapshot(slotId, snap)
+		if err := task.Update(zkConn); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// modify slot status
+	if err := s.SetMigrateStatus(zkConn, from, to); err != nil {
+		log.Error(err)
+		return err
+	}
+	task.SetSlotStatus(slotId, models.MIGRATE_SLOT_MIGRATING)
+	if err := task.Update(zkConn); err != nil {
+		return errors.Trace(err)
+	}
+
+	// do real migrate
+	err = MigrateSingleSlot(zkConn, slotId, from, to, task.Delay, task.Replace, task.throttle, stopChan)
+	if err == ErrStopMigrateByUser {
+		return err
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if snap := task.SlotSnapshot(slotId); len(task.Verify) > 0 && snap != nil {
+		diffs, err := verifySlot(slotId, snap)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(diffs) > 0 {
+			msg := strings.Join(diffs, "; ")
+			if !task.VerifyAlert {
+				return errors.Errorf("verify failed, slot %d stays migrating: %s", slotId, msg)
 			}
-			exists, err = models.GroupExists(conn, productName, to)
-			if err != nil {
+			log.Error("verify failed:", msg)
+			task.Alerts = append(task.Alerts, msg)
+		}
+	}
+
+	// migrate done, change slot status back
+	s.State.Status = models.SLOT_STATUS_ONLINE
+	s.State.MigrateStatus.From = models.INVALID_ID
+	s.State.MigrateStatus.To = models.INVALID_ID
+	if err := s.Update(zkConn); err != nil {
+		log.Error(err)
+		return err
+	}
+	task.SetSlotStatus(slotId, models.MIGRATE_SLOT_FINISHED)
+	return nil
+}
+
+// move the keys of a migrating slot back to its source group, proxies move
+// keys read meanwhile back too
+func rollbackTaskSlot(task *MigrateTask, slotId int) error {
+	lock := models.GetZkLock(zkConn, productName)
+	lock.Lock(fmt.Sprintf("rollback migrate %d", slotId))
+	defer func() {
+		err := lock.Unlock()
+		if err != nil {
+			log.Info(err)
+		}
+	}()
+
+	s, err := models.GetSlot(zkConn, productName, slotId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if s.State.Status == models.SLOT_STATUS_MIGRATE {
+		from, to := s.State.MigrateStatus.From, s.State.MigrateStatus.To
+		//not reversed yet if the rollback is not resumed
+		if to == task.NewGroupId {
+			from, to = to, from
+			if err := s.SetMigrateStatus(zkConn, from, to); err != nil {
 				return errors.Trace(err)
 			}
-			if !exists {
-				return errors.NotFoundf("group %d", to)
-			}
+		}
 
-			// cannot migrate to itself
-			if from == to {
-				log.Warning("from == to, ignore", s)
-				return nil
-			}
+		log.Infof("rollback slot %d to group %d", slotId, to)
+		if err := MigrateSingleSlot(zkConn, slotId, from, to, task.Delay, task.Replace, task.throttle, nil); err != nil {
+			return errors.Trace(err)
+		}
 
-			// modify slot status
-			if err := s.SetMigrateStatus(conn, from, to); err != nil {
-				log.Error(err)
-				return err
-			}
+		s.State.Status = models.SLOT_STATUS_ONLINE
+		s.State.MigrateStatus.From = models.INVALID_ID
+		s.State.MigrateStatus.To = models.INVALID_ID
+		if err := s.Update(zkConn); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	task.SetSlotStatus(slotId, models.MIGRATE_SLOT_PENDING)
+	return nil
+}
 
-			// do real migrate
-			err = MigrateSingleSlot(conn, slotId, from, to, task.Delay, task.stopChan)
-			if err != nil {
-				log.Error(err)
-				return err
-			}
+// do what operators requested to a claimed task, it cannot be paused or
+// rolled back any more once cancelling
+func handleMigrateRequest(task *MigrateTask, req string) error {
+	switch req {
+	case models.MIGRATE_REQUEST_PAUSE:
+		if task.Status != models.MIGRATE_TASK_PAUSED {
+			log.Infof("migrate task %s paused at %d%%", task.Id, task.Percent)
+			task.Status = models.MIGRATE_TASK_PAUSED
+			return errors.Trace(task.Update(zkConn))
+		}
+		return nil
+	case models.MIGRATE_REQUEST_CANCEL, models.MIGRATE_REQUEST_ROLLBACK:
+	default:
+		return errors.NotValidf("migrate request %s", req)
+	}
 
-			// migrate done, change slot status back
-			s.State.Status = models.SLOT_STATUS_ONLINE
-			s.State.MigrateStatus.From = models.INVALID_ID
-			s.State.MigrateStatus.To = models.INVALID_ID
-			if err := s.Update(zkConn); err != nil {
-				log.Error(err)
-				return err
+	if slotId := task.MigratingSlot(); slotId >= 0 {
+		var err error
+		if req == models.MIGRATE_REQUEST_ROLLBACK {
+			err = rollbackTaskSlot(task, slotId)
+		} else {
+			err = migrateTaskSlot(task, slotId, nil)
+		}
+		if err != nil {
+			task.Status = models.MIGRATE_TASK_ERR
+			task.Error = err.Error()
+			if uerr := task.Update(zkConn); uerr != nil {
+				log.Error(uerr)
 			}
-			return nil
-		}()
+			return errors.Trace(err)
+		}
+	}
+
+	log.Infof("migrate task %s cancelled at %d%%", task.Id, task.Percent)
+	task.Status = models.MIGRATE_TASK_CANCELLED
+	return errors.Trace(task.Update(zkConn))
+}
+
+// migrate multi slots of a claimed task, finished slots of an interrupted
+// task are not migrated again. Requests of operators are checked between
+// batches of keys and between slots.
+func RunMigrateTask(task *MigrateTask) error {
+	task.Status = models.MIGRATE_TASK_MIGRATING
+	if err := task.Update(zkConn); err != nil {
+		return errors.Trace(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go watchMigrateRequest(task, done)
+
+	for slotId := task.FromSlot; slotId <= task.ToSlot; slotId++ {
+		switch task.SlotStatus(slotId) {
+		case models.MIGRATE_SLOT_FINISHED, models.MIGRATE_SLOT_SKIPPED:
+			continue
+		}
+
+		req, err := task.GetRequest(zkConn)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(req) > 0 {
+			return handleMigrateRequest(task, req)
+		}
+
+		err = migrateTaskSlot(task, slotId, task.stopChan)
 		if err == ErrStopMigrateByUser {
-			log.Info("stop migration job by user")
-			break
+			req, err := task.GetRequest(zkConn)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			return handleMigrateRequest(task, req)
 		} else if err != nil {
 			log.Error(err)
-			task.Status = MIGRATE_TASK_ERR
+			task.Status = models.MIGRATE_TASK_ERR
+			task.Error = err.Error()
+			if uerr := task.Update(zkConn); uerr != nil {
+				log.Error(uerr)
+			}
 			return err
 		}
-		task.Percent = (slotId - task.FromSlot + 1) * 100 / (task.ToSlot - task.FromSlot + 1)
+		if err := task.Update(zkConn); err != nil {
+			return errors.Trace(err)
+		}
 		log.Info("total percent:", task.Percent)
 	}
-	task.Status = MIGRATE_TASK_FINISHED
+	task.Status = models.MIGRATE_TASK_FINISHED
 	log.Info("migration finished")
-	return nil
+	return errors.Trace(task.Update(zkConn))
 }
 
 func preMigrateCheck(t *MigrateTask) (bool, error) {
-	conn := CreateZkConn()
-	defer conn.Close()
-
-	slots, err := models.GetMigratingSlots(conn, productName)
+	slots, err := models.GetMigratingSlots(zkConn, productName)
 
 	if err != nil {
 		return false, err
@@ -179,52 +344,194 @@ func preMigrateCheck(t *MigrateTask) (bool, error) {
 	} else if len(slots) > 1 {
 		return false, errors.New("more than one slots are migrating, unknown error")
 	} else if len(slots) == 1 {
+		//left by an interrupted run of the task
 		slot := slots[0]
-		if t.NewGroupId != slot.State.MigrateStatus.To || t.FromSlot != slot.Id || t.ToSlot != slot.Id {
+		if t.NewGroupId != slot.State.MigrateStatus.To || slot.Id < t.FromSlot || slot.Id > t.ToSlot {
 			return false, errors.Errorf("there is a migrating slot %+v, finish it first", slot)
 		}
 	}
 	return true, nil
 }
 
+// run the first task not done unless another cconfig runs it or it is
+// paused or failed, returns the task run, nil if none
+func runNextMigrateTask() (*models.MigrateTask, error) {
+	next, err := models.NextMigrateTask(zkConn, productName)
+	if err != nil || next == nil || next.Paused() || next.Failed() {
+		return nil, errors.Trace(err)
+	}
+	return runMigrateTaskById(next.Id)
+}
+
+// claim and run the task with id, or do what operators requested, returns
+// nil if another cconfig runs it
+func runMigrateTaskById(id string) (*models.MigrateTask, error) {
+	next, err := models.GetMigrateTask(zkConn, productName, id)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := next.Claim(zkConn, taskOwner()); err != nil {
+		if zkhelper.ZkErrorEqual(errors.Cause(err), zk.ErrNodeExists) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+	defer func() {
+		if err := next.Release(zkConn); err != nil {
+			log.Warning(err)
+		}
+	}()
+	if next.Done() || next.Failed() { //finished or failed by the previous owner meanwhile
+		return next, nil
+	}
+
+	defer func() {
+		if !next.Done() {
+			return
+		}
+		if n, err := models.PruneMigrateTasks(zkConn, productName, keepDoneMigrateTasks); err != nil {
+			log.Warning(errors.ErrorStack(err))
+		} else if n > 0 {
+			log.Infof("%d done migrate tasks removed", n)
+		}
+	}()
+
+	task := newMigrateTask(next)
+	if len(next.Request) > 0 {
+		return next, handleMigrateRequest(task, next.Request)
+	}
+
+	if next.Status == models.MIGRATE_TASK_MIGRATING || next.Status == models.MIGRATE_TASK_PAUSED {
+		log.Infof("resume migrate task %s at %d%%", next.Id, next.Percent)
+	} else {
+		log.Infof("new migrate task %s arrive", next.Id)
+	}
+
+	if ok, err := preMigrateCheck(task); !ok {
+		task.Status = models.MIGRATE_TASK_ERR
+		task.Error = err.Error()
+		if uerr := task.Update(zkConn); uerr != nil {
+			log.Error(uerr)
+		}
+		return next, errors.Trace(err)
+	}
+
+	err = RunMigrateTask(task)
+	log.Info("migrate task", next.Id, "done")
+	return next, errors.Trace(err)
+}
+
+// waitMigrateTask runs queued tasks until the task with id is done, paused
+// or failed, tasks claimed by other cconfigs are waited for.
+func waitMigrateTask(id string) (*models.MigrateTask, error) {
+	for {
+		if _, err := runNextMigrateTask(); err != nil {
+			log.Warning(errors.ErrorStack(err))
+		}
+
+		t, err := models.GetMigrateTask(zkConn, productName, id)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if t.Done() || t.Paused() || t.Failed() {
+			return t, nil
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// sendMigrateRequest asks the owner of the task with id to pause or cancel
+// it, an empty request resumes a paused task. A failed task is run again
+// with the request, a failed cancel only by cancelling it the same way.
+func sendMigrateRequest(id string, req string) error {
+	t, err := models.GetMigrateTask(zkConn, productName, id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if t.Done() {
+		return errors.NotValidf("migrate task %s %s, request %q", id, t.Status, req)
+	}
+	switch {
+	case t.Request == models.MIGRATE_REQUEST_CANCEL || t.Request == models.MIGRATE_REQUEST_ROLLBACK:
+		if !t.Failed() || req != t.Request {
+			return errors.NotValidf("migrate task %s cancelling, request %q", id, req)
+		}
+	case t.Failed() && req == models.MIGRATE_REQUEST_PAUSE:
+		return errors.NotValidf("migrate task %s failed, request %q", id, req)
+	case len(req) == 0 && t.Request != models.MIGRATE_REQUEST_PAUSE && !t.Failed():
+		return errors.NotValidf("migrate task %s not paused, resume", id)
+	}
+	if err := t.SetRequest(zkConn, req); err != nil {
+		return errors.Trace(err)
+	}
+	if t.Failed() {
+		return errors.Trace(clearMigrateTaskError(t))
+	}
+	return nil
+}
+
+// clearMigrateTaskError lets the next cconfig run a failed task again, it is
+// claimed meanwhile as only the owner writes the task.
+func clearMigrateTaskError(t *models.MigrateTask) error {
+	if err := t.Claim(zkConn, taskOwner()); err != nil {
+		if zkhelper.ZkErrorEqual(errors.Cause(err), zk.ErrNodeExists) {
+			return errors.NotValidf("migrate task %s claimed by others, retry", t.Id)
+		}
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err := t.Release(zkConn); err != nil {
+			log.Warning(err)
+		}
+	}()
+	if !t.Failed() {
+		return nil
+	}
+
+	log.Infof("retry migrate task %s at %d%% after error: %s", t.Id, t.Percent, t.Error)
+	t.Status = models.MIGRATE_TASK_PENDING
+	if t.Percent > 0 || t.MigratingSlot() >= 0 {
+		t.Status = models.MIGRATE_TASK_MIGRATING
+	}
+	t.Error = ""
+	return errors.Trace(t.Update(zkConn))
+}
+
+// requestMigrateTask sends a request to the task with id and waits until
+// it is done: a paused or failed task is resumed and run to the end, a task
+// not run by others is paused or cancelled here.
+func requestMigrateTask(id string, req string) (*models.MigrateTask, error) {
+	if err := sendMigrateRequest(id, req); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(req) == 0 {
+		log.Infof("migrate task %s resumed", id)
+		return waitMigrateTask(id)
+	}
+
+	for {
+		if _, err := runMigrateTaskById(id); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		t, err := models.GetMigrateTask(zkConn, productName, id)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if t.Done() || t.Paused() || t.Failed() {
+			return t, nil
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
 func migrateTaskWorker() {
 	for {
 		select {
 		case <-time.After(1 * time.Second):
-			{
-				// check if there is new task
-				lck.RLock()
-				cnt := pendingMigrateTask.Len()
-				lck.RUnlock()
-				if cnt > 0 {
-					lck.RLock()
-					t := pendingMigrateTask.Front()
-					lck.RUnlock()
-
-					log.Info("new migrate task arrive")
-					if t != nil {
-						lck.Lock()
-						curMigrateTask = t.Value.(*MigrateTask)
-						lck.Unlock()
-
-						if ok, err := preMigrateCheck(curMigrateTask); ok {
-							RunMigrateTask(curMigrateTask)
-						} else {
-							log.Warning(err)
-						}
-
-						lck.Lock()
-						curMigrateTask = nil
-						lck.Unlock()
-					}
-					log.Info("migrate task", t, "done")
-
-					lck.Lock()
-					if t != nil {
-						pendingMigrateTask.Remove(t)
-					}
-					lck.Unlock()
-				}
+			if _, err := runNextMigrateTask(); err != nil {
+				log.Warning(errors.ErrorStack(err))
 			}
 		}
 	}
@@ -0,0 +1,171 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+
+	"github.com/garyburd/redigo/redis"
+	log "github.com/ngaut/logging"
+)
+
+const (
+	//keys per batch when the key rate is not limited
+	defaultMigrateBatch = 100
+	maxMigrateBatch     = 1000
+
+	//a ping slower than this many times the fastest one seen means the
+	//source or target is busy, the migration backs off until it recovers
+	busyLatencyRatio  = 4
+	minBusyLatency    = 5 * time.Millisecond
+	minMigrateBackoff = 10 * time.Millisecond
+	maxMigrateBackoff = 2 * time.Second
+)
+
+// migrateThrottle keeps a slot migration under the limit of its task and
+// slows it down while the source or target answers pings slowly. The limit
+// can be changed while it runs.
+type migrateThrottle struct {
+	mu    sync.Mutex
+	limit models.MigrateLimit
+
+	//keys and bytes moved since start, restarted when the limit changes
+	start time.Time
+	keys  int64
+	bytes int64
+
+	baseLatency time.Duration
+	backoff     time.Duration
+}
+
+func newMigrateThrottle(l models.MigrateLimit) *migrateThrottle {
+	return &migrateThrottle{limit: l, start: time.Now()}
+}
+
+func (t *migrateThrottle) setLimit(l models.MigrateLimit) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l != t.limit {
+		log.Infof("migrate limit changed from %+v to %+v", t.limit, l)
+		t.limit = l
+		t.start, t.keys, t.bytes = time.Now(), 0, 0
+	}
+}
+
+func (t *migrateThrottle) getLimit() models.MigrateLimit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limit
+}
+
+// batch returns how many keys to move at once, about a tenth of a second
+// of keys if the key rate is limited.
+func (t *migrateThrottle) batch() int {
+	if t == nil {
+		return defaultMigrateBatch
+	}
+	l := t.getLimit()
+	if l.KeysPerSec <= 0 {
+		return defaultMigrateBatch
+	}
+
+	n := l.KeysPerSec / 10
+	if n < 1 {
+		n = 1
+	} else if n > maxMigrateBatch {
+		n = maxMigrateBatch
+	}
+	return n
+}
+
+// done counts a batch moved and sleeps long enough to keep both rates
+// under the limit.
+func (t *migrateThrottle) done(keys int, bytes int64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.keys += int64(keys)
+	t.bytes += bytes
+	wait := t.wait(time.Now())
+	t.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+//how long to wait at now until the keys and bytes moved are within the
+//limit, use it in lock
+func (t *migrateThrottle) wait(now time.Time) time.Duration {
+	var want time.Duration
+	if t.limit.KeysPerSec > 0 {
+		want = time.Duration(t.keys) * time.Second / time.Duration(t.limit.KeysPerSec)
+	}
+	if t.limit.BytesPerSec > 0 {
+		if d := time.Duration(float64(t.bytes) / float64(t.limit.BytesPerSec) * float64(time.Second)); d > want {
+			want = d
+		}
+	}
+	wait := want - now.Sub(t.start)
+	if wait < -time.Second {
+		//slowed down by backoff or delay, do not burst to catch up
+		t.start, t.keys, t.bytes = now, 0, 0
+	}
+	return wait
+}
+
+// checkLatency pings the source and target, backs off exponentially while
+// either is busy and recovers the same way.
+func (t *migrateThrottle) checkLatency(conns ...redis.Conn) {
+	if t == nil {
+		return
+	}
+
+	var latency time.Duration
+	for _, c := range conns {
+		start := time.Now()
+		if _, err := c.Do("ping"); err != nil {
+			//the migrate command fails on it too
+			return
+		}
+		if d := time.Since(start); d > latency {
+			latency = d
+		}
+	}
+
+	if t.baseLatency == 0 || latency < t.baseLatency {
+		t.baseLatency = latency
+	}
+
+	busy := t.baseLatency * busyLatencyRatio
+	if busy < minBusyLatency {
+		busy = minBusyLatency
+	}
+	if latency > busy {
+		if t.backoff == 0 {
+			log.Warningf("migration backs off, ping latency %v, normal %v", latency, t.baseLatency)
+		}
+		t.backoff *= 2
+		if t.backoff < minMigrateBackoff {
+			t.backoff = minMigrateBackoff
+		} else if t.backoff > maxMigrateBackoff {
+			t.backoff = maxMigrateBackoff
+		}
+	} else if t.backoff > 0 {
+		t.backoff /= 2
+		if t.backoff < minMigrateBackoff {
+			log.Info("migration back to normal speed")
+			t.backoff = 0
+		}
+	}
+
+	if t.backoff > 0 {
+		time.Sleep(t.backoff)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+)
+
+func TestMigrateThrottleBatch(t *testing.T) {
+	var nilThrottle *migrateThrottle
+	if n := nilThrottle.batch(); n != defaultMigrateBatch {
+		t.Errorf("batch of no throttle %d", n)
+	}
+
+	tests := []struct {
+		limit models.MigrateLimit
+		batch int
+	}{
+		{models.MigrateLimit{}, defaultMigrateBatch},
+		{models.MigrateLimit{BytesPerSec: 1 << 20}, defaultMigrateBatch},
+		{models.MigrateLimit{KeysPerSec: 5}, 1},
+		{models.MigrateLimit{KeysPerSec: 250}, 25},
+		{models.MigrateLimit{KeysPerSec: 1000000}, maxMigrateBatch},
+	}
+	for _, tt := range tests {
+		if n := newMigrateThrottle(tt.limit).batch(); n != tt.batch {
+			t.Errorf("batch of %+v is %d, want %d", tt.limit, n, tt.batch)
+		}
+	}
+}
+
+func TestMigrateThrottleWait(t *testing.T) {
+	tests := []struct {
+		limit   models.MigrateLimit
+		keys    int64
+		bytes   int64
+		elapsed time.Duration
+		wait    time.Duration
+	}{
+		{models.MigrateLimit{}, 1000, 1 << 30, 0, 0},
+		{models.MigrateLimit{KeysPerSec: 100}, 50, 0, 0, 500 * time.Millisecond},
+		{models.MigrateLimit{KeysPerSec: 100}, 50, 0, 200 * time.Millisecond, 300 * time.Millisecond},
+		{models.MigrateLimit{KeysPerSec: 100}, 50, 0, time.Second, -500 * time.Millisecond},
+		{models.MigrateLimit{BytesPerSec: 1 << 20}, 10, 2 << 20, 0, 2 * time.Second},
+		//the slower rate wins
+		{models.MigrateLimit{KeysPerSec: 100, BytesPerSec: 1 << 20}, 300, 1 << 20, 0, 3 * time.Second},
+		{models.MigrateLimit{KeysPerSec: 100, BytesPerSec: 1 << 20}, 10, 4 << 20, 0, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		th := newMigrateThrottle(tt.limit)
+		th.keys, th.bytes = tt.keys, tt.bytes
+		if wait := th.wait(th.start.Add(tt.elapsed)); wait != tt.wait {
+			t.Errorf("wait of %d keys %d bytes after %v under %+v is %v, want %v",
+				tt.keys, tt.bytes, tt.elapsed, tt.limit, wait, tt.wait)
+		}
+	}
+
+	//far behind, counted again from now instead of bursting
+	th := newMigrateThrottle(models.MigrateLimit{KeysPerSec: 100})
+	th.keys = 100
+	now := th.start.Add(3 * time.Second)
+	if wait := th.wait(now); wait > 0 || th.keys != 0 || th.start != now {
+		t.Errorf("not restarted, wait %v keys %d", wait, th.keys)
+	}
+
+	//a new limit restarts the count
+	th.keys = 100
+	th.setLimit(models.MigrateLimit{KeysPerSec: 10})
+	if th.keys != 0 || th.getLimit().KeysPerSec != 10 {
+		t.Errorf("limit change kept %d keys", th.keys)
+	}
+}
+
+func TestMigrateThrottleDone(t *testing.T) {
+	th := newMigrateThrottle(models.MigrateLimit{KeysPerSec: 100})
+	start := time.Now()
+	th.done(10, 0)
+	th.done(10, 0)
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Errorf("20 keys at 100 keys/s took %v", d)
+	}
+}
+
+func TestCheckMigrateLimit(t *testing.T) {
+	defer func(b string) { broker = b }(broker)
+
+	tests := []struct {
+		broker string
+		limit  models.MigrateLimit
+		valid  bool
+	}{
+		{LedisBroker, models.MigrateLimit{KeysPerSec: 100}, true},
+		{LedisBroker, models.MigrateLimit{BytesPerSec: 1 << 20}, false},
+		{"redis", models.MigrateLimit{KeysPerSec: 100, BytesPerSec: 1 << 20}, true},
+		{"redis", models.MigrateLimit{KeysPerSec: -1}, false},
+	}
+	for _, tt := range tests {
+		broker = tt.broker
+		if err := checkMigrateLimit(tt.limit); (err == nil) != tt.valid {
+			t.Errorf("limit %+v on %s, %v", tt.limit, tt.broker, err)
+		}
+	}
+}
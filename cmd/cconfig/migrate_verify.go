@@ -0,0 +1,278 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ledisdb/xcodis/models"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/juju/errors"
+)
+
+// keys of the source sampled to compare their dumps after migration
+const verifySampleKeys = 16
+
+var ledisDataTypes = []string{"KV", "HASH", "LIST", "SET", "ZSET"}
+
+// connect to the master of group and select the database of slotId
+func slotConn(groupId int, meta *models.SlotMeta, slotId int) (redis.Conn, error) {
+	group, err := models.GetGroup(zkConn, productName, groupId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	master, err := group.Master(zkConn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if master == nil {
+		return nil, errors.Annotatef(ErrGroupMasterNotFound, "group %d", groupId)
+	}
+
+	c, err := redis.Dial("tcp", master.Addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := c.Do("select", meta.DB(slotId)); err != nil {
+		c.Close()
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
+
+// scan the database for keys of slotId, or all of its keys if slotId < 0,
+// fn gets the ledisdb data type of each key too, empty on redis
+func scanSlotKeys(c redis.Conn, meta *models.SlotMeta, slotId int, fn func(dataType string, key string)) error {
+	dataTypes := []string{""}
+	if broker == LedisBroker {
+		dataTypes = ledisDataTypes
+	}
+
+	for _, dataType := range dataTypes {
+		cursor := "0"
+		if broker == LedisBroker {
+			cursor = ""
+		}
+		for {
+			var reply []interface{}
+			var err error
+			if broker == LedisBroker {
+				reply, err = redis.Values(c.Do("xscan", dataType, cursor, "count", 1000))
+			} else {
+				reply, err = redis.Values(c.Do("scan", cursor, "count", 1000))
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			var keys []string
+			if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+				return errors.Trace(err)
+			}
+			for _, key := range keys {
+				if slotId < 0 || !meta.Virtual() || models.MapKey2Slot([]byte(key), meta.SlotNum) == slotId {
+					fn(dataType, key)
+				}
+			}
+
+			if (broker == LedisBroker && len(cursor) == 0) || (broker != LedisBroker && cursor == "0") {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// count the keys of slotId, sampling up to sample of them. The database of a
+// slot on redis only holds its keys, they are counted by DBSIZE instead of a
+// scan.
+func countSlotKeys(c redis.Conn, meta *models.SlotMeta, slotId int, sample int) (int64, []string, error) {
+	if !meta.Virtual() && broker != LedisBroker {
+		n, err := redis.Int64(c.Do("dbsize"))
+		if err != nil {
+			return 0, nil, errors.Trace(err)
+		}
+		sampled, err := sampleKeys(c, sample)
+		return n, sampled, errors.Trace(err)
+	}
+
+	var n int64
+	var sampled []string
+	err := scanSlotKeys(c, meta, slotId, func(dataType string, key string) {
+		n++
+		if len(sampled) < sample {
+			if len(dataType) > 0 {
+				key = dataType + " " + key
+			}
+			sampled = append(sampled, key)
+		}
+	})
+	return n, sampled, errors.Trace(err)
+}
+
+// scan the selected database until sample keys are found
+func sampleKeys(c redis.Conn, sample int) ([]string, error) {
+	var sampled []string
+	cursor := "0"
+	for len(sampled) < sample {
+		reply, err := redis.Values(c.Do("scan", cursor, "count", sample))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, key := range keys {
+			if len(sampled) < sample {
+				sampled = append(sampled, key)
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	return sampled, nil
+}
+
+// sha1 of the dump of a sampled key, empty if it does not exist
+func keyDigest(c redis.Conn, sampled string) (string, error) {
+	var b []byte
+	var err error
+	if parts := strings.SplitN(sampled, " ", 2); broker == LedisBroker && len(parts) == 2 {
+		b, err = redis.Bytes(c.Do("xdump", parts[0], parts[1]))
+	} else {
+		b, err = redis.Bytes(c.Do("dump", sampled))
+	}
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// takeSlotSnapshot counts the keys of slotId in both groups, and digests
+// sampled keys of the source if digest is set.
+func takeSlotSnapshot(slotId int, from int, to int, digest bool) (*models.SlotSnapshot, error) {
+	meta, err := getSlotMeta(zkConn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	fc, err := slotConn(from, meta, slotId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer fc.Close()
+	tc, err := slotConn(to, meta, slotId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer tc.Close()
+
+	s := &models.SlotSnapshot{From: from, To: to}
+	sample := 0
+	if digest {
+		sample = verifySampleKeys
+	}
+	var sampled []string
+	if s.FromKeys, sampled, err = countSlotKeys(fc, meta, slotId, sample); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if s.ToKeys, _, err = countSlotKeys(tc, meta, slotId, 0); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, key := range sampled {
+		d, err := keyDigest(fc, key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(d) > 0 {
+			if s.Digests == nil {
+				s.Digests = make(map[string]string)
+			}
+			s.Digests[key] = d
+		}
+	}
+	return s, nil
+}
+
+// lastSlotSnapshot returns the snapshot of the last finished migration of
+// slotId to groupId, nil if none.
+func lastSlotSnapshot(slotId int, groupId int) (*models.SlotSnapshot, error) {
+	tasks, err := models.MigrateTasks(zkConn, productName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for i := len(tasks) - 1; i >= 0; i-- {
+		t := tasks[i]
+		if s := t.SlotSnapshot(slotId); s != nil && s.To == groupId && t.SlotStatus(slotId) == models.MIGRATE_SLOT_FINISHED {
+			return s, nil
+		}
+	}
+	return nil, nil
+}
+
+// verifySlot compares slotId in the groups of s with the snapshot: the source
+// must have no key of the slot, the target the keys of both and the same
+// dumps of sampled keys. It returns the differences found, writes to the
+// slot since the snapshot show up too.
+func verifySlot(slotId int, s *models.SlotSnapshot) ([]string, error) {
+	meta, err := getSlotMeta(zkConn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	fc, err := slotConn(s.From, meta, slotId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer fc.Close()
+	tc, err := slotConn(s.To, meta, slotId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer tc.Close()
+
+	var diffs []string
+	left, _, err := countSlotKeys(fc, meta, slotId, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if left > 0 {
+		diffs = append(diffs, fmt.Sprintf("slot %d has %d keys left in group %d", slotId, left, s.From))
+	}
+
+	n, _, err := countSlotKeys(tc, meta, slotId, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if want := s.FromKeys + s.ToKeys; n != want {
+		diffs = append(diffs, fmt.Sprintf("slot %d has %d keys in group %d, %d expected", slotId, n, s.To, want))
+	}
+
+	keys := make([]string, 0, len(s.Digests))
+	for key := range s.Digests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		d, err := keyDigest(tc, key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if d != s.Digests[key] {
+			diffs = append(diffs, fmt.Sprintf("slot %d key %q differs in group %d", slotId, key, s.To))
+		}
+	}
+	return diffs, nil
+}
@@ -6,10 +6,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/ledisdb/xcodis/models"
 
 	"github.com/docopt/docopt-go"
+	"github.com/juju/errors"
 	log "github.com/ngaut/logging"
 )
 
@@ -18,6 +20,17 @@ func cmdProxy(argv []string) (err error) {
 	codis-config proxy list
 	codis-config proxy offline <proxy_name>
 	codis-config proxy online <proxy_name>
+	codis-config proxy config get
+	codis-config proxy config set <key=value>...
+
+config keys, applied live by all proxies of the product, an empty value resets
+a key to the value of the proxy config file:
+	net_timeout		seconds
+	concurrent_limit	requests forwarded at the same time
+	pool_size		connections per backend server
+	pool_idle_timeout	seconds
+	black_list		denied commands, comma separated, replaces the builtin list
+	log_level		fatal, error, warning, info or debug
 `
 	args, err := docopt.Parse(usage, argv, true, "", false)
 	if err != nil {
@@ -39,6 +52,13 @@ func cmdProxy(argv []string) (err error) {
 		return runProxyList()
 	}
 
+	if args["config"].(bool) {
+		if args["set"].(bool) {
+			return runSetProxyConfig(args["<key=value>"].([]string))
+		}
+		return runGetProxyConfig()
+	}
+
 	proxyName := args["<proxy_name>"].(string)
 	if args["online"].(bool) {
 		return runSetProxyStatus(proxyName, models.PROXY_STATE_ONLINE)
@@ -67,3 +87,44 @@ func runSetProxyStatus(proxyName, status string) error {
 	}
 	return nil
 }
+
+func runGetProxyConfig() error {
+	c, err := models.GetProxyConfig(zkConn, productName)
+	if err != nil {
+		log.Warning(err)
+		return err
+	}
+	if c == nil {
+		c = &models.ProxyConfig{}
+	}
+	b, _ := json.MarshalIndent(c, " ", "  ")
+	fmt.Println(string(b))
+	return nil
+}
+
+func runSetProxyConfig(pairs []string) error {
+	c, err := models.GetProxyConfig(zkConn, productName)
+	if err != nil {
+		log.Warning(err)
+		return err
+	}
+	if c == nil {
+		c = &models.ProxyConfig{}
+	}
+
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("invalid %s, should be key=value", pair)
+		}
+		if err := c.Set(kv[0], kv[1]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := models.SetProxyConfig(zkConn, productName, c); err != nil {
+		log.Warning(err)
+		return err
+	}
+	return runGetProxyConfig()
+}
@@ -4,6 +4,9 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"time"
 
@@ -11,143 +14,634 @@ import (
 	"github.com/ledisdb/xcodis/models"
 	"github.com/ledisdb/xcodis/utils"
 	log "github.com/ngaut/logging"
-	"github.com/ngaut/zkhelper"
-	uuid "github.com/nu7hatch/gouuid"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	REBALANCE_COUNT     = "count"     // the same number of slots per group
+	REBALANCE_MAXMEMORY = "maxmemory" // slots in proportion to maxmemory
+	REBALANCE_MEMORY    = "memory"    // used memory of slots
+	REBALANCE_KEYS      = "keys"      // keys of slots
+	REBALANCE_TRAFFIC   = "traffic"   // requests to slots seen by the proxies
 )
 
-type NodeInfo struct {
-	GroupId   int
-	CurSlots  []int
-	MaxMemory int64
+// seconds the proxies are watched by the traffic strategy
+const defaultRebalanceWindow = 10
+
+// a rebalance strategy sets the weight of every group and the load of every
+// slot, the plan moves slots until every group has its share of the load.
+// Keys are only counted, scanning the groups, by strategies loading slots
+// by them.
+type rebalanceStrategy struct {
+	unit      string
+	countKeys bool
+	load      func(p *RebalancePlan, window int) error
 }
 
-func getLivingNodeInfos(zkConn zkhelper.Conn) ([]*NodeInfo, error) {
-	groups, err := models.ServerGroups(zkConn, productName)
+var rebalanceStrategies = map[string]rebalanceStrategy{
+	REBALANCE_COUNT:     {"slots", false, loadBySlotCount},
+	REBALANCE_MAXMEMORY: {"slots", false, loadByMaxMemory},
+	REBALANCE_MEMORY:    {"bytes", true, loadByUsedMemory},
+	REBALANCE_KEYS:      {"keys", true, loadByKeys},
+	REBALANCE_TRAFFIC:   {"ops", false, loadByTraffic},
+}
+
+// RebalanceGroup is a server group as seen by the rebalance planner.
+type RebalanceGroup struct {
+	GroupId    int     `json:"group_id"`
+	Addr       string  `json:"addr"`
+	Slots      []int   `json:"slots"`
+	MaxMemory  int64   `json:"maxmemory"`   // 0 if unknown
+	UsedMemory int64   `json:"used_memory"` // 0 if unknown
+	Keys       int64   `json:"keys"`
+	Weight     float64 `json:"weight"`
+	Load       float64 `json:"load"`
+	Target     float64 `json:"target"`
+	PlanLoad   float64 `json:"plan_load"` // load once the plan is executed
+}
+
+// RebalanceMove is a slot migration of a rebalance plan. Bytes are estimated
+// from the used memory and keys of the source group.
+type RebalanceMove struct {
+	SlotId int     `json:"slot_id"`
+	From   int     `json:"from"`
+	To     int     `json:"to"`
+	Load   float64 `json:"load"`
+	Keys   int64   `json:"keys"`
+	Bytes  int64   `json:"bytes"`
+}
+
+// RebalancePlan is the result of a dry run, executed move by move through
+// the migrate task queue. Keys and bytes of the moves are 0 unless the keys
+// of their source groups are counted.
+type RebalancePlan struct {
+	Strategy    string            `json:"strategy"`
+	Unit        string            `json:"unit"`
+	Groups      []*RebalanceGroup `json:"groups"`
+	Moves       []*RebalanceMove  `json:"moves"`
+	Keys        int64             `json:"keys"`
+	Bytes       int64             `json:"bytes"`
+	KeysCounted bool              `json:"keys_counted"`
+
+	meta     *models.SlotMeta
+	slotKeys map[int]int64
+	slotLoad map[int]float64
+}
+
+// PlanRebalance loads the groups and slots of the product and plans the
+// moves balancing them by strategy. Nothing is migrated.
+func PlanRebalance(strategy string, window int) (*RebalancePlan, error) {
+	s, ok := rebalanceStrategies[strategy]
+	if !ok {
+		return nil, errors.NotValidf("rebalance strategy %s", strategy)
+	}
+
+	p, err := loadRebalancePlan(func(int) bool { return s.countKeys })
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	p.Strategy, p.Unit, p.KeysCounted = strategy, s.unit, s.countKeys
+	if err := s.load(p, window); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := p.plan(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return p, nil
+}
+
+// load groups with a master and the slots they own, keys are counted in the
+// groups countKeys returns true for, all if nil
+func loadRebalancePlan(countKeys func(groupId int) bool) (*RebalancePlan, error) {
+	meta, err := getSlotMeta(zkConn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	//slots moving now would be counted in the wrong group
+	tasks, err := models.MigrateTasks(zkConn, productName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, t := range tasks {
+		if !t.Done() {
+			return nil, errors.Errorf("migrate task %s is %s, rebalance after it is done", t.Id, t.Status)
+		}
+	}
+
 	slots, err := models.Slots(zkConn, productName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(slots) != meta.SlotNum {
+		return nil, errors.Errorf("%d slots of %d found", len(slots), meta.SlotNum)
+	}
 	slotMap := make(map[int][]int)
 	for _, slot := range slots {
-		if slot.State.Status == models.SLOT_STATUS_ONLINE {
-			slotMap[slot.GroupId] = append(slotMap[slot.GroupId], slot.Id)
+		if slot.State.Status != models.SLOT_STATUS_ONLINE {
+			return nil, errors.Errorf("slot %d is %s, all slots must be online", slot.Id, slot.State.Status)
 		}
+		slotMap[slot.GroupId] = append(slotMap[slot.GroupId], slot.Id)
+	}
+
+	groups, err := models.ServerGroups(zkConn, productName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p := &RebalancePlan{
+		meta:     meta,
+		slotKeys: make(map[int]int64),
+		slotLoad: make(map[int]float64),
 	}
-	var ret []*NodeInfo
 	for _, g := range groups {
 		master, err := g.Master(zkConn)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
 		if master == nil {
-			return nil, errors.Errorf("group %d has no master", g.Id)
+			if len(slotMap[g.Id]) > 0 {
+				return nil, errors.Annotatef(ErrGroupMasterNotFound, "group %d", g.Id)
+			}
+			log.Warningf("group %d has no master, left out of rebalance", g.Id)
+			continue
+		}
+
+		rg := &RebalanceGroup{GroupId: g.Id, Addr: master.Addr, Slots: slotMap[g.Id]}
+		sort.Ints(rg.Slots)
+		if stat, err := utils.GetRedisStat(master.Addr); err != nil {
+			log.Warningf("stat of %s, %v", master.Addr, err)
+		} else {
+			rg.UsedMemory, _ = strconv.ParseInt(stat["used_memory"], 10, 64)
+			rg.MaxMemory, _ = strconv.ParseInt(stat["maxmemory"], 10, 64)
 		}
-		out, err := utils.GetRedisConfig(master.Addr, "maxmemory")
+		if countKeys == nil || countKeys(g.Id) {
+			if err := p.countKeys(rg); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		p.Groups = append(p.Groups, rg)
+		delete(slotMap, g.Id)
+	}
+	for groupId := range slotMap {
+		return nil, errors.NotFoundf("group %d of slots", groupId)
+	}
+	if len(p.Groups) == 0 {
+		return nil, errors.NotFoundf("server group")
+	}
+	sort.Sort(rebalanceGroupsById(p.Groups))
+	return p, nil
+}
+
+type rebalanceGroupsById []*RebalanceGroup
+
+func (s rebalanceGroupsById) Len() int           { return len(s) }
+func (s rebalanceGroupsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s rebalanceGroupsById) Less(i, j int) bool { return s[i].GroupId < s[j].GroupId }
+
+// count the keys of every slot of g, from info keyspace if slots have
+// their own database, by scanning otherwise
+func (p *RebalancePlan) countKeys(g *RebalanceGroup) error {
+	if !p.meta.Virtual() && broker != LedisBroker {
+		info, err := utils.SlotsInfo(g.Addr, 0, p.meta.DBNum-1)
 		if err != nil {
-			return nil, errors.Trace(err)
+			return errors.Trace(err)
+		}
+		for _, slotId := range g.Slots {
+			p.slotKeys[slotId] = int64(info[p.meta.DB(slotId)])
+			g.Keys += p.slotKeys[slotId]
 		}
-		maxMem, err := strconv.ParseInt(out, 10, 64)
+		return nil
+	}
+
+	owned := make(map[int]bool)
+	dbs := make(map[int]bool)
+	for _, slotId := range g.Slots {
+		owned[slotId] = true
+		dbs[p.meta.DB(slotId)] = true
+	}
+
+	c, err := redis.Dial("tcp", g.Addr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer c.Close()
+	for db := range dbs {
+		if _, err := c.Do("select", db); err != nil {
+			return errors.Trace(err)
+		}
+		err := scanSlotKeys(c, p.meta, -1, func(dataType string, key string) {
+			slotId := db
+			if p.meta.Virtual() {
+				slotId = models.MapKey2Slot([]byte(key), p.meta.SlotNum)
+			}
+			//keys left behind by an old migration belong to another group
+			if owned[slotId] {
+				p.slotKeys[slotId]++
+				g.Keys++
+			}
+		})
 		if err != nil {
-			return nil, errors.Trace(err)
+			return errors.Trace(err)
 		}
-		if maxMem <= 0 {
-			return nil, errors.Errorf("redis %s should set maxmemory", master.Addr)
+	}
+	return nil
+}
+
+// estimated bytes of slotId in g, its share of the used memory by keys
+func (p *RebalancePlan) slotBytes(g *RebalanceGroup, slotId int) int64 {
+	if g.Keys == 0 {
+		return 0
+	}
+	return int64(float64(g.UsedMemory) * float64(p.slotKeys[slotId]) / float64(g.Keys))
+}
+
+func loadBySlotCount(p *RebalancePlan, window int) error {
+	for _, g := range p.Groups {
+		g.Weight = 1
+		for _, slotId := range g.Slots {
+			p.slotLoad[slotId] = 1
+		}
+	}
+	return nil
+}
+
+func loadByMaxMemory(p *RebalancePlan, window int) error {
+	loadBySlotCount(p, window)
+
+	//groups without maxmemory count as the average of the others
+	var total int64
+	known := 0
+	for _, g := range p.Groups {
+		if g.MaxMemory > 0 {
+			total += g.MaxMemory
+			known++
 		}
-		node := &NodeInfo{
-			GroupId:   g.Id,
-			CurSlots:  slotMap[g.Id],
-			MaxMemory: maxMem,
+	}
+	if known == 0 {
+		return errors.NotFoundf("maxmemory of all groups")
+	}
+	for _, g := range p.Groups {
+		if g.MaxMemory > 0 {
+			g.Weight = float64(g.MaxMemory)
+		} else {
+			g.Weight = float64(total) / float64(known)
+			log.Warningf("group %d has no maxmemory, weighted as the average", g.GroupId)
 		}
-		ret = append(ret, node)
 	}
-	cnt := 0
-	for _, info := range ret {
-		cnt += len(info.CurSlots)
+	return nil
+}
+
+func loadByUsedMemory(p *RebalancePlan, window int) error {
+	for _, g := range p.Groups {
+		if g.Keys > 0 && g.UsedMemory == 0 {
+			return errors.NotFoundf("used memory of group %d", g.GroupId)
+		}
+		g.Weight = 1
+		for _, slotId := range g.Slots {
+			p.slotLoad[slotId] = float64(p.slotBytes(g, slotId))
+		}
 	}
-	if cnt != slot_num {
-		return nil, errors.New("not all slots are online")
+	return nil
+}
+
+func loadByKeys(p *RebalancePlan, window int) error {
+	for _, g := range p.Groups {
+		g.Weight = 1
+		for _, slotId := range g.Slots {
+			p.slotLoad[slotId] = float64(p.slotKeys[slotId])
+		}
 	}
-	return ret, nil
+	return nil
 }
 
-func getQuotaMap(zkConn zkhelper.Conn) (map[int]int, error) {
-	nodes, err := getLivingNodeInfos(zkConn)
+// requests per slot served by all online proxies during window seconds
+func loadByTraffic(p *RebalancePlan, window int) error {
+	proxies, err := models.ProxyList(zkConn, productName, func(pi *models.ProxyInfo) bool {
+		return pi.State == models.PROXY_STATE_ONLINE
+	})
 	if err != nil {
-		return nil, errors.Trace(err)
+		return errors.Trace(err)
+	}
+	if len(proxies) == 0 {
+		return errors.NotFoundf("online proxy")
+	}
+	if window <= 0 {
+		window = defaultRebalanceWindow
 	}
 
-	ret := make(map[int]int)
-	var totalMem int64
-	totalQuota := 0
-	for _, node := range nodes {
-		totalMem += node.MaxMemory
+	sample := func() ([]map[int]int64, error) {
+		var ret []map[int]int64
+		for _, pi := range proxies {
+			ops, err := pi.SlotOps(productName)
+			if err != nil {
+				return nil, errors.Annotatef(err, "proxy %s", pi.Id)
+			}
+			ret = append(ret, ops)
+		}
+		return ret, nil
+	}
+	before, err := sample()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Infof("watching the traffic of %d proxies for %d seconds", len(proxies), window)
+	time.Sleep(time.Duration(window) * time.Second)
+	after, err := sample()
+	if err != nil {
+		return errors.Trace(err)
 	}
 
-	for _, node := range nodes {
-		quota := int(int64(slot_num) * node.MaxMemory * 1.0 / totalMem)
-		ret[node.GroupId] = quota
-		totalQuota += quota
+	for i := range proxies {
+		for slotId, n := range after[i] {
+			//a restarted proxy counts from zero again
+			if d := n - before[i][slotId]; d > 0 {
+				p.slotLoad[slotId] += float64(d)
+			} else if d < 0 {
+				p.slotLoad[slotId] += float64(n)
+			}
+		}
+	}
+	for _, g := range p.Groups {
+		g.Weight = 1
 	}
+	return nil
+}
 
-	// round up
-	if totalQuota < slot_num {
-		for k, _ := range ret {
-			ret[k] += slot_num - totalQuota
+// plan moves slots from the most loaded group, relative to its share, to
+// the least loaded one while a slot brings both closer to their share.
+func (p *RebalancePlan) plan() error {
+	var total, weight float64
+	slotGroup := make(map[int]*RebalanceGroup)
+	for _, g := range p.Groups {
+		g.Load = 0
+		for _, slotId := range g.Slots {
+			g.Load += p.slotLoad[slotId]
+			slotGroup[slotId] = g
+		}
+		total += g.Load
+		weight += g.Weight
+	}
+	if total <= 0 {
+		return errors.NotFoundf("%s to balance by %s", p.Unit, p.Strategy)
+	}
+	if weight <= 0 {
+		return errors.NotValidf("weights of groups")
+	}
+
+	owned := make(map[int]map[int]bool)
+	slotNum := make(map[int]int)
+	for _, g := range p.Groups {
+		slotNum[g.GroupId] = len(g.Slots)
+		g.Target = total * g.Weight / weight
+		g.PlanLoad = g.Load
+		owned[g.GroupId] = make(map[int]bool)
+		for _, slotId := range g.Slots {
+			owned[g.GroupId][slotId] = true
+		}
+	}
+
+	eps := total * 1e-9
+	moved := make(map[int]*RebalanceMove)
+	var moves []*RebalanceMove
+	for i := 0; i < p.meta.SlotNum; i++ {
+		over, under := p.Groups[0], p.Groups[0]
+		for _, g := range p.Groups {
+			if g.PlanLoad-g.Target > over.PlanLoad-over.Target {
+				over = g
+			}
+			if g.PlanLoad-g.Target < under.PlanLoad-under.Target {
+				under = g
+			}
+		}
+		a, b := over.PlanLoad-over.Target, under.Target-under.PlanLoad
+		if a <= eps || b <= eps {
+			break
+		}
+
+		//the slot closing most of the gap of both groups
+		best, bestGain := -1, eps
+		for _, slotId := range over.Slots {
+			if !owned[over.GroupId][slotId] {
+				continue
+			}
+			c := p.slotLoad[slotId]
+			if gain := a + b - math.Abs(a-c) - math.Abs(b-c); gain > bestGain {
+				best, bestGain = slotId, gain
+			}
+		}
+		if best < 0 {
 			break
 		}
+
+		c := p.slotLoad[best]
+		over.PlanLoad -= c
+		under.PlanLoad += c
+		delete(owned[over.GroupId], best)
+		owned[under.GroupId][best] = true
+		under.Slots = append(under.Slots, best)
+
+		if m, ok := moved[best]; ok {
+			m.To = under.GroupId
+			continue
+		}
+		from := slotGroup[best]
+		m := &RebalanceMove{
+			SlotId: best,
+			From:   from.GroupId,
+			To:     under.GroupId,
+			Load:   c,
+			Keys:   p.slotKeys[best],
+			Bytes:  p.slotBytes(from, best),
+		}
+		moved[best] = m
+		moves = append(moves, m)
 	}
 
-	return ret, nil
+	//groups keep their current slots, slots moved back and forth are dropped
+	for _, g := range p.Groups {
+		g.Slots = g.Slots[:slotNum[g.GroupId]]
+	}
+	p.Moves, p.Keys, p.Bytes = nil, 0, 0
+	for _, m := range moves {
+		if m.From != m.To {
+			p.Moves = append(p.Moves, m)
+			p.Keys += m.Keys
+			p.Bytes += m.Bytes
+		}
+	}
+	return nil
 }
 
-// experimental simple auto rebalance :)
-func Rebalance(zkConn zkhelper.Conn, delay int) error {
-	targetQuota, err := getQuotaMap(zkConn)
+// PlanDrain plans moving every slot of groupId to the groups in to, or all
+// other groups if to is empty. Each slot goes to the group with the fewest
+// slots for its maxmemory, groups without maxmemory count as the average of
+// the others and all the same if none has it.
+func PlanDrain(groupId int, to []int) (*RebalancePlan, error) {
+	p, err := loadRebalancePlan(func(id int) bool { return id == groupId })
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
-	livingNodes, err := getLivingNodeInfos(zkConn)
-	if err != nil {
-		return errors.Trace(err)
+	p.KeysCounted = true //the source of every move
+	if err := p.planDrain(groupId, to); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return p, nil
+}
+
+func (p *RebalancePlan) planDrain(groupId int, to []int) error {
+	p.Strategy, p.Unit = "drain", "slots"
+
+	want := make(map[int]bool)
+	for _, id := range to {
+		if id == groupId {
+			return errors.NotValidf("drain group %d into itself", groupId)
+		}
+		want[id] = true
+	}
+	var from *RebalanceGroup
+	var dests []*RebalanceGroup
+	for _, g := range p.Groups {
+		g.Load = float64(len(g.Slots))
+		g.PlanLoad, g.Target = g.Load, g.Load
+		if g.GroupId == groupId {
+			from = g
+		} else if len(to) == 0 || want[g.GroupId] {
+			dests = append(dests, g)
+			delete(want, g.GroupId)
+		}
+	}
+	for id := range want {
+		return errors.NotFoundf("group %d with a master", id)
+	}
+	if from == nil || len(from.Slots) == 0 {
+		//a group without master owns no slot either
+		return nil
 	}
-	for _, node := range livingNodes {
-		for len(node.CurSlots) > targetQuota[node.GroupId] {
-			for _, dest := range livingNodes {
-				if dest.GroupId != node.GroupId && len(dest.CurSlots) < targetQuota[dest.GroupId] {
-					slot := node.CurSlots[len(node.CurSlots)-1]
-					// create a migration task
-					t := &MigrateTask{
-						MigrateTaskForm: MigrateTaskForm{
-							Delay:      delay,
-							FromSlot:   slot,
-							ToSlot:     slot,
-							NewGroupId: dest.GroupId,
-							Status:     "migrating",
-							CreateAt:   strconv.FormatInt(time.Now().Unix(), 10),
-						},
-						stopChan: make(chan struct{}),
-					}
-					u, err := uuid.NewV4()
-					if err != nil {
-						return errors.Trace(err)
-					}
-					t.Id = u.String()
-
-					if ok, err := preMigrateCheck(t); ok {
-						err = RunMigrateTask(t)
-						if err != nil {
-							log.Warning(err)
-							return errors.Trace(err)
-						}
-					} else {
-						log.Warning(err)
-						return errors.Trace(err)
-					}
-					node.CurSlots = node.CurSlots[0 : len(node.CurSlots)-1]
-					dest.CurSlots = append(dest.CurSlots, slot)
-				}
+	if len(dests) == 0 {
+		return errors.NotFoundf("group to drain group %d into", groupId)
+	}
+
+	var total int64
+	known := 0
+	for _, g := range dests {
+		if g.MaxMemory > 0 {
+			total += g.MaxMemory
+			known++
+		}
+	}
+	var slots, weight float64
+	for _, g := range dests {
+		switch {
+		case g.MaxMemory > 0:
+			g.Weight = float64(g.MaxMemory)
+		case known > 0:
+			g.Weight = float64(total) / float64(known)
+			log.Warningf("group %d has no maxmemory, weighted as the average", g.GroupId)
+		default:
+			g.Weight = 1
+		}
+		slots += g.Load
+		weight += g.Weight
+	}
+	slots += from.Load
+	for _, g := range dests {
+		g.Target = slots * g.Weight / weight
+	}
+
+	for _, slotId := range from.Slots {
+		best := dests[0]
+		for _, g := range dests[1:] {
+			if (g.PlanLoad+1)/g.Weight < (best.PlanLoad+1)/best.Weight {
+				best = g
 			}
 		}
+		best.PlanLoad++
+		m := &RebalanceMove{
+			SlotId: slotId,
+			From:   groupId,
+			To:     best.GroupId,
+			Load:   1,
+			Keys:   p.slotKeys[slotId],
+			Bytes:  p.slotBytes(from, slotId),
+		}
+		p.Moves = append(p.Moves, m)
+		p.Keys += m.Keys
+		p.Bytes += m.Bytes
+	}
+	from.PlanLoad, from.Target = 0, 0
+	return nil
+}
+
+// ask a yes or no question on stdin, no by default
+func confirm(format string, args ...interface{}) bool {
+	fmt.Printf(format+" [y/N] ", args...)
+	var answer string
+	fmt.Scanln(&answer)
+	return answer == "y" || answer == "yes"
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// Print writes the plan to stdout.
+func (p *RebalancePlan) Print() {
+	fmt.Printf("rebalance by %s, load in %s\n", p.Strategy, p.Unit)
+	if !p.KeysCounted {
+		for _, g := range p.Groups {
+			fmt.Printf("group %d: %d slots, load %.0f -> %.0f, target %.0f\n",
+				g.GroupId, len(g.Slots), g.Load, g.PlanLoad, g.Target)
+		}
+		for _, m := range p.Moves {
+			fmt.Printf("move slot %d from group %d to group %d, load %.0f\n", m.SlotId, m.From, m.To, m.Load)
+		}
+		fmt.Printf("%d moves, keys not counted by %s\n", len(p.Moves), p.Strategy)
+		return
+	}
+	for _, g := range p.Groups {
+		fmt.Printf("group %d: %d slots, %d keys, load %.0f -> %.0f, target %.0f\n",
+			g.GroupId, len(g.Slots), g.Keys, g.Load, g.PlanLoad, g.Target)
+	}
+	for _, m := range p.Moves {
+		fmt.Printf("move slot %d from group %d to group %d, load %.0f, %d keys, ~%s\n",
+			m.SlotId, m.From, m.To, m.Load, m.Keys, formatBytes(m.Bytes))
+	}
+	fmt.Printf("%d moves, %d keys, ~%s\n", len(p.Moves), p.Keys, formatBytes(p.Bytes))
+}
+
+// Execute queues a migrate task per move and waits for it. Moves of slots
+// changed since the plan are skipped.
+func (p *RebalancePlan) Execute(delay int) error {
+	migrated := 0
+	for i, m := range p.Moves {
+		slot, err := models.GetSlot(zkConn, productName, m.SlotId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if slot.GroupId != m.From || slot.State.Status != models.SLOT_STATUS_ONLINE {
+			log.Warningf("slot %d is %s in group %d since the plan, skipped", m.SlotId, slot.State.Status, slot.GroupId)
+			continue
+		}
+
+		log.Infof("[%d/%d] migrating slot %d from group %d to group %d, %d keys",
+			i+1, len(p.Moves), m.SlotId, m.From, m.To, m.Keys)
+		t := models.NewMigrateTask(productName, m.SlotId, m.SlotId, m.To, delay)
+		t.MigrateLimit = defaultMigrateLimit()
+		if err := runSlotMigrate(t); err != nil {
+			log.Warning(err)
+			return errors.Trace(err)
+		}
+		migrated++
 	}
+	log.Infof("%d of %d slots migrated", migrated, len(p.Moves))
 	return nil
 }
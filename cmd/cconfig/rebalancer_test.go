@@ -0,0 +1,271 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ledisdb/xcodis/models"
+)
+
+func slotRange(from, to int) []int {
+	var ret []int
+	for i := from; i <= to; i++ {
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+func newTestPlan(slotNum int, slotKeys map[int]int64, groups ...*RebalanceGroup) *RebalancePlan {
+	p := &RebalancePlan{
+		Groups:   groups,
+		meta:     &models.SlotMeta{SlotNum: slotNum, DBNum: slotNum},
+		slotKeys: make(map[int]int64),
+		slotLoad: make(map[int]float64),
+	}
+	for _, g := range groups {
+		for _, slotId := range g.Slots {
+			p.slotKeys[slotId] = slotKeys[slotId]
+			g.Keys += slotKeys[slotId]
+		}
+	}
+	return p
+}
+
+//slots of every group once the moves are done
+func plannedSlots(p *RebalancePlan) map[int]int {
+	ret := make(map[int]int)
+	for _, g := range p.Groups {
+		ret[g.GroupId] = len(g.Slots)
+	}
+	for _, m := range p.Moves {
+		ret[m.From]--
+		ret[m.To]++
+	}
+	return ret
+}
+
+func TestRebalancePlan(t *testing.T) {
+	const gb = 1 << 30
+	even := map[int]int64{0: 100, 1: 100, 2: 100, 3: 100}
+
+	tests := []struct {
+		name     string
+		strategy string
+		plan     *RebalancePlan
+		want     map[int]int //slots per group
+		keys     int64
+		bytes    int64
+		err      bool
+	}{
+		{
+			name:     "count spreads slots evenly",
+			strategy: REBALANCE_COUNT,
+			plan: newTestPlan(12, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 11)},
+				&RebalanceGroup{GroupId: 2},
+				&RebalanceGroup{GroupId: 3}),
+			want: map[int]int{1: 4, 2: 4, 3: 4},
+		},
+		{
+			name:     "count keeps a balanced layout",
+			strategy: REBALANCE_COUNT,
+			plan: newTestPlan(4, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 1)},
+				&RebalanceGroup{GroupId: 2, Slots: slotRange(2, 3)}),
+			want: map[int]int{1: 2, 2: 2},
+		},
+		{
+			name:     "maxmemory weights groups",
+			strategy: REBALANCE_MAXMEMORY,
+			plan: newTestPlan(12, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 11), MaxMemory: 2 * gb},
+				&RebalanceGroup{GroupId: 2, MaxMemory: gb}),
+			want: map[int]int{1: 8, 2: 4},
+		},
+		{
+			name:     "maxmemory unknown counts as the average",
+			strategy: REBALANCE_MAXMEMORY,
+			plan: newTestPlan(12, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 11), MaxMemory: gb},
+				&RebalanceGroup{GroupId: 2, MaxMemory: 2 * gb},
+				&RebalanceGroup{GroupId: 3}),
+			want: map[int]int{1: 3, 2: 5, 3: 4},
+		},
+		{
+			name:     "maxmemory of no group",
+			strategy: REBALANCE_MAXMEMORY,
+			plan: newTestPlan(4, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 3)},
+				&RebalanceGroup{GroupId: 2}),
+			err: true,
+		},
+		{
+			name:     "keys moves the keys, bytes by used memory",
+			strategy: REBALANCE_KEYS,
+			plan: newTestPlan(6, even,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 3), UsedMemory: 4000},
+				&RebalanceGroup{GroupId: 2, Slots: slotRange(4, 5)}),
+			want:  map[int]int{1: 2, 2: 4},
+			keys:  200,
+			bytes: 2000,
+		},
+		{
+			name:     "keys moves small slots instead of a big one",
+			strategy: REBALANCE_KEYS,
+			plan: newTestPlan(4, map[int]int64{0: 10, 1: 10, 2: 200, 3: 180},
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 2)},
+				&RebalanceGroup{GroupId: 2, Slots: slotRange(3, 3)}),
+			want: map[int]int{1: 1, 2: 3},
+			keys: 20,
+		},
+		{
+			name:     "keys of empty groups",
+			strategy: REBALANCE_KEYS,
+			plan: newTestPlan(4, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 3)},
+				&RebalanceGroup{GroupId: 2}),
+			err: true,
+		},
+	}
+
+	for _, tt := range tests {
+		p := tt.plan
+		err := rebalanceStrategies[tt.strategy].load(p, 0)
+		if err == nil {
+			err = p.plan()
+		}
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: should fail", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, errors.ErrorStack(err))
+			continue
+		}
+
+		got := plannedSlots(p)
+		for groupId, n := range tt.want {
+			if got[groupId] != n {
+				t.Errorf("%s: group %d has %d slots, want %d, moves %+v", tt.name, groupId, got[groupId], n, p.Moves)
+			}
+		}
+		if p.Keys != tt.keys || p.Bytes != tt.bytes {
+			t.Errorf("%s: %d keys %d bytes moved, want %d and %d", tt.name, p.Keys, p.Bytes, tt.keys, tt.bytes)
+		}
+		for _, m := range p.Moves {
+			if m.From == m.To {
+				t.Errorf("%s: slot %d moved to its own group", tt.name, m.SlotId)
+			}
+		}
+	}
+}
+
+//groups are only scanned for strategies loading slots by keys
+func TestRebalanceStrategyCountKeys(t *testing.T) {
+	for name, s := range rebalanceStrategies {
+		want := name == REBALANCE_MEMORY || name == REBALANCE_KEYS
+		if s.countKeys != want {
+			t.Errorf("strategy %s counts keys %v, want %v", name, s.countKeys, want)
+		}
+	}
+}
+
+func TestRebalancePlanDrain(t *testing.T) {
+	const gb = 1 << 30
+
+	tests := []struct {
+		name string
+		to   []int
+		plan *RebalancePlan
+		want map[int]int //slots per group
+		err  bool
+	}{
+		{
+			name: "by maxmemory",
+			plan: newTestPlan(6, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 5)},
+				&RebalanceGroup{GroupId: 2, MaxMemory: 2 * gb},
+				&RebalanceGroup{GroupId: 3, MaxMemory: gb}),
+			want: map[int]int{1: 0, 2: 4, 3: 2},
+		},
+		{
+			name: "unknown maxmemory counts as the average",
+			plan: newTestPlan(6, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 5)},
+				&RebalanceGroup{GroupId: 2, MaxMemory: 2 * gb},
+				&RebalanceGroup{GroupId: 3}),
+			want: map[int]int{1: 0, 2: 3, 3: 3},
+		},
+		{
+			name: "slots already owned count",
+			plan: newTestPlan(6, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 3)},
+				&RebalanceGroup{GroupId: 2, Slots: slotRange(4, 5)},
+				&RebalanceGroup{GroupId: 3}),
+			want: map[int]int{1: 0, 2: 3, 3: 3},
+		},
+		{
+			name: "only into the given groups",
+			to:   []int{3},
+			plan: newTestPlan(4, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 3)},
+				&RebalanceGroup{GroupId: 2, MaxMemory: 8 * gb},
+				&RebalanceGroup{GroupId: 3, MaxMemory: gb}),
+			want: map[int]int{1: 0, 2: 0, 3: 4},
+		},
+		{
+			name: "into itself",
+			to:   []int{1},
+			plan: newTestPlan(4, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 3)},
+				&RebalanceGroup{GroupId: 2}),
+			err: true,
+		},
+		{
+			name: "into an unknown group",
+			to:   []int{5},
+			plan: newTestPlan(4, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 3)},
+				&RebalanceGroup{GroupId: 2}),
+			err: true,
+		},
+		{
+			name: "no other group",
+			plan: newTestPlan(4, nil,
+				&RebalanceGroup{GroupId: 1, Slots: slotRange(0, 3)}),
+			err: true,
+		},
+	}
+
+	for _, tt := range tests {
+		p := tt.plan
+		err := p.planDrain(1, tt.to)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: should fail", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, errors.ErrorStack(err))
+			continue
+		}
+
+		got := plannedSlots(p)
+		for groupId, n := range tt.want {
+			if got[groupId] != n {
+				t.Errorf("%s: group %d has %d slots, want %d, moves %+v", tt.name, groupId, got[groupId], n, p.Moves)
+			}
+		}
+		for _, m := range p.Moves {
+			if m.From != 1 {
+				t.Errorf("%s: slot %d moved from group %d", tt.name, m.SlotId, m.From)
+			}
+		}
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/ledisdb/xcodis/models"
 
 	"github.com/docopt/docopt-go"
+	"github.com/juju/errors"
 	log "github.com/ngaut/logging"
 )
 
@@ -24,6 +26,14 @@ func cmdServer(argv []string) (err error) {
 	codis-config server promote <group_id> <redis_addr>
 	codis-config server add-group <group_id>
 	codis-config server remove-group <group_id>
+	codis-config server drain-group <group_id> [--to=<groups>] [--delay=<delay_time_in_ms>] [--dry-run] [--yes]
+
+drain-group migrates every slot of a group to the groups in --to, a comma
+separated list of group ids, or all other groups, spread by their maxmemory.
+It prints the moves with the keys and estimated bytes of each, migrates them
+one task at a time once confirmed, then removes the group if no slot or
+migrate task uses it anymore. --yes skips the question and --dry-run only
+prints the moves. All slots must be online and no migrate task unfinished.
 `
 	args, err := docopt.Parse(usage, argv, true, "", false)
 	if err != nil {
@@ -32,6 +42,35 @@ func cmdServer(argv []string) (err error) {
 	}
 	log.Debug(args)
 
+	// locked by the migrate tasks and the removal
+	if args["drain-group"].(bool) {
+		groupId, err := strconv.Atoi(args["<group_id>"].(string))
+		if err != nil {
+			log.Warning(err)
+			return errors.Trace(err)
+		}
+		var to []int
+		if args["--to"] != nil {
+			for _, v := range strings.Split(args["--to"].(string), ",") {
+				id, err := strconv.Atoi(strings.TrimSpace(v))
+				if err != nil {
+					log.Warning(err)
+					return errors.Trace(err)
+				}
+				to = append(to, id)
+			}
+		}
+		delay := 0
+		if args["--delay"] != nil {
+			delay, err = strconv.Atoi(args["--delay"].(string))
+			if err != nil {
+				log.Warning(err)
+				return errors.Trace(err)
+			}
+		}
+		return runDrainServerGroup(groupId, to, delay, args["--dry-run"].(bool), args["--yes"].(bool))
+	}
+
 	zkLock.Lock(fmt.Sprintf("server, %+v", argv))
 	defer func() {
 		err := zkLock.Unlock()
@@ -135,6 +174,59 @@ func runRemoveServerGroup(groupId int) error {
 	return nil
 }
 
+// migrate the slots of groupId away and remove it
+func runDrainServerGroup(groupId int, to []int, delay int, dryRun bool, yes bool) error {
+	group := models.NewServerGroup(productName, groupId)
+	exists, err := group.Exists(zkConn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !exists {
+		return errors.NotFoundf("group %d", groupId)
+	}
+
+	p, err := PlanDrain(groupId, to)
+	if err != nil {
+		log.Warning(err)
+		return errors.Trace(err)
+	}
+	p.Print()
+	if dryRun {
+		return nil
+	}
+	if !yes && !confirm("migrate %d slots and remove group %d?", len(p.Moves), groupId) {
+		fmt.Println("drain aborted")
+		return nil
+	}
+
+	if err := p.Execute(delay); err != nil {
+		log.Warning(err)
+		return errors.Trace(err)
+	}
+
+	zkLock.Lock(fmt.Sprintf("server, drain-group %d", groupId))
+	defer func() {
+		err := zkLock.Unlock()
+		if err != nil {
+			log.Error(err)
+		}
+	}()
+
+	refs, err := group.References(zkConn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(refs) > 0 {
+		return errors.Errorf("group %d still used by %s", groupId, strings.Join(refs, ", "))
+	}
+	if err := group.Remove(zkConn); err != nil {
+		log.Warning(err)
+		return errors.Trace(err)
+	}
+	fmt.Printf("group %d drained and removed\n", groupId)
+	return nil
+}
+
 func runRemoveServerFromGroup(groupId int, addr string) error {
 	serverGroup, err := models.GetGroup(zkConn, productName, groupId)
 	if err != nil {
@@ -7,23 +7,77 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"time"
 
 	"github.com/juju/errors"
+	"github.com/ledisdb/xcodis/config"
 	"github.com/ledisdb/xcodis/models"
+	"github.com/ngaut/go-zookeeper/zk"
+	"github.com/ngaut/zkhelper"
 
 	"github.com/docopt/docopt-go"
 	log "github.com/ngaut/logging"
-	uuid "github.com/nu7hatch/gouuid"
 )
 
 func cmdSlot(argv []string) (err error) {
 	usage := `usage:
 	codis-config slot init [-f]
+	codis-config slot expand <slot_num>
 	codis-config slot info <slot_id>
+	codis-config slot verify <slot_id>
 	codis-config slot set <slot_id> <group_id> <status>
 	codis-config slot range-set <slot_from> <slot_to> <group_id> <status>
-	codis-config slot migrate <slot_from> <slot_to> <group_id> [--delay=<delay_time_in_ms>]
+	codis-config slot migrate <slot_from> <slot_to> <group_id> [--delay=<delay_time_in_ms>] [--keys-per-sec=<n>] [--bytes-per-sec=<size>] [--replace] [--verify=<mode>] [--verify-alert]
+	codis-config slot migrate limit <task_id> [--keys-per-sec=<n>] [--bytes-per-sec=<size>]
+	codis-config slot migrate (pause|resume) <task_id>
+	codis-config slot migrate cancel <task_id> [--rollback]
+	codis-config slot migrate-status [<task_id>]
+	codis-config slot rebalance [--strategy=<strategy>] [--window=<seconds>] [--delay=<delay_time_in_ms>] [--dry-run] [--yes]
+
+migrate tasks are queued in zk and run one by one, a task interrupted by the
+exit of its cconfig is resumed by the next cconfig migrating or serving the
+dashboard.
+
+pause stops a task after the current batch of keys, the migrating slot stays
+in migrate status so proxies keep moving keys read, and later tasks wait until
+it is resumed. resume runs the rest of a paused task unless a dashboard does.
+cancel finishes the migrating slot, or moves it back to its source group with
+--rollback, then stops the task. A task failed by an error keeps its slot in
+migrate status and blocks later tasks too, resume runs it again and cancel
+stops it.
+
+--keys-per-sec and --bytes-per-sec limit the rate of a task, 0 is unlimited,
+migrate_keys_per_sec and migrate_bytes_per_sec in the config file are the
+defaults. Bytes are counted with MEMORY USAGE on redis, a byte limit is
+rejected on ledisdb. limit changes
+the rate of a queued or running task, the migration also backs off while the
+source or target answers pings slowly.
+
+on redis keys already in the target group are conflicts failing the task, they
+are overwritten with --replace.
+
+--verify=count counts the keys of each slot in both groups before migrating
+it, and after it checks the source has none left and the target has all.
+--verify=digest also compares dumps of sampled keys. A slot failing the check
+stays in migrate status and fails the task, unless --verify-alert is set: the
+slot is then set online and the failure is recorded in the alerts of the task.
+Writes to a slot while it migrates show up as failures too. verify checks an
+online slot against its last verified migration, and that no other group has
+keys of it. On a slot left migrating by a failed task it checks the snapshot of
+the task, and sets the slot online and resumes the task if nothing differs.
+
+rebalance plans slot moves balancing the load of groups and prints them with
+the keys and estimated bytes to move, then migrates them one task at a time
+once confirmed, --yes skips the question and --dry-run only prints the plan.
+All slots must be online and no migrate task unfinished. The load of groups
+is measured by --strategy:
+	count      the same number of slots per group, the default
+	maxmemory  slots in proportion to maxmemory, groups without it count as
+	           the average of the others
+	memory     used memory of slots, the used memory of a group shared by
+	           its slots in proportion to their keys
+	keys       keys of slots
+	traffic    requests to slots seen by online proxies during --window
+	           seconds, 10 by default
 `
 
 	args, err := docopt.Parse(usage, argv, true, "", false)
@@ -33,6 +87,29 @@ func cmdSlot(argv []string) (err error) {
 	}
 	log.Debug(args)
 
+	if args["migrate-status"].(bool) {
+		if args["<task_id>"] != nil {
+			return runSlotMigrateStatus(args["<task_id>"].(string))
+		}
+		return runSlotMigrateStatus("")
+	}
+
+	if args["migrate"].(bool) && args["<task_id>"] != nil {
+		id := args["<task_id>"].(string)
+		switch {
+		case args["limit"].(bool):
+			return runSlotMigrateLimit(id, args)
+		case args["pause"].(bool):
+			return runSlotMigrateRequest(id, models.MIGRATE_REQUEST_PAUSE)
+		case args["resume"].(bool):
+			return runSlotMigrateRequest(id, "")
+		case args["--rollback"].(bool):
+			return runSlotMigrateRequest(id, models.MIGRATE_REQUEST_ROLLBACK)
+		default:
+			return runSlotMigrateRequest(id, models.MIGRATE_REQUEST_CANCEL)
+		}
+	}
+
 	// no need to lock here
 	// locked in runmigratetask
 	if args["migrate"].(bool) {
@@ -56,19 +133,44 @@ func cmdSlot(argv []string) (err error) {
 			log.Warning(err)
 			return errors.Trace(err)
 		}
-		return runSlotMigrate(slotFrom, slotTo, groupId, delay)
+		limit, err := parseMigrateLimit(args, defaultMigrateLimit())
+		if err != nil {
+			log.Warning(err)
+			return errors.Trace(err)
+		}
+		t := models.NewMigrateTask(productName, slotFrom, slotTo, groupId, delay)
+		t.Replace = args["--replace"].(bool)
+		t.VerifyAlert = args["--verify-alert"].(bool)
+		t.MigrateLimit = limit
+		if args["--verify"] != nil {
+			t.Verify = args["--verify"].(string)
+		}
+		return runSlotMigrate(t)
+	}
+	// locked by the migrate tasks of the plan
+	if args["rebalance"].(bool) {
+		strategy := REBALANCE_COUNT
+		if args["--strategy"] != nil {
+			strategy = args["--strategy"].(string)
+		}
+		window := defaultRebalanceWindow
+		if args["--window"] != nil {
+			window, err = strconv.Atoi(args["--window"].(string))
+			if err != nil {
+				log.Warning(err)
+				return errors.Trace(err)
+			}
+		}
+		delay := 0
+		if args["--delay"] != nil {
+			delay, err = strconv.Atoi(args["--delay"].(string))
+			if err != nil {
+				log.Warning(err)
+				return errors.Trace(err)
+			}
+		}
+		return runRebalance(strategy, window, delay, args["--dry-run"].(bool), args["--yes"].(bool))
 	}
-	// if args["rebalance"].(bool) {
-	// 	delay := 0
-	// 	if args["--delay"] != nil {
-	// 		delay, err = strconv.Atoi(args["--delay"].(string))
-	// 		if err != nil {
-	// 			log.Warning(err)
-	// 			return errors.Trace(err)
-	// 		}
-	// 	}
-	// 	return runRebalance(delay)
-	// }
 
 	zkLock.Lock(fmt.Sprintf("slot, %+v", argv))
 	defer func() {
@@ -83,6 +185,15 @@ func cmdSlot(argv []string) (err error) {
 		return runSlotInit(force)
 	}
 
+	if args["expand"].(bool) {
+		num, err := strconv.Atoi(args["<slot_num>"].(string))
+		if err != nil {
+			log.Warning(err)
+			return errors.Trace(err)
+		}
+		return runSlotExpand(num)
+	}
+
 	if args["info"].(bool) {
 		slotId, err := strconv.Atoi(args["<slot_id>"].(string))
 		if err != nil {
@@ -92,6 +203,15 @@ func cmdSlot(argv []string) (err error) {
 		return runSlotInfo(slotId)
 	}
 
+	if args["verify"].(bool) {
+		slotId, err := strconv.Atoi(args["<slot_id>"].(string))
+		if err != nil {
+			log.Warning(err)
+			return errors.Trace(err)
+		}
+		return runSlotVerify(slotId)
+	}
+
 	groupId, err := strconv.Atoi(args["<group_id>"].(string))
 	if err != nil {
 		log.Warning(err)
@@ -136,10 +256,40 @@ func runSlotInit(isForce bool) error {
 			return errors.New("slots already exists. use -f flag to force init")
 		}
 	}
+	meta := &models.SlotMeta{SlotNum: slot_num, DBNum: db_num}
+	if err := meta.Validate(); err != nil {
+		return errors.Trace(err)
+	}
 	err := models.InitSlotSet(zkConn, productName, slot_num)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	return errors.Trace(models.SetSlotMeta(zkConn, productName, meta))
+}
+
+// slot layout of the product, one database per slot if created before virtual slots
+func getSlotMeta(conn zkhelper.Conn) (*models.SlotMeta, error) {
+	meta, err := models.GetSlotMeta(conn, productName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if meta == nil {
+		meta = &models.SlotMeta{SlotNum: slot_num, DBNum: slot_num}
+	}
+	return meta, nil
+}
+
+// split every slot into virtual slots, keys are not moved
+func runSlotExpand(num int) error {
+	meta, err := getSlotMeta(zkConn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := models.ExpandSlots(zkConn, productName, meta, num); err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("expanded to %d slots on %d databases, set slot_num=%d and db_num=%d in the config of proxies\n",
+		num, meta.DBNum, num, meta.DBNum)
 	return nil
 }
 
@@ -153,6 +303,150 @@ func runSlotInfo(slotId int) error {
 	return nil
 }
 
+// check an online slot against the snapshot of its last verified migration,
+// and that other groups have no key of it. A migrating slot is checked
+// against the snapshot of its task and finished if nothing differs.
+func runSlotVerify(slotId int) error {
+	s, err := models.GetSlot(zkConn, productName, slotId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if s.State.Status == models.SLOT_STATUS_MIGRATE {
+		return errors.Trace(runMigratingSlotVerify(s))
+	}
+	if s.State.Status != models.SLOT_STATUS_ONLINE {
+		return errors.NotValidf("slot %d %s, verify", slotId, s.State.Status)
+	}
+
+	var diffs []string
+	checked := map[int]bool{s.GroupId: true}
+	snap, err := lastSlotSnapshot(slotId, s.GroupId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if snap != nil {
+		if diffs, err = verifySlot(slotId, snap); err != nil {
+			return errors.Trace(err)
+		}
+		checked[snap.From] = true
+	} else {
+		fmt.Printf("slot %d has no verified migration to group %d, only other groups are checked\n", slotId, s.GroupId)
+	}
+
+	others, err := otherGroupSlotKeys(slotId, checked)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	diffs = append(diffs, others...)
+
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		return errors.Errorf("slot %d verify failed", slotId)
+	}
+	fmt.Printf("slot %d in group %d verified\n", slotId, s.GroupId)
+	return nil
+}
+
+// verify the migrating slot s of a task not running, e.g. failed by writes
+// during a verified migration, against the snapshot of the task. The slot is
+// set online and the task goes on with its other slots if nothing differs.
+func runMigratingSlotVerify(s *models.Slot) error {
+	t, err := models.NextMigrateTask(zkConn, productName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if t == nil || t.MigratingSlot() != s.Id {
+		return errors.NotFoundf("migrate task of slot %d", s.Id)
+	}
+	if err := t.Claim(zkConn, taskOwner()); err != nil {
+		if zkhelper.ZkErrorEqual(errors.Cause(err), zk.ErrNodeExists) {
+			return errors.NotValidf("migrate task %s running, verify slot %d", t.Id, s.Id)
+		}
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err := t.Release(zkConn); err != nil {
+			log.Warning(err)
+		}
+	}()
+
+	snap := t.SlotSnapshot(s.Id)
+	if snap == nil || snap.To != s.State.MigrateStatus.To {
+		return errors.NotFoundf("snapshot of slot %d in migrate task %s", s.Id, t.Id)
+	}
+	diffs, err := verifySlot(s.Id, snap)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	others, err := otherGroupSlotKeys(s.Id, map[int]bool{snap.From: true, snap.To: true})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	diffs = append(diffs, others...)
+
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		return errors.Errorf("slot %d verify failed, it stays migrating", s.Id)
+	}
+
+	s.State.Status = models.SLOT_STATUS_ONLINE
+	s.State.MigrateStatus.From = models.INVALID_ID
+	s.State.MigrateStatus.To = models.INVALID_ID
+	if err := s.Update(zkConn); err != nil {
+		return errors.Trace(err)
+	}
+	t.SetSlotStatus(s.Id, models.MIGRATE_SLOT_FINISHED)
+	if t.Percent == 100 {
+		t.Status = models.MIGRATE_TASK_FINISHED
+	} else if t.Failed() {
+		t.Status = models.MIGRATE_TASK_MIGRATING
+	}
+	t.Error = ""
+	if err := t.Update(zkConn); err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("slot %d in group %d verified, migrate task %s %s\n", s.Id, snap.To, t.Id, t.Status)
+	return nil
+}
+
+// keys of slotId found in the groups not checked
+func otherGroupSlotKeys(slotId int, checked map[int]bool) ([]string, error) {
+	meta, err := getSlotMeta(zkConn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	groups, err := models.ServerGroups(zkConn, productName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var diffs []string
+	for _, g := range groups {
+		if checked[g.Id] {
+			continue
+		}
+		c, err := slotConn(g.Id, meta, slotId)
+		if errors.Cause(err) == ErrGroupMasterNotFound {
+			continue
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		n, _, err := countSlotKeys(c, meta, slotId, 0)
+		c.Close()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if n > 0 {
+			diffs = append(diffs, fmt.Sprintf("slot %d has %d keys in group %d", slotId, n, g.Id))
+		}
+	}
+	return diffs, nil
+}
+
 func runSlotRangeSet(fromSlotId, toSlotId int, groupId int, status string) error {
 	err := models.SetSlotRange(zkConn, productName, fromSlotId, toSlotId, groupId, models.SlotStatus(status))
 	if err != nil {
@@ -169,41 +463,140 @@ func runSlotSet(slotId int, groupId int, status string) error {
 	return nil
 }
 
-func runSlotMigrate(fromSlotId, toSlotId int, newGroupId int, delay int) error {
-	t := &MigrateTask{}
-	t.Delay = delay
-	t.FromSlot = fromSlotId
-	t.ToSlot = toSlotId
-	t.NewGroupId = newGroupId
-	t.Status = "migrating"
-	t.CreateAt = strconv.FormatInt(time.Now().Unix(), 10)
-	u, err := uuid.NewV4()
+// limit of new migrate tasks in the config file
+func defaultMigrateLimit() models.MigrateLimit {
+	conf := getConf()
+	return models.MigrateLimit{
+		KeysPerSec:  conf.Int("migrate_keys_per_sec"),
+		BytesPerSec: conf.Size("migrate_bytes_per_sec"),
+	}
+}
+
+// l with the rates given in args
+func parseMigrateLimit(args map[string]interface{}, l models.MigrateLimit) (models.MigrateLimit, error) {
+	if v := args["--keys-per-sec"]; v != nil {
+		n, err := strconv.Atoi(v.(string))
+		if err != nil {
+			return l, errors.NewNotValid(err, "invalid --keys-per-sec")
+		}
+		l.KeysPerSec = n
+	}
+	if v := args["--bytes-per-sec"]; v != nil {
+		n, err := config.ParseSize(v.(string))
+		if err != nil {
+			return l, errors.NewNotValid(err, "invalid --bytes-per-sec")
+		}
+		l.BytesPerSec = n
+	}
+	return l, errors.Trace(checkMigrateLimit(l))
+}
+
+// ledisdb migrates keys without their sizes, a byte limit would never apply
+func checkMigrateLimit(l models.MigrateLimit) error {
+	if err := l.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+	if broker == LedisBroker && l.BytesPerSec > 0 {
+		return errors.NotValidf("bytes per sec limit on broker %s", broker)
+	}
+	return nil
+}
+
+// queue t and wait until it is done
+func runSlotMigrate(t *models.MigrateTask) error {
+	if err := t.Create(zkConn); err != nil {
+		log.Warning(err)
+		return errors.Trace(err)
+	}
+	log.Infof("migrate task %s queued", t.Id)
+
+	// run queued tasks until this one is done
+	t, err := waitMigrateTask(t.Id)
 	if err != nil {
 		log.Warning(err)
 		return errors.Trace(err)
 	}
-	t.Id = u.String()
-	t.stopChan = make(chan struct{})
+	if t.Status != models.MIGRATE_TASK_FINISHED {
+		return errors.Errorf("migrate task %s %s %s", t.Id, t.Status, t.Error)
+	}
+	return nil
+}
+
+// change the rates of a migrate task, applied within a second if it runs
+func runSlotMigrateLimit(id string, args map[string]interface{}) error {
+	t, err := models.GetMigrateTask(zkConn, productName, id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if t.Done() {
+		return errors.NotValidf("migrate task %s %s, limit", id, t.Status)
+	}
+
+	l, err := parseMigrateLimit(args, t.MigrateLimit)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := t.SetLimit(zkConn, l); err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("migrate task %s limit %d keys/s %d bytes/s\n", id, l.KeysPerSec, l.BytesPerSec)
+	return nil
+}
 
-	// run migrate
-	if ok, err := preMigrateCheck(t); ok {
-		err = RunMigrateTask(t)
+// pause, resume or cancel a migrate task and wait for it
+func runSlotMigrateRequest(id string, req string) error {
+	t, err := requestMigrateTask(id, req)
+	if err != nil {
+		log.Warning(err)
+		return errors.Trace(err)
+	}
+	if t.Status == models.MIGRATE_TASK_ERR {
+		return errors.Errorf("migrate task %s %s %s", t.Id, t.Status, t.Error)
+	}
+	fmt.Printf("migrate task %s %s at %d%%\n", t.Id, t.Status, t.Percent)
+	return nil
+}
+
+// list all migrate tasks, or the one with id
+func runSlotMigrateStatus(id string) error {
+	var v interface{}
+	if len(id) > 0 {
+		t, err := models.GetMigrateTask(zkConn, productName, id)
 		if err != nil {
-			log.Warning(err)
 			return errors.Trace(err)
 		}
+		v = t
 	} else {
+		tasks, err := models.MigrateTasks(zkConn, productName)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		v = tasks
+	}
+
+	b, _ := json.MarshalIndent(v, " ", "  ")
+	fmt.Println(string(b))
+	return nil
+}
+
+func runRebalance(strategy string, window int, delay int, dryRun bool, yes bool) error {
+	p, err := PlanRebalance(strategy, window)
+	if err != nil {
+		log.Warning(err)
+		return errors.Trace(err)
+	}
+	p.Print()
+	if dryRun || len(p.Moves) == 0 {
+		return nil
+	}
+
+	if !yes && !confirm("migrate %d slots?", len(p.Moves)) {
+		fmt.Println("rebalance aborted")
+		return nil
+	}
+	if err := p.Execute(delay); err != nil {
 		log.Warning(err)
 		return errors.Trace(err)
 	}
 	return nil
 }
-
-// func runRebalance(delay int) error {
-// 	err := Rebalance(zkConn, delay)
-// 	if err != nil {
-// 		log.Warning(err)
-// 		return errors.Trace(err)
-// 	}
-// 	return nil
-// }
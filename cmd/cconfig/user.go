@@ -0,0 +1,123 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ledisdb/xcodis/models"
+
+	"github.com/docopt/docopt-go"
+	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
+)
+
+// client users and their ACLs, checked by proxies
+
+func cmdUser(argv []string) (err error) {
+	usage := `usage:
+	codis-config user list
+	codis-config user add <name> <password> [--category=<categories>] [--key-pattern=<patterns>] [--read-only]
+	codis-config user remove <name>
+
+options:
+	--category=<categories>		allowed command categories, comma separated: read, write, admin [default: read,write]
+	--key-pattern=<patterns>	allowed key glob patterns, comma separated, all keys if not set
+	--read-only			only read commands are allowed
+`
+	args, err := docopt.Parse(usage, argv, true, "", false)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Debug(args)
+
+	zkLock.Lock(fmt.Sprintf("user, %+v", argv))
+	defer func() {
+		err := zkLock.Unlock()
+		if err != nil {
+			log.Error(err)
+		}
+	}()
+
+	if args["list"].(bool) {
+		return runListUser()
+	}
+
+	name := args["<name>"].(string)
+	if args["remove"].(bool) {
+		return runRemoveUser(name)
+	}
+
+	if args["add"].(bool) {
+		var patterns []string
+		if args["--key-pattern"] != nil {
+			patterns = splitList(args["--key-pattern"].(string))
+		}
+		return runAddUser(name, args["<password>"].(string), splitList(args["--category"].(string)),
+			patterns, args["--read-only"].(bool))
+	}
+
+	return nil
+}
+
+func splitList(s string) []string {
+	var ret []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func runListUser() error {
+	users, err := models.Users(zkConn, productName)
+	if err != nil {
+		log.Warning(err)
+		return errors.Trace(err)
+	}
+
+	//never print password hashes
+	for i := range users {
+		users[i].Password = ""
+	}
+
+	b, _ := json.MarshalIndent(users, " ", "  ")
+	fmt.Println(string(b))
+	return nil
+}
+
+func runAddUser(name string, password string, categories []string, patterns []string, readOnly bool) error {
+	hash, err := models.HashPassword(password)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u := &models.User{
+		Name:        name,
+		Password:    hash,
+		Categories:  categories,
+		KeyPatterns: patterns,
+		ReadOnly:    readOnly,
+	}
+
+	if err := models.CreateOrUpdateUser(zkConn, productName, u); err != nil {
+		log.Warning(errors.ErrorStack(err))
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func runRemoveUser(name string) error {
+	if err := models.RemoveUser(zkConn, productName, name); err != nil {
+		log.Warning(errors.ErrorStack(err))
+		return errors.Trace(err)
+	}
+
+	return nil
+}
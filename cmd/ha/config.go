@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ledisdb/redis-failover/failover"
+	"github.com/ledisdb/xcodis/config"
+	"github.com/ledisdb/xcodis/coordinator"
+	"github.com/ledisdb/xcodis/models"
+)
+
+//flags overriding keys of the failover config file
+var configFlags = map[string]string{
+	"addr":               "addr",
+	"check_interval":     "check_interval",
+	"max_down_time":      "max_down_time",
+	"masters":            "masters",
+	"masters_state":      "masters_state",
+	"broker":             "broker",
+	"raft_addr":          "raft.addr",
+	"raft_data_dir":      "raft.data_dir",
+	"raft_log_dir":       "raft.log_dir",
+	"raft_cluster":       "raft.cluster",
+	"raft_cluster_state": "raft.cluster_state",
+}
+
+//load the failover config file, the defaults if not set, and override it
+//with the flags set on the command line
+func loadConfig() (*config.Config, error) {
+	file := config.HA.Empty()
+	if len(*configFile) > 0 {
+		var err error
+		if file, err = config.HA.LoadTOML(*configFile); err != nil {
+			return nil, errors.Annotatef(err, "load failover config %s", *configFile)
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := configFlags[f.Name]; ok && err == nil {
+			err = file.Set(key, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid flags")
+	}
+
+	//the zk broker stores failover state in zookeeper, not in the coordinator
+	if file.String("broker") == "zk" && *coord == coordinator.Etcd {
+		return nil, errors.New("broker zk needs coordinator zookeeper, use broker raft with etcd")
+	}
+	//the zk broker creates its nodes open to everyone
+	if file.String("broker") == "zk" && len(*zkAuth) > 0 {
+		return nil, errors.New("broker zk does not support zk_auth, use broker raft")
+	}
+	return file, nil
+}
+
+func failoverConfig(file *config.Config) *failover.Config {
+	c := new(failover.Config)
+	c.Addr = file.String("addr")
+	c.Masters = file.List("masters")
+	c.MastersState = file.String("masters_state")
+	c.CheckInterval = int(file.Duration("check_interval") / time.Millisecond)
+	c.MaxDownTime = int(file.Duration("max_down_time") / time.Second)
+	c.Broker = file.String("broker")
+
+	c.Raft.Addr = file.String("raft.addr")
+	c.Raft.DataDir = file.String("raft.data_dir")
+	c.Raft.LogDir = file.String("raft.log_dir")
+	c.Raft.Cluster = file.List("raft.cluster")
+	c.Raft.ClusterState = file.String("raft.cluster_state")
+
+	// for zk, we use same zk with xcodis
+	c.Zk.BaseDir = models.GetProductPath(*productName) + "/failover"
+	c.Zk.Addr = strings.Split(*zkAddr, ",")
+	return c
+}
+
+//flags of the xcodis coordinator, the failover ones are checked with the config
+func checkFlags() error {
+	if err := checkValue("coordinator", *coord, coordinator.Zookeeper, "zk", coordinator.Etcd); err != nil {
+		return err
+	}
+	if err := models.CheckRootPath(*zkRoot); err != nil {
+		return errors.Trace(err)
+	}
+	if len(*productName) == 0 {
+		return errors.New("product is empty")
+	}
+	return nil
+}
+
+func checkValue(key string, value string, values ...string) error {
+	for _, v := range values {
+		if v == value {
+			return nil
+		}
+	}
+	return errors.Errorf("invalid %s %q, should be one of %q", key, value, values)
+}
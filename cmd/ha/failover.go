@@ -5,13 +5,16 @@ import (
 
 	"github.com/ledisdb/redis-failover/failover"
 	"github.com/ledisdb/xcodis/models"
-	"github.com/ledisdb/xcodis/utils"
+	"github.com/ledisdb/xcodis/coordinator"
 	log "github.com/ngaut/logging"
-	"github.com/ngaut/zkhelper"
 )
 
 func BeforePromote(oldMaster string) error {
-	conn, _ := zkhelper.ConnectToZk(*zkAddr)
+	conn, err := coordinator.Connect(*coord, *zkAuth, *zkAddr)
+	if err != nil {
+		log.Errorf("connect to %s error %v, give up failover", *coord, err)
+		return failover.ErrGiveupFailover
+	}
 	defer conn.Close()
 
 	groups, err := models.ServerGroups(conn, *productName)
@@ -39,7 +42,10 @@ func BeforePromote(oldMaster string) error {
 }
 
 func Promote(oldMaster string, newMaster string) error {
-	conn, _ := zkhelper.ConnectToZk(*zkAddr)
+	conn, err := coordinator.Connect(*coord, *zkAuth, *zkAddr)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
 	groups, err := models.ServerGroups(conn, *productName)
@@ -63,7 +69,7 @@ func Promote(oldMaster string, newMaster string) error {
 		return fmt.Errorf("can not find %s in any groups", oldMaster)
 	}
 
-	lock := utils.GetZkLock(conn, *productName)
+	lock := models.GetZkLock(conn, *productName)
 	lock.Lock(fmt.Sprintf("promote server %+v", newMaster))
 	defer func() {
 		err := lock.Unlock()
@@ -5,16 +5,17 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 
 	"github.com/ledisdb/redis-failover/failover"
+	"github.com/ledisdb/xcodis/models"
+	log "github.com/ngaut/logging"
 )
 
 var configFile = flag.String("config", "", "failover config file")
 var addr = flag.String("addr", ":11000", "failover http listen addr")
 var checkInterval = flag.Int("check_interval", 1000, "check master alive every n millisecond")
-var maxDownTime = flag.Int("max_down_time", 3, "max down time for a master, after that, we will do failover")
+var maxDownTime = flag.Int("max_down_time", 3, "max down time for a master in seconds, after that, we will do failover")
 var masters = flag.String("masters", "", "redis master need to be monitored, seperated by comma")
 var mastersState = flag.String("masters_state", "", "new or existing for raft, if new, we will depracted old saved masters")
 
@@ -26,71 +27,34 @@ var raftAddr = flag.String("raft_addr", "", "raft listen addr, if empty, we will
 var raftCluster = flag.String("raft_cluster", "", "raft cluster,vseperated by comma")
 var raftClusterState = flag.String("raft_cluster_state", "", "new or existing, if new, we will deprecate old saved cluster and use new")
 
-var zkAddr = flag.String("zk", "", "zookeeper address")
+var zkAddr = flag.String("zk", "", "zookeeper or etcd address of xcodis")
+var coord = flag.String("coordinator", "zookeeper", "coordinator of xcodis, zookeeper or etcd")
+var zkRoot = flag.String("zk_root", models.DEFAULT_ROOT_PATH, "root path of xcodis in coordinator")
+var zkAuth = flag.String("zk_auth", "", "user:password of coordinator, digest auth for zookeeper")
 var productName = flag.String("product", "test", "product name")
 
+var checkConfigOnly = flag.Bool("check-config", false, "validate the config file and flags, then exit")
+
 func main() {
 	flag.Parse()
 
-	var c *failover.Config
-	var err error
-	if len(*configFile) > 0 {
-		c, err = failover.NewConfigWithFile(*configFile)
-		if err != nil {
-			fmt.Printf("load failover config %s err %v", *configFile, err)
-			return
-		}
-	} else {
-		fmt.Printf("no config file, use default config")
-		c = new(failover.Config)
-		c.Addr = ":11000"
-	}
-
-	if *checkInterval > 0 {
-		c.CheckInterval = *checkInterval
-	}
-
-	if *maxDownTime > 0 {
-		c.MaxDownTime = *maxDownTime
-	}
-
-	c.Broker = *broker
-
-	if len(*raftAddr) > 0 {
-		c.Raft.Addr = *raftAddr
-	}
-
-	if len(*raftDataDir) > 0 {
-		c.Raft.DataDir = *raftDataDir
+	if err := checkFlags(); err != nil {
+		fmt.Printf("invalid flags %v\n", err)
+		os.Exit(1)
 	}
+	models.SetRootPath(*zkRoot)
 
-	if len(*raftLogDir) > 0 {
-		c.Raft.LogDir = *raftLogDir
-	}
-
-	seps := strings.Split(*raftCluster, ",")
-	if len(seps) > 0 {
-		c.Raft.Cluster = seps
-	}
-
-	if len(*raftClusterState) > 0 {
-		c.Raft.ClusterState = *raftClusterState
-	}
-
-	seps = strings.Split(*masters, ",")
-	if len(seps) > 0 {
-		c.Masters = seps
+	file, err := loadConfig()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
 	}
-
-	if len(*mastersState) > 0 {
-		c.MastersState = *mastersState
+	if *checkConfigOnly {
+		fmt.Println("config is valid")
+		return
 	}
 
-	// for zk, we use same zk with xcodis
-	c.Zk.BaseDir = fmt.Sprintf("/zk/codis/db_%s/failover", *productName)
-	c.Zk.Addr = strings.Split(*zkAddr, ",")
-
-	app, err := failover.NewApp(c)
+	app, err := failover.NewApp(failoverConfig(file))
 	if err != nil {
 		fmt.Printf("new failover app error %v", err)
 		return
@@ -109,8 +73,22 @@ func main() {
 		syscall.SIGQUIT)
 
 	go func() {
-		<-sc
-		app.Close()
+		for sig := range sc {
+			if sig != syscall.SIGHUP {
+				app.Close()
+				return
+			}
+
+			//nothing is applied live, only report problems before a restart
+			if len(*configFile) == 0 {
+				continue
+			}
+			if _, err := loadConfig(); err != nil {
+				log.Errorf("reload failover config failed, %v", err)
+			} else {
+				log.Warningf("failover config %s is valid, restart to apply it", *configFile)
+			}
+		}
 	}()
 
 	app.Run()
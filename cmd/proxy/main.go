@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strconv"
+	"syscall"
 
 	"github.com/ledisdb/xcodis/proxy/router"
 	"github.com/ledisdb/xcodis/utils"
@@ -25,10 +28,11 @@ var (
 	configFile = "config.ini"
 )
 
-var usage = `usage: proxy [-c <config_file>] [-L <log_file>] [--log-level=<loglevel>] [--cpu=<cpu_num>] [--addr=<proxy_listen_addr>] [--http-addr=<debug_http_server_addr>]
+var usage = `usage: proxy [-c <config_file>] [-L <log_file>] [--log-level=<loglevel>] [--cpu=<cpu_num>] [--addr=<proxy_listen_addr>] [--http-addr=<debug_http_server_addr>] [--check-config]
 
 options:
-   -c	set config file
+   -c <config_file>  set config file, reloaded on SIGHUP
+   --check-config  validate the config file and exit
    -L	set output log file, default is stdout
    --log-level=<loglevel>	set log level: info, warn, error, debug [default: info]
    --cpu=<cpu_num>		num of cpu cores that proxy can use
@@ -65,6 +69,19 @@ func main() {
 		configFile = args["-c"].(string)
 	}
 
+	conf, err := router.LoadConf(configFile)
+	if args["--check-config"].(bool) {
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", configFile)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// set output log file
 	if args["-L"] != nil {
 		log.SetOutputByName(args["-L"].(string))
@@ -104,11 +121,19 @@ func main() {
 	http.HandleFunc("/setloglevel", handleSetLogLevel)
 	go http.ListenAndServe(httpAddr, nil)
 	log.Info("running on ", addr)
-	conf, err := router.LoadConf(configFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	s := router.NewServer(addr, httpAddr, conf)
+	s := router.NewProxy(addr, httpAddr, conf)
+
+	//an invalid file is not applied, the running config is kept
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := s.ReloadConf(configFile); err != nil {
+				log.Errorf("reload config %s failed, %v", configFile, err)
+			}
+		}
+	}()
+
 	s.Run()
 	log.Warning("exit")
 }
@@ -0,0 +1,385 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+// Package config reads key=value config files against a typed schema.
+//
+// Lines starting with # are comments. Every key must be declared in the
+// schema and every value must parse as the type of its option, all problems
+// of a file are reported at once with their line numbers:
+//   - Int, a decimal integer, checked against Min and Max
+//   - Bool, true/false, 1/0, t/f
+//   - Duration, a number in the Unit of the option or a Go duration, e.g. 500ms or 5s
+//   - Size, bytes or a number with a k, m or g suffix (KiB, MiB, GiB), e.g. 64m
+//   - List, comma separated, spaces around items are ignored
+//
+// Options declared as "*.<key>" are per item of the list option named by the
+// schema, e.g. foo.password for product foo in products.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+type Type int
+
+const (
+	String Type = iota
+	Int
+	Bool
+	Duration
+	Size
+	List
+)
+
+func (t Type) String() string {
+	switch t {
+	case Int:
+		return "int"
+	case Bool:
+		return "bool"
+	case Duration:
+		return "duration"
+	case Size:
+		return "size"
+	case List:
+		return "list"
+	}
+	return "string"
+}
+
+type Option struct {
+	Key     string
+	Type    Type
+	Default string
+	Unit    time.Duration //unit of a plain number, Duration only, seconds if 0
+	Min     int64         //Int, Size and Duration in Unit
+	Max     int64         //no limit if 0
+	Values  []string      //allowed values of a String, any if empty
+	Reload  bool          //applied on SIGHUP, others need a restart
+	Desc    string
+}
+
+type Schema struct {
+	options map[string]*Option
+	keys    []string
+	items   string //list option whose items prefix "*." options
+}
+
+// NewSchema returns the schema of options, items names the list option
+// whose items can be used as the prefix of "*." options.
+func NewSchema(items string, options ...*Option) *Schema {
+	s := &Schema{options: make(map[string]*Option), items: items}
+	for _, o := range options {
+		if _, ok := s.options[o.Key]; ok {
+			panic("duplicate config option " + o.Key)
+		}
+		s.options[o.Key] = o
+		s.keys = append(s.keys, o.Key)
+	}
+	return s
+}
+
+// Option returns the option of key, "*." options match any prefix.
+func (s *Schema) Option(key string) *Option {
+	if o, ok := s.options[key]; ok {
+		return o
+	}
+	if i := strings.Index(key, "."); i > 0 {
+		return s.options["*"+key[i:]]
+	}
+	return nil
+}
+
+// Options returns all options in declaration order.
+func (s *Schema) Options() []*Option {
+	var ret []*Option
+	for _, k := range s.keys {
+		ret = append(ret, s.options[k])
+	}
+	return ret
+}
+
+type Config struct {
+	schema *Schema
+	values map[string]string //set in the file
+}
+
+// Empty returns a config with every option at its default.
+func (s *Schema) Empty() *Config {
+	return &Config{schema: s, values: make(map[string]string)}
+}
+
+func (s *Schema) Load(file string) (*Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	return s.Parse(f, file)
+}
+
+// Parse reads a config from r, name is used in errors.
+func (s *Schema) Parse(r io.Reader, name string) (*Config, error) {
+	c := s.Empty()
+	lines := make(map[string]int)
+
+	var errs []string
+	fail := func(line int, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s:%d: ", name, line)+fmt.Sprintf(format, args...))
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			fail(n, "invalid line %q, should be key=value", line)
+			continue
+		}
+
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if prev, ok := lines[key]; ok {
+			fail(n, "duplicate key %s, set on line %d", key, prev)
+			continue
+		}
+		lines[key] = n
+
+		o := s.Option(key)
+		if o == nil {
+			fail(n, "unknown key %s", key)
+			continue
+		}
+		if err := o.check(value); err != nil {
+			fail(n, "%s", err)
+			continue
+		}
+		c.values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	//items are known once the whole file is read
+	items := make(map[string]bool)
+	for _, item := range c.List(s.items) {
+		items[item] = true
+	}
+	for key, n := range lines {
+		if i := strings.Index(key, "."); i > 0 && s.options[key] == nil && !items[key[:i]] {
+			fail(n, "%s is not in %s", key[:i], s.items)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return c, nil
+}
+
+func (o *Option) check(value string) error {
+	var n int64
+	var err error
+	switch o.Type {
+	case String:
+		if len(o.Values) == 0 {
+			return nil
+		}
+		for _, v := range o.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return errors.Errorf("invalid %s %q, should be one of %s", o.Key, value, strings.Join(o.Values, ", "))
+	case Bool:
+		_, err = strconv.ParseBool(value)
+	case Int:
+		n, err = strconv.ParseInt(value, 10, 64)
+	case Size:
+		n, err = ParseSize(value)
+	case Duration:
+		var d time.Duration
+		if d, err = parseDuration(value, o.unit()); err == nil {
+			n = int64(d / o.unit())
+		}
+	case List:
+		return nil
+	}
+	if err != nil {
+		return errors.Errorf("invalid %s %q, not a valid %s", o.Key, value, o.Type)
+	}
+
+	if n < o.Min || (o.Max > 0 && n > o.Max) {
+		if o.Max > 0 {
+			return errors.Errorf("invalid %s %s, should be in [%d, %d]", o.Key, value, o.Min, o.Max)
+		}
+		return errors.Errorf("invalid %s %s, should be at least %d", o.Key, value, o.Min)
+	}
+	return nil
+}
+
+func (o *Option) unit() time.Duration {
+	if o.Unit == 0 {
+		return time.Second
+	}
+	return o.Unit
+}
+
+func parseDuration(value string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// ParseSize parses a size in bytes with an optional k, m or g suffix.
+func ParseSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"gb", 1 << 30}, {"g", 1 << 30}, {"mb", 1 << 20}, {"m", 1 << 20}, {"kb", 1 << 10}, {"k", 1 << 10}, {"b", 1}}
+
+	v := strings.ToLower(value)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), 10, 64)
+			return n * u.size, err
+		}
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func (c *Config) option(key string) *Option {
+	o := c.schema.Option(key)
+	if o == nil {
+		panic("undeclared config option " + key)
+	}
+	return o
+}
+
+//value of key, the default if not set. "*." options default to the value
+//without prefix if it is declared, e.g. foo.broker to broker.
+func (c *Config) value(key string) string {
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	if i := strings.Index(key, "."); i > 0 && c.schema.options[key] == nil {
+		if _, ok := c.schema.options[key[i+1:]]; ok {
+			return c.value(key[i+1:])
+		}
+	}
+	return c.option(key).Default
+}
+
+// Set sets key as if it was in the file, e.g. from a flag.
+func (c *Config) Set(key string, value string) error {
+	o := c.schema.Option(key)
+	if o == nil {
+		return errors.NotFoundf("config option %s", key)
+	}
+	if err := o.check(value); err != nil {
+		return errors.Trace(err)
+	}
+	c.values[key] = value
+	return nil
+}
+
+// IsSet reports if key is set in the file.
+func (c *Config) IsSet(key string) bool {
+	_, ok := c.values[key]
+	return ok
+}
+
+func (c *Config) String(key string) string {
+	c.option(key)
+	return c.value(key)
+}
+
+func (c *Config) Int(key string) int {
+	c.option(key)
+	n, _ := strconv.Atoi(c.value(key))
+	return n
+}
+
+func (c *Config) Bool(key string) bool {
+	c.option(key)
+	b, _ := strconv.ParseBool(c.value(key))
+	return b
+}
+
+func (c *Config) Duration(key string) time.Duration {
+	d, _ := parseDuration(c.value(key), c.option(key).unit())
+	return d
+}
+
+func (c *Config) Size(key string) int64 {
+	c.option(key)
+	n, _ := ParseSize(c.value(key))
+	return n
+}
+
+func (c *Config) List(key string) []string {
+	c.option(key)
+	var ret []string
+	for _, item := range strings.Split(c.value(key), ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+// Changed returns keys whose value differs from old, sorted.
+func (c *Config) Changed(old *Config) []string {
+	keys := make(map[string]bool)
+	for k := range c.values {
+		keys[k] = true
+	}
+	for k := range old.values {
+		keys[k] = true
+	}
+
+	var ret []string
+	for k := range keys {
+		if c.canonical(k) != old.canonical(k) {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+//value of key in one form, e.g. 5 and 5s of a duration in seconds are the same
+func (c *Config) canonical(key string) string {
+	switch c.option(key).Type {
+	case Bool:
+		return strconv.FormatBool(c.Bool(key))
+	case Duration:
+		return c.Duration(key).String()
+	case Size:
+		return strconv.FormatInt(c.Size(key), 10)
+	case List:
+		return strings.Join(c.List(key), ",")
+	}
+	return c.value(key)
+}
+
+// Reloadable reports if a change of key is applied on SIGHUP.
+func (c *Config) Reloadable(key string) bool {
+	o := c.schema.Option(key)
+	return o != nil && o.Reload
+}
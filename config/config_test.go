@@ -0,0 +1,158 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Xcodis.Parse(strings.NewReader(`
+# comment
+zk = localhost:2181,localhost:2182
+net_timeout=10s
+premigrate_wait_ms=2
+read_cache_max_bytes=2m
+migrate_bytes_per_sec=10k
+read_cache_prefix=hot:, conf:
+stale_start=true
+products=foo,bar
+foo.broker=redis
+foo.concurrent_limit=10
+`), "test.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.String("zk") != "localhost:2181,localhost:2182" || c.String("product") != "" {
+		t.Fatal(c.String("zk"), c.String("product"))
+	}
+	if c.Duration("net_timeout") != 10*time.Second || c.Duration("premigrate_wait_ms") != 2*time.Millisecond {
+		t.Fatal(c.Duration("net_timeout"), c.Duration("premigrate_wait_ms"))
+	}
+	if c.Duration("read_cache_ttl_ms") != time.Second || c.Size("read_cache_max_bytes") != 2<<20 {
+		t.Fatal(c.Duration("read_cache_ttl_ms"), c.Size("read_cache_max_bytes"))
+	}
+	if c.Size("migrate_bytes_per_sec") != 10<<10 || c.Int("migrate_keys_per_sec") != 0 {
+		t.Fatal(c.Size("migrate_bytes_per_sec"), c.Int("migrate_keys_per_sec"))
+	}
+	if p := c.List("read_cache_prefix"); len(p) != 2 || p[1] != "conf:" {
+		t.Fatal(p)
+	}
+	if !c.Bool("stale_start") || c.Int("slot_num") != 16 {
+		t.Fatal(c.Bool("stale_start"), c.Int("slot_num"))
+	}
+
+	//per product options default to the global ones
+	if c.String("foo.broker") != "redis" || c.String("bar.broker") != "ledisdb" {
+		t.Fatal(c.String("foo.broker"), c.String("bar.broker"))
+	}
+	if c.Int("foo.concurrent_limit") != 10 || c.Int("bar.concurrent_limit") != 100 {
+		t.Fatal(c.Int("foo.concurrent_limit"), c.Int("bar.concurrent_limit"))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Xcodis.Parse(strings.NewReader(`zk=localhost:2181
+net_timeout=5d
+slot_num=0
+foo=1
+broker=mysql
+product
+product=a
+product=b
+baz.password=x
+`), "test.ini")
+	if err == nil {
+		t.Fatal("should fail")
+	}
+
+	for _, e := range []string{
+		"test.ini:2: invalid net_timeout",
+		"test.ini:3: invalid slot_num 0",
+		"test.ini:4: unknown key foo",
+		"test.ini:5: invalid broker",
+		"test.ini:6: invalid line",
+		"test.ini:8: duplicate key product",
+		"test.ini:9: baz is not in products",
+	} {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("%q not reported in\n%s", e, err)
+		}
+	}
+}
+
+func TestChanged(t *testing.T) {
+	old, err := Xcodis.Parse(strings.NewReader("net_timeout=5\nproduct=a\n"), "old.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Xcodis.Parse(strings.NewReader("net_timeout=5s\nproduct=b\nconcurrent_limit=10\n"), "new.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := c.Changed(old)
+	if strings.Join(changed, ",") != "concurrent_limit,product" {
+		t.Fatal(changed)
+	}
+	if !c.Reloadable("concurrent_limit") || c.Reloadable("product") {
+		t.Fatal("reloadable options")
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	c, err := HA.ParseTOML(strings.NewReader(`
+addr = "127.0.0.1:11000"
+masters = ["127.0.0.1:6379", "127.0.0.1:6380"]
+check_interval = "500ms"
+broker = "raft"
+
+[raft]
+cluster = ["127.0.0.1:12000"]
+cluster_state = "new"
+`), "failover.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := c.List("masters"); len(m) != 2 || m[1] != "127.0.0.1:6380" {
+		t.Fatal(m)
+	}
+	if c.Duration("check_interval") != 500*time.Millisecond || c.Duration("max_down_time") != 3*time.Second {
+		t.Fatal(c.Duration("check_interval"), c.Duration("max_down_time"))
+	}
+	if c.String("raft.cluster_state") != "new" || c.String("raft.data_dir") != "./var/store" {
+		t.Fatal(c.String("raft.cluster_state"), c.String("raft.data_dir"))
+	}
+
+	//flags are checked like the file
+	if err := c.Set("broker", "etcd"); err == nil {
+		t.Error("invalid broker set")
+	}
+	if err := c.Set("max_down_time", "10"); err != nil || c.Duration("max_down_time") != 10*time.Second {
+		t.Error(err, c.Duration("max_down_time"))
+	}
+
+	_, err = HA.ParseTOML(strings.NewReader(`
+check_interval = -1
+masters_state = "old"
+[raft]
+port = 12000
+`), "failover.toml")
+	if err == nil {
+		t.Fatal("should fail")
+	}
+	for _, e := range []string{
+		"failover.toml: invalid check_interval -1",
+		"failover.toml: invalid masters_state",
+		"failover.toml: unknown key raft.port",
+	} {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("%q not reported in\n%s", e, err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package config
+
+import (
+	"time"
+)
+
+// HA is the schema of the TOML failover config of cmd/ha, keys of a table
+// are prefixed by its name.
+var HA = NewSchema("",
+	&Option{Key: "addr", Default: ":11000", Desc: "failover http listen addr"},
+	&Option{Key: "masters", Type: List, Desc: "monitored redis masters"},
+	&Option{Key: "masters_state", Values: []string{"new", "existing"}, Desc: "new drops the saved masters, raft only"},
+	&Option{Key: "check_interval", Type: Duration, Unit: time.Millisecond, Default: "1000", Min: 1},
+	&Option{Key: "max_down_time", Type: Duration, Unit: time.Second, Default: "3", Min: 1,
+		Desc: "failover once a master is down that long"},
+	&Option{Key: "broker", Values: []string{"raft", "zk"}, Desc: "cluster of failover nodes, none if empty"},
+
+	&Option{Key: "raft.addr", Desc: "raft listen addr, raft disabled if empty"},
+	&Option{Key: "raft.data_dir", Default: "./var/store"},
+	&Option{Key: "raft.log_dir", Default: "./var/log", Desc: "stdout if empty"},
+	&Option{Key: "raft.cluster", Type: List},
+	&Option{Key: "raft.cluster_state", Values: []string{"new", "existing"}, Desc: "new drops the saved cluster"},
+
+	&Option{Key: "zk.addr", Type: List, Desc: "replaced by the xcodis coordinator"},
+	&Option{Key: "zk.base_dir", Desc: "replaced by the failover path of the product"},
+)
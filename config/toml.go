@@ -0,0 +1,70 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+)
+
+func (s *Schema) LoadTOML(file string) (*Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	return s.ParseTOML(f, file)
+}
+
+// ParseTOML reads a TOML config from r, name is used in errors. Keys of a
+// table are prefixed by its name, e.g. raft.addr, and arrays are lists.
+func (s *Schema) ParseTOML(r io.Reader, name string) (*Config, error) {
+	var m map[string]interface{}
+	if _, err := toml.DecodeReader(r, &m); err != nil {
+		return nil, errors.Annotatef(err, "%s", name)
+	}
+
+	c := s.Empty()
+	var errs []string
+	flatten("", m, func(key string, value string) {
+		o := s.Option(key)
+		if o == nil {
+			errs = append(errs, fmt.Sprintf("%s: unknown key %s", name, key))
+		} else if err := o.check(value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		} else {
+			c.values[key] = value
+		}
+	})
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return c, nil
+}
+
+func flatten(prefix string, m map[string]interface{}, fn func(key string, value string)) {
+	for k, v := range m {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flatten(prefix+k+".", v, fn)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			fn(prefix+k, strings.Join(items, ","))
+		default:
+			fn(prefix+k, fmt.Sprint(v))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package config
+
+import (
+	"time"
+)
+
+// Xcodis is the schema of config.ini shared by proxy and cconfig.
+var Xcodis = NewSchema("products",
+	&Option{Key: "zk", Default: "localhost:2181", Desc: "zookeeper or etcd servers, comma separated"},
+	&Option{Key: "coordinator", Default: "zookeeper", Values: []string{"zookeeper", "zk", "etcd"}},
+	&Option{Key: "zk_root", Default: "/zk/codis", Desc: "root of xcodis nodes, an absolute path"},
+	&Option{Key: "zk_auth", Desc: "user:password, zookeeper digest auth"},
+	&Option{Key: "product", Desc: "required unless a proxy serves products"},
+	&Option{Key: "proxy_id", Desc: "proxy only"},
+	&Option{Key: "broker", Default: "ledisdb", Values: []string{"ledisdb", "redis"}},
+	&Option{Key: "slot_num", Type: Int, Default: "16", Min: 1},
+	&Option{Key: "db_num", Type: Int, Default: "0", Desc: "backend databases, slot_num if 0"},
+
+	&Option{Key: "net_timeout", Type: Duration, Unit: time.Second, Default: "5", Min: 1, Reload: true},
+	&Option{Key: "concurrent_limit", Type: Int, Default: "100", Min: 1, Reload: true,
+		Desc: "max concurrent requests to backends"},
+	&Option{Key: "premigrate_wait_ms", Type: Duration, Unit: time.Millisecond, Default: "3000", Reload: true,
+		Desc: "max wait of a request to a pre migrate slot"},
+
+	&Option{Key: "migrate_keys_per_sec", Type: Int, Default: "0", Reload: true,
+		Desc: "default key rate of slot migration, 0 is unlimited"},
+	&Option{Key: "migrate_bytes_per_sec", Type: Size, Default: "0", Reload: true,
+		Desc: "default byte rate of slot migration on redis, 0 is unlimited"},
+
+	&Option{Key: "topology_snapshot", Desc: "file the applied topology is saved to"},
+	&Option{Key: "stale_start", Type: Bool, Default: "false", Desc: "serve from topology_snapshot until zk is available"},
+
+	&Option{Key: "coalesce_commands", Type: List, Desc: "read only commands whose identical concurrent requests are merged"},
+	&Option{Key: "coalesce_window_ms", Type: Duration, Unit: time.Millisecond, Default: "5"},
+
+	&Option{Key: "read_cache_prefix", Type: List, Desc: "key prefixes of the read cache, disabled if empty"},
+	&Option{Key: "read_cache_commands", Type: List, Default: "GET,HGET,HGETALL"},
+	&Option{Key: "read_cache_ttl_ms", Type: Duration, Unit: time.Millisecond, Default: "1000", Min: 1},
+	&Option{Key: "read_cache_max_bytes", Type: Size, Default: "64m", Min: 1},
+
+	&Option{Key: "password", Desc: "AUTH password, auth disabled if empty"},
+	&Option{Key: "acl_audit_log", Desc: "file of ACL denials, main log if empty"},
+
+	&Option{Key: "dashboard_token", Reload: true,
+		Desc: "bearer token of cconfig dashboard requests, no auth if empty"},
+
+	&Option{Key: "products", Type: List, Desc: "products served by one proxy"},
+	&Option{Key: "*.password"},
+	&Option{Key: "*.broker", Values: []string{"ledisdb", "redis"}},
+	&Option{Key: "*.concurrent_limit", Type: Int, Min: 1, Reload: true},
+)
@@ -0,0 +1,73 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+// Package coordinator connects to the service storing the topology, either
+// zookeeper or etcd.
+//
+// Every backend implements the zookeeper style Conn, so models and the lock
+// helpers of zkhelper work on all of them:
+//   - nodes are kv pairs with versions, Set and Delete check the version unless it is -1
+//   - Children lists the direct children of a node
+//   - GetW, ChildrenW and ExistsW fire a single event on the next change
+//   - nodes created with zk.FlagEphemeral are removed when the session is lost
+//   - nodes created with zk.FlagSequence get a 10 digit increasing suffix, which
+//     is what zkhelper.CreateMutex builds distributed locks on
+package coordinator
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/zkhelper"
+)
+
+const (
+	Zookeeper = "zookeeper"
+	Etcd      = "etcd"
+)
+
+// Conn is a session with the coordinator.
+type Conn = zkhelper.Conn
+
+// Factory connects to the coordinator at addr, a comma separated server list.
+type Factory func(addr string) (Conn, error)
+
+// NewFactory returns the factory of coordinator kind, zookeeper if empty.
+// Sessions are authenticated as auth, user:password, if not empty. On
+// zookeeper it is digest auth and nodes created get a digest acl only open
+// to the user, etcd uses its own user and role permissions.
+func NewFactory(kind string, auth string) (Factory, error) {
+	var user, password string
+	if len(auth) > 0 {
+		var err error
+		if user, password, err = parseAuth(auth); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	switch strings.ToLower(kind) {
+	case "", Zookeeper, "zk":
+		if len(user) > 0 {
+			return zkDigestFactory(user, password), nil
+		}
+		return zkhelper.ConnectToZk, nil
+	case Etcd:
+		return etcdFactory(user, password), nil
+	}
+
+	return nil, errors.NotSupportedf("coordinator %s", kind)
+}
+
+func Connect(kind string, auth string, addr string) (Conn, error) {
+	f, err := NewFactory(kind, auth)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return f(addr)
+}
+
+// NewFake returns an in memory coordinator for tests.
+func NewFake() Conn {
+	return zkhelper.NewConn()
+}
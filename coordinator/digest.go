@@ -0,0 +1,100 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package coordinator
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	log "github.com/ngaut/logging"
+)
+
+const zkSessionTimeout = 3 * time.Second
+
+// parseAuth splits auth of form user:password.
+func parseAuth(auth string) (string, string, error) {
+	seps := strings.SplitN(auth, ":", 2)
+	if len(seps) != 2 || len(seps[0]) == 0 {
+		return "", "", errors.NotValidf("auth %q, must be user:password", auth)
+	}
+
+	return seps[0], seps[1], nil
+}
+
+// digestConn is a zookeeper session authenticated by digest, nodes it
+// creates are only accessible to the digest user.
+type digestConn struct {
+	*zk.Conn
+	auth []byte
+	id   string //digest acl id of the user
+	quit chan struct{}
+}
+
+func zkDigestFactory(user string, password string) Factory {
+	return func(addr string) (Conn, error) {
+		conn, events, err := zk.Connect(strings.Split(addr, ","), zkSessionTimeout)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		c := &digestConn{
+			Conn: conn,
+			auth: []byte(user + ":" + password),
+			id:   zk.DigestACL(zk.PermAll, user, password)[0].ID,
+			quit: make(chan struct{}),
+		}
+
+		//queued before any other request
+		if err := conn.AddAuth("digest", c.auth); err != nil {
+			conn.Close()
+			return nil, errors.Trace(err)
+		}
+
+		go c.reauth(events)
+		return c, nil
+	}
+}
+
+//auth belongs to the connection, add it again whenever the session is reestablished
+func (c *digestConn) reauth(events <-chan zk.Event) {
+	for {
+		select {
+		case e := <-events:
+			if e.Type != zk.EventSession || e.State != zk.StateHasSession {
+				continue
+			}
+
+			if err := c.AddAuth("digest", c.auth); err != nil {
+				log.Warning("zk digest auth failed", err)
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+//acl of the digest user with perms of aclv
+func (c *digestConn) acl(aclv []zk.ACL) []zk.ACL {
+	perms := int32(zk.PermAdmin) //to change acl later
+	for _, acl := range aclv {
+		perms |= acl.Perms
+	}
+
+	return []zk.ACL{{Perms: perms, Scheme: "digest", ID: c.id}}
+}
+
+func (c *digestConn) Create(path string, value []byte, flags int32, aclv []zk.ACL) (string, error) {
+	return c.Conn.Create(path, value, flags, c.acl(aclv))
+}
+
+func (c *digestConn) SetACL(path string, aclv []zk.ACL, version int32) (zk.Stat, error) {
+	return c.Conn.SetACL(path, c.acl(aclv), version)
+}
+
+func (c *digestConn) Close() {
+	close(c.quit)
+	c.Conn.Close()
+}
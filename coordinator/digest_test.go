@@ -0,0 +1,43 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/ngaut/go-zookeeper/zk"
+	"github.com/ngaut/zkhelper"
+)
+
+func TestParseAuth(t *testing.T) {
+	if user, password, err := parseAuth("codis:p:w"); err != nil || user != "codis" || password != "p:w" {
+		t.Error(user, password, err)
+	}
+
+	for _, auth := range []string{"codis", ":pw"} {
+		if _, _, err := parseAuth(auth); err == nil {
+			t.Errorf("%s should be invalid", auth)
+		}
+	}
+
+	if _, err := NewFactory(Zookeeper, "codis"); err == nil {
+		t.Error("invalid auth should be rejected")
+	}
+}
+
+func TestDigestACL(t *testing.T) {
+	c := &digestConn{id: zk.DigestACL(zk.PermAll, "codis", "pw")[0].ID}
+
+	acl := c.acl(zkhelper.DefaultFileACLs())
+	if len(acl) != 1 || acl[0].Scheme != "digest" || acl[0].ID != c.id {
+		t.Fatal("invalid acl", acl)
+	}
+	if acl[0].Perms != zkhelper.PERM_FILE {
+		t.Error("perms should be kept", acl[0].Perms)
+	}
+
+	if acl := c.acl(zk.WorldACL(zk.PermRead)); acl[0].Perms != zk.PermRead|zk.PermAdmin {
+		t.Error("owner should be admin", acl[0].Perms)
+	}
+}
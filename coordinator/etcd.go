@@ -0,0 +1,558 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	log "github.com/ngaut/logging"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	etcdDialTimeout    = 3 * time.Second
+	etcdRequestTimeout = 5 * time.Second
+	//ephemeral nodes are removed so long after the session is lost
+	etcdSessionTTL = 10
+
+	//sequence counters of parent nodes, out of the zk tree
+	etcdSequencePrefix = "/_sequence"
+)
+
+// etcdConn stores every zk node as the etcd key of the same path, parents
+// included. Ephemeral nodes are attached to a lease kept alive while the
+// connection is open, which plays the part of the zk session.
+type etcdConn struct {
+	client *clientv3.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	lease   clientv3.LeaseID //0 until the first ephemeral node
+	watches map[*etcdWatch]struct{}
+}
+
+// ConnectToEtcd connects to the etcd v3 servers of addr.
+func ConnectToEtcd(addr string) (Conn, error) {
+	return etcdFactory("", "")(addr)
+}
+
+//user is empty if etcd auth is disabled
+func etcdFactory(user string, password string) Factory {
+	return func(addr string) (Conn, error) {
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints:   strings.Split(addr, ","),
+			DialTimeout: etcdDialTimeout,
+			Username:    user,
+			Password:    password,
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		c := &etcdConn{client: client, watches: make(map[*etcdWatch]struct{})}
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		return c, nil
+	}
+}
+
+func (c *etcdConn) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.ctx, etcdRequestTimeout)
+}
+
+//turn failed requests into zk errors
+func (c *etcdConn) convertError(ctx context.Context, err error) error {
+	if c.ctx.Err() != nil {
+		return zk.ErrClosing
+	}
+
+	if ctx.Err() != nil {
+		return zk.ErrNoServer
+	}
+
+	return errors.Trace(err)
+}
+
+func parentPath(p string) string {
+	return path.Dir(p)
+}
+
+//prefix of the keys of all descendants
+func childPrefix(p string) string {
+	if p == "/" {
+		return p
+	}
+	return p + "/"
+}
+
+//names of the direct children of p in keys
+func childNames(p string, kvs []*mvccpb.KeyValue) []string {
+	prefix := childPrefix(p)
+	var children []string
+	for _, kv := range kvs {
+		name := strings.TrimPrefix(string(kv.Key), prefix)
+		if len(name) > 0 && !strings.Contains(name, "/") {
+			children = append(children, name)
+		}
+	}
+
+	return children
+}
+
+func (c *etcdConn) Get(p string) ([]byte, zk.Stat, error) {
+	data, stat, _, err := c.get(p)
+	return data, stat, err
+}
+
+func (c *etcdConn) get(p string) ([]byte, zk.Stat, int64, error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	resp, err := c.client.Get(ctx, p)
+	if err != nil {
+		return nil, nil, 0, c.convertError(ctx, err)
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil, 0, zk.ErrNoNode
+	}
+
+	kv := resp.Kvs[0]
+	return kv.Value, &etcdStat{kv: kv}, resp.Header.Revision, nil
+}
+
+func (c *etcdConn) GetW(p string) ([]byte, zk.Stat, <-chan zk.Event, error) {
+	data, stat, rev, err := c.get(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	watch := c.watch(p, p, rev, false, func(ev *clientv3.Event) (zk.EventType, bool) {
+		if ev.Type == clientv3.EventTypeDelete {
+			return zk.EventNodeDeleted, true
+		}
+		return zk.EventNodeDataChanged, true
+	})
+
+	return data, stat, watch, nil
+}
+
+func (c *etcdConn) Children(p string) ([]string, zk.Stat, error) {
+	children, stat, _, err := c.children(p)
+	return children, stat, err
+}
+
+func (c *etcdConn) children(p string) ([]string, zk.Stat, int64, error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	//read the node and its children at the same revision
+	resp, err := c.client.Txn(ctx).Then(
+		clientv3.OpGet(p),
+		clientv3.OpGet(childPrefix(p), clientv3.WithPrefix(), clientv3.WithKeysOnly()),
+	).Commit()
+	if err != nil {
+		return nil, nil, 0, c.convertError(ctx, err)
+	}
+
+	node := resp.Responses[0].GetResponseRange().Kvs
+	if len(node) == 0 && p != "/" {
+		return nil, nil, 0, zk.ErrNoNode
+	}
+
+	children := childNames(p, resp.Responses[1].GetResponseRange().Kvs)
+	stat := &etcdStat{kv: &mvccpb.KeyValue{Key: []byte(p)}, children: len(children)}
+	if len(node) > 0 {
+		stat.kv = node[0]
+	}
+
+	return children, stat, resp.Header.Revision, nil
+}
+
+func (c *etcdConn) ChildrenW(p string) ([]string, zk.Stat, <-chan zk.Event, error) {
+	children, stat, rev, err := c.children(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	watch := c.watch(p, childPrefix(p), rev, true, func(ev *clientv3.Event) (zk.EventType, bool) {
+		//only creation and deletion of direct children
+		if len(childNames(p, []*mvccpb.KeyValue{ev.Kv})) == 0 {
+			return 0, false
+		}
+		return zk.EventNodeChildrenChanged, ev.Type == clientv3.EventTypeDelete || ev.IsCreate()
+	})
+
+	return children, stat, watch, nil
+}
+
+func (c *etcdConn) Exists(p string) (bool, zk.Stat, error) {
+	_, stat, err := c.Get(p)
+	if err == zk.ErrNoNode {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, stat, nil
+}
+
+func (c *etcdConn) ExistsW(p string) (bool, zk.Stat, <-chan zk.Event, error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	resp, err := c.client.Get(ctx, p)
+	if err != nil {
+		return false, nil, nil, c.convertError(ctx, err)
+	}
+
+	var stat zk.Stat
+	if len(resp.Kvs) > 0 {
+		stat = &etcdStat{kv: resp.Kvs[0]}
+	}
+
+	watch := c.watch(p, p, resp.Header.Revision, false, func(ev *clientv3.Event) (zk.EventType, bool) {
+		switch {
+		case ev.Type == clientv3.EventTypeDelete:
+			return zk.EventNodeDeleted, true
+		case ev.IsCreate():
+			return zk.EventNodeCreated, true
+		}
+		return zk.EventNodeDataChanged, true
+	})
+
+	return stat != nil, stat, watch, nil
+}
+
+func (c *etcdConn) Create(p string, value []byte, flags int32, aclv []zk.ACL) (string, error) {
+	if flags&zk.FlagSequence != 0 {
+		seq, err := c.nextSequence(parentPath(p))
+		if err != nil {
+			return "", err
+		}
+		p = fmt.Sprintf("%s%010d", p, seq)
+	}
+
+	var opts []clientv3.OpOption
+	if flags&zk.FlagEphemeral != 0 {
+		lease, err := c.sessionLease()
+		if err != nil {
+			return "", err
+		}
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.CreateRevision(p), "=", 0)}
+	if parent := parentPath(p); parent != "/" {
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(parent), ">", 0))
+	}
+
+	resp, err := c.client.Txn(ctx).If(cmps...).
+		Then(clientv3.OpPut(p, string(value), opts...)).
+		Else(clientv3.OpGet(p, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return "", c.convertError(ctx, err)
+	}
+
+	if !resp.Succeeded {
+		if resp.Responses[0].GetResponseRange().Count > 0 {
+			return "", zk.ErrNodeExists
+		}
+		return "", zk.ErrNoNode
+	}
+
+	return p, nil
+}
+
+//next sequence number of children of parent, counted by the version of its counter
+func (c *etcdConn) nextSequence(parent string) (int64, error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	resp, err := c.client.Put(ctx, etcdSequencePrefix+parent, "", clientv3.WithPrevKV())
+	if err != nil {
+		return 0, c.convertError(ctx, err)
+	}
+
+	if resp.PrevKv == nil {
+		return 0, nil
+	}
+	return resp.PrevKv.Version, nil
+}
+
+//cmp of version, zk versions start from 0 and etcd ones from 1
+func versionCmp(p string, version int32) clientv3.Cmp {
+	if version < 0 {
+		return clientv3.Compare(clientv3.CreateRevision(p), ">", 0)
+	}
+	return clientv3.Compare(clientv3.Version(p), "=", int64(version)+1)
+}
+
+func (c *etcdConn) Set(p string, value []byte, version int32) (zk.Stat, error) {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	//keep the lease of ephemeral nodes
+	resp, err := c.client.Txn(ctx).If(versionCmp(p, version)).
+		Then(clientv3.OpPut(p, string(value), clientv3.WithIgnoreLease()), clientv3.OpGet(p)).
+		Else(clientv3.OpGet(p, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return nil, c.convertError(ctx, err)
+	}
+
+	if !resp.Succeeded {
+		if resp.Responses[0].GetResponseRange().Count > 0 {
+			return nil, zk.ErrBadVersion
+		}
+		return nil, zk.ErrNoNode
+	}
+
+	return &etcdStat{kv: resp.Responses[1].GetResponseRange().Kvs[0]}, nil
+}
+
+func (c *etcdConn) Delete(p string, version int32) error {
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	resp, err := c.client.Get(ctx, childPrefix(p), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return c.convertError(ctx, err)
+	}
+	if resp.Count > 0 {
+		return zk.ErrNotEmpty
+	}
+
+	txn, err := c.client.Txn(ctx).If(versionCmp(p, version)).
+		Then(clientv3.OpDelete(p)).
+		Else(clientv3.OpGet(p, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return c.convertError(ctx, err)
+	}
+
+	if !txn.Succeeded {
+		if txn.Responses[0].GetResponseRange().Count > 0 {
+			return zk.ErrBadVersion
+		}
+		return zk.ErrNoNode
+	}
+
+	return nil
+}
+
+// etcd has its own access control, nodes are open to the session
+func (c *etcdConn) GetACL(p string) ([]zk.ACL, zk.Stat, error) {
+	_, stat, err := c.Get(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return zk.WorldACL(zk.PermAll), stat, nil
+}
+
+func (c *etcdConn) SetACL(p string, aclv []zk.ACL, version int32) (zk.Stat, error) {
+	_, stat, err := c.Get(p)
+	return stat, err
+}
+
+// Close revokes the lease of ephemeral nodes and stops all watches.
+func (c *etcdConn) Close() {
+	c.mu.Lock()
+	lease := c.lease
+	c.lease = 0
+	c.mu.Unlock()
+
+	if lease != 0 {
+		ctx, cancel := c.requestContext()
+		if _, err := c.client.Revoke(ctx, lease); err != nil {
+			log.Warning("revoke etcd lease failed", err)
+		}
+		cancel()
+	}
+
+	c.cancel()
+	c.client.Close()
+}
+
+//lease of ephemeral nodes, granted on first use and again after it expired
+func (c *etcdConn) sessionLease() (clientv3.LeaseID, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lease != 0 {
+		return c.lease, nil
+	}
+
+	ctx, cancel := c.requestContext()
+	defer cancel()
+
+	resp, err := c.client.Grant(ctx, etcdSessionTTL)
+	if err != nil {
+		return 0, c.convertError(ctx, err)
+	}
+
+	ka, err := c.client.KeepAlive(c.ctx, resp.ID)
+	if err != nil {
+		return 0, c.convertError(ctx, err)
+	}
+
+	c.lease = resp.ID
+	go c.keepAlive(resp.ID, ka)
+	return resp.ID, nil
+}
+
+func (c *etcdConn) keepAlive(lease clientv3.LeaseID, ka <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range ka {
+	}
+
+	if c.ctx.Err() != nil { //closed
+		return
+	}
+
+	//like an expired zk session, ephemeral nodes are gone and so are the watches
+	log.Warningf("etcd lease %x expired", lease)
+	c.mu.Lock()
+	if c.lease == lease {
+		c.lease = 0
+	}
+	watches := make([]*etcdWatch, 0, len(c.watches))
+	for w := range c.watches {
+		watches = append(watches, w)
+	}
+	c.mu.Unlock()
+
+	for _, w := range watches {
+		w.fire(zk.Event{Type: zk.EventNotWatching, State: zk.StateExpired, Path: w.path, Err: zk.ErrSessionExpired})
+	}
+}
+
+// etcdWatch sends a single zk event, the first change matched or the loss
+// of the watch.
+type etcdWatch struct {
+	path   string
+	ch     chan zk.Event
+	once   sync.Once
+	cancel context.CancelFunc
+}
+
+func (w *etcdWatch) fire(e zk.Event) {
+	w.once.Do(func() {
+		w.ch <- e
+		close(w.ch)
+		w.cancel()
+	})
+}
+
+//watch key or keys with prefix for changes after rev, match returns the event of a change
+func (c *etcdConn) watch(p string, key string, rev int64, prefix bool, match func(ev *clientv3.Event) (zk.EventType, bool)) <-chan zk.Event {
+	w := &etcdWatch{path: p, ch: make(chan zk.Event, 1)}
+
+	var ctx context.Context
+	ctx, w.cancel = context.WithCancel(clientv3.WithRequireLeader(c.ctx))
+
+	opts := []clientv3.OpOption{clientv3.WithRev(rev + 1)}
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	wch := c.client.Watch(ctx, key, opts...)
+
+	c.mu.Lock()
+	c.watches[w] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.watches, w)
+			c.mu.Unlock()
+		}()
+
+		for resp := range wch {
+			if err := resp.Err(); err != nil {
+				w.fire(zk.Event{Type: zk.EventNotWatching, State: zk.StateDisconnected, Path: p, Err: err})
+				return
+			}
+
+			for _, ev := range resp.Events {
+				if typ, ok := match(ev); ok {
+					w.fire(zk.Event{Type: typ, State: zk.StateConnected, Path: p})
+					return
+				}
+			}
+		}
+
+		//canceled
+		err := zk.ErrNoServer
+		if c.ctx.Err() != nil {
+			err = zk.ErrClosing
+		}
+		w.fire(zk.Event{Type: zk.EventNotWatching, State: zk.StateDisconnected, Path: p, Err: err})
+	}()
+
+	return w.ch
+}
+
+// etcdStat is the zk stat of a kv, etcd keeps no time and child versions.
+type etcdStat struct {
+	kv       *mvccpb.KeyValue
+	children int //known for Children only
+}
+
+func (st *etcdStat) Czxid() int64 {
+	return st.kv.CreateRevision
+}
+
+func (st *etcdStat) Mzxid() int64 {
+	return st.kv.ModRevision
+}
+
+func (st *etcdStat) CTime() time.Time {
+	return time.Time{}
+}
+
+func (st *etcdStat) MTime() time.Time {
+	return time.Time{}
+}
+
+func (st *etcdStat) Version() int {
+	return int(st.kv.Version) - 1
+}
+
+func (st *etcdStat) CVersion() int {
+	return 0
+}
+
+func (st *etcdStat) AVersion() int {
+	return 0
+}
+
+func (st *etcdStat) EphemeralOwner() int64 {
+	return st.kv.Lease
+}
+
+func (st *etcdStat) DataLength() int {
+	return len(st.kv.Value)
+}
+
+func (st *etcdStat) NumChildren() int {
+	return st.children
+}
+
+func (st *etcdStat) Pzxid() int64 {
+	return st.kv.ModRevision
+}
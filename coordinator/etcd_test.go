@@ -0,0 +1,188 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package coordinator
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngaut/go-zookeeper/zk"
+	"github.com/ngaut/zkhelper"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestChildNames(t *testing.T) {
+	var kvs []*mvccpb.KeyValue
+	for _, key := range []string{"/zk/a/b", "/zk/a/b/c", "/zk/a/d", "/zk/ab"} {
+		kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(key)})
+	}
+
+	if names := childNames("/zk/a", kvs); strings.Join(names, ",") != "b,d" {
+		t.Error("invalid children", names)
+	}
+	if names := childNames("/", kvs); len(names) != 0 {
+		t.Error("invalid children of root", names)
+	}
+}
+
+//run against a test etcd server, e.g. ETCD_ADDR=127.0.0.1:2379
+func testEtcdConn(t *testing.T) (Conn, string) {
+	addr := os.Getenv("ETCD_ADDR")
+	if len(addr) == 0 {
+		t.Skip("ETCD_ADDR not set")
+	}
+
+	conn, err := Connect(Etcd, "", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := fmt.Sprintf("/zk/test_%d", time.Now().UnixNano())
+	if _, err := zkhelper.CreateRecursive(conn, root, "", 0, zkhelper.DefaultDirACLs()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn, err := Connect(Etcd, "", addr)
+		if err == nil {
+			zkhelper.DeleteRecursive(conn, root, -1)
+			conn.Close()
+		}
+	})
+
+	return conn, root
+}
+
+func TestEtcdNodes(t *testing.T) {
+	conn, root := testEtcdConn(t)
+	defer conn.Close()
+
+	if _, err := conn.Create(root+"/a/b", nil, 0, zkhelper.DefaultFileACLs()); err != zk.ErrNoNode {
+		t.Fatal("parent should be required", err)
+	}
+	if _, err := zkhelper.CreateRecursive(conn, root+"/a/b", "b", 0, zkhelper.DefaultFileACLs()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Create(root+"/a", nil, 0, zkhelper.DefaultFileACLs()); err != zk.ErrNodeExists {
+		t.Fatal("should exist", err)
+	}
+
+	data, stat, err := conn.Get(root + "/a/b")
+	if err != nil || string(data) != "b" || stat.Version() != 0 {
+		t.Fatal(string(data), err)
+	}
+
+	if _, err := conn.Set(root+"/a/b", []byte("c"), 1); err != zk.ErrBadVersion {
+		t.Fatal("version should be checked", err)
+	}
+	if stat, err = conn.Set(root+"/a/b", []byte("c"), 0); err != nil || stat.Version() != 1 {
+		t.Fatal(err)
+	}
+
+	if err := conn.Delete(root+"/a", -1); err != zk.ErrNotEmpty {
+		t.Fatal("should have children", err)
+	}
+
+	children, _, err := conn.Children(root)
+	if err != nil || len(children) != 1 || children[0] != "a" {
+		t.Fatal(children, err)
+	}
+
+	if err := zkhelper.DeleteRecursive(conn, root+"/a", -1); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _, err := conn.Exists(root + "/a/b"); err != nil || exist {
+		t.Fatal("should be deleted", err)
+	}
+}
+
+func TestEtcdSequenceAndEphemeral(t *testing.T) {
+	conn, root := testEtcdConn(t)
+	defer conn.Close()
+
+	var created []string
+	for i := 0; i < 3; i++ {
+		p, err := conn.Create(root+"/action_", nil, zk.FlagSequence, zkhelper.DefaultFileACLs())
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, p)
+	}
+	if !sort.StringsAreSorted(created) || created[0] != root+"/action_0000000000" {
+		t.Fatal("invalid sequence", created)
+	}
+
+	other, err := Connect(Etcd, "", os.Getenv("ETCD_ADDR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Create(root+"/proxy", nil, zk.FlagEphemeral, zkhelper.DefaultFileACLs()); err != nil {
+		t.Fatal(err)
+	}
+
+	exist, _, watch, err := conn.ExistsW(root + "/proxy")
+	if err != nil || !exist {
+		t.Fatal("ephemeral node not created", err)
+	}
+
+	//the session is closed
+	other.Close()
+	select {
+	case e := <-watch:
+		if e.Type != zk.EventNodeDeleted {
+			t.Fatal("unexpected event", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ephemeral node not deleted")
+	}
+}
+
+func TestEtcdWatch(t *testing.T) {
+	conn, root := testEtcdConn(t)
+
+	_, _, watch, err := conn.ChildrenW(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Create(root+"/a", nil, 0, zkhelper.DefaultFileACLs()); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-watch; e.Type != zk.EventNodeChildrenChanged || e.Path != root {
+		t.Fatal("unexpected event", e)
+	}
+
+	_, _, watch, err = conn.GetW(root + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Set(root+"/a", []byte("x"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-watch; e.Type != zk.EventNodeDataChanged {
+		t.Fatal("unexpected event", e)
+	}
+
+	//lock built on sequence nodes
+	lock := zkhelper.CreateMutex(conn, root+"/LOCK")
+	if err := lock.Lock("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	//watches are lost when closed
+	_, _, watch, err = conn.GetW(root + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if e := <-watch; e.Type != zk.EventNotWatching || e.Err != zk.ErrClosing {
+		t.Fatal("unexpected event", e)
+	}
+}
@@ -3,7 +3,7 @@ module github.com/ledisdb/xcodis
 go 1.14
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/BurntSushi/toml v0.3.1
 	github.com/alicebob/gopher-json v0.0.0-20180125190556-5a6b3ba71ee6 // indirect
 	github.com/alicebob/miniredis v2.5.0+incompatible
 	github.com/armon/go-metrics v0.3.3 // indirect
@@ -11,6 +11,7 @@ require (
 	github.com/docopt/docopt-go v0.0.0-20141128170934-854c423c8108
 	github.com/garyburd/redigo v1.0.0
 	github.com/gomodule/redigo v2.0.0+incompatible // indirect
+	github.com/gorilla/mux v0.0.0-20160317213430-0eeaf8392f5b
 	github.com/juju/errors v0.0.0-20150108020425-c3aaee403f14
 	github.com/juju/loggo v0.0.0-20190526231331-6e530bcce5d8 // indirect
 	github.com/juju/testing v0.0.0-20191001232224-ce9dec17d28b // indirect
@@ -25,5 +26,7 @@ require (
 	github.com/ngaut/zkhelper v0.0.0-20141111053527-50ed4f0e6258
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
 	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb // indirect
+	go.etcd.io/etcd/api/v3 v3.5.1
+	go.etcd.io/etcd/client/v3 v3.5.1
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
 )
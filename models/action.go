@@ -12,7 +12,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/ledisdb/xcodis/utils"
 	"github.com/ngaut/zkhelper"
 
 	"github.com/juju/errors"
@@ -29,6 +28,17 @@ const (
 	ACTION_TYPE_MULTI_SLOT_CHANGED   ActionType = "multi_slot_changed"
 	ACTION_TYPE_SLOT_MIGRATE         ActionType = "slot_migrate"
 	ACTION_TYPE_SLOT_PREMIGRATE      ActionType = "slot_premigrate"
+	ACTION_TYPE_SLOT_EXPAND          ActionType = "slot_expand"
+	ACTION_TYPE_USER_CHANGED         ActionType = "user_changed"
+	ACTION_TYPE_ROLLBACK             ActionType = "rollback"
+)
+
+// outcome of an action waiting for confirmation
+const (
+	ACTION_STATUS_SUCCEEDED   = "succeeded"
+	ACTION_STATUS_FAILED      = "failed"
+	ACTION_STATUS_TIMEOUT     = "timeout"
+	ACTION_STATUS_ROLLED_BACK = "rolled_back"
 )
 
 const (
@@ -42,10 +52,35 @@ type Action struct {
 	Target    interface{} `json:"target"`
 	Ts        string      `json:"ts"` // timestamp
 	Receivers []string    `json:"receivers"`
+	// set when all receivers responded or timed out
+	Status string            `json:"status,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"` // proxy id -> error
+}
+
+// ActionResponse is created by a receiver under the action node when it has
+// applied the action, Error is set if it failed to.
+type ActionResponse struct {
+	ProxyInfo
+	Error string `json:"error,omitempty"`
+}
+
+// ActionFailedError is returned if some receivers failed to apply an action.
+type ActionFailedError struct {
+	Action string            // zk path of the action
+	Errors map[string]string // proxy id -> error
+}
+
+func (e *ActionFailedError) Error() string {
+	var msgs []string
+	for id, msg := range e.Errors {
+		msgs = append(msgs, id+": "+msg)
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("action %s failed, %s", path.Base(e.Action), strings.Join(msgs, "; "))
 }
 
 func GetWatchActionPath(productName string) string {
-	return fmt.Sprintf("/zk/codis/db_%s/actions", productName)
+	return GetProductPath(productName) + "/actions"
 }
 
 func GetActionWithSeq(zkConn zkhelper.Conn, productName string, seq int64) (*Action, error) {
@@ -77,6 +112,8 @@ func GetActionObject(zkConn zkhelper.Conn, productName string, seq int64, act in
 
 var ErrReceiverTimeout = errors.New("receiver timeout")
 
+// WaitForReceiver waits until all proxies responded to the action, it returns
+// an ActionFailedError if any of them failed to apply it.
 func WaitForReceiver(zkConn zkhelper.Conn, productName string, actionZkPath string, proxies []ProxyInfo) error {
 	if len(proxies) == 0 {
 		return nil
@@ -98,24 +135,23 @@ func WaitForReceiver(zkConn zkhelper.Conn, productName string, actionZkPath stri
 		if err != nil {
 			return errors.Trace(err)
 		}
-		var confirmIds []string
+		confirmed := make(map[string]bool)
 		for _, node := range nodes {
-			id := path.Base(node)
-			confirmIds = append(confirmIds, id)
+			confirmed[path.Base(node)] = true
 		}
-		if len(confirmIds) != 0 {
-			sort.Strings(confirmIds)
-			if utils.Strings(proxyIds).Eq(confirmIds) {
-				return nil
+		offlineProxyIds = offlineProxyIds[:0]
+		for _, id := range proxyIds {
+			if !confirmed[id] {
+				offlineProxyIds = append(offlineProxyIds, id)
 			}
-			offlineProxyIds = proxyIds[len(confirmIds)-1:]
+		}
+		if len(offlineProxyIds) == 0 {
+			return checkResponses(zkConn, actionZkPath, proxyIds)
 		}
 		times += 1
 		time.Sleep(500 * time.Millisecond)
 	}
-	if len(offlineProxyIds) > 0 {
-		log.Error("proxies didn't responed: ", offlineProxyIds)
-	}
+	log.Error("proxies didn't responed: ", offlineProxyIds)
 	// set offline proxies
 	for _, id := range offlineProxyIds {
 		log.Errorf("mark proxy %s to PROXY_STATE_MARK_OFFLINE", id)
@@ -127,6 +163,53 @@ func WaitForReceiver(zkConn zkhelper.Conn, productName string, actionZkPath stri
 	return ErrReceiverTimeout
 }
 
+func checkResponses(zkConn zkhelper.Conn, actionZkPath string, proxyIds []string) error {
+	failed := make(map[string]string)
+	for _, id := range proxyIds {
+		data, _, err := zkConn.Get(path.Join(actionZkPath, id))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		var resp ActionResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return errors.Trace(err)
+		}
+		if len(resp.Error) > 0 {
+			failed[id] = resp.Error
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ActionFailedError{Action: actionZkPath, Errors: failed}
+	}
+	return nil
+}
+
+// SetActionStatus records the outcome of the action on its node.
+func SetActionStatus(zkConn zkhelper.Conn, actionZkPath string, status string, failed map[string]string) error {
+	data, _, err := zkConn.Get(actionZkPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var act Action
+	if err := json.Unmarshal(data, &act); err != nil {
+		return errors.Trace(err)
+	}
+
+	act.Status = status
+	if failed != nil {
+		act.Errors = failed
+	}
+	if data, err = json.Marshal(act); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = zkConn.Set(actionZkPath, data, -1)
+	return errors.Trace(err)
+}
+
 func GetActionSeqList(zkConn zkhelper.Conn, productName string) ([]int, error) {
 	nodes, _, err := zkConn.Children(GetWatchActionPath(productName))
 	if err != nil {
@@ -261,17 +344,29 @@ func NewAction(zkConn zkhelper.Conn, productName string, actionType ActionType,
 		return errors.Trace(err)
 	}
 
-	if needConfirm {
-		if err := WaitForReceiver(zkConn, productName, actionCreated, proxies); err != nil {
-			return errors.Trace(err)
-		}
+	if !needConfirm {
+		return nil
 	}
 
-	return nil
+	err = WaitForReceiver(zkConn, productName, actionCreated, proxies)
+	status, failed := ACTION_STATUS_SUCCEEDED, map[string]string(nil)
+	if e, ok := err.(*ActionFailedError); ok {
+		status, failed = ACTION_STATUS_FAILED, e.Errors
+	} else if err == ErrReceiverTimeout {
+		status = ACTION_STATUS_TIMEOUT
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := SetActionStatus(zkConn, actionCreated, status, failed); err != nil {
+		log.Warning("set action status failed", actionCreated, err)
+	}
+
+	return errors.Trace(err)
 }
 
 func ForceRemoveLock(zkConn zkhelper.Conn, productName string) error {
-	lockPath := fmt.Sprintf("/zk/codis/db_%s/LOCK", productName)
+	lockPath := GetLockPath(productName)
 	children, _, err := zkConn.Children(lockPath)
 	if err != nil {
 		return errors.Trace(err)
@@ -6,12 +6,12 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/ngaut/zkhelper"
-
-	"github.com/ledisdb/xcodis/utils"
 )
 
 var (
@@ -43,13 +43,13 @@ func TestNewAction(t *testing.T) {
 
 func TestForceRemoveLock(t *testing.T) {
 	fakeZkConn := zkhelper.NewConn()
-	zkLock := utils.GetZkLock(fakeZkConn, productName)
+	zkLock := GetZkLock(fakeZkConn, productName)
 	if zkLock == nil {
 		t.Error("create lock error")
 	}
 
 	zkLock.Lock("force remove lock")
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/LOCK", productName)
+	zkPath := GetLockPath(productName)
 	children, _, err := fakeZkConn.Children(zkPath)
 	if err != nil {
 		t.Error(err)
@@ -66,3 +66,97 @@ func TestForceRemoveLock(t *testing.T) {
 		t.Error("remove lock error")
 	}
 }
+
+//respond to actions as proxy id, actions of type fail are not applied
+func fakeReceiver(conn zkhelper.Conn, id string, fail ActionType, stop chan struct{}) {
+	prefix := GetWatchActionPath(productName)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		seqs, _ := GetActionSeqList(conn, productName)
+		for _, seq := range seqs {
+			actionPath := path.Join(prefix, fmt.Sprintf("action_%0.10d", seq))
+			act, err := GetActionWithSeq(conn, productName, int64(seq))
+			if err != nil || len(act.Receivers) != 1 || act.Receivers[0] != id {
+				continue
+			}
+			if exist, _, _ := conn.Exists(path.Join(actionPath, id)); exist {
+				continue
+			}
+
+			resp := ActionResponse{ProxyInfo: ProxyInfo{Id: id}}
+			if act.Type == fail {
+				resp.Error = "apply failed"
+			}
+			data, _ := json.Marshal(resp)
+			conn.Create(path.Join(actionPath, id), data, 0, zkhelper.DefaultFileACLs())
+		}
+	}
+}
+
+func TestActionRollback(t *testing.T) {
+	conn := zkhelper.NewConn()
+	if err := InitSlotSet(conn, productName, 4); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1, 2} {
+		if err := NewServerGroup(productName, id).Create(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetSlotRange(conn, productName, 0, 3, 1, SLOT_STATUS_ONLINE); err != nil {
+		t.Fatal(err)
+	}
+
+	pi := &ProxyInfo{Id: "proxy_1", State: PROXY_STATE_ONLINE}
+	if _, err := CreateProxyInfo(conn, productName, pi); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go fakeReceiver(conn, pi.Id, ACTION_TYPE_MULTI_SLOT_CHANGED, stop)
+
+	err := SetSlotRange(conn, productName, 2, 3, 2, SLOT_STATUS_ONLINE)
+	close(stop)
+	failed, ok := errors.Cause(err).(*ActionFailedError)
+	if !ok || failed.Errors[pi.Id] != "apply failed" {
+		t.Fatal("action should fail", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if s, err := GetSlot(conn, productName, i); err != nil || s.GroupId != 1 {
+			t.Error("slot not rolled back", i, err)
+		}
+	}
+
+	data, _, err := conn.Get(failed.Action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var act Action
+	json.Unmarshal(data, &act)
+	if act.Status != ACTION_STATUS_ROLLED_BACK || act.Errors[pi.Id] != "apply failed" {
+		t.Errorf("invalid outcome %+v", act)
+	}
+
+	seqs, _ := GetActionSeqList(conn, productName)
+	last, err := GetActionWithSeq(conn, productName, int64(seqs[len(seqs)-1]))
+	if err != nil || last.Type != ACTION_TYPE_ROLLBACK || last.Status != ACTION_STATUS_SUCCEEDED {
+		t.Errorf("rollback action not confirmed %+v", last)
+	}
+
+	//a failed group change restores the servers
+	g := NewServerGroup(productName, 2)
+	stop = make(chan struct{})
+	defer close(stop)
+	go fakeReceiver(conn, pi.Id, ACTION_TYPE_SERVER_GROUP_CHANGED, stop)
+	if err := g.AddServer(conn, NewServer(SERVER_TYPE_MASTER, "localhost:1111")); err == nil {
+		t.Fatal("action should fail")
+	}
+	if servers, err := g.GetServers(conn); err != nil || len(servers) != 0 {
+		t.Error("server not removed", servers, err)
+	}
+}
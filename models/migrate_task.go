@@ -0,0 +1,462 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	"github.com/ngaut/zkhelper"
+)
+
+const (
+	MIGRATE_TASK_PENDING   = "pending"
+	MIGRATE_TASK_MIGRATING = "migrating"
+	MIGRATE_TASK_PAUSED    = "paused" // the migrating slot stays in migrate status
+	MIGRATE_TASK_FINISHED  = "finished"
+	MIGRATE_TASK_CANCELLED = "cancelled"
+	MIGRATE_TASK_ERR       = "error"
+)
+
+// requests of operators to the cconfig running a task
+const (
+	MIGRATE_REQUEST_PAUSE    = "pause"
+	MIGRATE_REQUEST_CANCEL   = "cancel"   // finish the migrating slot and stop
+	MIGRATE_REQUEST_ROLLBACK = "rollback" // move the migrating slot back and stop
+)
+
+// status of a slot in a migrate task
+const (
+	MIGRATE_SLOT_PENDING   = "pending"
+	MIGRATE_SLOT_MIGRATING = "migrating"
+	MIGRATE_SLOT_FINISHED  = "finished"
+	MIGRATE_SLOT_SKIPPED   = "skipped" // not online or already in the target group
+)
+
+// verification of migrated slots
+const (
+	MIGRATE_VERIFY_COUNT  = "count"  // compare key counts
+	MIGRATE_VERIFY_DIGEST = "digest" // compare key counts and dumps of sampled keys
+)
+
+// SlotSnapshot is taken before a slot is migrated to verify it after. Keys
+// moving between the groups keep the sum of the counts.
+type SlotSnapshot struct {
+	From     int   `json:"from"`
+	To       int   `json:"to"`
+	FromKeys int64 `json:"from_keys"`
+	ToKeys   int64 `json:"to_keys"`
+	//sampled key of the source, "type key" on ledisdb, to sha1 of its dump
+	Digests map[string]string `json:"digests,omitempty"`
+}
+
+// MigrateLimit throttles a migrate task, zero is unlimited.
+type MigrateLimit struct {
+	KeysPerSec  int   `json:"keys_per_sec,omitempty"`
+	BytesPerSec int64 `json:"bytes_per_sec,omitempty"`
+}
+
+func (l MigrateLimit) Validate() error {
+	if l.KeysPerSec < 0 || l.BytesPerSec < 0 {
+		return errors.NotValidf("migrate limit %+v", l)
+	}
+	return nil
+}
+
+type MigrateSlotProgress struct {
+	Id       int           `json:"id"`
+	Status   string        `json:"status"`
+	Snapshot *SlotSnapshot `json:"snapshot,omitempty"`
+}
+
+// MigrateTask is a slot range migration queued in zk, tasks run one by one
+// in creation order. A task whose owner is gone is resumed by the next
+// cconfig daemon, finished slots are not migrated again. Operators pause or
+// cancel a task with a request node and change its limit with a limit node,
+// both read by its owner, the owner is the only writer of the task.
+type MigrateTask struct {
+	Id          string                `json:"id"` // node name, in creation order
+	FromSlot    int                   `json:"from"`
+	ToSlot      int                   `json:"to"`
+	NewGroupId  int                   `json:"new_group"`
+	Delay       int                   `json:"delay"`             // milliseconds between keys
+	Replace     bool                  `json:"replace,omitempty"` // overwrite keys existing in the target group
+	Verify      string                `json:"verify,omitempty"`
+	VerifyAlert bool                  `json:"verify_alert,omitempty"` // slots failing verification still go online
+	CreateAt    string                `json:"create_at"`
+	Percent     int                   `json:"percent"`
+	Status      string                `json:"status"`
+	Error       string                `json:"error,omitempty"`
+	Alerts      []string              `json:"alerts,omitempty"` // failed verifications of slots set online
+	Owner       string                `json:"owner,omitempty"`  // cconfig running it, hostname-pid
+	Request     string                `json:"request,omitempty"`
+	Slots       []MigrateSlotProgress `json:"slots"`
+	MigrateLimit
+
+	ProductName string `json:"-"`
+}
+
+func GetMigrateTaskBasePath(productName string) string {
+	return GetProductPath(productName) + "/migrate_tasks"
+}
+
+func GetMigrateTaskPath(productName string, id string) string {
+	return path.Join(GetMigrateTaskBasePath(productName), id)
+}
+
+func NewMigrateTask(productName string, fromSlot, toSlot, newGroupId, delay int) *MigrateTask {
+	t := &MigrateTask{
+		ProductName: productName,
+		FromSlot:    fromSlot,
+		ToSlot:      toSlot,
+		NewGroupId:  newGroupId,
+		Delay:       delay,
+		CreateAt:    time.Now().Format(time.RFC3339),
+		Status:      MIGRATE_TASK_PENDING,
+	}
+	for i := fromSlot; i <= toSlot; i++ {
+		t.Slots = append(t.Slots, MigrateSlotProgress{Id: i, Status: MIGRATE_SLOT_PENDING})
+	}
+	return t
+}
+
+// Done reports if the task will not run any more.
+func (t *MigrateTask) Done() bool {
+	switch t.Status {
+	case MIGRATE_TASK_FINISHED, MIGRATE_TASK_CANCELLED:
+		return true
+	}
+	return false
+}
+
+// Failed reports if the task stopped on an error, its slot may stay in
+// migrate status so it blocks the tasks after it until it is resumed or
+// cancelled.
+func (t *MigrateTask) Failed() bool {
+	return t.Status == MIGRATE_TASK_ERR
+}
+
+// SetSlotStatus updates the progress of slot and the percent of the task.
+func (t *MigrateTask) SetSlotStatus(slotId int, status string) {
+	done := 0
+	for i := range t.Slots {
+		if t.Slots[i].Id == slotId {
+			t.Slots[i].Status = status
+		}
+		if s := t.Slots[i].Status; s == MIGRATE_SLOT_FINISHED || s == MIGRATE_SLOT_SKIPPED {
+			done++
+		}
+	}
+	if len(t.Slots) > 0 {
+		t.Percent = done * 100 / len(t.Slots)
+	}
+}
+
+// Paused reports if the task is paused and not resumed yet, it blocks the
+// tasks after it.
+func (t *MigrateTask) Paused() bool {
+	return t.Status == MIGRATE_TASK_PAUSED && t.Request == MIGRATE_REQUEST_PAUSE
+}
+
+// MigratingSlot returns the slot being migrated, -1 if none.
+func (t *MigrateTask) MigratingSlot() int {
+	for _, s := range t.Slots {
+		if s.Status == MIGRATE_SLOT_MIGRATING {
+			return s.Id
+		}
+	}
+	return -1
+}
+
+// SetSlotSnapshot records the snapshot of slot taken before migrating it.
+func (t *MigrateTask) SetSlotSnapshot(slotId int, s *SlotSnapshot) {
+	for i := range t.Slots {
+		if t.Slots[i].Id == slotId {
+			t.Slots[i].Snapshot = s
+		}
+	}
+}
+
+// SlotSnapshot returns the snapshot of slot, nil if not taken.
+func (t *MigrateTask) SlotSnapshot(slotId int) *SlotSnapshot {
+	for _, s := range t.Slots {
+		if s.Id == slotId {
+			return s.Snapshot
+		}
+	}
+	return nil
+}
+
+// SlotStatus returns the progress of slot, empty if not in the task.
+func (t *MigrateTask) SlotStatus(slotId int) string {
+	for _, s := range t.Slots {
+		if s.Id == slotId {
+			return s.Status
+		}
+	}
+	return ""
+}
+
+// Create queues the task and sets its id.
+func (t *MigrateTask) Create(zkConn zkhelper.Conn) error {
+	if t.FromSlot < 0 || t.FromSlot > t.ToSlot {
+		return errors.NotValidf("slot range [%d, %d]", t.FromSlot, t.ToSlot)
+	}
+	if err := t.MigrateLimit.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+	switch t.Verify {
+	case "", MIGRATE_VERIFY_COUNT, MIGRATE_VERIFY_DIGEST:
+	default:
+		return errors.NotValidf("verify mode %s", t.Verify)
+	}
+
+	basePath := GetMigrateTaskBasePath(t.ProductName)
+	if _, err := zkhelper.CreateRecursive(zkConn, basePath, "", 0, zkhelper.DefaultDirACLs()); err != nil &&
+		!zkhelper.ZkErrorEqual(err, zk.ErrNodeExists) {
+		return errors.Trace(err)
+	}
+
+	b, _ := json.Marshal(t)
+	created, err := zkConn.Create(basePath+"/task_", b, int32(zk.FlagSequence), zkhelper.DefaultDirACLs())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	t.Id = path.Base(created)
+	return errors.Trace(t.Update(zkConn))
+}
+
+// Update saves the task.
+func (t *MigrateTask) Update(zkConn zkhelper.Conn) error {
+	b, _ := json.Marshal(t)
+	_, err := zkConn.Set(GetMigrateTaskPath(t.ProductName, t.Id), b, -1)
+	return errors.Trace(err)
+}
+
+func (t *MigrateTask) Remove(zkConn zkhelper.Conn) error {
+	err := zkhelper.DeleteRecursive(zkConn, GetMigrateTaskPath(t.ProductName, t.Id), -1)
+	return errors.Trace(err)
+}
+
+// Claim makes owner the runner of the task with an ephemeral node and reloads
+// the task, it fails with ErrNodeExists if another cconfig runs the task.
+func (t *MigrateTask) Claim(zkConn zkhelper.Conn, owner string) error {
+	_, err := zkConn.Create(path.Join(GetMigrateTaskPath(t.ProductName, t.Id), "owner"), []byte(owner),
+		zk.FlagEphemeral, zkhelper.DefaultFileACLs())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	//the previous owner may have changed it since it was read
+	fresh, err := GetMigrateTask(zkConn, t.ProductName, t.Id)
+	if err == nil {
+		*t = *fresh
+		t.Owner = owner
+		err = t.Update(zkConn)
+	}
+	if err != nil {
+		t.Release(zkConn)
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (t *MigrateTask) Release(zkConn zkhelper.Conn) error {
+	err := zkConn.Delete(path.Join(GetMigrateTaskPath(t.ProductName, t.Id), "owner"), -1)
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// Claimed reports if a living cconfig runs the task.
+func (t *MigrateTask) Claimed(zkConn zkhelper.Conn) (bool, error) {
+	exists, _, err := zkConn.Exists(path.Join(GetMigrateTaskPath(t.ProductName, t.Id), "owner"))
+	return exists, errors.Trace(err)
+}
+
+// SetRequest asks the owner to pause or cancel the task, an empty request
+// resumes a paused task.
+func (t *MigrateTask) SetRequest(zkConn zkhelper.Conn, request string) error {
+	switch request {
+	case "", MIGRATE_REQUEST_PAUSE, MIGRATE_REQUEST_CANCEL, MIGRATE_REQUEST_ROLLBACK:
+	default:
+		return errors.NotValidf("migrate request %s", request)
+	}
+
+	p := path.Join(GetMigrateTaskPath(t.ProductName, t.Id), "request")
+	var err error
+	if len(request) == 0 {
+		err = zkConn.Delete(p, -1)
+		if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			err = nil
+		}
+	} else {
+		_, err = zkhelper.CreateOrUpdate(zkConn, p, request, 0, zkhelper.DefaultFileACLs(), false)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	t.Request = request
+	return nil
+}
+
+// GetRequest reloads the request of operators, empty if none.
+func (t *MigrateTask) GetRequest(zkConn zkhelper.Conn) (string, error) {
+	data, _, err := zkConn.Get(path.Join(GetMigrateTaskPath(t.ProductName, t.Id), "request"))
+	if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	t.Request = string(data)
+	return t.Request, nil
+}
+
+// SetLimit changes the limit of the task while it runs.
+func (t *MigrateTask) SetLimit(zkConn zkhelper.Conn, l MigrateLimit) error {
+	if err := l.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+
+	b, _ := json.Marshal(l)
+	p := path.Join(GetMigrateTaskPath(t.ProductName, t.Id), "limit")
+	if _, err := zkhelper.CreateOrUpdate(zkConn, p, string(b), 0, zkhelper.DefaultFileACLs(), false); err != nil {
+		return errors.Trace(err)
+	}
+	t.MigrateLimit = l
+	return nil
+}
+
+// GetLimit reloads the limit, the one the task was created with if not
+// changed.
+func (t *MigrateTask) GetLimit(zkConn zkhelper.Conn) (MigrateLimit, error) {
+	data, _, err := zkConn.Get(path.Join(GetMigrateTaskPath(t.ProductName, t.Id), "limit"))
+	if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return t.MigrateLimit, nil
+	}
+	if err != nil {
+		return t.MigrateLimit, errors.Trace(err)
+	}
+
+	var l MigrateLimit
+	if err := json.Unmarshal(data, &l); err != nil {
+		return t.MigrateLimit, errors.Trace(err)
+	}
+	t.MigrateLimit = l
+	return l, nil
+}
+
+func GetMigrateTask(zkConn zkhelper.Conn, productName string, id string) (*MigrateTask, error) {
+	data, _, err := zkConn.Get(GetMigrateTaskPath(productName, id))
+	if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, errors.NotFoundf("migrate task %s", id)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var t MigrateTask
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, errors.Trace(err)
+	}
+	t.Id, t.ProductName = id, productName
+	if t.Done() { //requests and limits are not read any more
+		return &t, nil
+	}
+	if _, err := t.GetRequest(zkConn); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := t.GetLimit(zkConn); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &t, nil
+}
+
+// MigrateTasks returns all tasks in creation order.
+func MigrateTasks(zkConn zkhelper.Conn, productName string) ([]*MigrateTask, error) {
+	children, _, err := zkConn.Children(GetMigrateTaskBasePath(productName))
+	if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(children)
+
+	var tasks []*MigrateTask
+	for _, id := range children {
+		t, err := GetMigrateTask(zkConn, productName, id)
+		if errors.IsNotFound(err) { //removed meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
+
+// NextMigrateTask returns the first task not done, nil if none. Tasks run
+// one by one so a later task waits for it even if it is claimed by others or
+// paused.
+func NextMigrateTask(zkConn zkhelper.Conn, productName string) (*MigrateTask, error) {
+	children, _, err := zkConn.Children(GetMigrateTaskBasePath(productName))
+	if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(children)
+
+	//the tasks after it are not read
+	for _, id := range children {
+		t, err := GetMigrateTask(zkConn, productName, id)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !t.Done() {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// PruneMigrateTasks removes the oldest done tasks but the last keep ones,
+// returns the number removed.
+func PruneMigrateTasks(zkConn zkhelper.Conn, productName string, keep int) (int, error) {
+	tasks, err := MigrateTasks(zkConn, productName)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var done []*MigrateTask
+	for _, t := range tasks {
+		if t.Done() {
+			done = append(done, t)
+		}
+	}
+	if len(done) <= keep {
+		return 0, nil
+	}
+	n := 0
+	for _, t := range done[:len(done)-keep] {
+		if err := t.Remove(zkConn); err != nil {
+			return n, errors.Trace(err)
+		}
+		n++
+	}
+	return n, nil
+}
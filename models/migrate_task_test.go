@@ -0,0 +1,177 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	"github.com/ngaut/zkhelper"
+)
+
+func TestMigrateTask(t *testing.T) {
+	conn := zkhelper.NewConn()
+
+	if next, err := NextMigrateTask(conn, productName); err != nil || next != nil {
+		t.Fatal(next, err)
+	}
+
+	t1 := NewMigrateTask(productName, 0, 3, 2, 0)
+	t2 := NewMigrateTask(productName, 4, 4, 1, 0)
+	for _, task := range []*MigrateTask{t1, t2} {
+		if err := task.Create(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewMigrateTask(productName, 3, 2, 1, 0).Create(conn); !errors.IsNotValid(errors.Cause(err)) {
+		t.Fatal("invalid range should fail", err)
+	}
+	bad := NewMigrateTask(productName, 0, 1, 1, 0)
+	bad.Verify = "all"
+	if err := bad.Create(conn); !errors.IsNotValid(errors.Cause(err)) {
+		t.Fatal("invalid verify mode should fail", err)
+	}
+
+	tasks, err := MigrateTasks(conn, productName)
+	if err != nil || len(tasks) != 2 || tasks[0].Id != t1.Id || tasks[1].Id != t2.Id {
+		t.Fatal(tasks, err)
+	}
+
+	//a task is run by one owner only
+	next, err := NextMigrateTask(conn, productName)
+	if err != nil || next.Id != t1.Id {
+		t.Fatal(next, err)
+	}
+	if err := next.Claim(conn, "a"); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := GetMigrateTask(conn, productName, t1.Id)
+	if err := other.Claim(conn, "b"); !zkhelper.ZkErrorEqual(errors.Cause(err), zk.ErrNodeExists) {
+		t.Fatal("claimed twice", err)
+	}
+
+	next.Status = MIGRATE_TASK_MIGRATING
+	next.SetSlotStatus(0, MIGRATE_SLOT_FINISHED)
+	next.SetSlotStatus(1, MIGRATE_SLOT_SKIPPED)
+	next.SetSlotStatus(2, MIGRATE_SLOT_MIGRATING)
+	next.SetSlotSnapshot(2, &SlotSnapshot{From: 1, To: 2, FromKeys: 10, Digests: map[string]string{"a": "x"}})
+	if err := next.Update(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := next.Release(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	//resumed by another owner with the saved progress
+	resumed, err := NextMigrateTask(conn, productName)
+	if err != nil || resumed.Id != t1.Id {
+		t.Fatal(resumed, err)
+	}
+	if err := resumed.Claim(conn, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Owner != "b" || resumed.Percent != 50 || resumed.SlotStatus(2) != MIGRATE_SLOT_MIGRATING ||
+		resumed.SlotStatus(3) != MIGRATE_SLOT_PENDING || resumed.SlotSnapshot(2).Digests["a"] != "x" ||
+		resumed.SlotSnapshot(3) != nil {
+		t.Fatalf("%+v", resumed)
+	}
+
+	//requests are kept apart from the task written by its owner
+	if err := resumed.SetRequest(conn, "stop"); !errors.IsNotValid(errors.Cause(err)) {
+		t.Fatal("unknown request should fail", err)
+	}
+	other, _ = GetMigrateTask(conn, productName, t1.Id)
+	if err := other.SetRequest(conn, MIGRATE_REQUEST_PAUSE); err != nil {
+		t.Fatal(err)
+	}
+	resumed.Status = MIGRATE_TASK_PAUSED
+	if err := resumed.Update(conn); err != nil {
+		t.Fatal(err)
+	}
+	paused, _ := GetMigrateTask(conn, productName, t1.Id)
+	if !paused.Paused() || paused.MigratingSlot() != 2 || paused.Done() {
+		t.Fatalf("%+v", paused)
+	}
+	if err := other.SetRequest(conn, ""); err != nil {
+		t.Fatal(err)
+	}
+	if req, err := resumed.GetRequest(conn); err != nil || req != "" || resumed.Paused() {
+		t.Fatal(req, err)
+	}
+
+	//limits change while the task runs
+	if err := other.SetLimit(conn, MigrateLimit{KeysPerSec: -1}); !errors.IsNotValid(errors.Cause(err)) {
+		t.Fatal("negative limit should fail", err)
+	}
+	if err := other.SetLimit(conn, MigrateLimit{KeysPerSec: 100, BytesPerSec: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := resumed.GetLimit(conn); err != nil || l.KeysPerSec != 100 || l.BytesPerSec != 1<<20 {
+		t.Fatal(l, err)
+	}
+	if l, err := t2.GetLimit(conn); err != nil || l != (MigrateLimit{}) {
+		t.Fatal(l, err)
+	}
+
+	//a failed task keeps blocking the queue
+	resumed.Status, resumed.Error = MIGRATE_TASK_ERR, "conflict"
+	resumed.Update(conn)
+	if next, err := NextMigrateTask(conn, productName); err != nil || next.Id != t1.Id || !next.Failed() || next.Done() {
+		t.Fatal(next, err)
+	}
+
+	resumed.Status = MIGRATE_TASK_FINISHED
+	resumed.Update(conn)
+	resumed.Release(conn)
+	if next, err := NextMigrateTask(conn, productName); err != nil || next.Id != t2.Id {
+		t.Fatal(next, err)
+	}
+
+	if err := t2.Remove(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetMigrateTask(conn, productName, t2.Id); !errors.IsNotFound(errors.Cause(err)) {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneMigrateTasks(t *testing.T) {
+	conn := zkhelper.NewConn()
+
+	var tasks []*MigrateTask
+	for i := 0; i < 5; i++ {
+		task := NewMigrateTask(productName, i, i, 1, 0)
+		if err := task.Create(conn); err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+	for _, i := range []int{0, 1, 3} {
+		tasks[i].Status = MIGRATE_TASK_FINISHED
+		tasks[i].Update(conn)
+	}
+	tasks[2].Status = MIGRATE_TASK_ERR
+	tasks[2].Update(conn)
+
+	//the request of a done task is not read any more
+	tasks[0].SetRequest(conn, MIGRATE_REQUEST_PAUSE)
+	if done, err := GetMigrateTask(conn, productName, tasks[0].Id); err != nil || done.Request != "" {
+		t.Fatal(done, err)
+	}
+
+	if n, err := PruneMigrateTasks(conn, productName, 1); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	left, err := MigrateTasks(conn, productName)
+	if err != nil || len(left) != 3 || left[0].Id != tasks[2].Id || left[1].Id != tasks[3].Id {
+		t.Fatal(left, err)
+	}
+	if next, err := NextMigrateTask(conn, productName); err != nil || next.Id != tasks[2].Id {
+		t.Fatal(next, err)
+	}
+	if n, err := PruneMigrateTasks(conn, productName, 1); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+}
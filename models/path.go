@@ -0,0 +1,53 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"path"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/zkhelper"
+)
+
+const DEFAULT_ROOT_PATH = "/zk/codis"
+
+// root of the topology of all products in the coordinator
+var rootPath = DEFAULT_ROOT_PATH
+
+// SetRootPath changes the root all topology paths are derived from.
+func SetRootPath(root string) error {
+	if err := CheckRootPath(root); err != nil {
+		return errors.Trace(err)
+	}
+
+	rootPath = root
+	return nil
+}
+
+// CheckRootPath only checks root is an absolute and clean path, constraints
+// of the coordinator are left to its backend.
+func CheckRootPath(root string) error {
+	if !path.IsAbs(root) || path.Clean(root) != root || root == "/" {
+		return errors.NotValidf("root path %s, must be absolute and clean", root)
+	}
+	return nil
+}
+
+func GetRootPath() string {
+	return rootPath
+}
+
+// GetProductPath returns the root of the topology of a product.
+func GetProductPath(productName string) string {
+	return path.Join(rootPath, "db_"+productName)
+}
+
+func GetLockPath(productName string) string {
+	return GetProductPath(productName) + "/LOCK"
+}
+
+// GetZkLock returns the lock serializing topology changes of a product.
+func GetZkLock(zkConn zkhelper.Conn, productName string) zkhelper.ZLocker {
+	return zkhelper.CreateMutex(zkConn, GetLockPath(productName))
+}
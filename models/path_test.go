@@ -0,0 +1,38 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"testing"
+
+	"github.com/ngaut/zkhelper"
+)
+
+func TestSetRootPath(t *testing.T) {
+	defer SetRootPath(DEFAULT_ROOT_PATH)
+
+	for _, root := range []string{"", "/", "zk/codis", "/zk/codis/", "/zk//codis", "/zk/../codis"} {
+		if err := SetRootPath(root); err == nil {
+			t.Errorf("root %q should be rejected", root)
+		}
+	}
+	if err := CheckRootPath("/teams/codis"); err != nil {
+		t.Error(err)
+	}
+
+	if err := SetRootPath("/zk/team_a/codis"); err != nil {
+		t.Fatal(err)
+	}
+	if p := GetSlotPath(productName, 1); p != "/zk/team_a/codis/db_"+productName+"/slots/slot_1" {
+		t.Error("invalid slot path", p)
+	}
+
+	fakeZkConn := zkhelper.NewConn()
+	if err := InitSlotSet(fakeZkConn, productName, 16); err != nil {
+		t.Fatal(err)
+	}
+	if children, _, _ := fakeZkConn.Children("/zk/team_a/codis/db_" + productName + "/slots"); len(children) != 16 {
+		t.Error("slots not created under root")
+	}
+}
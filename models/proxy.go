@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"strings"
 
 	"github.com/ngaut/zkhelper"
 
@@ -31,6 +32,8 @@ type ProxyInfo struct {
 	State        string `json:"state"`
 	Description  string `json:"description"`
 	DebugVarAddr string `json:"debug_var_addr"`
+	//version of the proxy config applied
+	ConfigVersion int `json:"config_version"`
 }
 
 func (p ProxyInfo) Ops() (int64, error) {
@@ -60,6 +63,36 @@ func (p ProxyInfo) Ops() (int64, error) {
 	return 0, nil
 }
 
+// SlotOps returns the requests served per slot of the product since the
+// proxy started.
+func (p ProxyInfo) SlotOps(productName string) (map[int]int64, error) {
+	m, err := p.DebugVars()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	//suffixed with the product if the proxy serves several
+	v, ok := m["slot_ops_"+productName].(string)
+	if !ok {
+		v, _ = m["slot_ops"].(string)
+	}
+	return ParseSlotStats(v)
+}
+
+// ParseSlotStats parses the "slot:count" list of a per slot stat.
+func ParseSlotStats(v string) (map[int]int64, error) {
+	ret := make(map[int]int64)
+	for _, f := range strings.Fields(v) {
+		var slot int
+		var n int64
+		if _, err := fmt.Sscanf(f, "%d:%d", &slot, &n); err != nil {
+			return nil, errors.NotValidf("slot stat %q", f)
+		}
+		ret[slot] = n
+	}
+	return ret, nil
+}
+
 func (p ProxyInfo) DebugVars() (map[string]interface{}, error) {
 	resp, err := http.Get("http://" + p.DebugVarAddr + "/debug/vars")
 	if err != nil {
@@ -81,7 +114,7 @@ func (p ProxyInfo) DebugVars() (map[string]interface{}, error) {
 }
 
 func GetProxyPath(productName string) string {
-	return fmt.Sprintf("/zk/codis/db_%s/proxy", productName)
+	return GetProductPath(productName) + "/proxy"
 }
 
 func CreateProxyInfo(zkConn zkhelper.Conn, productName string, pi *ProxyInfo) (string, error) {
@@ -0,0 +1,165 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	"github.com/ngaut/zkhelper"
+)
+
+// ProxyConfig is the dynamic config of all proxies of a product, proxies
+// watch it and apply changes live. Zero values keep the value of the proxy
+// config file.
+type ProxyConfig struct {
+	Version         int      `json:"version"`           // increased on every change
+	NetTimeout      int      `json:"net_timeout"`       // seconds
+	ConcurrentLimit int      `json:"concurrent_limit"`  // requests forwarded at the same time
+	PoolSize        int      `json:"pool_size"`         // connections per backend server
+	PoolIdleTimeout int      `json:"pool_idle_timeout"` // seconds
+	BlackList       []string `json:"black_list"`        // denied commands, replaces the builtin list
+	LogLevel        string   `json:"log_level"`
+}
+
+var proxyConfigKeys = []string{"net_timeout", "concurrent_limit", "pool_size", "pool_idle_timeout", "black_list", "log_level"}
+
+func GetProxyConfigPath(productName string) string {
+	return GetProductPath(productName) + "/proxy_config"
+}
+
+func (c *ProxyConfig) Validate() error {
+	if c.NetTimeout < 0 || c.NetTimeout > 3600 {
+		return errors.Errorf("invalid net_timeout %d, should be in [0, 3600]", c.NetTimeout)
+	}
+	if c.ConcurrentLimit < 0 || c.ConcurrentLimit > 100000 {
+		return errors.Errorf("invalid concurrent_limit %d, should be in [0, 100000]", c.ConcurrentLimit)
+	}
+	if c.PoolSize < 0 || c.PoolSize > 10000 {
+		return errors.Errorf("invalid pool_size %d, should be in [0, 10000]", c.PoolSize)
+	}
+	if c.PoolIdleTimeout < 0 {
+		return errors.Errorf("invalid pool_idle_timeout %d", c.PoolIdleTimeout)
+	}
+	for _, cmd := range c.BlackList {
+		if len(cmd) == 0 || cmd != strings.ToUpper(cmd) {
+			return errors.Errorf("invalid command %q in black_list", cmd)
+		}
+	}
+	switch c.LogLevel {
+	case "", "fatal", "error", "warn", "warning", "info", "debug":
+	default:
+		return errors.Errorf("invalid log_level %s, should be fatal, error, warning, info or debug", c.LogLevel)
+	}
+
+	return nil
+}
+
+// Set sets config key to value, an empty value resets it.
+func (c *ProxyConfig) Set(key string, value string) error {
+	var n int
+	switch key {
+	case "net_timeout", "concurrent_limit", "pool_size", "pool_idle_timeout":
+		if len(value) > 0 {
+			var err error
+			if n, err = strconv.Atoi(value); err != nil {
+				return errors.Errorf("invalid %s %s", key, value)
+			}
+		}
+	}
+
+	switch key {
+	case "net_timeout":
+		c.NetTimeout = n
+	case "concurrent_limit":
+		c.ConcurrentLimit = n
+	case "pool_size":
+		c.PoolSize = n
+	case "pool_idle_timeout":
+		c.PoolIdleTimeout = n
+	case "black_list":
+		c.BlackList = nil
+		for _, cmd := range strings.Split(value, ",") {
+			if cmd = strings.TrimSpace(cmd); len(cmd) > 0 {
+				c.BlackList = append(c.BlackList, strings.ToUpper(cmd))
+			}
+		}
+	case "log_level":
+		c.LogLevel = value
+	default:
+		return errors.NotFoundf("config key %s, should be one of %s", key, strings.Join(proxyConfigKeys, ", "))
+	}
+
+	return nil
+}
+
+// GetProxyConfig returns the proxy config of the product, nil if not set.
+func GetProxyConfig(zkConn zkhelper.Conn, productName string) (*ProxyConfig, error) {
+	data, _, err := zkConn.Get(GetProxyConfigPath(productName))
+	if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var c ProxyConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &c, nil
+}
+
+// SetProxyConfig validates and stores the proxy config with the next version.
+func SetProxyConfig(zkConn zkhelper.Conn, productName string, c *ProxyConfig) error {
+	if err := c.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+
+	zkPath := GetProxyConfigPath(productName)
+	data, stat, err := zkConn.Get(zkPath)
+	if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		c.Version = 1
+		b, _ := json.Marshal(c)
+		_, err = zkhelper.CreateRecursive(zkConn, zkPath, string(b), 0, zkhelper.DefaultFileACLs())
+		return errors.Trace(err)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var old ProxyConfig
+	if err := json.Unmarshal(data, &old); err != nil {
+		return errors.Trace(err)
+	}
+	c.Version = old.Version + 1
+	b, _ := json.Marshal(c)
+
+	//fails if changed by others meanwhile
+	_, err = zkConn.Set(zkPath, b, int32(stat.Version()))
+	return errors.Trace(err)
+}
+
+// SetProxyConfigVersion publishes the proxy config version applied by the proxy.
+func SetProxyConfigVersion(zkConn zkhelper.Conn, productName string, proxyName string, version int) error {
+	zkPath := path.Join(GetProxyPath(productName), proxyName)
+	data, stat, err := zkConn.Get(zkPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var pi ProxyInfo
+	if err := json.Unmarshal(data, &pi); err != nil {
+		return errors.Trace(err)
+	}
+	pi.ConfigVersion = version
+	b, _ := json.Marshal(pi)
+
+	_, err = zkConn.Set(zkPath, b, int32(stat.Version()))
+	return errors.Trace(err)
+}
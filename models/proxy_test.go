@@ -93,3 +93,50 @@ func TestProxy(t *testing.T) {
 		t.Error("change status error")
 	}
 }
+
+func TestParseSlotStats(t *testing.T) {
+	m, err := ParseSlotStats("0:3 15:100")
+	if err != nil || len(m) != 2 || m[0] != 3 || m[15] != 100 {
+		t.Fatal(m, err)
+	}
+	if m, err := ParseSlotStats(""); err != nil || len(m) != 0 {
+		t.Fatal(m, err)
+	}
+	if _, err := ParseSlotStats("0:3 x"); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	fakeZkConn := zkhelper.NewConn()
+	if c, err := GetProxyConfig(fakeZkConn, productName); err != nil || c != nil {
+		t.Fatal("should not be set", c, err)
+	}
+
+	c := &ProxyConfig{}
+	if err := c.Set("net_timeout", "5d"); err == nil {
+		t.Error("malformed value should fail")
+	}
+	if err := c.Set("unknown", "1"); err == nil {
+		t.Error("unknown key should fail")
+	}
+	if err := c.Set("black_list", "keys, scan"); err != nil || len(c.BlackList) != 2 || c.BlackList[1] != "SCAN" {
+		t.Error("invalid black list", c.BlackList, err)
+	}
+
+	c.LogLevel = "verbose"
+	if err := SetProxyConfig(fakeZkConn, productName, c); err == nil {
+		t.Error("invalid config should not be stored")
+	}
+
+	c.LogLevel = "info"
+	for i := 1; i <= 2; i++ {
+		if err := SetProxyConfig(fakeZkConn, productName, c); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := GetProxyConfig(fakeZkConn, productName)
+		if err != nil || stored.Version != i || stored.LogLevel != "info" {
+			t.Errorf("invalid config %+v, %v", stored, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"path"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	log "github.com/ngaut/logging"
+	"github.com/ngaut/zkhelper"
+)
+
+//state of a node tree before a topology change
+type nodeBackup struct {
+	path     string
+	exists   bool
+	data     []byte
+	children []*nodeBackup
+}
+
+func backupNode(zkConn zkhelper.Conn, p string) (*nodeBackup, error) {
+	b := &nodeBackup{path: p}
+	data, _, err := zkConn.Get(p)
+	if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	b.exists, b.data = true, data
+
+	children, _, err := zkConn.Children(p)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, c := range children {
+		child, err := backupNode(zkConn, path.Join(p, c))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		b.children = append(b.children, child)
+	}
+
+	return b, nil
+}
+
+func (b *nodeBackup) restore(zkConn zkhelper.Conn) error {
+	if !b.exists {
+		err := zkhelper.DeleteRecursive(zkConn, b.path, -1)
+		if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			return errors.Trace(err)
+		}
+		return nil
+	}
+
+	acls := zkhelper.DefaultFileACLs()
+	if len(b.children) > 0 {
+		acls = zkhelper.DefaultDirACLs()
+	}
+	if _, err := zkhelper.CreateOrUpdate(zkConn, b.path, string(b.data), 0, acls, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	//remove children created by the change
+	children, _, err := zkConn.Children(b.path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, c := range children {
+		if !b.hasChild(c) {
+			if err := zkhelper.DeleteRecursive(zkConn, path.Join(b.path, c), -1); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	for _, child := range b.children {
+		if err := child.restore(zkConn); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (b *nodeBackup) hasChild(name string) bool {
+	for _, child := range b.children {
+		if path.Base(child.path) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// changeTopology applies change to the nodes under paths and notifies the
+// proxies with an action waiting for their confirmation. If any proxy fails
+// to apply it, the nodes are restored to their previous state and a rollback
+// action makes the proxies reload them.
+func changeTopology(zkConn zkhelper.Conn, productName string, paths []string, change func() error,
+	actionType ActionType, target interface{}) error {
+	var backups []*nodeBackup
+	for _, p := range paths {
+		b, err := backupNode(zkConn, p)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		backups = append(backups, b)
+	}
+
+	if err := change(); err != nil {
+		//undo a partial change
+		if rerr := restoreNodes(zkConn, backups); rerr != nil {
+			log.Error("restore topology failed", errors.ErrorStack(rerr))
+		}
+		return errors.Trace(err)
+	}
+
+	err := NewAction(zkConn, productName, actionType, target, "", true)
+	failed, ok := errors.Cause(err).(*ActionFailedError)
+	if !ok {
+		return errors.Trace(err)
+	}
+
+	log.Errorf("%s, rolling back", failed)
+	if rerr := rollback(zkConn, productName, failed.Action, backups); rerr != nil {
+		log.Error("rollback failed", errors.ErrorStack(rerr))
+		return errors.Annotatef(err, "rollback failed, %s", rerr)
+	}
+
+	return errors.Trace(err)
+}
+
+func restoreNodes(zkConn zkhelper.Conn, backups []*nodeBackup) error {
+	for _, b := range backups {
+		if err := b.restore(zkConn); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func rollback(zkConn zkhelper.Conn, productName string, actionZkPath string, backups []*nodeBackup) error {
+	if err := restoreNodes(zkConn, backups); err != nil {
+		return errors.Trace(err)
+	}
+
+	//proxies which applied the failed action reload the previous topology
+	if err := NewAction(zkConn, productName, ACTION_TYPE_ROLLBACK, path.Base(actionZkPath), "", true); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(SetActionStatus(zkConn, actionZkPath, ACTION_STATUS_ROLLED_BACK, nil))
+}
@@ -6,6 +6,7 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"path"
 	"strconv"
 	"strings"
 
@@ -74,8 +75,12 @@ func NewServerGroup(productName string, id int) *ServerGroup {
 	}
 }
 
+func GetGroupPath(productName string, groupId int) string {
+	return fmt.Sprintf("%s/servers/group_%d", GetProductPath(productName), groupId)
+}
+
 func GroupExists(zkConn zkhelper.Conn, productName string, groupId int) (bool, error) {
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/servers/group_%d", productName, groupId)
+	zkPath := GetGroupPath(productName, groupId)
 	exists, _, err := zkConn.Exists(zkPath)
 	if err != nil {
 		return false, errors.Trace(err)
@@ -106,7 +111,7 @@ func GetGroup(zkConn zkhelper.Conn, productName string, groupId int) (*ServerGro
 
 func ServerGroups(zkConn zkhelper.Conn, productName string) ([]ServerGroup, error) {
 	var ret []ServerGroup
-	root := fmt.Sprintf("/zk/codis/db_%s/servers", productName)
+	root := GetProductPath(productName) + "/servers"
 	groups, _, err := zkConn.Children(root)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -144,21 +149,48 @@ func (self *ServerGroup) Master(zkConn zkhelper.Conn) (*Server, error) {
 	return nil, nil
 }
 
-func (self *ServerGroup) Remove(zkConn zkhelper.Conn) error {
-	// check if this group is not used by any slot
+// References lists what still uses the group: slots it owns or migrating
+// from or to it, and unfinished migrate tasks to it.
+func (self *ServerGroup) References(zkConn zkhelper.Conn) ([]string, error) {
 	slots, err := Slots(zkConn, self.ProductName)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
+	var refs []string
 	for _, slot := range slots {
+		migrating := slot.State.Status == SLOT_STATUS_MIGRATE || slot.State.Status == SLOT_STATUS_PRE_MIGRATE
 		if slot.GroupId == self.Id {
-			return errors.AlreadyExistsf("group %d is using by slot %d", slot.GroupId, slot.Id)
+			refs = append(refs, fmt.Sprintf("slot %d", slot.Id))
+		} else if migrating && (slot.State.MigrateStatus.From == self.Id || slot.State.MigrateStatus.To == self.Id) {
+			refs = append(refs, fmt.Sprintf("slot %d migrating", slot.Id))
+		}
+	}
+
+	tasks, err := MigrateTasks(zkConn, self.ProductName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, t := range tasks {
+		if !t.Done() && t.NewGroupId == self.Id {
+			refs = append(refs, fmt.Sprintf("migrate task %s", t.Id))
 		}
 	}
+	return refs, nil
+}
+
+func (self *ServerGroup) Remove(zkConn zkhelper.Conn) error {
+	// check if this group is not used by any slot or migrate task
+	refs, err := self.References(zkConn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(refs) > 0 {
+		return errors.AlreadyExistsf("group %d is used by %s", self.Id, refs[0])
+	}
 
 	// do delte
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/servers/group_%d", self.ProductName, self.Id)
+	zkPath := GetGroupPath(self.ProductName, self.Id)
 	err = zkhelper.DeleteRecursive(zkConn, zkPath, -1)
 
 	err = NewAction(zkConn, self.ProductName, ACTION_TYPE_SERVER_GROUP_REMOVE, self, "", false)
@@ -170,20 +202,20 @@ func (self *ServerGroup) RemoveServer(zkConn zkhelper.Conn, s Server) error {
 		return errors.New("cannot remove master, use promote first")
 	}
 
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/servers/group_%d/%s", self.ProductName, self.Id, s.Addr)
-	err := zkConn.Delete(zkPath, -1)
-	if err != nil {
-		return errors.Trace(err)
+	zkPath := path.Join(GetGroupPath(self.ProductName, self.Id), s.Addr)
+	change := func() error {
+		return errors.Trace(zkConn.Delete(zkPath, -1))
 	}
 
-	for i := 0; i < len(self.Servers); i++ {
-		if self.Servers[i].Addr == s.Addr {
-			self.Servers = append(self.Servers[:i], self.Servers[i+1:]...)
-			break
+	servers := make([]Server, 0, len(self.Servers))
+	for _, server := range self.Servers {
+		if server.Addr != s.Addr {
+			servers = append(servers, server)
 		}
 	}
+	self.Servers = servers
 
-	err = NewAction(zkConn, self.ProductName, ACTION_TYPE_SERVER_GROUP_CHANGED, self, "", false)
+	err := changeTopology(zkConn, self.ProductName, []string{zkPath}, change, ACTION_TYPE_SERVER_GROUP_CHANGED, self)
 	return errors.Trace(err)
 }
 
@@ -213,18 +245,22 @@ func (self *ServerGroup) Promote(conn zkhelper.Conn, addr string) error {
 		return errors.Trace(err)
 	}
 
-	// old master may be nil
-	if master != nil {
-		master.Type = SERVER_TYPE_OFFLINE
-		err = self.AddServer(conn, master)
-		if err != nil {
-			return errors.Trace(err)
+	change := func() error {
+		// old master may be nil
+		if master != nil {
+			master.Type = SERVER_TYPE_OFFLINE
+			if err := self.addServer(conn, master); err != nil {
+				return errors.Trace(err)
+			}
 		}
+
+		// promote new server to master
+		s.Type = SERVER_TYPE_MASTER
+		return errors.Trace(self.addServer(conn, &s))
 	}
 
-	// promote new server to master
-	s.Type = SERVER_TYPE_MASTER
-	err = self.AddServer(conn, &s)
+	zkPath := GetGroupPath(self.ProductName, self.Id)
+	err = changeTopology(conn, self.ProductName, []string{zkPath}, change, ACTION_TYPE_SERVER_GROUP_CHANGED, self)
 	return errors.Trace(err)
 }
 
@@ -232,12 +268,12 @@ func (self *ServerGroup) Create(zkConn zkhelper.Conn) error {
 	if self.Id < 0 {
 		return errors.NotSupportedf("invalid server group id %d", self.Id)
 	}
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/servers/group_%d", self.ProductName, self.Id)
-	_, err := zkhelper.CreateOrUpdate(zkConn, zkPath, "", 0, zkhelper.DefaultDirACLs(), true)
-	if err != nil {
+	zkPath := GetGroupPath(self.ProductName, self.Id)
+	change := func() error {
+		_, err := zkhelper.CreateOrUpdate(zkConn, zkPath, "", 0, zkhelper.DefaultDirACLs(), true)
 		return errors.Trace(err)
 	}
-	err = NewAction(zkConn, self.ProductName, ACTION_TYPE_SERVER_GROUP_CHANGED, self, "", false)
+	err := changeTopology(zkConn, self.ProductName, []string{zkPath}, change, ACTION_TYPE_SERVER_GROUP_CHANGED, self)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -252,7 +288,7 @@ func (self *ServerGroup) Create(zkConn zkhelper.Conn) error {
 }
 
 func (self *ServerGroup) Exists(zkConn zkhelper.Conn) (bool, error) {
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/servers/group_%d", self.ProductName, self.Id)
+	zkPath := GetGroupPath(self.ProductName, self.Id)
 	b, err := zkhelper.NodeExists(zkConn, zkPath)
 	if err != nil {
 		return false, errors.Trace(err)
@@ -263,6 +299,19 @@ func (self *ServerGroup) Exists(zkConn zkhelper.Conn) (bool, error) {
 var ErrNodeExists = errors.New("node already exists")
 
 func (self *ServerGroup) AddServer(zkConn zkhelper.Conn, s *Server) error {
+	if s.Type != SERVER_TYPE_MASTER {
+		return errors.Trace(self.addServer(zkConn, s))
+	}
+
+	zkPath := GetGroupPath(self.ProductName, self.Id)
+	change := func() error {
+		return errors.Trace(self.addServer(zkConn, s))
+	}
+	err := changeTopology(zkConn, self.ProductName, []string{zkPath}, change, ACTION_TYPE_SERVER_GROUP_CHANGED, self)
+	return errors.Trace(err)
+}
+
+func (self *ServerGroup) addServer(zkConn zkhelper.Conn, s *Server) error {
 	s.GroupId = self.Id
 	val, err := json.Marshal(s)
 	if err != nil {
@@ -282,8 +331,11 @@ func (self *ServerGroup) AddServer(zkConn zkhelper.Conn, s *Server) error {
 		}
 	}
 
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/servers/group_%d/%s", self.ProductName, self.Id, s.Addr)
+	zkPath := path.Join(GetGroupPath(self.ProductName, self.Id), s.Addr)
 	_, err = zkhelper.CreateOrUpdate(zkConn, zkPath, string(val), 0, zkhelper.DefaultFileACLs(), true)
+	if err != nil {
+		return errors.Trace(err)
+	}
 
 	// update servers
 	servers, err := self.GetServers(zkConn)
@@ -292,19 +344,12 @@ func (self *ServerGroup) AddServer(zkConn zkhelper.Conn, s *Server) error {
 	}
 	self.Servers = servers
 
-	if s.Type == SERVER_TYPE_MASTER {
-		err = NewAction(zkConn, self.ProductName, ACTION_TYPE_SERVER_GROUP_CHANGED, self, "", true)
-		if err != nil {
-			return errors.Trace(err)
-		}
-	}
-
 	return nil
 }
 
 func (self *ServerGroup) GetServers(zkConn zkhelper.Conn) ([]Server, error) {
 	var ret []Server
-	root := fmt.Sprintf("/zk/codis/db_%s/servers/group_%d", self.ProductName, self.Id)
+	root := GetGroupPath(self.ProductName, self.Id)
 	nodes, _, err := zkConn.Children(root)
 	if err != nil {
 		return nil, errors.Trace(err)
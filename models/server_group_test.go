@@ -88,3 +88,65 @@ func TestServerGroup(t *testing.T) {
 		t.Error("master error")
 	}
 }
+
+func TestRemoveServerGroup(t *testing.T) {
+	fakeZkConn := zkhelper.NewConn()
+	if err := InitSlotSet(fakeZkConn, productName, 16); err != nil {
+		t.Fatal(err)
+	}
+	g1 := NewServerGroup(productName, 1)
+	g1.Create(fakeZkConn)
+	g2 := NewServerGroup(productName, 2)
+	g2.Create(fakeZkConn)
+	if err := SetSlotRange(fakeZkConn, productName, 0, 15, 1, SLOT_STATUS_ONLINE); err != nil {
+		t.Fatal(err)
+	}
+
+	// slot 3 migrating from group 1 to group 2
+	s, err := GetSlot(fakeZkConn, productName, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMigrateStatus(fakeZkConn, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := g1.References(fakeZkConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrating := 0
+	for _, ref := range refs {
+		if ref == "slot 3 migrating" {
+			migrating++
+		}
+	}
+	if len(refs) != 16 || migrating != 1 {
+		t.Error("references error", refs)
+	}
+	if err := g2.Remove(fakeZkConn); err == nil {
+		t.Error("group 2 removed while a slot migrates to it")
+	}
+
+	// all slots moved to group 1, a task still queued to group 2
+	if err := SetSlotRange(fakeZkConn, productName, 0, 15, 1, SLOT_STATUS_ONLINE); err != nil {
+		t.Fatal(err)
+	}
+	task := NewMigrateTask(productName, 0, 0, 2, 0)
+	if err := task.Create(fakeZkConn); err != nil {
+		t.Fatal(err)
+	}
+	if err := g2.Remove(fakeZkConn); err == nil {
+		t.Error("group 2 removed while a migrate task goes to it")
+	}
+
+	task.Status = MIGRATE_TASK_CANCELLED
+	if err := task.Update(fakeZkConn); err != nil {
+		t.Fatal(err)
+	}
+	if err := g2.Remove(fakeZkConn); err != nil {
+		t.Error(err)
+	}
+	if ok, _ := g2.Exists(fakeZkConn); ok {
+		t.Error("remove group error")
+	}
+}
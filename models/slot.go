@@ -72,11 +72,11 @@ func NewSlot(productName string, id int) *Slot {
 }
 
 func GetSlotPath(productName string, slotId int) string {
-	return fmt.Sprintf("/zk/codis/db_%s/slots/slot_%d", productName, slotId)
+	return fmt.Sprintf("%s/slots/slot_%d", GetProductPath(productName), slotId)
 }
 
 func GetSlotBasePath(productName string) string {
-	return fmt.Sprintf("/zk/codis/db_%s/slots", productName)
+	return GetProductPath(productName) + "/slots"
 }
 
 func GetSlot(zkConn zkhelper.Conn, productName string, id int) (*Slot, error) {
@@ -161,19 +161,27 @@ func SetSlots(zkConn zkhelper.Conn, productName string, slots []Slot, groupId in
 		return errors.NotFoundf("group %d", groupId)
 	}
 
+	var paths []string
 	for _, s := range slots {
-		s.GroupId = groupId
-		s.State.Status = status
-		data, err := json.Marshal(s)
-		if err != nil {
-			return errors.Trace(err)
-		}
+		paths = append(paths, GetSlotPath(productName, s.Id))
+	}
 
-		zkPath := GetSlotPath(productName, s.Id)
-		_, err = zkhelper.CreateOrUpdate(zkConn, zkPath, string(data), 0, zkhelper.DefaultFileACLs(), true)
-		if err != nil {
-			return errors.Trace(err)
+	change := func() error {
+		for _, s := range slots {
+			s.GroupId = groupId
+			s.State.Status = status
+			data, err := json.Marshal(s)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			zkPath := GetSlotPath(productName, s.Id)
+			_, err = zkhelper.CreateOrUpdate(zkConn, zkPath, string(data), 0, zkhelper.DefaultFileACLs(), true)
+			if err != nil {
+				return errors.Trace(err)
+			}
 		}
+		return nil
 	}
 
 	param := SlotMultiSetParam{
@@ -183,7 +191,7 @@ func SetSlots(zkConn zkhelper.Conn, productName string, slots []Slot, groupId in
 		Status:  status,
 	}
 
-	err = NewAction(zkConn, productName, ACTION_TYPE_MULTI_SLOT_CHANGED, param, "", true)
+	err = changeTopology(zkConn, productName, paths, change, ACTION_TYPE_MULTI_SLOT_CHANGED, param)
 	return errors.Trace(err)
 
 }
@@ -201,23 +209,31 @@ func SetSlotRange(zkConn zkhelper.Conn, productName string, fromSlot, toSlot, gr
 		return errors.NotFoundf("group %d", groupId)
 	}
 
+	var paths []string
 	for i := fromSlot; i <= toSlot; i++ {
-		s, err := GetSlot(zkConn, productName, i)
-		if err != nil {
-			return errors.Trace(err)
-		}
-		s.GroupId = groupId
-		s.State.Status = status
-		data, err := json.Marshal(s)
-		if err != nil {
-			return errors.Trace(err)
-		}
+		paths = append(paths, GetSlotPath(productName, i))
+	}
 
-		zkPath := GetSlotPath(productName, i)
-		_, err = zkhelper.CreateOrUpdate(zkConn, zkPath, string(data), 0, zkhelper.DefaultFileACLs(), true)
-		if err != nil {
-			return errors.Trace(err)
+	change := func() error {
+		for i := fromSlot; i <= toSlot; i++ {
+			s, err := GetSlot(zkConn, productName, i)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			s.GroupId = groupId
+			s.State.Status = status
+			data, err := json.Marshal(s)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			zkPath := GetSlotPath(productName, i)
+			_, err = zkhelper.CreateOrUpdate(zkConn, zkPath, string(data), 0, zkhelper.DefaultFileACLs(), true)
+			if err != nil {
+				return errors.Trace(err)
+			}
 		}
+		return nil
 	}
 
 	param := SlotMultiSetParam{
@@ -226,7 +242,7 @@ func SetSlotRange(zkConn zkhelper.Conn, productName string, fromSlot, toSlot, gr
 		GroupId: groupId,
 		Status:  status,
 	}
-	err = NewAction(zkConn, productName, ACTION_TYPE_MULTI_SLOT_CHANGED, param, "", true)
+	err = changeTopology(zkConn, productName, paths, change, ACTION_TYPE_MULTI_SLOT_CHANGED, param)
 	return errors.Trace(err)
 }
 
@@ -279,16 +295,16 @@ func (s *Slot) Update(zkConn zkhelper.Conn) error {
 		return errors.Trace(err)
 	}
 	zkPath := GetSlotPath(s.ProductName, s.Id)
-	_, err = zkhelper.CreateOrUpdate(zkConn, zkPath, string(data), 0, zkhelper.DefaultFileACLs(), true)
-	if err != nil {
+	change := func() error {
+		_, err := zkhelper.CreateOrUpdate(zkConn, zkPath, string(data), 0, zkhelper.DefaultFileACLs(), true)
 		return errors.Trace(err)
 	}
 
+	actionType := ACTION_TYPE_SLOT_CHANGED
 	if s.State.Status == SLOT_STATUS_MIGRATE {
-		err = NewAction(zkConn, s.ProductName, ACTION_TYPE_SLOT_MIGRATE, s, "", true)
-	} else {
-		err = NewAction(zkConn, s.ProductName, ACTION_TYPE_SLOT_CHANGED, s, "", true)
+		actionType = ACTION_TYPE_SLOT_MIGRATE
 	}
 
+	err = changeTopology(zkConn, s.ProductName, []string{zkPath}, change, actionType, s)
 	return errors.Trace(err)
 }
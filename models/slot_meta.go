@@ -0,0 +1,162 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+
+	"github.com/ngaut/zkhelper"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+)
+
+const (
+	HASHTAG_START = '{'
+	HASHTAG_END   = '}'
+)
+
+// SlotMeta is the slot layout of a product. Keys are hashed into SlotNum
+// virtual slots, the unit of migration, and every virtual slot is stored in
+// backend database slot % DBNum. Products created before virtual slots have
+// no meta and use one database per slot.
+type SlotMeta struct {
+	SlotNum int `json:"slot_num"`
+	DBNum   int `json:"db_num"`
+}
+
+func (m *SlotMeta) String() string {
+	b, _ := json.MarshalIndent(m, "", "  ")
+	return string(b)
+}
+
+func (m *SlotMeta) Validate() error {
+	if m.SlotNum <= 0 || m.DBNum <= 0 {
+		return errors.NotValidf("slot_num %d, db_num %d", m.SlotNum, m.DBNum)
+	}
+
+	if m.SlotNum%m.DBNum != 0 {
+		return errors.NotValidf("slot_num %d not a multiple of db_num %d", m.SlotNum, m.DBNum)
+	}
+
+	return nil
+}
+
+// backend database index of slot
+func (m *SlotMeta) DB(slotId int) int {
+	return slotId % m.DBNum
+}
+
+// is a database shared by several virtual slots
+func (m *SlotMeta) Virtual() bool {
+	return m.SlotNum != m.DBNum
+}
+
+func GetSlotMetaPath(productName string) string {
+	return GetProductPath(productName) + "/slot_meta"
+}
+
+// GetSlotMeta returns nil if the product has no slot meta.
+func GetSlotMeta(zkConn zkhelper.Conn, productName string) (*SlotMeta, error) {
+	data, _, err := zkConn.Get(GetSlotMetaPath(productName))
+	if err != nil {
+		if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+
+	var m SlotMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &m, nil
+}
+
+func SetSlotMeta(zkConn zkhelper.Conn, productName string, m *SlotMeta) error {
+	if err := m.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = zkhelper.CreateOrUpdate(zkConn, GetSlotMetaPath(productName), string(data), 0, zkhelper.DefaultFileACLs(), true)
+	return errors.Trace(err)
+}
+
+// MapKey2Slot hashes key into one of slotNum slots, only the part in
+// braces is hashed if key has a hash tag.
+func MapKey2Slot(key []byte, slotNum int) int {
+	hashKey := key
+	//hash tag support
+	htagStart := bytes.IndexByte(key, HASHTAG_START)
+	if htagStart >= 0 {
+		htagEnd := bytes.IndexByte(key[htagStart:], HASHTAG_END)
+		if htagEnd >= 0 {
+			hashKey = key[htagStart+1 : htagStart+htagEnd]
+		}
+	}
+
+	return int(crc32.ChecksumIEEE(hashKey) % uint32(slotNum))
+}
+
+// ExpandSlots splits every slot of the product into slotNum/old.SlotNum
+// virtual slots in the same group. Since slotNum is a multiple of the old
+// count, a key is hashed to a new slot sharing the database of its old slot,
+// so no data is moved. The new slots and the meta are written at once and
+// proxies switch to the new layout with a single action, if any of them
+// fails the product is rolled back to the old layout.
+func ExpandSlots(zkConn zkhelper.Conn, productName string, old *SlotMeta, slotNum int) error {
+	if slotNum <= old.SlotNum || slotNum%old.SlotNum != 0 {
+		return errors.NotValidf("slot_num %d, must be a multiple of %d", slotNum, old.SlotNum)
+	}
+
+	slots, err := Slots(zkConn, productName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(slots) != old.SlotNum {
+		return errors.Errorf("%d slots found, expect %d", len(slots), old.SlotNum)
+	}
+
+	for _, s := range slots {
+		if s.State.Status != SLOT_STATUS_ONLINE && s.State.Status != SLOT_STATUS_OFFLINE {
+			return errors.Errorf("slot %d is %s, finish it first", s.Id, s.State.Status)
+		}
+	}
+
+	meta := &SlotMeta{SlotNum: slotNum, DBNum: old.DBNum}
+	paths := []string{GetSlotMetaPath(productName)}
+	for id := old.SlotNum; id < slotNum; id++ {
+		paths = append(paths, GetSlotPath(productName, id))
+	}
+
+	change := func() error {
+		for _, s := range slots {
+			for id := s.Id + old.SlotNum; id < slotNum; id += old.SlotNum {
+				slot := NewSlot(productName, id)
+				slot.GroupId = s.GroupId
+				slot.State.Status = s.State.Status
+				data, err := json.Marshal(slot)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				_, err = zkhelper.CreateOrUpdate(zkConn, GetSlotPath(productName, id), string(data), 0, zkhelper.DefaultFileACLs(), true)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+		return errors.Trace(SetSlotMeta(zkConn, productName, meta))
+	}
+
+	err = changeTopology(zkConn, productName, paths, change, ACTION_TYPE_SLOT_EXPAND, meta)
+	return errors.Trace(err)
+}
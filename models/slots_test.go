@@ -74,3 +74,60 @@ func TestSlots(t *testing.T) {
 	}
 
 }
+
+func TestExpandSlots(t *testing.T) {
+	fakeZkConn := zkhelper.NewConn()
+	if err := InitSlotSet(fakeZkConn, productName, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	g := NewServerGroup(productName, 1)
+	g.Create(fakeZkConn)
+	if err := SetSlotRange(fakeZkConn, productName, 0, 15, 1, SLOT_STATUS_ONLINE); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err := GetSlotMeta(fakeZkConn, productName); err != nil || m != nil {
+		t.Fatal("no slot meta expected", m, err)
+	}
+
+	old := &SlotMeta{SlotNum: 16, DBNum: 16}
+	if err := ExpandSlots(fakeZkConn, productName, old, 24); err == nil {
+		t.Error("slot_num must be a multiple of the old one")
+	}
+
+	before, _ := GetActionSeqList(fakeZkConn, productName)
+	if err := ExpandSlots(fakeZkConn, productName, old, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	//one action for all the new slots
+	seqs, err := GetActionSeqList(fakeZkConn, productName)
+	if err != nil || len(seqs) != len(before)+1 {
+		t.Fatal("one action expected", len(before), seqs, err)
+	}
+	act, err := GetActionWithSeq(fakeZkConn, productName, int64(seqs[len(seqs)-1]))
+	if err != nil || act.Type != ACTION_TYPE_SLOT_EXPAND {
+		t.Fatal(act, err)
+	}
+
+	m, err := GetSlotMeta(fakeZkConn, productName)
+	if err != nil || m.SlotNum != 1024 || m.DBNum != 16 {
+		t.Fatal("invalid slot meta", m, err)
+	}
+
+	s, err := GetSlot(fakeZkConn, productName, 1023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.GroupId != 1 || s.State.Status != SLOT_STATUS_ONLINE {
+		t.Error("new slot should inherit group and status", s)
+	}
+
+	//keys stay in the database of their old slot
+	for _, key := range []string{"a", "foo", "{user}:1", "key:123456"} {
+		if m.DB(MapKey2Slot([]byte(key), m.SlotNum)) != MapKey2Slot([]byte(key), old.SlotNum) {
+			t.Errorf("key %s moved to another database", key)
+		}
+	}
+}
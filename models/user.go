@@ -0,0 +1,174 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ngaut/zkhelper"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+)
+
+// command categories a user may be allowed to run
+const (
+	CMD_CATEGORY_READ  = "read"
+	CMD_CATEGORY_WRITE = "write"
+	CMD_CATEGORY_ADMIN = "admin"
+)
+
+const passwordHashRounds = 1000
+
+// client user of a product
+type User struct {
+	Name        string   `json:"name"`
+	Password    string   `json:"password"`     // sha256$<rounds>$<salt>$<hash>
+	Categories  []string `json:"categories"`   // allowed command categories
+	KeyPatterns []string `json:"key_patterns"` // allowed key glob patterns, empty for all keys
+	ReadOnly    bool     `json:"read_only"`
+}
+
+func (u User) String() string {
+	b, _ := json.MarshalIndent(u, "", "  ")
+	return string(b)
+}
+
+func GetUserBasePath(productName string) string {
+	return GetProductPath(productName) + "/users"
+}
+
+func GetUserPath(productName string, name string) string {
+	return path.Join(GetUserBasePath(productName), name)
+}
+
+func hashPassword(password string, salt []byte, rounds int) []byte {
+	sum := sha256.Sum256(append(salt, password...))
+	for i := 1; i < rounds; i++ {
+		sum = sha256.Sum256(append(salt, sum[:]...))
+	}
+	return sum[:]
+}
+
+// HashPassword returns a salted hash of password to store in User.Password.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return fmt.Sprintf("sha256$%d$%s$%s", passwordHashRounds, hex.EncodeToString(salt),
+		hex.EncodeToString(hashPassword(password, salt, passwordHashRounds))), nil
+}
+
+func (u *User) CheckPassword(password string) bool {
+	parts := strings.Split(u.Password, "$")
+	if len(parts) != 4 || parts[0] != "sha256" {
+		return false
+	}
+
+	rounds, err := strconv.Atoi(parts[1])
+	if err != nil || rounds <= 0 {
+		return false
+	}
+
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(hash, hashPassword(password, salt, rounds)) == 1
+}
+
+func validCategory(c string) bool {
+	switch c {
+	case CMD_CATEGORY_READ, CMD_CATEGORY_WRITE, CMD_CATEGORY_ADMIN:
+		return true
+	default:
+		return false
+	}
+}
+
+// CreateOrUpdateUser saves u and notifies the proxies to reload users.
+func CreateOrUpdateUser(zkConn zkhelper.Conn, productName string, u *User) error {
+	if len(u.Name) == 0 || strings.Contains(u.Name, "/") {
+		return errors.NotValidf("user name %q", u.Name)
+	}
+
+	for _, c := range u.Categories {
+		if !validCategory(c) {
+			return errors.NotValidf("command category %q", c)
+		}
+	}
+
+	data, err := json.Marshal(u)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = zkhelper.CreateOrUpdate(zkConn, GetUserPath(productName, u.Name), string(data), 0, zkhelper.DefaultFileACLs(), true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = NewAction(zkConn, productName, ACTION_TYPE_USER_CHANGED, u.Name, "", true)
+	return errors.Trace(err)
+}
+
+func GetUser(zkConn zkhelper.Conn, productName string, name string) (*User, error) {
+	data, _, err := zkConn.Get(GetUserPath(productName, name))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var u User
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &u, nil
+}
+
+func Users(zkConn zkhelper.Conn, productName string) ([]User, error) {
+	names, _, err := zkConn.Children(GetUserBasePath(productName))
+	if err != nil {
+		if zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+			return nil, nil
+		}
+		return nil, errors.Trace(err)
+	}
+
+	var users []User
+	for _, name := range names {
+		u, err := GetUser(zkConn, productName, name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		users = append(users, *u)
+	}
+
+	return users, nil
+}
+
+func RemoveUser(zkConn zkhelper.Conn, productName string, name string) error {
+	if err := zkConn.Delete(GetUserPath(productName, name), -1); err != nil {
+		return errors.Trace(err)
+	}
+
+	err := NewAction(zkConn, productName, ACTION_TYPE_USER_CHANGED, name, "", true)
+	return errors.Trace(err)
+}
@@ -0,0 +1,52 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package models
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/zkhelper"
+)
+
+func TestUser(t *testing.T) {
+	fakeZkConn := zkhelper.NewConn()
+
+	users, err := Users(fakeZkConn, productName)
+	if err != nil || len(users) != 0 {
+		t.Fatal("should have no user", err)
+	}
+
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &User{Name: "app", Password: hash, Categories: []string{CMD_CATEGORY_READ}}
+	if err := CreateOrUpdateUser(fakeZkConn, productName, u); err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+
+	u, err = GetUser(fakeZkConn, productName, "app")
+	if err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+
+	if !u.CheckPassword("secret") || u.CheckPassword("wrong") {
+		t.Error("check password error")
+	}
+
+	if err := CreateOrUpdateUser(fakeZkConn, productName, &User{Name: "bad", Categories: []string{"unknown"}}); err == nil {
+		t.Error("should return error for unknown category")
+	}
+
+	if err := RemoveUser(fakeZkConn, productName, "app"); err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+
+	users, err = Users(fakeZkConn, productName)
+	if err != nil || len(users) != 0 {
+		t.Error("user should be removed", err)
+	}
+}
@@ -16,17 +16,62 @@ type LivePool struct {
 	pool *redispool.ConnectionPool
 }
 
+const (
+	DefaultCapacity    = 16
+	DefaultIdleTimeout = 120 * time.Second
+)
+
 type CachePool struct {
 	mu    sync.RWMutex
 	pools map[string]*LivePool
+
+	capacity    int
+	idleTimeout time.Duration
 }
 
 func NewCachePool() *CachePool {
 	return &CachePool{
-		pools: make(map[string]*LivePool),
+		pools:       make(map[string]*LivePool),
+		capacity:    DefaultCapacity,
+		idleTimeout: DefaultIdleTimeout,
 	}
 }
 
+// SetOptions resizes all pools, pools added later use the new values too.
+func (cp *CachePool) SetOptions(capacity int, idleTimeout time.Duration) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.capacity = capacity
+	cp.idleTimeout = idleTimeout
+
+	for key, pool := range cp.pools {
+		//a pool can not grow over its initial capacity, replace it
+		if int64(capacity) > pool.pool.MaxCap() {
+			cp.pools[key] = cp.newPool(key)
+			go pool.pool.Close()
+			continue
+		}
+
+		if err := pool.pool.SetCapacity(capacity); err != nil {
+			return errors.Annotatef(err, "pool %s", key)
+		}
+		pool.pool.SetIdleTimeout(idleTimeout)
+	}
+
+	return nil
+}
+
+//use it in lock
+func (cp *CachePool) newPool(key string) *LivePool {
+	pool := &LivePool{
+		pool: redispool.NewConnectionPool("redis conn pool", cp.capacity, cp.idleTimeout),
+	}
+
+	pool.pool.Open(redispool.ConnectionCreator(key))
+	return pool
+}
+
 func (cp *CachePool) GetConn(key string) (redispool.PoolConnection, error) {
 	cp.mu.RLock()
 
@@ -60,17 +105,10 @@ func (cp *CachePool) AddPool(key string) error {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 
-	pool, ok := cp.pools[key]
-	if ok {
+	if _, ok := cp.pools[key]; ok {
 		return nil
 	}
-	pool = &LivePool{
-		pool: redispool.NewConnectionPool("redis conn pool", 16, 120*time.Second),
-	}
-
-	pool.pool.Open(redispool.ConnectionCreator(key))
-
-	cp.pools[key] = pool
+	cp.pools[key] = cp.newPool(key)
 
 	return nil
 }
@@ -8,7 +8,6 @@ import (
 	"bytes"
 	"io"
 	"strconv"
-	"strings"
 
 	"github.com/juju/errors"
 	respcoding "github.com/ngaut/resp"
@@ -144,6 +143,14 @@ func (r *Resp) GetOpKeys() (op []byte, keys [][]byte, err error) {
 	return op, keys, errors.Trace(err)
 }
 
+// GetArgs returns all the arguments after the command name.
+func (r *Resp) GetArgs() ([][]byte, error) {
+	if len(r.Multi) == 0 {
+		return nil, nil
+	}
+	return defaultGetKeys(r)
+}
+
 type funGetKeys func(r *Resp) ([][]byte, error)
 
 func defaultGetKeys(r *Resp) ([][]byte, error) {
@@ -217,27 +224,145 @@ func Parse(r *bufio.Reader) (*Resp, error) {
 			return nil, errors.New("redis protocol error, " + string(line))
 		}
 
-		resp.Type = MultiResp
-		strs := strings.Split(string(line), " ")
+		args, err := splitInlineArgs(line[:len(line)-2]) //strip \r\n
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 
+		resp.Type = MultiResp
 		resp.Raw = make([]byte, 0, 20)
 		resp.Raw = append(resp.Raw, '*')
-		resp.Raw = append(resp.Raw, []byte(strconv.Itoa(len(strs)))...)
+		resp.Raw = append(resp.Raw, Itoa(len(args))...)
 		resp.Raw = append(resp.Raw, NEW_LINE...)
-		for i := 0; i < len(strs); i++ { //last element is \r\n
-			if str := strings.TrimSpace(strs[i]); len(str) > 0 {
-				b, err := respcoding.Marshal(str)
-				if err != nil {
-					return nil, errors.New("redis protocol error, " + string(line))
-				}
-
-				resp.Multi = append(resp.Multi, &Resp{Type: BulkResp, Raw: b})
+		for _, arg := range args {
+			b, err := respcoding.Marshal(arg)
+			if err != nil {
+				return nil, errors.New("redis protocol error, " + string(line))
 			}
+
+			resp.Multi = append(resp.Multi, &Resp{Type: BulkResp, Raw: b})
 		}
 		return resp, nil
 	}
 }
 
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\n', '\r', '\t', '\v', '\f':
+		return true
+	default:
+		return false
+	}
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// splitInlineArgs splits an inline (telnet) command line into arguments,
+// following the same rules as sdssplitargs in redis-server: arguments are
+// separated by whitespace, double quoted strings support \xHH and the usual
+// backslash escapes, single quoted strings only support \'. A closing quote
+// must be followed by a space or the end of line.
+func splitInlineArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	p := 0
+	for {
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return args, nil
+		}
+
+		inq := false  //inside "double quotes"
+		insq := false //inside 'single quotes'
+		done := false
+		cur := make([]byte, 0, 16)
+		for !done {
+			if inq {
+				if p == len(line) {
+					return nil, errors.New("redis protocol error, unbalanced quotes in request")
+				}
+				if line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' &&
+					isHexDigit(line[p+2]) && isHexDigit(line[p+3]) {
+					cur = append(cur, hexDigitToInt(line[p+2])*16+hexDigitToInt(line[p+3]))
+					p += 3
+				} else if line[p] == '\\' && p+1 < len(line) {
+					p++
+					switch line[p] {
+					case 'n':
+						cur = append(cur, '\n')
+					case 'r':
+						cur = append(cur, '\r')
+					case 't':
+						cur = append(cur, '\t')
+					case 'b':
+						cur = append(cur, '\b')
+					case 'a':
+						cur = append(cur, '\a')
+					default:
+						cur = append(cur, line[p])
+					}
+				} else if line[p] == '"' {
+					//closing quote must be followed by a space or nothing at all
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, errors.New("redis protocol error, unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					cur = append(cur, line[p])
+				}
+			} else if insq {
+				if p == len(line) {
+					return nil, errors.New("redis protocol error, unbalanced quotes in request")
+				}
+				if line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					cur = append(cur, '\'')
+				} else if line[p] == '\'' {
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, errors.New("redis protocol error, unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					cur = append(cur, line[p])
+				}
+			} else {
+				if p == len(line) {
+					break
+				}
+				switch line[p] {
+				case ' ', '\n', '\r', '\t', '\v', '\f':
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					cur = append(cur, line[p])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+
+		args = append(args, cur)
+	}
+}
+
 func IsLetter(c byte) bool {
 	if c >= 'a' && c <= 'z' {
 		return true
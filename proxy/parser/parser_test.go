@@ -6,6 +6,7 @@ package parser
 import (
 	"bufio"
 	"bytes"
+	"strconv"
 	"testing"
 
 	"github.com/juju/errors"
@@ -130,6 +131,22 @@ func TestParser(t *testing.T) {
 	}
 }
 
+func TestArgs(t *testing.T) {
+	s := "*5\r\n$11\r\nZINTERSTORE\r\n$3\r\ndst\r\n$1\r\n1\r\n$3\r\nsrc\r\n$7\r\nWEIGHTS\r\n"
+	resp, err := Parse(bufio.NewReader(bytes.NewBufferString(s)))
+	if err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+
+	args, err := resp.GetArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 4 || string(args[0]) != "dst" || string(args[3]) != "WEIGHTS" {
+		t.Fatalf("args not match, got %q", args)
+	}
+}
+
 func TestEval(t *testing.T) {
 	table := []string{
 		"*3\r\n$4\r\nEVAL\r\n$31\r\nreturn {1,2,{3,'Hello World!'}}\r\n$1\r\n0\r\n",
@@ -210,3 +227,61 @@ func TestParserInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestParserInline(t *testing.T) {
+	table := []struct {
+		line string
+		args []string
+	}{
+		{"mget a b c\r\n", []string{"mget", "a", "b", "c"}},
+		{"set  a\t b   \r\n", []string{"set", "a", "b"}},
+		{"set a \"hello world\"\r\n", []string{"set", "a", "hello world"}},
+		{"set a 'it\\'s'\r\n", []string{"set", "a", "it's"}},
+		{"set a \"\\x41\\x62\\n\"\r\n", []string{"set", "a", "Ab\n"}},
+		{"set a \"\"\r\n", []string{"set", "a", ""}},
+	}
+
+	for _, v := range table {
+		r := bufio.NewReader(bytes.NewBuffer([]byte(v.line)))
+		resp, err := Parse(r)
+		if err != nil {
+			t.Fatal(errors.ErrorStack(err))
+		}
+
+		if len(resp.Multi) != len(v.args) {
+			t.Fatalf("argument count not match, expect %d got %d, %q", len(v.args), len(resp.Multi), v.line)
+		}
+
+		for i, arg := range v.args {
+			b, err := resp.Multi[i].Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect := "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+			if string(b) != expect {
+				t.Errorf("not match, expect %q, got %q", expect, string(b))
+			}
+		}
+
+		b, err := resp.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(b, []byte("*"+strconv.Itoa(len(v.args))+"\r\n")) {
+			t.Errorf("header not match, %q", string(b))
+		}
+	}
+
+	invalid := []string{
+		"set a \"hello\r\n",
+		"set a 'hello\r\n",
+		"set a \"hello\"world\r\n",
+	}
+
+	for _, s := range invalid {
+		r := bufio.NewReader(bytes.NewBuffer([]byte(s)))
+		if _, err := Parse(r); err == nil {
+			t.Error("should return error", s)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package readcache
+
+import (
+	"bytes"
+	"container/list"
+	"hash/crc32"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of invalidation generation stripes, see Generation
+const genStripes = 1024
+
+type Config struct {
+	Prefixes []string
+	Commands []string
+	TTL      time.Duration
+	MaxBytes int64
+}
+
+type entry struct {
+	key      string
+	slot     int
+	replies  map[string][]byte //sub key (op + field) -> reply
+	expireAt map[string]time.Time
+	size     int64
+	elem     *list.Element
+}
+
+// Cache is a proxy local LRU cache of read replies. Entries are grouped by
+// key, so a write to a key drops every cached reply for it.
+type Cache struct {
+	mu       sync.Mutex
+	prefixes [][]byte
+	commands map[string]struct{}
+	ttl      time.Duration
+	maxBytes int64
+
+	entries map[string]*entry
+	lru     *list.List
+	size    int64
+	gens    [genStripes]uint64
+	tracked map[string]struct{}
+
+	hits   int64
+	misses int64
+}
+
+func NewCache(conf *Config) *Cache {
+	c := &Cache{
+		commands: make(map[string]struct{}),
+		ttl:      conf.TTL,
+		maxBytes: conf.MaxBytes,
+		entries:  make(map[string]*entry),
+		lru:      list.New(),
+	}
+
+	for _, p := range conf.Prefixes {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			c.prefixes = append(c.prefixes, []byte(p))
+		}
+	}
+
+	for _, cmd := range conf.Commands {
+		if cmd = strings.TrimSpace(cmd); len(cmd) > 0 {
+			c.commands[strings.ToUpper(cmd)] = struct{}{}
+		}
+	}
+
+	return c
+}
+
+// Match reports whether key is under one of the cached prefixes.
+func (c *Cache) Match(key []byte) bool {
+	for _, p := range c.prefixes {
+		if bytes.HasPrefix(key, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Cacheable reports whether the reply of op on key may be cached.
+func (c *Cache) Cacheable(op string, key []byte) bool {
+	if _, ok := c.commands[op]; !ok {
+		return false
+	}
+
+	return c.Match(key)
+}
+
+func subKey(op string, args [][]byte) string {
+	if len(args) == 0 {
+		return op
+	}
+
+	return op + "\x00" + string(bytes.Join(args, []byte{0}))
+}
+
+// Get returns the cached reply of op with args on key.
+func (c *Cache) Get(op string, key []byte, args [][]byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[string(key)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	sk := subKey(op, args)
+	reply, ok := e.replies[sk]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	if time.Now().After(e.expireAt[sk]) {
+		c.removeReply(e, sk)
+		c.misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e.elem)
+	c.hits++
+	return reply, true
+}
+
+func stripe(key []byte) int {
+	return int(crc32.ChecksumIEEE(key) % genStripes)
+}
+
+// Generation returns the invalidation generation for key. It must be read
+// before the request is sent to the backend and passed to Put, so a reply
+// that raced with a write is never cached.
+func (c *Cache) Generation(key []byte) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gens[stripe(key)]
+}
+
+// Put caches the reply of op with args on key, unless key was invalidated
+// since gen was read.
+func (c *Cache) Put(slot int, op string, key []byte, args [][]byte, gen uint64, reply []byte) {
+	sk := subKey(op, args)
+	size := int64(len(key) + len(sk) + len(reply))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gens[stripe(key)] != gen {
+		return
+	}
+
+	e, ok := c.entries[string(key)]
+	if !ok {
+		e = &entry{
+			key:      string(key),
+			slot:     slot,
+			replies:  make(map[string][]byte),
+			expireAt: make(map[string]time.Time),
+			size:     int64(len(key)),
+		}
+		e.elem = c.lru.PushFront(e)
+		c.entries[e.key] = e
+		c.size += e.size
+	} else {
+		c.removeReply(e, sk)
+		c.lru.MoveToFront(e.elem)
+	}
+
+	buf := make([]byte, len(reply))
+	copy(buf, reply)
+	e.replies[sk] = buf
+	e.expireAt[sk] = time.Now().Add(c.ttl)
+	e.size += int64(len(sk) + len(buf))
+	c.size += int64(len(sk) + len(buf))
+
+	for c.size > c.maxBytes {
+		c.removeEntry(c.lru.Back().Value.(*entry))
+	}
+}
+
+// Invalidate drops every cached reply for key.
+func (c *Cache) Invalidate(key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gens[stripe(key)]++
+	if e, ok := c.entries[string(key)]; ok {
+		c.removeEntry(e)
+	}
+}
+
+// FlushSlot drops every cached reply for keys in slot.
+func (c *Cache) FlushSlot(slot int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.gens {
+		c.gens[i]++
+	}
+
+	for _, e := range c.entries {
+		if e.slot == slot {
+			c.removeEntry(e)
+		}
+	}
+}
+
+// Flush drops every cached reply.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.gens {
+		c.gens[i]++
+	}
+
+	c.entries = make(map[string]*entry)
+	c.lru.Init()
+	c.size = 0
+}
+
+// use it in lock
+func (c *Cache) removeReply(e *entry, sk string) {
+	reply, ok := e.replies[sk]
+	if !ok {
+		return
+	}
+
+	delete(e.replies, sk)
+	delete(e.expireAt, sk)
+	e.size -= int64(len(sk) + len(reply))
+	c.size -= int64(len(sk) + len(reply))
+}
+
+// use it in lock
+func (c *Cache) removeEntry(e *entry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+type Stats struct {
+	Keys   int
+	Bytes  int64
+	Hits   int64
+	Misses int64
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{Keys: len(c.entries), Bytes: c.size, Hits: c.hits, Misses: c.misses}
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package readcache
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestCache(maxBytes int64) *Cache {
+	return NewCache(&Config{
+		Prefixes: []string{"hot:"},
+		Commands: []string{"get", "HGET"},
+		TTL:      time.Minute,
+		MaxBytes: maxBytes,
+	})
+}
+
+func TestCacheable(t *testing.T) {
+	c := newTestCache(1024)
+	if !c.Cacheable("GET", []byte("hot:a")) || !c.Cacheable("HGET", []byte("hot:a")) {
+		t.Error("should be cacheable")
+	}
+
+	if c.Cacheable("SET", []byte("hot:a")) || c.Cacheable("GET", []byte("cold:a")) {
+		t.Error("should not be cacheable")
+	}
+}
+
+func TestGetPutInvalidate(t *testing.T) {
+	c := newTestCache(1024)
+	key := []byte("hot:a")
+	reply := []byte("$1\r\n1\r\n")
+
+	gen := c.Generation(key)
+	c.Put(0, "GET", key, nil, gen, reply)
+	if b, ok := c.Get("GET", key, nil); !ok || string(b) != string(reply) {
+		t.Fatal("should hit")
+	}
+
+	if _, ok := c.Get("HGET", key, [][]byte{[]byte("f")}); ok {
+		t.Error("should miss other sub key")
+	}
+
+	c.Invalidate(key)
+	if _, ok := c.Get("GET", key, nil); ok {
+		t.Error("should miss after invalidate")
+	}
+
+	//reply raced with a write, must not be cached
+	c.Put(0, "GET", key, nil, gen, reply)
+	if _, ok := c.Get("GET", key, nil); ok {
+		t.Error("stale generation should not be cached")
+	}
+}
+
+func TestFlushSlot(t *testing.T) {
+	c := newTestCache(1024)
+	c.Put(1, "GET", []byte("hot:a"), nil, c.Generation([]byte("hot:a")), []byte("+a\r\n"))
+	c.Put(2, "GET", []byte("hot:b"), nil, c.Generation([]byte("hot:b")), []byte("+b\r\n"))
+
+	c.FlushSlot(1)
+	if _, ok := c.Get("GET", []byte("hot:a"), nil); ok {
+		t.Error("slot 1 should be flushed")
+	}
+	if _, ok := c.Get("GET", []byte("hot:b"), nil); !ok {
+		t.Error("slot 2 should be kept")
+	}
+}
+
+func TestEvict(t *testing.T) {
+	c := newTestCache(64)
+	for _, k := range []string{"hot:a", "hot:b", "hot:c"} {
+		key := []byte(k)
+		c.Put(0, "GET", key, nil, c.Generation(key), []byte("$10\r\n0123456789\r\n"))
+	}
+
+	st := c.Stats()
+	if st.Bytes > 64 {
+		t.Errorf("memory cap exceeded, %d", st.Bytes)
+	}
+
+	if _, ok := c.Get("GET", []byte("hot:a"), nil); ok {
+		t.Error("oldest key should be evicted")
+	}
+	if _, ok := c.Get("GET", []byte("hot:c"), nil); !ok {
+		t.Error("newest key should be kept")
+	}
+}
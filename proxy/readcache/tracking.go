@@ -0,0 +1,151 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package readcache
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
+)
+
+const (
+	invalidateChannel = "__redis__:invalidate"
+	maxTrackBackoff   = 30 * time.Second
+)
+
+// Track subscribes to the CLIENT TRACKING invalidation messages of the redis
+// server at addr, in broadcast mode for the cached prefixes, so writes that do
+// not go through this proxy also invalidate the cache. Servers without
+// CLIENT TRACKING support are only covered by the ttl.
+func (c *Cache) Track(addr string) {
+	c.mu.Lock()
+	if c.tracked == nil {
+		c.tracked = make(map[string]struct{})
+	}
+	if _, ok := c.tracked[addr]; ok {
+		c.mu.Unlock()
+		return
+	}
+	c.tracked[addr] = struct{}{}
+	c.mu.Unlock()
+
+	go c.track(addr)
+}
+
+func (c *Cache) track(addr string) {
+	backoff := time.Second
+	for {
+		supported, err := c.trackOnce(addr)
+		if !supported {
+			log.Warningf("client tracking not supported by %s, read cache relies on ttl, %v", addr, err)
+			return
+		}
+
+		//invalidation messages may be lost
+		c.Flush()
+		log.Warningf("client tracking on %s broken, retry in %v, %v", addr, backoff, err)
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxTrackBackoff {
+			backoff = maxTrackBackoff
+		}
+	}
+}
+
+func (c *Cache) trackOnce(addr string) (supported bool, err error) {
+	sub, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return true, errors.Trace(err)
+	}
+	defer sub.Close()
+
+	id, err := redis.Int64(sub.Do("CLIENT", "ID"))
+	if err != nil {
+		_, isReplyErr := err.(redis.Error)
+		return !isReplyErr, errors.Trace(err)
+	}
+
+	//tracking is bound to the connection which enables it, keep it open
+	ctl, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return true, errors.Trace(err)
+	}
+	defer ctl.Close()
+
+	args := []interface{}{"TRACKING", "ON", "REDIRECT", id, "BCAST"}
+	for _, p := range c.prefixes {
+		args = append(args, "PREFIX", p)
+	}
+	if _, err := ctl.Do("CLIENT", args...); err != nil {
+		_, isReplyErr := err.(redis.Error)
+		return !isReplyErr, errors.Trace(err)
+	}
+
+	if err := sub.Send("SUBSCRIBE", invalidateChannel); err != nil {
+		return true, errors.Trace(err)
+	}
+	if err := sub.Flush(); err != nil {
+		return true, errors.Trace(err)
+	}
+
+	//the subscriber never notices the control connection is gone, ping it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := ctl.Do("PING"); err != nil {
+					sub.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	log.Infof("client tracking on %s enabled, redirect to %d", addr, id)
+
+	for {
+		reply, err := redis.Values(sub.Receive())
+		if err != nil {
+			return true, errors.Trace(err)
+		}
+
+		c.handleInvalidate(reply)
+	}
+}
+
+func (c *Cache) handleInvalidate(reply []interface{}) {
+	if len(reply) < 3 {
+		return
+	}
+
+	if kind, _ := redis.String(reply[0], nil); kind != "message" {
+		return
+	}
+
+	//a nil payload means the server flushed its keyspace
+	if reply[2] == nil {
+		c.Flush()
+		return
+	}
+
+	keys, err := redis.Values(reply[2], nil)
+	if err != nil {
+		log.Warning("invalid invalidation message", err)
+		return
+	}
+
+	for _, k := range keys {
+		if key, ok := k.([]byte); ok {
+			c.Invalidate(key)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	stdlog "log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ledisdb/xcodis/models"
+	"github.com/ledisdb/xcodis/proxy/parser"
+
+	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
+)
+
+var (
+	NOPERM_CMD_BYTES = []byte("-NOPERM this user has no permissions to run this command\r\n")
+	NOPERM_KEY_BYTES = []byte("-NOPERM this user has no permissions to access one of the keys used as arguments\r\n")
+)
+
+//random password used by the proxy itself, e.g. multi key operations
+func newInternalPassword() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+
+	return "internal-" + hex.EncodeToString(b)
+}
+
+func (s *Server) loadUsers() error {
+	users, err := s.top.GetUsers()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	m := make(map[string]*models.User, len(users))
+	for i := range users {
+		m[users[i].Name] = &users[i]
+	}
+	s.users.Store(m)
+
+	log.Infof("%d users loaded", len(m))
+	return nil
+}
+
+func (s *Server) getUser(name string) *models.User {
+	m, _ := s.users.Load().(map[string]*models.User)
+	return m[name]
+}
+
+func (s *Server) authEnabled() bool {
+	m, _ := s.users.Load().(map[string]*models.User)
+	return len(s.password) > 0 || len(m) > 0
+}
+
+//keys to check against user key patterns, found in the arguments after the
+//command name by its key positions
+func aclKeys(op string, args [][]byte) [][]byte {
+	spec, ok := commandKeys[op]
+	if !ok {
+		spec = keySpec{first: 0, last: 0, step: 1}
+	}
+
+	var keys [][]byte
+	if spec.step > 0 {
+		last := spec.last
+		if last < 0 {
+			last += len(args)
+		}
+		for i := spec.first; i <= last && i < len(args); i += spec.step {
+			keys = append(keys, args[i])
+		}
+	}
+
+	if spec.numkeys > 0 && spec.numkeys < len(args) {
+		rest := args[spec.numkeys+1:]
+		//a malformed count checks all the arguments left
+		if n, err := strconv.Atoi(string(args[spec.numkeys])); err == nil && n >= 0 && n <= len(rest) {
+			rest = rest[:n]
+		}
+		keys = append(keys, rest...)
+	}
+	return keys
+}
+
+//returns the denial reply, nil if allowed
+func aclCheck(u *models.User, op string, args [][]byte) []byte {
+	category := cmdCategory(op)
+	if len(category) == 0 {
+		return nil
+	}
+
+	if u.ReadOnly && category != models.CMD_CATEGORY_READ {
+		return NOPERM_CMD_BYTES
+	}
+
+	allowed := false
+	for _, c := range u.Categories {
+		if c == category {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return NOPERM_CMD_BYTES
+	}
+
+	if len(u.KeyPatterns) == 0 {
+		return nil
+	}
+
+	for _, key := range aclKeys(op, args) {
+		matched := false
+		for _, pattern := range u.KeyPatterns {
+			if globMatch([]byte(pattern), key) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return NOPERM_KEY_BYTES
+		}
+	}
+
+	return nil
+}
+
+//the keys of the request are looked up in all its arguments, the keys
+//routed by may leave some out
+func (s *Server) checkACL(c *session, op string, resp *parser.Resp) (allowed bool, err error) {
+	if len(c.user) == 0 {
+		return true, nil
+	}
+
+	args, err := resp.GetArgs()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	u := s.getUser(c.user)
+	reply := NOPERM_CMD_BYTES
+	if u != nil {
+		reply = aclCheck(u, op, args)
+	}
+	if reply == nil {
+		return true, nil
+	}
+
+	s.counter.Add("ACLDenied", 1)
+	s.auditf("denied user=%s product=%s client=%s op=%s keys=%q reason=%s", c.user, s.top.ProductName,
+		c.RemoteAddr().String(), op, aclKeys(op, args), strings.TrimSpace(string(reply[1:])))
+
+	return false, errors.Trace(writeReply2Client(c, reply, s.netTimeout()))
+}
+
+func (s *Server) auditf(format string, v ...interface{}) {
+	if s.audit == nil {
+		log.Warningf("[audit] "+format, v...)
+		return
+	}
+
+	s.audit.Output(2, fmt.Sprintf(format, v...))
+}
+
+func openAuditLog(path string) (*stdlog.Logger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return stdlog.New(f, "", stdlog.LstdFlags), nil
+}
+
+// globMatch matches key against a redis style glob pattern,
+// supporting '*', '?', '[...]' and '\' escape.
+func globMatch(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if globMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			end := 1
+			for end < len(pattern) && pattern[end] != ']' {
+				end++
+			}
+			if end == len(pattern) { //no closing bracket, match literally
+				if key[0] != '[' {
+					return false
+				}
+				key = key[1:]
+				break
+			}
+			class := pattern[1:end]
+			not := len(class) > 0 && class[0] == '^'
+			if not {
+				class = class[1:]
+			}
+			match := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					if class[i] <= key[0] && key[0] <= class[i+2] {
+						match = true
+					}
+					i += 2
+				} else if class[i] == key[0] {
+					match = true
+				}
+			}
+			if match == not {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[end:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			key = key[1:]
+		}
+		pattern = pattern[1:]
+	}
+
+	return len(key) == 0
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ledisdb/xcodis/models"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tbl := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"h[ae]llo", "hello", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"user:/1", "user:/1", true},
+	}
+
+	for _, v := range tbl {
+		if globMatch([]byte(v.pattern), []byte(v.key)) != v.match {
+			t.Errorf("pattern %s, key %s, expect %v", v.pattern, v.key, v.match)
+		}
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	reader := &models.User{
+		Name:        "reader",
+		Categories:  []string{models.CMD_CATEGORY_READ, models.CMD_CATEGORY_WRITE},
+		KeyPatterns: []string{"app:*"},
+		ReadOnly:    true,
+	}
+
+	tbl := []struct {
+		op    string
+		keys  []string
+		reply []byte
+	}{
+		{"PING", nil, nil},
+		{"GET", []string{"app:1"}, nil},
+		{"GET", []string{"other:1"}, NOPERM_KEY_BYTES},
+		{"SET", []string{"app:1", "v"}, NOPERM_CMD_BYTES},
+		{"MGET", []string{"app:1", "other:1"}, NOPERM_KEY_BYTES},
+		{"EVAL", []string{"app:1"}, NOPERM_CMD_BYTES},
+		{"SINTER", []string{"app:1", "other:1"}, NOPERM_KEY_BYTES},
+	}
+
+	for _, v := range tbl {
+		var keys [][]byte
+		for _, k := range v.keys {
+			keys = append(keys, []byte(k))
+		}
+		if reply := aclCheck(reader, v.op, keys); !bytes.Equal(reply, v.reply) {
+			t.Errorf("%s %v, expect %q, got %q", v.op, v.keys, v.reply, reply)
+		}
+	}
+
+	//destinations are checked too
+	writer := &models.User{Name: "writer", Categories: []string{models.CMD_CATEGORY_WRITE}, KeyPatterns: []string{"app:*"}}
+	for _, args := range [][]string{
+		{"SMOVE", "app:1", "other:1", "m"},
+		{"RPOPLPUSH", "app:1", "other:1"},
+		{"ZUNIONSTORE", "other:1", "1", "app:1"},
+	} {
+		var keys [][]byte
+		for _, k := range args[1:] {
+			keys = append(keys, []byte(k))
+		}
+		if reply := aclCheck(writer, args[0], keys); !bytes.Equal(reply, NOPERM_KEY_BYTES) {
+			t.Errorf("%v, expect %q, got %q", args, NOPERM_KEY_BYTES, reply)
+		}
+	}
+
+	writer = &models.User{Name: "writer", Categories: []string{models.CMD_CATEGORY_WRITE}}
+	if reply := aclCheck(writer, "MSET", [][]byte{[]byte("a"), []byte("1")}); reply != nil {
+		t.Error("writer should be allowed to MSET")
+	}
+	if reply := aclCheck(writer, "GET", [][]byte{[]byte("a")}); reply == nil {
+		t.Error("writer should not be allowed to GET")
+	}
+}
+
+func TestACLKeys(t *testing.T) {
+	tbl := []struct {
+		op   string
+		args string
+		keys string
+	}{
+		{"GET", "a", "a"},
+		{"SET", "a v", "a"},
+		{"HMSET", "a f v", "a"},
+		{"PING", "", ""},
+		{"MSET", "a 1 b 2", "a b"},
+		{"DEL", "a b c", "a b c"},
+		{"SMOVE", "a b m", "a b"},
+		{"RPOPLPUSH", "a b", "a b"},
+		{"ZINTERSTORE", "d 2 a b WEIGHTS 1 2 AGGREGATE MAX", "d a b"},
+		{"ZUNIONSTORE", "d 1 a", "d a"},
+		{"EVAL", "script 2 a b arg", "a b"},
+		{"EVALSHA", "sha 0 arg", ""},
+		{"XDUMP", "KV a", "a"},
+		//a malformed count checks all the arguments left
+		{"EVAL", "script x a b", "a b"},
+		{"EVAL", "script 5 a b", "a b"},
+	}
+
+	for _, v := range tbl {
+		var args [][]byte
+		for _, a := range strings.Fields(v.args) {
+			args = append(args, []byte(a))
+		}
+		if keys := bytes.Join(aclKeys(v.op, args), []byte(" ")); string(keys) != v.keys {
+			t.Errorf("%s %s, expect keys %q, got %q", v.op, v.args, v.keys, keys)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	log "github.com/ngaut/logging"
+	"github.com/ngaut/zkhelper"
+)
+
+// hash slots of redis cluster, only used to spread clients over proxies
+const clusterSlotNum = 16384
+
+var CLUSTERDOWN_BYTES = []byte("-CLUSTERDOWN no online proxy\r\n")
+
+// a proxy presented as a redis cluster master, every proxy accepts any key
+// so the claimed range only balances the clients
+type clusterNode struct {
+	id    string
+	host  string
+	port  int
+	start int
+	end   int
+	self  bool
+}
+
+func clusterNodeId(productName string, proxyId string) string {
+	sum := sha1.Sum([]byte(productName + "/" + proxyId))
+	return hex.EncodeToString(sum[:])
+}
+
+// clusterLayout splits the cluster slots evenly over proxies ordered by id.
+func clusterLayout(productName string, proxies []models.ProxyInfo, self string) []clusterNode {
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].Id < proxies[j].Id
+	})
+
+	nodes := make([]clusterNode, 0, len(proxies))
+	for _, pi := range proxies {
+		host, port, err := net.SplitHostPort(pi.Addr)
+		if err != nil {
+			continue
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			continue
+		}
+
+		nodes = append(nodes, clusterNode{
+			id:   clusterNodeId(productName, pi.Id),
+			host: host,
+			port: p,
+			self: pi.Id == self,
+		})
+	}
+
+	for i := range nodes {
+		nodes[i].start = i * clusterSlotNum / len(nodes)
+		nodes[i].end = (i+1)*clusterSlotNum/len(nodes) - 1
+	}
+
+	return nodes
+}
+
+func onlineProxy(pi *models.ProxyInfo) bool {
+	return pi.State == models.PROXY_STATE_ONLINE
+}
+
+func (s *Server) clusterNodes() ([]clusterNode, error) {
+	proxies, ok := s.proxies.Load().([]models.ProxyInfo)
+	if !ok {
+		//not loaded by watchProxies yet
+		var err error
+		if proxies, err = s.top.GetProxyList(onlineProxy); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	//sorted by clusterLayout, the cached list is shared
+	proxies = append([]models.ProxyInfo(nil), proxies...)
+	return clusterLayout(s.top.ProductName, proxies, s.pi.Id), nil
+}
+
+// watchProxies keeps the online proxies of the product cached for CLUSTER
+// commands. The proxy list and every proxy node are watched once, a fired
+// watch reloads the list. The cached list is kept while zk is unavailable.
+func (s *Server) watchProxies() {
+	evtbus := make(chan interface{}, 100)
+	watched := make(map[string]bool) //paths with a watch not fired yet
+	for {
+		if err := s.loadProxies(evtbus, watched); err != nil {
+			log.Warning("load proxy list failed", errors.ErrorStack(err))
+			time.Sleep(time.Second)
+		} else {
+			e := <-evtbus
+			delete(watched, GetEventPath(e))
+		}
+
+	drain: //one reload for all events pending
+		for {
+			select {
+			case e := <-evtbus:
+				delete(watched, GetEventPath(e))
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+//watch the proxy list and nodes not watched yet, then read online proxies
+func (s *Server) loadProxies(evtbus chan interface{}, watched map[string]bool) error {
+	base := models.GetProxyPath(s.top.ProductName)
+	if !watched[base] {
+		names, err := s.top.WatchChildren(base, evtbus)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		watched[base] = true
+
+		for _, name := range names {
+			p := path.Join(base, name)
+			if watched[p] {
+				continue
+			}
+			_, err := s.top.WatchNode(p, evtbus)
+			if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+				return errors.Trace(err)
+			}
+			if err == nil {
+				watched[p] = true
+			}
+		}
+	}
+
+	proxies, err := s.top.GetProxyList(onlineProxy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.proxies.Store(proxies)
+	return nil
+}
+
+func writeArrayHeader(b *bytes.Buffer, n int) {
+	fmt.Fprintf(b, "*%d\r\n", n)
+}
+
+func writeBulk(b *bytes.Buffer, s string) {
+	fmt.Fprintf(b, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeInt(b *bytes.Buffer, n int) {
+	fmt.Fprintf(b, ":%d\r\n", n)
+}
+
+func clusterSlotsReply(nodes []clusterNode) []byte {
+	var b bytes.Buffer
+	writeArrayHeader(&b, len(nodes))
+	for _, n := range nodes {
+		writeArrayHeader(&b, 3)
+		writeInt(&b, n.start)
+		writeInt(&b, n.end)
+		writeArrayHeader(&b, 3)
+		writeBulk(&b, n.host)
+		writeInt(&b, n.port)
+		writeBulk(&b, n.id)
+	}
+	return b.Bytes()
+}
+
+func clusterShardsReply(nodes []clusterNode) []byte {
+	var b bytes.Buffer
+	writeArrayHeader(&b, len(nodes))
+	for _, n := range nodes {
+		writeArrayHeader(&b, 4)
+		writeBulk(&b, "slots")
+		writeArrayHeader(&b, 2)
+		writeInt(&b, n.start)
+		writeInt(&b, n.end)
+		writeBulk(&b, "nodes")
+		writeArrayHeader(&b, 1)
+		writeArrayHeader(&b, 14)
+		writeBulk(&b, "id")
+		writeBulk(&b, n.id)
+		writeBulk(&b, "port")
+		writeInt(&b, n.port)
+		writeBulk(&b, "ip")
+		writeBulk(&b, n.host)
+		writeBulk(&b, "endpoint")
+		writeBulk(&b, n.host)
+		writeBulk(&b, "role")
+		writeBulk(&b, "master")
+		writeBulk(&b, "replication-offset")
+		writeInt(&b, 0)
+		writeBulk(&b, "health")
+		writeBulk(&b, "online")
+	}
+	return b.Bytes()
+}
+
+func clusterNodesReply(nodes []clusterNode) []byte {
+	var lines bytes.Buffer
+	for _, n := range nodes {
+		flags := "master"
+		if n.self {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&lines, "%s %s:%d@%d %s - 0 0 1 connected %d-%d\n",
+			n.id, n.host, n.port, n.port+10000, flags, n.start, n.end)
+	}
+
+	var b bytes.Buffer
+	writeBulk(&b, lines.String())
+	return b.Bytes()
+}
+
+func clusterInfoReply(nodes []clusterNode) []byte {
+	state := "ok"
+	assigned := clusterSlotNum
+	if len(nodes) == 0 {
+		state = "fail"
+		assigned = 0
+	}
+
+	info := fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\ncluster_slots_pfail:0\r\ncluster_slots_fail:0\r\n"+
+		"cluster_known_nodes:%d\r\ncluster_size:%d\r\ncluster_current_epoch:1\r\ncluster_my_epoch:1\r\n",
+		state, assigned, assigned, len(nodes), len(nodes))
+
+	var b bytes.Buffer
+	writeBulk(&b, info)
+	return b.Bytes()
+}
+
+// handleCluster answers CLUSTER subcommands as a redis cluster made of the
+// online proxies of the product, so cluster mode clients spread over them.
+func (s *Server) handleCluster(c *session, args [][]byte) error {
+	if len(args) == 0 {
+		return errors.Trace(writeReply2Client(c,
+			[]byte("-ERR wrong number of arguments for 'cluster' command\r\n"), s.netTimeout()))
+	}
+
+	sub := strings.ToUpper(string(args[0]))
+	if sub == "KEYSLOT" {
+		if len(args) != 2 {
+			return errors.Trace(writeReply2Client(c,
+				[]byte("-ERR wrong number of arguments for 'cluster|keyslot' command\r\n"), s.netTimeout()))
+		}
+		var b bytes.Buffer
+		writeInt(&b, s.mapKey2Slot(args[1]))
+		return errors.Trace(writeReply2Client(c, b.Bytes(), s.netTimeout()))
+	}
+
+	nodes, err := s.clusterNodes()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var reply []byte
+	switch sub {
+	case "SLOTS":
+		reply = clusterSlotsReply(nodes)
+	case "SHARDS":
+		reply = clusterShardsReply(nodes)
+	case "NODES":
+		reply = clusterNodesReply(nodes)
+	case "INFO":
+		reply = clusterInfoReply(nodes)
+	case "MYID":
+		var b bytes.Buffer
+		writeBulk(&b, clusterNodeId(s.top.ProductName, s.pi.Id))
+		reply = b.Bytes()
+	default:
+		reply = []byte(fmt.Sprintf("-ERR unknown subcommand '%s'\r\n", strings.ToLower(sub)))
+	}
+
+	if len(nodes) == 0 && sub != "INFO" && sub != "MYID" {
+		reply = CLUSTERDOWN_BYTES
+	}
+
+	return errors.Trace(writeReply2Client(c, reply, s.netTimeout()))
+}
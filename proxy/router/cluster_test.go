@@ -0,0 +1,117 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+	"github.com/ledisdb/xcodis/proxy/parser"
+	topo "github.com/ledisdb/xcodis/proxy/router/topology"
+
+	"github.com/ngaut/zkhelper"
+)
+
+func TestClusterLayout(t *testing.T) {
+	proxies := []models.ProxyInfo{
+		{Id: "proxy_3", Addr: "host3:19000"},
+		{Id: "proxy_1", Addr: "host1:19000"},
+		{Id: "proxy_2", Addr: "host2:19001"},
+	}
+
+	nodes := clusterLayout("test", proxies, "proxy_2")
+	if len(nodes) != 3 {
+		t.Fatal(nodes)
+	}
+
+	next := 0
+	for i, n := range nodes {
+		if n.start != next || n.end < n.start {
+			t.Fatalf("node %d has invalid range %d-%d", i, n.start, n.end)
+		}
+		next = n.end + 1
+		if len(n.id) != 40 {
+			t.Error("invalid node id", n.id)
+		}
+	}
+	if next != clusterSlotNum {
+		t.Error("not all slots covered")
+	}
+
+	if nodes[0].host != "host1" || !nodes[1].self || nodes[1].port != 19001 {
+		t.Errorf("unexpected nodes %+v", nodes)
+	}
+
+	for _, reply := range [][]byte{clusterSlotsReply(nodes), clusterShardsReply(nodes),
+		clusterNodesReply(nodes), clusterInfoReply(nodes)} {
+		r := bufio.NewReader(bytes.NewReader(reply))
+		if _, err := parser.Parse(r); err != nil {
+			t.Fatal(err, string(reply))
+		}
+		if r.Buffered() != 0 {
+			t.Error("trailing data in reply", string(reply))
+		}
+	}
+
+	//skip bulk header
+	lines := strings.Split(strings.TrimSpace(string(clusterNodesReply(nodes))), "\n")[1:]
+	if !strings.Contains(lines[1], "myself,master") || !strings.HasSuffix(lines[2], "connected 10922-16383") {
+		t.Errorf("unexpected cluster nodes %q", lines)
+	}
+}
+
+func TestWatchProxies(t *testing.T) {
+	fakeZkConn := zkhelper.NewConn()
+	s := &Server{top: topo.NewTopo("cluster", "", func(string) (zkhelper.Conn, error) { return fakeZkConn, nil })}
+
+	p1 := &models.ProxyInfo{Id: "proxy_1", Addr: "host1:19000", State: models.PROXY_STATE_ONLINE}
+	p2 := &models.ProxyInfo{Id: "proxy_2", Addr: "host2:19000", State: models.PROXY_STATE_OFFLINE}
+	for _, pi := range []*models.ProxyInfo{p1, p2} {
+		if _, err := models.CreateProxyInfo(fakeZkConn, "cluster", pi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go s.watchProxies()
+
+	online := func(n int) {
+		for i := 0; i < 100; i++ {
+			if proxies, ok := s.proxies.Load().([]models.ProxyInfo); ok && len(proxies) == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%d online proxies expected, got %v", n, s.proxies.Load())
+	}
+	online(1)
+
+	//state changed
+	p2.State = models.PROXY_STATE_ONLINE
+	data, _ := json.Marshal(p2)
+	if _, err := fakeZkConn.Set(path.Join(models.GetProxyPath("cluster"), p2.Id), data, -1); err != nil {
+		t.Fatal(err)
+	}
+	online(2)
+
+	//proxy added and removed
+	p3 := &models.ProxyInfo{Id: "proxy_3", Addr: "host3:19000", State: models.PROXY_STATE_ONLINE}
+	if _, err := models.CreateProxyInfo(fakeZkConn, "cluster", p3); err != nil {
+		t.Fatal(err)
+	}
+	online(3)
+	if err := fakeZkConn.Delete(path.Join(models.GetProxyPath("cluster"), p1.Id), -1); err != nil {
+		t.Fatal(err)
+	}
+	online(2)
+
+	nodes, err := s.clusterNodes()
+	if err != nil || len(nodes) != 2 || nodes[0].id != clusterNodeId("cluster", "proxy_2") {
+		t.Error("cluster nodes not match", nodes, err)
+	}
+}
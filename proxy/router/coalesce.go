@@ -0,0 +1,127 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescer merges identical in-flight read requests for the same slot, only
+// the first one (the leader) is sent to backend and its reply is fanned out to
+// the others. Only read-only commands can be enabled, LoadConf rejects others.
+// A request only joins a flight started after the last write to its keys, so
+// a client always reads its own writes.
+type coalescer struct {
+	mu       sync.Mutex
+	commands map[string]struct{}
+	window   time.Duration
+	flights  map[string]*flight
+
+	//write generations of keys, striped like the read cache
+	gens [coalesceGenStripes]uint64
+}
+
+const coalesceGenStripes = 1024
+
+type flight struct {
+	start time.Time
+	gen   uint64 //sum of the generations of its keys when it started
+	done  chan struct{}
+	reply []byte //nil if leader failed
+}
+
+func newCoalescer(commands []string, window time.Duration) *coalescer {
+	c := &coalescer{
+		commands: make(map[string]struct{}),
+		window:   window,
+		flights:  make(map[string]*flight),
+	}
+
+	for _, cmd := range commands {
+		if cmd = strings.TrimSpace(cmd); len(cmd) > 0 {
+			c.commands[strings.ToUpper(cmd)] = struct{}{}
+		}
+	}
+
+	return c
+}
+
+func (c *coalescer) enabled(op string) bool {
+	_, ok := c.commands[op]
+	return ok
+}
+
+func coalesceKey(slot int, request []byte) string {
+	return strconv.Itoa(slot) + "\x00" + string(request)
+}
+
+func coalesceStripe(key []byte) int {
+	return int(crc32.ChecksumIEEE(key) % coalesceGenStripes)
+}
+
+// generations only grow, so the sum changes whenever one of keys is written
+func (c *coalescer) generation(keys [][]byte) uint64 {
+	var gen uint64
+	for _, k := range keys {
+		gen += c.gens[coalesceStripe(k)]
+	}
+	return gen
+}
+
+// written ends the flights of keys, a write to them has completed.
+func (c *coalescer) written(keys [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range keys {
+		c.gens[coalesceStripe(k)]++
+	}
+}
+
+// join returns the in-flight request for key reading keys, or starts a new
+// one and makes the caller its leader. A flight older than the wait window,
+// or started before the last write to keys, is not joined.
+func (c *coalescer) join(key string, keys [][]byte) (f *flight, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gen := c.generation(keys)
+	if f, ok := c.flights[key]; ok && f.gen == gen && time.Since(f.start) < c.window {
+		return f, false
+	}
+
+	f = &flight{start: time.Now(), gen: gen, done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// finish publishes the leader reply, reply is nil if the leader failed.
+func (c *coalescer) finish(key string, f *flight, reply []byte) {
+	c.mu.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mu.Unlock()
+
+	f.reply = reply
+	close(f.done)
+}
+
+// wait returns the leader reply, or false if the leader failed or did not
+// answer within the wait window.
+func (c *coalescer) wait(f *flight) ([]byte, bool) {
+	timer := time.NewTimer(c.window)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return f.reply, f.reply != nil
+	case <-timer.C:
+		return nil, false
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer([]string{"get", " HGET"}, 100*time.Millisecond)
+	if !c.enabled("GET") || !c.enabled("HGET") || c.enabled("SET") {
+		t.Fatal("enabled commands not match")
+	}
+
+	keys := [][]byte{[]byte("a")}
+	key := coalesceKey(1, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	f, leader := c.join(key, keys)
+	if !leader {
+		t.Fatal("first request should be leader")
+	}
+
+	f2, leader := c.join(key, keys)
+	if leader || f2 != f {
+		t.Fatal("second request should join the leader")
+	}
+
+	if _, leader := c.join(coalesceKey(2, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n")), keys); !leader {
+		t.Error("other slot should not be coalesced")
+	}
+
+	go c.finish(key, f, []byte("$1\r\n1\r\n"))
+	if b, ok := c.wait(f2); !ok || string(b) != "$1\r\n1\r\n" {
+		t.Error("should get leader reply", string(b))
+	}
+
+	//leader failed
+	f, _ = c.join(key, keys)
+	c.finish(key, f, nil)
+	if _, ok := c.wait(f); ok {
+		t.Error("failed leader should not be fanned out")
+	}
+
+	//leader too slow
+	f, _ = c.join(key, keys)
+	start := time.Now()
+	if _, ok := c.wait(f); ok || time.Since(start) < c.window {
+		t.Error("should wait for the whole window")
+	}
+	c.finish(key, f, nil)
+}
+
+func TestCoalesceAfterWrite(t *testing.T) {
+	c := newCoalescer([]string{"GET"}, time.Second)
+	keys := [][]byte{[]byte("a")}
+	key := coalesceKey(1, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	f, _ := c.join(key, keys)
+
+	//a write to another key does not end the flight
+	c.written([][]byte{[]byte("b")})
+	if f2, leader := c.join(key, keys); leader || f2 != f {
+		t.Fatal("should join the flight")
+	}
+
+	//the flight may have read a before the write completed
+	c.written(keys)
+	f3, leader := c.join(key, keys)
+	if !leader || f3 == f {
+		t.Fatal("should not join a flight sent before the write")
+	}
+	if f4, leader := c.join(key, keys); leader || f4 != f3 {
+		t.Fatal("should join the flight sent after the write")
+	}
+
+	c.finish(key, f, nil)
+	c.finish(key, f3, nil)
+}
+
+func TestCoalesceCommandsConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.ini")
+	tbl := []struct {
+		commands string
+		valid    bool
+	}{
+		{"get, hget,ZRANGE", true},
+		{"GET,SET", false},
+		{"incr", false},
+		{"LPOP", false},
+		{"PING", false},
+	}
+	for _, v := range tbl {
+		conf := "zk=localhost:2181\nproduct=test\nproxy_id=p1\ncoalesce_commands=" + v.commands + "\n"
+		if err := ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConf(file); (err == nil) != v.valid {
+			t.Errorf("coalesce_commands=%s: valid %v, got %v", v.commands, v.valid, err)
+		}
+	}
+}
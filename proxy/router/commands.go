@@ -0,0 +1,172 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"github.com/ledisdb/xcodis/models"
+)
+
+// positions of the keys in the arguments after the command name, like
+// COMMAND INFO: keys from first to last every step, a negative last counts
+// from the end and a zero step means no keys at fixed positions. If numkeys
+// is set, the argument at it is the number of the keys following it.
+type keySpec struct {
+	first, last, step int
+	numkeys           int
+}
+
+// key positions of the commands checked by user ACLs, the first argument is
+// the only key of commands not listed.
+var commandKeys = make(map[string]keySpec)
+
+// command table, category of every command checked by user ACLs.
+// connection commands have no category and are always allowed,
+// commands not listed are treated as writes.
+var commandCategory = make(map[string]string)
+
+func init() {
+	regCategory := func(category string, cmds ...string) {
+		for _, cmd := range cmds {
+			commandCategory[cmd] = category
+		}
+	}
+
+	regCategory("",
+		"PING",
+		"QUIT",
+		"SELECT",
+		"AUTH",
+		"ECHO",
+		"CLUSTER",
+		"READONLY",
+		"READWRITE",
+		"ASKING")
+
+	regCategory(models.CMD_CATEGORY_READ,
+		//kv
+		"EXISTS",
+		"GET",
+		"MGET",
+		"TTL",
+		"PTTL",
+		"TYPE",
+		"GETRANGE",
+		"STRLEN",
+		"BITCOUNT",
+		"BITPOS",
+		"GETBIT",
+
+		//hash
+		"HEXISTS",
+		"HGET",
+		"HGETALL",
+		"HKEYS",
+		"HLEN",
+		"HMGET",
+		"HVALS",
+		"HSTRLEN",
+		"HTTL",
+		"HKEYEXISTS",
+
+		//list
+		"LINDEX",
+		"LLEN",
+		"LRANGE",
+		"LTTL",
+		"LKEYEXISTS",
+
+		//set
+		"SCARD",
+		"SISMEMBER",
+		"SMEMBERS",
+		"SRANDMEMBER",
+		"SDIFF",
+		"SINTER",
+		"SUNION",
+		"STTL",
+		"SKEYEXISTS",
+
+		//zset
+		"ZCARD",
+		"ZCOUNT",
+		"ZRANGE",
+		"ZRANGEBYSCORE",
+		"ZRANK",
+		"ZREVRANGE",
+		"ZREVRANK",
+		"ZREVRANGEBYSCORE",
+		"ZRANGEBYLEX",
+		"ZLEXCOUNT",
+		"ZSCORE",
+		"ZTTL",
+		"ZKEYEXISTS")
+
+	regCategory(models.CMD_CATEGORY_ADMIN,
+		"DUMP",
+		"XDUMP",
+		"RESTORE",
+		"XRESTORE",
+		"MIGRATE",
+		"XMIGRATE",
+		"EVAL",
+		"EVALSHA",
+		"SLOTSNUM",
+		"SLOTSCHECK")
+
+	regKeys := func(spec keySpec, cmds ...string) {
+		for _, cmd := range cmds {
+			commandKeys[cmd] = spec
+		}
+	}
+
+	regKeys(keySpec{first: 0, last: -1, step: 2},
+		"MSET",
+		"MSETNX")
+
+	regKeys(keySpec{first: 0, last: -1, step: 1},
+		"MGET",
+		"DEL",
+		"EXISTS",
+		"LMCLEAR",
+		"HMCLEAR",
+		"SMCLEAR",
+		"ZMCLEAR",
+		"SDIFF",
+		"SDIFFSTORE",
+		"SINTER",
+		"SINTERSTORE",
+		"SUNION",
+		"SUNIONSTORE")
+
+	//source and destination
+	regKeys(keySpec{first: 0, last: 1, step: 1},
+		"SMOVE",
+		"RPOPLPUSH",
+		"RENAME",
+		"RENAMENX")
+
+	//destination numkeys key [key ...] [WEIGHTS ...] [AGGREGATE ...]
+	regKeys(keySpec{first: 0, last: 0, step: 1, numkeys: 1},
+		"ZINTERSTORE",
+		"ZUNIONSTORE")
+
+	//script numkeys key [key ...] arg [arg ...]
+	regKeys(keySpec{numkeys: 1},
+		"EVAL",
+		"EVALSHA")
+
+	//the data type comes first on ledisdb
+	regKeys(keySpec{first: 1, last: 1, step: 1},
+		"XDUMP",
+		"XRESTORE")
+}
+
+func cmdCategory(op string) string {
+	category, ok := commandCategory[op]
+	if !ok {
+		return models.CMD_CATEGORY_WRITE
+	}
+
+	return category
+}
@@ -8,15 +8,17 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	stdlog "log"
 	"os/exec"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/ledisdb/xcodis/utils"
-
-	// "github.com/ledisdb/xcodis/models"
+	"github.com/ledisdb/xcodis/config"
+	"github.com/ledisdb/xcodis/coordinator"
+	"github.com/ledisdb/xcodis/models"
 	"github.com/ledisdb/xcodis/proxy/parser"
+	"github.com/ledisdb/xcodis/proxy/readcache"
 	"github.com/ledisdb/xcodis/proxy/router/topology"
 
 	log "github.com/ngaut/logging"
@@ -40,6 +42,9 @@ var blackList = []string{
 var (
 	blackListCommand = make(map[string]struct{})
 	OK_BYTES         = []byte("+OK\r\n")
+	NOAUTH_BYTES     = []byte("-NOAUTH Authentication required.\r\n")
+	WRONGPASS_BYTES  = []byte("-WRONGPASS invalid username-password pair\r\n")
+	TRYAGAIN_BYTES   = []byte("-TRYAGAIN slot is being migrated, please try again\r\n")
 )
 
 func init() {
@@ -62,8 +67,8 @@ func isMulOp(op string) bool {
 	}
 }
 
-func validSlot(i int) bool {
-	if i < 0 || i >= slot_num {
+func (s *Server) validSlot(i int) bool {
+	if i < 0 || i >= s.getSlotNum() {
 		return false
 	}
 
@@ -81,6 +86,21 @@ func writeMigrateKeyCmd(w io.Writer, addr string, timeoutMs int, key []byte, slo
 	return errors.Trace(err)
 }
 
+//MIGRATE host port "" db timeout KEYS key [key ...], redis 3.0.6 and later
+func writeMigrateKeysCmd(w io.Writer, addr string, timeoutMs int, keys [][]byte, slotIndex int) error {
+	hostPort := strings.Split(addr, ":")
+	if len(hostPort) != 2 {
+		return errors.Errorf("invalid address " + addr)
+	}
+	args := []string{"migrate", hostPort[0], hostPort[1], "", strconv.Itoa(slotIndex), strconv.Itoa(int(timeoutMs)), "keys"}
+	for _, key := range keys {
+		args = append(args, string(key))
+	}
+	respW := respcoding.NewRESPWriter(w)
+	err := respW.WriteCommand(args...)
+	return errors.Trace(err)
+}
+
 func ledisWriteMigrateKeyCmd(w io.Writer, addr string, timeoutMs int, group string, key []byte, slotIndex int) error {
 	hostPort := strings.Split(addr, ":")
 	if len(hostPort) != 2 {
@@ -138,18 +158,33 @@ func handleSpecCommand(cmd string, clientWriter DeadlineReadWriter, keys [][]byt
 }
 
 func write2Client(redisReader *bufio.Reader, clientWriter io.Writer) (redisErr error, clientErr error) {
+	_, redisErr, clientErr = write2ClientReply(redisReader, clientWriter)
+	return
+}
+
+//same as write2Client, but also returns the reply
+func write2ClientReply(redisReader *bufio.Reader, clientWriter io.Writer) (reply []byte, redisErr error, clientErr error) {
 	resp, err := parser.Parse(redisReader)
 	if err != nil {
-		return errors.Trace(err), errors.Trace(err)
+		return nil, errors.Trace(err), errors.Trace(err)
 	}
 
 	b, err := resp.Bytes()
 	if err != nil {
-		return errors.Trace(err), errors.Trace(err)
+		return nil, errors.Trace(err), errors.Trace(err)
 	}
 
 	_, err = clientWriter.Write(b)
-	return nil, errors.Trace(err)
+	return b, nil, errors.Trace(err)
+}
+
+func writeReply2Client(c DeadlineReadWriter, reply []byte, timeout int) error {
+	if err := c.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err := c.Write(reply)
+	return errors.Trace(err)
 }
 
 func write2Redis(resp *parser.Resp, redisWriter io.Writer) error {
@@ -174,25 +209,31 @@ type BufioDeadlineReadWriter interface {
 }
 
 func forward(c DeadlineReadWriter, redisConn BufioDeadlineReadWriter, resp *parser.Resp, timeout int) (redisErr error, clientErr error) {
+	_, redisErr, clientErr = forwardReply(c, redisConn, resp, timeout)
+	return
+}
+
+//same as forward, but also returns the reply sent to client
+func forwardReply(c DeadlineReadWriter, redisConn BufioDeadlineReadWriter, resp *parser.Resp, timeout int) (reply []byte, redisErr error, clientErr error) {
 	redisReader := redisConn.BufioReader()
 	if err := redisConn.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
-		return errors.Trace(err), errors.Trace(err)
+		return nil, errors.Trace(err), errors.Trace(err)
 	}
 
 	if err := write2Redis(resp, redisConn); err != nil {
-		return errors.Trace(err), errors.Trace(err)
+		return nil, errors.Trace(err), errors.Trace(err)
 	}
 
 	if err := redisConn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
-		return errors.Trace(err), errors.Trace(err)
+		return nil, errors.Trace(err), errors.Trace(err)
 	}
 
 	if err := c.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 
 	// read and parse redis response
-	return write2Client(redisReader, c)
+	return write2ClientReply(redisReader, c)
 }
 
 func selectDB(redisConn BufioDeadlineReadWriter, dbIndex int, timeout int) error {
@@ -288,15 +329,15 @@ func recordResponseTime(c *stats.Counters, d time.Duration) {
 	}
 }
 
-func checkMigrateKeys(op string, keys [][]byte) (int, [][]byte, error) {
+func (s *Server) checkMigrateKeys(op string, keys [][]byte) (int, [][]byte, error) {
 	switch op {
 	case "ZINTERSTORE", "ZUNIONSTORE", "EVAL", "EVALSHA", "SDIFF", "SDIFFSTORE",
 		"SINTER", "SINTERSTORE", "SUNION", "SUNIONSTORE":
-		slot, err := checkKeysInSameSlot(keys)
+		slot, err := s.checkKeysInSameSlot(keys)
 		return slot, keys, err
 	default:
 		//we will use the first key for migration
-		return mapKey2Slot(keys[0]), keys[0:1], nil
+		return s.mapKey2Slot(keys[0]), keys[0:1], nil
 	}
 }
 
@@ -304,40 +345,151 @@ type Conf struct {
 	proxyId     string
 	productName string
 	zkAddr      string
+	zkRoot      string //root of xcodis nodes, set by NewProxy
 	f           topology.ZkFactory
 	net_timeout int //seconds
 	broker      string
 	slot_num    int
+	db_num      int //backend databases, slot_num if not set
+
+	readCache *readcache.Config //nil if disabled
+
+	coalesceCommands []string
+	coalesceWindow   int //milliseconds
+
+	premigrateWait int //milliseconds, max wait of a request to a pre migrate slot
+
+	snapshotFile string //topology snapshot, disabled if empty
+	staleStart   bool   //serve from the snapshot until zk is available
+
+	password        string //AUTH password, empty if auth disabled
+	concurrentLimit int
+
+	auditLogFile string //opened by NewProxy, acl denials go to main log if empty
+	auditLog     *stdlog.Logger
+
+	multiTenant bool
+	tenants     []*Conf //one per product when serving several products
+
+	file *config.Config //nil if not loaded from a file
 }
 
+//stats var name, suffixed with product name in multi tenant mode
+func (c *Conf) statsName(name string) string {
+	if !c.multiTenant {
+		return name
+	}
+
+	return name + "_" + c.productName
+}
+
+// LoadConf reads and validates configFile, it has no side effects so it is
+// also used to check a file before starting or reloading.
 func LoadConf(configFile string) (*Conf, error) {
-	srvConf := &Conf{}
-	conf, err := utils.InitConfigFromFile(configFile)
+	file, err := config.Xcodis.Load(configFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, errors.Trace(err)
+	}
+
+	invalid := func(format string, args ...interface{}) error {
+		return errors.Errorf("invalid config: %s in %s", fmt.Sprintf(format, args...), configFile)
 	}
 
-	srvConf.productName, _ = conf.ReadString("product", "test")
-	if len(srvConf.productName) == 0 {
-		log.Fatalf("invalid config: product entry is missing in %s", configFile)
+	srvConf := &Conf{file: file}
+	srvConf.productName = file.String("product")
+	if len(srvConf.productName) == 0 && len(file.List("products")) == 0 {
+		return nil, invalid("product entry is missing")
 	}
-	srvConf.zkAddr, _ = conf.ReadString("zk", "")
+	srvConf.zkAddr = file.String("zk")
 	if len(srvConf.zkAddr) == 0 {
-		log.Fatalf("invalid config: need zk entry is missing in %s", configFile)
+		return nil, invalid("zk entry is missing")
+	}
+
+	//zookeeper or etcd servers in zk entry
+	f, err := coordinator.NewFactory(file.String("coordinator"), file.String("zk_auth"))
+	if err != nil {
+		return nil, invalid("%v", err)
 	}
-	srvConf.proxyId, _ = conf.ReadString("proxy_id", "")
+	srvConf.f = topology.ZkFactory(f)
+
+	srvConf.zkRoot = file.String("zk_root")
+	if err := models.CheckRootPath(srvConf.zkRoot); err != nil {
+		return nil, invalid("%v", err)
+	}
+	srvConf.proxyId = file.String("proxy_id")
 	if len(srvConf.proxyId) == 0 {
-		log.Fatalf("invalid config: need proxy_id entry is missing in %s", configFile)
+		return nil, invalid("proxy_id entry is missing")
+	}
+
+	srvConf.broker = file.String("broker")
+
+	srvConf.slot_num = file.Int("slot_num")
+	srvConf.db_num = file.Int("db_num")
+	if srvConf.db_num == 0 {
+		srvConf.db_num = srvConf.slot_num
+	}
+	meta := models.SlotMeta{SlotNum: srvConf.slot_num, DBNum: srvConf.db_num}
+	if err := meta.Validate(); err != nil {
+		return nil, invalid("%v", err)
+	}
+
+	srvConf.net_timeout = int(file.Duration("net_timeout") / time.Second)
+
+	srvConf.premigrateWait = int(file.Duration("premigrate_wait_ms") / time.Millisecond)
+
+	srvConf.snapshotFile = file.String("topology_snapshot")
+	srvConf.staleStart = file.Bool("stale_start")
+	if srvConf.staleStart && len(srvConf.snapshotFile) == 0 {
+		return nil, invalid("stale_start needs topology_snapshot")
 	}
 
-	srvConf.broker, _ = conf.ReadString("broker", "ledisdb")
-	if len(srvConf.broker) == 0 {
-		log.Fatalf("invalid config: need broker entry is missing in %s", configFile)
+	//read only commands whose identical concurrent requests are merged
+	srvConf.coalesceCommands = file.List("coalesce_commands")
+	for _, cmd := range srvConf.coalesceCommands {
+		//merged writes would reach the backend only once
+		if cmdCategory(strings.ToUpper(strings.TrimSpace(cmd))) != models.CMD_CATEGORY_READ {
+			return nil, invalid("coalesce_commands %s is not a read command", cmd)
+		}
+	}
+	srvConf.coalesceWindow = int(file.Duration("coalesce_window_ms") / time.Millisecond)
+
+	//proxy local read cache, disabled if no prefix configured
+	if prefixes := file.List("read_cache_prefix"); len(prefixes) > 0 {
+		srvConf.readCache = &readcache.Config{
+			Prefixes: prefixes,
+			Commands: file.List("read_cache_commands"),
+			TTL:      file.Duration("read_cache_ttl_ms"),
+			MaxBytes: file.Size("read_cache_max_bytes"),
+		}
 	}
 
-	srvConf.slot_num, _ = conf.ReadInt("slot_num", 16)
+	srvConf.password = file.String("password")
+	srvConf.auditLogFile = file.String("acl_audit_log")
+	srvConf.concurrentLimit = file.Int("concurrent_limit")
+
+	//multi tenant, every product has its own password used by AUTH to select it
+	passwords := make(map[string]struct{})
+	for _, name := range file.List("products") {
+		t := *srvConf
+		t.productName = name
+		t.multiTenant = true
+		t.tenants = nil
+		if len(t.snapshotFile) > 0 {
+			t.snapshotFile += "." + name
+		}
+		t.password = file.String(name + ".password")
+		if !file.IsSet(name+".password") || len(t.password) == 0 {
+			return nil, invalid("%s.password entry is missing", name)
+		}
+		if _, ok := passwords[t.password]; ok {
+			return nil, invalid("%s.password is used by another product", name)
+		}
+		passwords[t.password] = struct{}{}
 
-	srvConf.net_timeout, _ = conf.ReadInt("net_timeout", 5)
+		t.broker = file.String(name + ".broker")
+		t.concurrentLimit = file.Int(name + ".concurrent_limit")
+		srvConf.tenants = append(srvConf.tenants, &t)
+	}
 
 	return srvConf, nil
 }
@@ -87,15 +87,16 @@ func TestRecordResponseTime(t *testing.T) {
 }
 
 func TestValidSlot(t *testing.T) {
-	if validSlot(-1) {
+	s := &Server{slotNum: 16, dbNum: 16}
+	if s.validSlot(-1) {
 		t.Error("should be invalid")
 	}
 
-	if validSlot(1024) {
+	if s.validSlot(1024) {
 		t.Error("should be invalid")
 	}
 
-	if !validSlot(0) {
+	if !s.validSlot(0) {
 		t.Error("should be valid")
 	}
 }
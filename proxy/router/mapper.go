@@ -4,40 +4,68 @@
 package router
 
 import (
-	"bytes"
-	"hash/crc32"
-
 	"fmt"
-	// "github.com/ledisdb/xcodis/models"
-)
+	"sync/atomic"
 
-const (
-	HASHTAG_START = '{'
-	HASHTAG_END   = '}'
+	"github.com/ledisdb/xcodis/models"
 )
 
-func mapKey2Slot(key []byte) int {
-	hashKey := key
-	//hash tag support
-	htagStart := bytes.IndexByte(key, HASHTAG_START)
-	if htagStart >= 0 {
-		htagEnd := bytes.IndexByte(key[htagStart:], HASHTAG_END)
-		if htagEnd >= 0 {
-			hashKey = key[htagStart+1 : htagStart+htagEnd]
+//per slot counters, indexed up to the slot count
+type slotCounters struct {
+	waiting []int64 //sessions waiting for pre migrate
+	ops     []int64 //requests dispatched
+}
+
+func (s *Server) getSlotNum() int {
+	return int(atomic.LoadInt32(&s.slotNum))
+}
+
+func (s *Server) counters() *slotCounters {
+	c, _ := s.slotCounters.Load().(*slotCounters)
+	return c
+}
+
+//use it in lock, the counters grow before the slot count so requests always
+//find theirs, counts of existing slots are carried over
+func (s *Server) setSlotNum(n int) {
+	old := s.counters()
+	if old == nil || len(old.ops) < n {
+		c := &slotCounters{waiting: make([]int64, n), ops: make([]int64, n)}
+		if old != nil {
+			for i := range old.ops {
+				c.waiting[i] = atomic.LoadInt64(&old.waiting[i])
+				c.ops[i] = atomic.LoadInt64(&old.ops[i])
+			}
 		}
+		s.slotCounters.Store(c)
 	}
+	atomic.StoreInt32(&s.slotNum, int32(n))
+}
+
+//a product whose slots were expanded since the slot count served has a
+//multiple of them on the same databases
+func (s *Server) expandedLayout(m *models.SlotMeta) bool {
+	n := s.getSlotNum()
+	return m.DBNum == s.dbNum && m.SlotNum > n && m.SlotNum%n == 0
+}
+
+func (s *Server) mapKey2Slot(key []byte) int {
+	return models.MapKey2Slot(key, s.getSlotNum())
+}
 
-	return int(crc32.ChecksumIEEE(hashKey) % uint32(slot_num))
+//backend database of slot, several virtual slots may share one
+func (s *Server) slotDB(i int) int {
+	return i % s.dbNum
 }
 
-func checkKeysInSameSlot(keys [][]byte) (int, error) {
+func (s *Server) checkKeysInSameSlot(keys [][]byte) (int, error) {
 	slot := -1
 
 	for _, key := range keys {
-		s := mapKey2Slot(key)
+		i := s.mapKey2Slot(key)
 		if slot == -1 {
-			slot = s
-		} else if slot != s {
+			slot = i
+		} else if slot != i {
 			return -1, fmt.Errorf("keys not in same slot")
 		}
 	}
@@ -3,20 +3,42 @@
 
 package router
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/ledisdb/xcodis/models"
+)
 
 func TestMapKey2Slot(t *testing.T) {
-	index := mapKey2Slot([]byte("xxx"))
+	s := &Server{slotNum: 16, dbNum: 16}
+	index := s.mapKey2Slot([]byte("xxx"))
 	table := []string{"123{xxx}abc", "{xxx}aa", "x{xxx}"}
 	for _, v := range table {
-		if index != mapKey2Slot([]byte(v)) {
+		if index != s.mapKey2Slot([]byte(v)) {
 			t.Error("not match", v)
 		}
 	}
 }
 
+//tenants of one proxy keep their own layout
+func TestSlotLayoutPerServer(t *testing.T) {
+	foo := &Server{slotNum: 16, dbNum: 16}
+	bar := &Server{slotNum: 1024, dbNum: 16}
+	key := []byte("foo")
+	if foo.mapKey2Slot(key) != models.MapKey2Slot(key, 16) || bar.mapKey2Slot(key) != models.MapKey2Slot(key, 1024) {
+		t.Error("slot of another layout")
+	}
+	if !bar.validSlot(1000) || foo.validSlot(1000) {
+		t.Error("valid slots of another layout")
+	}
+	if bar.slotDB(1000) != 1000%16 {
+		t.Error("db of virtual slot", bar.slotDB(1000))
+	}
+}
+
 func TestKeysInSameSlot(t *testing.T) {
-	if _, err := checkKeysInSameSlot([][]byte{
+	s := &Server{slotNum: 16, dbNum: 16}
+	if _, err := s.checkKeysInSameSlot([][]byte{
 		[]byte("123{xxx}abc"),
 		[]byte("{xxx}aa"),
 		[]byte("x{xxx}"),
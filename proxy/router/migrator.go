@@ -0,0 +1,183 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync"
+)
+
+// max keys remembered as migrated for every slot, the oldest are forgotten first
+const maxMigratedKeys = 100000
+
+// source, destination and db of keys to migrate
+type migrateTarget struct {
+	from  string
+	to    string
+	db    int
+	group string //ledis data type, empty for redis
+}
+
+type migrateQueueKey struct {
+	migrateTarget
+	index int //slot index, several slots may share the db
+	slot  *Slot
+}
+
+type migrateBatch struct {
+	keys [][]byte
+	seen map[string]struct{}
+	done chan struct{}
+	err  error
+}
+
+type migrateQueue struct {
+	running bool
+	next    *migrateBatch //collects keys while a batch is in progress
+}
+
+//a key of one ledis data type does not move the others of the same name
+func migratedKey(group string, key []byte) string {
+	return group + "\x00" + string(key)
+}
+
+// keys of a slot already moved by the current migration of the slot
+type migratedKeys struct {
+	owner *Slot //migration state the keys were moved in
+	keys  map[string]struct{}
+	order []string //ring of keys in insertion order
+	pos   int
+}
+
+// keyMigrator moves keys of migrating slots before requests on them. It
+// skips keys already moved and batches concurrent requests to the same
+// source, while a batch is running the keys of new requests are queued
+// for the next one.
+type keyMigrator struct {
+	mu       sync.Mutex
+	queues   map[migrateQueueKey]*migrateQueue
+	migrated map[int]*migratedKeys //slot -> data type and key
+	maxKeys  int
+
+	exec func(t migrateTarget, keys [][]byte) error
+}
+
+func newKeyMigrator(maxKeys int, exec func(t migrateTarget, keys [][]byte) error) *keyMigrator {
+	return &keyMigrator{
+		queues:   make(map[migrateQueueKey]*migrateQueue),
+		migrated: make(map[int]*migratedKeys),
+		maxKeys:  maxKeys,
+		exec:     exec,
+	}
+}
+
+// pending returns keys not moved yet by the migration of slot, use it in lock
+func (m *keyMigrator) pending(index int, slot *Slot, group string, keys [][]byte) [][]byte {
+	mk := m.migrated[index]
+	if mk == nil || mk.owner != slot {
+		return keys
+	}
+
+	var ret [][]byte
+	for _, key := range keys {
+		if _, ok := mk.keys[migratedKey(group, key)]; !ok {
+			ret = append(ret, key)
+		}
+	}
+
+	return ret
+}
+
+func (m *keyMigrator) markMigrated(index int, slot *Slot, group string, keys [][]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mk := m.migrated[index]
+	if mk == nil || mk.owner != slot {
+		//new migration of the slot, forget keys of the previous one
+		mk = &migratedKeys{owner: slot, keys: make(map[string]struct{})}
+		m.migrated[index] = mk
+	}
+
+	for _, key := range keys {
+		k := migratedKey(group, key)
+		if _, ok := mk.keys[k]; ok {
+			continue
+		}
+
+		if len(mk.order) < m.maxKeys {
+			mk.order = append(mk.order, k)
+		} else {
+			delete(mk.keys, mk.order[mk.pos])
+			mk.order[mk.pos] = k
+			mk.pos = (mk.pos + 1) % len(mk.order)
+		}
+		mk.keys[k] = struct{}{}
+	}
+}
+
+// forget drops the keys moved in slot index, called when the slot changes.
+func (m *keyMigrator) forget(index int) {
+	m.mu.Lock()
+	delete(m.migrated, index)
+	m.mu.Unlock()
+}
+
+// migrate returns once keys are moved to the destination of slot index, it
+// returns (0, nil) if all of them have been moved before.
+func (m *keyMigrator) migrate(index int, slot *Slot, t migrateTarget, keys [][]byte) (int, error) {
+	m.mu.Lock()
+	keys = m.pending(index, slot, t.group, keys)
+	if len(keys) == 0 {
+		m.mu.Unlock()
+		return 0, nil
+	}
+
+	qk := migrateQueueKey{t, index, slot}
+	q := m.queues[qk]
+	if q == nil {
+		q = &migrateQueue{}
+		m.queues[qk] = q
+	}
+	if q.next == nil {
+		q.next = &migrateBatch{seen: make(map[string]struct{}), done: make(chan struct{})}
+	}
+
+	b := q.next
+	for _, key := range keys {
+		if _, ok := b.seen[string(key)]; !ok {
+			b.seen[string(key)] = struct{}{}
+			b.keys = append(b.keys, key)
+		}
+	}
+
+	if !q.running {
+		q.running = true
+		go m.drain(qk, q)
+	}
+	m.mu.Unlock()
+
+	<-b.done
+	return len(keys), b.err
+}
+
+func (m *keyMigrator) drain(qk migrateQueueKey, q *migrateQueue) {
+	for {
+		m.mu.Lock()
+		b := q.next
+		if b == nil {
+			q.running = false
+			delete(m.queues, qk)
+			m.mu.Unlock()
+			return
+		}
+		q.next = nil
+		m.mu.Unlock()
+
+		b.err = m.exec(qk.migrateTarget, b.keys)
+		if b.err == nil {
+			m.markMigrated(qk.index, qk.slot, qk.group, b.keys)
+		}
+		close(b.done)
+	}
+}
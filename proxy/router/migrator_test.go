@@ -0,0 +1,179 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestKeyMigratorBatch(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][][]byte
+	block := make(chan struct{})
+	m := newKeyMigrator(100, func(t migrateTarget, keys [][]byte) error {
+		mu.Lock()
+		batches = append(batches, keys)
+		n := len(batches)
+		mu.Unlock()
+		if n == 1 {
+			<-block
+		}
+		return nil
+	})
+
+	slot := &Slot{}
+	target := migrateTarget{from: "127.0.0.1:6379", to: "127.0.0.1:6380", db: 1}
+
+	first := make(chan struct{})
+	go func() {
+		m.migrate(1, slot, target, [][]byte{[]byte("a")})
+		close(first)
+	}()
+
+	//wait for the first batch to run, later requests are queued for the next one
+	for {
+		mu.Lock()
+		n := len(batches)
+		mu.Unlock()
+		if n == 1 {
+			break
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"b", "c", "b"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if _, err := m.migrate(1, slot, target, [][]byte{[]byte(key)}); err != nil {
+				t.Error(err)
+			}
+		}(key)
+	}
+
+	//all of them joined the pending batch
+	for {
+		m.mu.Lock()
+		var n int
+		for _, q := range m.queues {
+			if q.next != nil {
+				n = len(q.next.seen)
+			}
+		}
+		m.mu.Unlock()
+		if n == 2 {
+			break
+		}
+	}
+
+	close(block)
+	wg.Wait()
+	<-first
+
+	if len(batches) != 2 || len(batches[1]) != 2 {
+		t.Fatalf("unexpected batches %q", batches)
+	}
+
+	//moved keys are skipped
+	if n, err := m.migrate(1, slot, target, [][]byte{[]byte("a"), []byte("c")}); err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+
+	//a new migration of the slot moves them again
+	if n, err := m.migrate(1, &Slot{}, target, [][]byte{[]byte("a")}); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestKeyMigratorError(t *testing.T) {
+	fail := true
+	m := newKeyMigrator(100, func(t migrateTarget, keys [][]byte) error {
+		if fail {
+			return errors.New("ERR migrate failed")
+		}
+		return nil
+	})
+
+	slot := &Slot{}
+	target := migrateTarget{from: "127.0.0.1:6379", to: "127.0.0.1:6380"}
+	if _, err := m.migrate(1, slot, target, [][]byte{[]byte("a")}); err == nil {
+		t.Fatal("should fail")
+	}
+
+	//failed keys are not remembered
+	fail = false
+	if n, err := m.migrate(1, slot, target, [][]byte{[]byte("a")}); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestKeyMigratorBounded(t *testing.T) {
+	m := newKeyMigrator(2, func(t migrateTarget, keys [][]byte) error {
+		return nil
+	})
+
+	slot := &Slot{}
+	target := migrateTarget{from: "127.0.0.1:6379", to: "127.0.0.1:6380"}
+	for _, key := range []string{"a", "b", "c"} {
+		m.migrate(0, slot, target, [][]byte{[]byte(key)})
+	}
+
+	if len(m.migrated[0].keys) != 2 {
+		t.Fatal("migrated keys not bounded")
+	}
+
+	//oldest is forgotten
+	if n, _ := m.migrate(0, slot, target, [][]byte{[]byte("a")}); n != 1 {
+		t.Fatal("a should be migrated again")
+	}
+	if n, _ := m.migrate(0, slot, target, [][]byte{[]byte("c")}); n != 0 {
+		t.Fatal("c should be skipped")
+	}
+}
+
+func TestKeyMigratorSharedDB(t *testing.T) {
+	m := newKeyMigrator(100, func(t migrateTarget, keys [][]byte) error { return nil })
+
+	//virtual slots 1 and 17 migrate at the same time in db 1
+	slot1, slot17 := &Slot{}, &Slot{}
+	target := migrateTarget{from: "127.0.0.1:6379", to: "127.0.0.1:6380", db: 1}
+	if n, err := m.migrate(1, slot1, target, [][]byte{[]byte("a")}); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if n, err := m.migrate(17, slot17, target, [][]byte{[]byte("b")}); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if n, _ := m.migrate(1, slot1, target, [][]byte{[]byte("a")}); n != 0 {
+		t.Error("moved keys of slot 1 forgotten by a migration of slot 17")
+	}
+	if n, _ := m.migrate(17, slot17, target, [][]byte{[]byte("b")}); n != 0 {
+		t.Error("moved keys of slot 17 forgotten")
+	}
+}
+
+func TestKeyMigratorDataTypes(t *testing.T) {
+	m := newKeyMigrator(100, func(t migrateTarget, keys [][]byte) error { return nil })
+
+	slot := &Slot{}
+	kv := migrateTarget{from: "127.0.0.1:6379", to: "127.0.0.1:6380", group: "kv"}
+	hash := kv
+	hash.group = "hash"
+	if n, err := m.migrate(1, slot, kv, [][]byte{[]byte("foo")}); err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if n, err := m.migrate(1, slot, hash, [][]byte{[]byte("foo")}); err != nil || n != 1 {
+		t.Error("hash foo skipped after kv foo moved", n, err)
+	}
+	if n, _ := m.migrate(1, slot, kv, [][]byte{[]byte("foo")}); n != 0 {
+		t.Error("kv foo moved again")
+	}
+
+	//replaced slots start over
+	m.forget(1)
+	if _, ok := m.migrated[1]; ok {
+		t.Error("moved keys of slot 1 kept")
+	}
+}
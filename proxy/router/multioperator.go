@@ -24,9 +24,9 @@ type MulOp struct {
 	wait chan error
 }
 
-func NewMultiOperator(server string) *MultiOperator {
+func NewMultiOperator(server string, password string) *MultiOperator {
 	oper := &MultiOperator{q: make(chan *MulOp, 128)}
-	oper.pool = newPool(server, "")
+	oper.pool = newPool(server, password)
 	for i := 0; i < 64; i++ {
 		go oper.work()
 	}
@@ -43,10 +43,12 @@ func newPool(server, password string) *redis.Pool {
 			if err != nil {
 				return nil, err
 			}
-			//if _, err := c.Do("AUTH", password); err != nil {
-			//	c.Close()
-			//	return nil, err
-			//}
+			if len(password) > 0 {
+				if _, err := c.Do("AUTH", password); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
 			return c, err
 		},
 		//	TestOnBorrow: func(c redis.Conn, t time.Time) error {
@@ -19,7 +19,7 @@ func TestMgetResults(t *testing.T) {
 	}
 	defer redisrv.Close()
 
-	moper := NewMultiOperator(redisrv.Addr())
+	moper := NewMultiOperator(redisrv.Addr(), "")
 	redisrv.Set("a", "a")
 	redisrv.Set("b", "b")
 	redisrv.Set("c", "c")
@@ -60,7 +60,7 @@ func TestDeltResults(t *testing.T) {
 	}
 	defer redisrv.Close()
 
-	moper := NewMultiOperator(redisrv.Addr())
+	moper := NewMultiOperator(redisrv.Addr(), "")
 	redisrv.Set("a", "a")
 	redisrv.Set("b", "b")
 	redisrv.Set("c", "c")
@@ -0,0 +1,148 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+	"github.com/ledisdb/xcodis/proxy/cachepool"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	log "github.com/ngaut/logging"
+	"github.com/ngaut/tokenlimiter"
+	"github.com/ngaut/zkhelper"
+)
+
+func (s *Server) netTimeout() int {
+	return int(atomic.LoadInt32(&s.netTimeoutSec))
+}
+
+func (s *Server) limiter() *tokenlimiter.TokenLimiter {
+	return s.concurrentLimiter.Load().(*tokenlimiter.TokenLimiter)
+}
+
+//requests holding tokens of the old limiter return them to it
+func (s *Server) setConcurrentLimit(limit int) {
+	if limit <= 0 {
+		limit = defaultConcurrentLimit
+	}
+	if limit == s.concurrentLimit {
+		return
+	}
+
+	s.concurrentLimiter.Store(tokenlimiter.NewTokenLimiter(limit))
+	s.concurrentLimit = limit
+}
+
+func (s *Server) allowOp(op string) bool {
+	_, black := s.blackList.Load().(map[string]struct{})[op]
+	return !black
+}
+
+//read and watch the proxy config of the product, an invalid config is
+//logged and ignored. use it in lock
+func (s *Server) reloadProxyConfig() error {
+	c, err := s.top.WatchProxyConfig(s.evtbus)
+	if errors.IsNotValid(errors.Cause(err)) {
+		log.Errorf("proxy config not applied, %s", errors.ErrorStack(err))
+		s.counter.Add("ProxyConfigInvalid", 1)
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if c == nil { //not set or deleted, back to config file values
+		c = &models.ProxyConfig{}
+	}
+	if c.Version == s.pi.ConfigVersion {
+		return nil
+	}
+
+	if err = c.Validate(); err == nil {
+		err = s.applyProxyConfig(c)
+	}
+	if err != nil {
+		log.Errorf("proxy config version %d not applied, %s", c.Version, errors.ErrorStack(err))
+		s.counter.Add("ProxyConfigInvalid", 1)
+		return nil
+	}
+	log.Infof("proxy config version %d applied, %+v", c.Version, c)
+	s.proxyConfig = c
+
+	//not registered yet, published with the proxy info
+	err = s.top.SetProxyConfigVersion(s.pi.Id, c.Version)
+	if err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNoNode) {
+		return errors.Trace(err)
+	}
+
+	s.pi.ConfigVersion = c.Version
+	return nil
+}
+
+func (s *Server) applyProxyConfig(c *models.ProxyConfig) error {
+	poolSize, idleTimeout := c.PoolSize, time.Duration(c.PoolIdleTimeout)*time.Second
+	if poolSize == 0 {
+		poolSize = cachepool.DefaultCapacity
+	}
+	if idleTimeout == 0 {
+		idleTimeout = cachepool.DefaultIdleTimeout
+	}
+	if err := s.pools.SetOptions(poolSize, idleTimeout); err != nil {
+		return errors.Trace(err)
+	}
+
+	timeout := c.NetTimeout
+	if timeout == 0 {
+		timeout = s.conf.net_timeout
+	}
+	atomic.StoreInt32(&s.netTimeoutSec, int32(timeout))
+
+	limit := c.ConcurrentLimit
+	if limit == 0 {
+		limit = s.conf.concurrentLimit
+	}
+	s.setConcurrentLimit(limit)
+
+	blackList := blackListCommand
+	if len(c.BlackList) > 0 {
+		blackList = make(map[string]struct{}, len(c.BlackList))
+		for _, cmd := range c.BlackList {
+			blackList[cmd] = struct{}{}
+		}
+	}
+	s.blackList.Store(blackList)
+
+	//the log is shared by all products, left as is if reset
+	if len(c.LogLevel) > 0 {
+		log.SetLevelByString(c.LogLevel)
+	}
+
+	return nil
+}
+
+//apply the reloadable values of a reloaded config file, proxy config keys
+//set in zk keep overriding them
+func (s *Server) reloadConf(t *Conf) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conf := *s.conf
+	conf.net_timeout = t.net_timeout
+	conf.concurrentLimit = t.concurrentLimit
+	conf.premigrateWait = t.premigrateWait
+	conf.file = t.file
+	s.conf = &conf
+
+	atomic.StoreInt32(&s.premigrateWaitMs, int32(conf.premigrateWait))
+
+	c := s.proxyConfig
+	if c == nil {
+		c = &models.ProxyConfig{}
+	}
+	return errors.Trace(s.applyProxyConfig(c))
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/go-zookeeper/zk"
+	log "github.com/ngaut/logging"
+	"github.com/ngaut/zkhelper"
+)
+
+const (
+	recoverMinBackoff = 100 * time.Millisecond
+	recoverMaxBackoff = 10 * time.Second
+	//open a new zk connection after so many failed attempts in a row
+	recoverReconnectAfter = 3
+)
+
+//read state of all slots from zk
+func (s *Server) loadSlots() (map[int]*Slot, error) {
+	n := s.getSlotNum()
+	slots := make(map[int]*Slot, n)
+	for i := 0; i < n; i++ {
+		slot, err := s.loadSlot(i)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		slots[i] = slot
+	}
+
+	return slots, nil
+}
+
+// recoverTopology retries with backoff until the proxy is registered and in
+// sync with zk again. Requests are served from the current slot table in the
+// meantime. Use it in lock, the lock is released while waiting between
+// attempts so config reloads are not blocked by an unavailable zk.
+func (s *Server) recoverTopology() {
+	atomic.StoreInt32(&s.degraded, 1)
+	s.counter.Add("ZkDegraded", 1)
+	defer atomic.StoreInt32(&s.degraded, 0)
+
+	backoff := recoverMinBackoff
+	for failures := 1; ; failures++ {
+		err := s.resyncTopology()
+		if err == nil {
+			log.Warning("topology recovered", s.pi.Id)
+			return
+		}
+
+		log.Warningf("recover topology failed %d times, %s", failures, errors.ErrorStack(err))
+		if failures%recoverReconnectAfter == 0 {
+			if err := s.top.Reconnect(); err != nil {
+				log.Warning("reconnect to zk failed", err)
+			} else {
+				s.counter.Add("ZkReconnect", 1)
+			}
+		}
+
+		s.mu.Unlock()
+		time.Sleep(backoff)
+		s.mu.Lock()
+		if backoff *= 2; backoff > recoverMaxBackoff {
+			backoff = recoverMaxBackoff
+		}
+	}
+}
+
+//use it in lock
+func (s *Server) resyncTopology() error {
+	if err := s.reloadProxyConfig(); err != nil {
+		return errors.Trace(err)
+	}
+
+	//the ephemeral node is gone if the session expired
+	if _, err := s.top.CreateProxyInfo(&s.pi); err != nil && !zkhelper.ZkErrorEqual(err, zk.ErrNodeExists) {
+		return errors.Trace(err)
+	}
+
+	//watched again, marked offline while disconnected
+	if err := s.handleProxyCommand(); err != nil || s.offline {
+		return errors.Trace(err)
+	}
+
+	nodes, err := s.top.WatchChildren(models.GetWatchActionPath(s.top.ProductName), s.evtbus)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	slots, err := s.loadSlots()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.swapSlots(slots)
+
+	if err := s.loadUsers(); err != nil {
+		return errors.Trace(err)
+	}
+
+	//actions were deleted, the state just read is up to date
+	seqs, err := models.ExtraSeqList(nodes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(seqs) > 0 && s.lastActionSeq > seqs[len(seqs)-1] {
+		s.lastActionSeq = seqs[len(seqs)-1]
+	}
+
+	return errors.Trace(s.replayActions(nodes))
+}
@@ -4,15 +4,17 @@
 package router
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"net"
+	stdlog "log"
 	"os"
 	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	topo "github.com/ledisdb/xcodis/proxy/router/topology"
@@ -20,6 +22,7 @@ import (
 	"github.com/ledisdb/xcodis/models"
 	"github.com/ledisdb/xcodis/proxy/group"
 	"github.com/ledisdb/xcodis/proxy/parser"
+	"github.com/ledisdb/xcodis/proxy/readcache"
 	"github.com/ledisdb/xcodis/proxy/redispool"
 
 	"github.com/ledisdb/xcodis/proxy/cachepool"
@@ -27,16 +30,18 @@ import (
 	"github.com/juju/errors"
 	stats "github.com/ngaut/gostats"
 	log "github.com/ngaut/logging"
-	"github.com/ngaut/tokenlimiter"
 )
 
-var slot_num int = 16
+const defaultConcurrentLimit = 100
 
 type Slot struct {
 	slotInfo    *models.Slot
 	groupInfo   *models.ServerGroup
 	dst         *group.Group
 	migrateFrom *group.Group
+	fromInfo    *models.ServerGroup //group of migrateFrom
+
+	replaced chan struct{} //closed once a new state of the slot is installed
 }
 
 type OnSuicideFun func() error
@@ -44,82 +49,209 @@ type OnSuicideFun func() error
 //change field not allowed whitout Lock()
 type Server struct {
 	mu     sync.RWMutex
-	slots  []*Slot
+	slots  atomic.Value //[]*Slot, never modified once stored, requests read it without lock
 	top    *topo.Topology
 	evtbus chan interface{}
 
 	lastActionSeq     int
+	offline           bool  //marked offline, topology events are ignored
+	degraded          int32 //set while zk is unavailable, slot table may be stale
+	stale             int32 //set while serving from the snapshot file, before zk is read
+	snapshotFile      string
 	pi                models.ProxyInfo
 	startAt           time.Time
 	addr              string
-	concurrentLimiter *tokenlimiter.TokenLimiter
-
-	moper *MultiOperator
-	pools *cachepool.CachePool
+	concurrentLimiter atomic.Value        //*tokenlimiter.TokenLimiter, replaced on proxy config change
+	concurrentLimit   int                 //size of concurrentLimiter
+	blackList         atomic.Value        //denied command -> struct{}
+	conf              *Conf               //config file values, for proxy config keys not set
+	proxyConfig       *models.ProxyConfig //last applied, nil if not set
+
+	moper    *MultiOperator
+	pools    *cachepool.CachePool
+	password string //AUTH password selecting this product, empty if none
+	//password used by the proxy itself, never disclosed
+	internalPassword string
+	users            atomic.Value //user name -> *models.User
+	proxies          atomic.Value //[]models.ProxyInfo online, cached by watchProxies
+	audit            *stdlog.Logger
+	cache            *readcache.Cache //nil if read cache disabled
+	coal             *coalescer       //nil if request coalescing disabled
+
+	slotCounters atomic.Value //*slotCounters, replaced when slots are expanded
+	migrator     *keyMigrator
+	//set if backend does not support MIGRATE with KEYS
+	noMultiKeyMigrate int32
+	premigrateWaitMs  int32 //milliseconds, reloaded on SIGHUP
 	//counter
-	counter     *stats.Counters
-	OnSuicide   OnSuicideFun
-	net_timeout int //seconds
+	counter       *stats.Counters
+	OnSuicide     OnSuicideFun
+	netTimeoutSec int32 //seconds
+
+	broker  string
+	slotNum int32 //slots of the product, from the config, grows when slots are expanded, atomic
+	dbNum   int   //backend databases the slots are mapped onto
+}
+
+func (s *Server) getSlots() []*Slot {
+	slots, _ := s.slots.Load().([]*Slot)
+	return slots
+}
+
+func (s *Server) getSlot(i int) *Slot {
+	slots := s.getSlots()
+	if i < 0 || i >= len(slots) {
+		return nil
+	}
 
-	broker string
+	return slots[i]
+}
+
+//use it in lock, installs a copy of the slot table with updated slots, nil clears a slot.
+//requests in flight keep the routing of the table they have read.
+func (s *Server) swapSlots(updated map[int]*Slot) {
+	s.installSlots(s.getSlotNum(), updated)
+}
+
+//use it in lock, like swapSlots with a table of n slots
+func (s *Server) installSlots(n int, updated map[int]*Slot) {
+	old := s.getSlots()
+	slots := make([]*Slot, n)
+	copy(slots, old)
+	for i, slot := range updated {
+		slots[i] = slot
+	}
+	s.slots.Store(slots)
+
+	for i := range updated {
+		if s.cache != nil {
+			s.cache.FlushSlot(i)
+		}
+		//a migrating slot is replaced too, its keys are moved again
+		if s.migrator != nil {
+			s.migrator.forget(i)
+		}
+		if i < len(old) && old[i] != nil {
+			close(old[i].replaced)
+		}
+	}
 }
 
 func (s *Server) clearSlot(i int) {
-	if !validSlot(i) {
+	if !s.validSlot(i) {
 		return
 	}
 
-	if s.slots[i] != nil {
-		s.slots[i].dst = nil
-		s.slots[i].migrateFrom = nil
-		s.slots[i] = nil
-	}
+	s.swapSlots(map[int]*Slot{i: nil})
 }
 
 //use it in lock
-func (s *Server) fillSlot(i int, force bool) {
-	if !validSlot(i) {
-		return
+func (s *Server) fillSlot(i int, force bool) error {
+	if !s.validSlot(i) {
+		return nil
 	}
 
-	if !force && s.slots[i] != nil { //check
-		log.Fatalf("slot %d already filled, slot: %+v", i, s.slots[i])
-		return
+	if !force && s.getSlot(i) != nil { //check
+		log.Fatalf("slot %d already filled, slot: %+v", i, s.getSlot(i))
+		return nil
 	}
 
 	log.Infof("fill slot %d, force %v", i, force)
 
-	s.clearSlot(i)
+	slot, err := s.loadSlot(i)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	s.swapSlots(map[int]*Slot{i: slot})
+	return nil
+}
 
+//read slot state from zk, the table is not changed
+func (s *Server) loadSlot(i int) (*Slot, error) {
 	slotInfo, groupInfo, err := s.top.GetSlotByIndex(i)
 	if err != nil {
-		log.Fatal(errors.ErrorStack(err))
+		return nil, errors.Trace(err)
+	}
+
+	var from *models.ServerGroup
+	if slotInfo.State.Status == models.SLOT_STATUS_MIGRATE {
+		//get migrate src group and fill it
+		from, err = s.top.GetGroup(slotInfo.State.MigrateStatus.From)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
 
+	s.counter.Add("FillSlot", 1)
+	return newSlot(slotInfo, groupInfo, from), nil
+}
+
+//from is the migrate src group, nil if not migrating
+func newSlot(slotInfo *models.Slot, groupInfo *models.ServerGroup, from *models.ServerGroup) *Slot {
 	slot := &Slot{
 		slotInfo:  slotInfo,
 		dst:       group.NewGroup(*groupInfo),
 		groupInfo: groupInfo,
+		replaced:  make(chan struct{}),
 	}
 
 	//s.pools.AddPool(slot.dst.Master())
 
-	if slot.slotInfo.State.Status == models.SLOT_STATUS_MIGRATE {
-		//get migrate src group and fill it
-		from, err := s.top.GetGroup(slot.slotInfo.State.MigrateStatus.From)
-		if err != nil { //todo: retry ?
-			log.Fatal(err)
-		}
+	if slotInfo.State.Status == models.SLOT_STATUS_MIGRATE && from != nil {
 		slot.migrateFrom = group.NewGroup(*from)
+		slot.fromInfo = from
 		//s.pools.AddPool(slot.migrateFrom.Master())
 	}
 
-	s.slots[i] = slot
-	s.counter.Add("FillSlot", 1)
+	return slot
+}
+
+//wait until slot i is out of pre migrate, false if timeout
+func (s *Server) waitSlotReady(i int, deadline time.Time) bool {
+	for {
+		slot := s.getSlot(i)
+		if slot == nil || slot.slotInfo.State.Status != models.SLOT_STATUS_PRE_MIGRATE {
+			return true
+		}
+
+		d := deadline.Sub(time.Now())
+		if d <= 0 {
+			return false
+		}
+
+		waiting := s.counters().waiting
+		atomic.AddInt64(&waiting[i], 1)
+		timer := time.NewTimer(d)
+		select {
+		case <-slot.replaced:
+		case <-timer.C:
+		}
+		timer.Stop()
+		atomic.AddInt64(&waiting[i], -1)
+	}
+}
+
+func (s *Server) slotWaitingStats() string {
+	return slotStats(s.counters().waiting)
 }
 
-func (s *Server) handleMigrateState(slotIndex int, op string, group string, keys [][]byte) error {
-	shd := s.slots[slotIndex]
+func (s *Server) slotOpsStats() string {
+	return slotStats(s.counters().ops)
+}
+
+//"slot:count" of slots with a positive count, space separated
+func slotStats(counts []int64) string {
+	var b bytes.Buffer
+	for i := range counts {
+		if n := atomic.LoadInt64(&counts[i]); n > 0 {
+			fmt.Fprintf(&b, "%d:%d ", i, n)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func (s *Server) handleMigrateState(slotIndex int, shd *Slot, op string, group string, keys [][]byte) error {
 	if shd.slotInfo.State.Status != models.SLOT_STATUS_MIGRATE {
 		return nil
 	}
@@ -132,67 +264,129 @@ func (s *Server) handleMigrateState(slotIndex int, op string, group string, keys
 		log.Fatalf("the same migrate src and dst, %+v", shd)
 	}
 
-	redisConn, err := s.pools.GetConn(shd.migrateFrom.Master())
+	t := migrateTarget{from: shd.migrateFrom.Master(), to: shd.dst.Master(), db: s.slotDB(slotIndex)}
+	if s.broker == LedisBroker {
+		t.group = group
+	}
+
+	n, err := s.migrator.migrate(slotIndex, shd, t, keys)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if n == 0 {
+		s.counter.Add("MigrateSkipped", 1)
+	}
+
+	return nil
+}
+
+//migrate a batch of keys of a slot, used by keyMigrator
+func (s *Server) migrateKeys(t migrateTarget, keys [][]byte) error {
+	redisConn, err := s.pools.GetConn(t.from)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
 	defer s.pools.ReleaseConn(redisConn)
 
-	if redisConn.(*redispool.PooledConn).DB != slotIndex {
-		if err := selectDB(redisConn.(*redispool.PooledConn), slotIndex, s.net_timeout); err != nil {
-			redisConn.Close()
+	conn := redisConn.(*redispool.PooledConn)
+	if conn.DB != t.db {
+		if err := selectDB(conn, t.db, s.netTimeout()); err != nil {
+			conn.Close()
 			return errors.Trace(err)
 		}
-		redisConn.(*redispool.PooledConn).DB = slotIndex
+		conn.DB = t.db
 	}
 
-	redisReader := redisConn.(*redispool.PooledConn).BufioReader()
+	s.counter.Add("MigrateBatch", 1)
 
-	//migrate multi keys
+	if s.broker != LedisBroker && len(keys) > 1 && atomic.LoadInt32(&s.noMultiKeyMigrate) == 0 {
+		err := s.migrateKeysCmd(conn, t, keys)
+		if err == nil || errors.Cause(err) != errMultiKeyMigrate {
+			return errors.Trace(err)
+		}
+
+		log.Warning("multi key MIGRATE not supported by", t.from, "fall back to single key")
+		atomic.StoreInt32(&s.noMultiKeyMigrate, 1)
+	}
+
+	//pipeline single key migrations
 	for _, key := range keys {
 		if s.broker == LedisBroker {
-			err = ledisWriteMigrateKeyCmd(redisConn.(*redispool.PooledConn), shd.dst.Master(), 30*1000, group, key, slotIndex)
+			err = ledisWriteMigrateKeyCmd(conn, t.to, 30*1000, t.group, key, t.db)
 		} else {
-			err = writeMigrateKeyCmd(redisConn.(*redispool.PooledConn), shd.dst.Master(), 30*1000, key, slotIndex)
+			err = writeMigrateKeyCmd(conn, t.to, 30*1000, key, t.db)
 		}
 
 		if err != nil {
-			redisConn.Close()
+			conn.Close()
 			log.Warningf("migrate key %s error", string(key))
 			return errors.Trace(err)
 		}
+	}
 
+	redisReader := conn.BufioReader()
+	var migrateErr error
+	for _, key := range keys {
 		//handle migrate result
 		resp, err := parser.Parse(redisReader)
 		if err != nil {
-			redisConn.Close()
+			conn.Close()
 			return errors.Trace(err)
 		}
 
 		result, err := resp.Bytes()
 
-		log.Debug("migrate", string(key), "from", shd.migrateFrom.Master(), "to", shd.dst.Master(),
-			string(result))
+		log.Debug("migrate", string(key), "from", t.from, "to", t.to, string(result))
 
 		if resp.Type == parser.ErrorResp {
-			redisConn.Close()
-			log.Error(string(key), string(resp.Raw), "migrateFrom", shd.migrateFrom.Master())
-			return errors.New(string(resp.Raw))
+			log.Error(string(key), string(resp.Raw), "migrateFrom", t.from)
+			if migrateErr == nil {
+				migrateErr = errors.New(string(resp.Raw))
+			}
+			continue
 		}
 
 		s.counter.Add("Migrate", 1)
 	}
 
+	return migrateErr
+}
+
+var errMultiKeyMigrate = errors.New("multi key migrate not supported")
+
+func (s *Server) migrateKeysCmd(conn *redispool.PooledConn, t migrateTarget, keys [][]byte) error {
+	if err := writeMigrateKeysCmd(conn, t.to, 30*1000, keys, t.db); err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+
+	resp, err := parser.Parse(conn.BufioReader())
+	if err != nil {
+		conn.Close()
+		return errors.Trace(err)
+	}
+
+	if resp.Type == parser.ErrorResp {
+		//servers older than 3.0.6 do not know the KEYS option
+		if strings.Contains(strings.ToLower(string(resp.Raw)), "syntax error") {
+			return errMultiKeyMigrate
+		}
+		log.Error(string(resp.Raw), "migrateFrom", t.from)
+		return errors.New(string(resp.Raw))
+	}
+
+	log.Debug("migrate", len(keys), "keys from", t.from, "to", t.to)
+	s.counter.Add("Migrate", int64(len(keys)))
 	return nil
 }
 
 func (s *Server) filter(opstr string, keys [][]byte, c *session) (next bool, err error) {
-	if !allowOp(opstr) {
+	if !s.allowOp(opstr) {
 		return false, errors.Trace(fmt.Errorf("%s not allowed", opstr))
 	}
 
-	shouldClose, handled, err := handleSpecCommand(opstr, c, keys, s.net_timeout)
+	shouldClose, handled, err := handleSpecCommand(opstr, c, keys, s.netTimeout())
 	if shouldClose { //quit command
 		return false, errors.Trace(io.EOF)
 	}
@@ -214,25 +408,34 @@ func (s *Server) filter(opstr string, keys [][]byte, c *session) (next bool, err
 	return true, nil
 }
 
-func (s *Server) redisTunnel(c *session) error {
-	resp, err := parser.Parse(c.r) // read client request
-	if err != nil {
-		return errors.Trace(err)
-	}
+func (s *Server) redisTunnel(c *session, resp *parser.Resp, op []byte, keys [][]byte) error {
+	opstr := strings.ToUpper(string(op))
 
-	op, keys, err := resp.GetOpKeys()
-	if err != nil {
-		return errors.Trace(err)
+	if !c.authed && s.authEnabled() && opstr != "QUIT" {
+		return errors.Trace(writeReply2Client(c, NOAUTH_BYTES, s.netTimeout()))
 	}
 
-	opstr := strings.ToUpper(string(op))
+	//redis cluster emulation for cluster mode clients
+	switch opstr {
+	case "CLUSTER":
+		s.counter.Add(opstr, 1)
+		return errors.Trace(s.handleCluster(c, keys))
+	case "READONLY", "READWRITE", "ASKING":
+		s.counter.Add(opstr, 1)
+		return errors.Trace(writeReply2Client(c, OK_BYTES, s.netTimeout()))
+	}
 
 	var group string
+	var err error
 	group, keys, err = s.getOpGroupKeys(opstr, keys)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	if allowed, err := s.checkACL(c, opstr, resp); !allowed || err != nil {
+		return errors.Trace(err)
+	}
+
 	if len(keys) == 0 {
 		keys = [][]byte{[]byte("fakeKey")}
 	}
@@ -253,67 +456,139 @@ func (s *Server) redisTunnel(c *session) error {
 	}
 
 	//must check multi keys in same slot
-	i, mkeys, err := checkMigrateKeys(opstr, keys)
+	i, mkeys, err := s.checkMigrateKeys(opstr, keys)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	atomic.AddInt64(&s.counters().ops[i], 1)
 
-	//i := mapKey2Slot(k)
-	token := s.concurrentLimiter.Get()
+	var cacheGen uint64
+	cacheable := s.cache != nil && s.cache.Cacheable(opstr, k)
+	if cacheable {
+		if reply, ok := s.cache.Get(opstr, k, keys[1:]); ok {
+			s.counter.Add("ReadCacheHit", 1)
+			return errors.Trace(writeReply2Client(c, reply, s.netTimeout()))
+		}
+		s.counter.Add("ReadCacheMiss", 1)
+		cacheGen = s.cache.Generation(k)
+	} else if s.cache != nil {
+		//invalidate before and after the write, a read racing with it
+		//may still fill the cache with the old value in between
+		s.invalidateCache(mkeys)
+		defer s.invalidateCache(mkeys)
+	}
+
+	var reply []byte
+	var redisErr error
+	if s.coal != nil && cmdCategory(opstr) != models.CMD_CATEGORY_READ {
+		//later reads of the keys must not join flights sent before the write
+		defer s.coal.written(mkeys)
+	} else if s.coal != nil && s.coal.enabled(opstr) {
+		request, err := resp.Bytes()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		key := coalesceKey(i, request)
+		f, leader := s.coal.join(key, mkeys)
+		if !leader {
+			if b, ok := s.coal.wait(f); ok {
+				s.counter.Add("Coalesced", 1)
+				return errors.Trace(writeReply2Client(c, b, s.netTimeout()))
+			}
+			s.counter.Add("CoalesceMiss", 1)
+		} else {
+			defer func() {
+				if redisErr != nil {
+					reply = nil
+				}
+				s.coal.finish(key, f, reply)
+			}()
+		}
+	}
 
+	//wait for state change without holding a token, should be soon
+	deadline := time.Now().Add(time.Duration(atomic.LoadInt32(&s.premigrateWaitMs)) * time.Millisecond)
 check_state:
-	s.mu.RLock()
-	if s.slots[i] == nil {
-		s.mu.RUnlock()
-		s.concurrentLimiter.Put(token)
+	if !s.waitSlotReady(i, deadline) {
+		s.counter.Add("PreMigrateTimeout", 1)
+		return errors.Trace(writeReply2Client(c, TRYAGAIN_BYTES, s.netTimeout()))
+	}
+
+	//i := s.mapKey2Slot(k)
+	limiter := s.limiter()
+	token := limiter.Get()
+
+	//routing of this request, not affected by later topology changes
+	slot := s.getSlot(i)
+	if slot == nil {
+		limiter.Put(token)
 		return errors.Errorf("should never happend, slot %d is empty", i)
 	}
-	//wait for state change, should be soon
-	if s.slots[i].slotInfo.State.Status == models.SLOT_STATUS_PRE_MIGRATE {
-		s.mu.RUnlock()
-		time.Sleep(10 * time.Millisecond)
+	if slot.slotInfo.State.Status == models.SLOT_STATUS_PRE_MIGRATE {
+		limiter.Put(token)
 		goto check_state
 	}
 
 	defer func() {
-		s.mu.RUnlock()
 		sec := time.Since(start).Seconds()
 		if sec > 2 {
 			log.Warningf("op: %s, key:%s, on: %s, too long %d seconds, client: %s", opstr,
-				string(k), s.slots[i].dst.Master(), int(sec), c.RemoteAddr().String())
+				string(k), slot.dst.Master(), int(sec), c.RemoteAddr().String())
 		}
 		recordResponseTime(s.counter, time.Duration(sec)*1000)
-		s.concurrentLimiter.Put(token)
+		limiter.Put(token)
 	}()
 
-	if err := s.handleMigrateState(i, opstr, group, mkeys); err != nil {
-		return errors.Trace(err)
+	if err := s.handleMigrateState(i, slot, opstr, group, mkeys); err != nil {
+		//the key is still on the source, the client may retry
+		log.Warningf("migrate keys %q of slot %d error, %v", mkeys, i, err)
+		s.counter.Add("MigrateFailed", 1)
+		return errors.Trace(writeReply2Client(c, TRYAGAIN_BYTES, s.netTimeout()))
 	}
 
 	//get redis connection
-	redisConn, err := s.pools.GetConn(s.slots[i].dst.Master())
+	redisConn, err := s.pools.GetConn(slot.dst.Master())
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	if redisConn.(*redispool.PooledConn).DB != i {
-		if err := selectDB(redisConn.(*redispool.PooledConn), i, s.net_timeout); err != nil {
+	db := s.slotDB(i)
+	if redisConn.(*redispool.PooledConn).DB != db {
+		if err := selectDB(redisConn.(*redispool.PooledConn), db, s.netTimeout()); err != nil {
 			redisConn.Close()
 			s.pools.ReleaseConn(redisConn)
 
 			return errors.Trace(err)
 		}
-		redisConn.(*redispool.PooledConn).DB = i
+		redisConn.(*redispool.PooledConn).DB = db
 	}
 
-	redisErr, clientErr := forward(c, redisConn.(*redispool.PooledConn), resp, s.net_timeout)
+	var clientErr error
+	reply, redisErr, clientErr = forwardReply(c, redisConn.(*redispool.PooledConn), resp, s.netTimeout())
 	if redisErr != nil {
 		redisConn.Close()
 	}
 	s.pools.ReleaseConn(redisConn)
+
+	if cacheable && redisErr == nil && len(reply) > 0 && reply[0] != '-' {
+		s.cache.Put(i, opstr, k, keys[1:], cacheGen, reply)
+		if s.broker != LedisBroker {
+			s.cache.Track(slot.dst.Master())
+		}
+	}
+
 	return errors.Trace(clientErr)
 }
 
+func (s *Server) invalidateCache(keys [][]byte) {
+	for _, key := range keys {
+		if s.cache.Match(key) {
+			s.cache.Invalidate(key)
+		}
+	}
+}
+
 // for ledisdb, we must know the op data type (group) for migration.
 func (s *Server) getOpGroupKeys(op string, keys [][]byte) (string, [][]byte, error) {
 	op = strings.ToUpper(op)
@@ -339,94 +614,120 @@ func (s *Server) getOpGroupKeys(op string, keys [][]byte) (string, [][]byte, err
 	return "", nil, fmt.Errorf("%s is not supported now", op)
 }
 
-func (s *Server) handleConn(c net.Conn) {
-	log.Info("new connection", c.RemoteAddr())
-
-	s.counter.Add("connections", 1)
-	client := &session{
-		Conn:     c,
-		r:        bufio.NewReader(c),
-		CreateAt: time.Now(),
-	}
-
-	var err error
-
-	defer func() {
-		if err != nil { //todo: fix this ugly error check
-			if GetOriginError(err.(*errors.Err)).Error() != io.EOF.Error() {
-				log.Warningf("close connection %v, %+v, %v", c.RemoteAddr(), client, errors.ErrorStack(err))
-			} else {
-				log.Infof("close connection %v, %+v", c.RemoteAddr(), client)
-			}
-		} else {
-			log.Infof("close connection %v, %+v", c.RemoteAddr(), client)
-		}
-
-		c.Close()
-		s.counter.Add("connections", -1)
-	}()
-
-	for {
-		err = s.redisTunnel(client)
-		if err != nil {
-			return
-		}
-		client.Ops++
-	}
-}
-
-func (s *Server) OnSlotRangeChange(param *models.SlotMultiSetParam) {
+func (s *Server) OnSlotRangeChange(param *models.SlotMultiSetParam) error {
 	log.Warningf("slotRangeChange %+v", param)
-	if !validSlot(param.From) || !validSlot(param.To) {
+	if !s.validSlot(param.From) || !s.validSlot(param.To) {
 		log.Errorf("invalid slot number, %+v", param)
-		return
+		return nil
 	}
 
+	updated := make(map[int]*Slot)
 	for i := param.From; i <= param.To; i++ {
 		switch param.Status {
 		case models.SLOT_STATUS_OFFLINE:
-			s.clearSlot(i)
+			updated[i] = nil
 		case models.SLOT_STATUS_ONLINE:
-			s.fillSlot(i, true)
+			slot, err := s.loadSlot(i)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			updated[i] = slot
 		default:
 			log.Errorf("can not handle status %v", param.Status)
 		}
 	}
+
+	//the whole range is switched at once
+	s.swapSlots(updated)
+	return nil
 }
 
-func (s *Server) OnGroupChange(groupId int) {
-	log.Warning("group changed", groupId)
+//reload all slots after a failed action was rolled back, a failed expansion
+//of the slots is undone first
+func (s *Server) OnRollback() error {
+	log.Warning("rollback")
 
-	for i, slot := range s.slots {
-		if slot.slotInfo.GroupId == groupId {
-			s.fillSlot(i, true)
+	m, err := s.top.GetSlotMeta()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if m == nil { //one database per slot
+		m = &models.SlotMeta{SlotNum: s.dbNum, DBNum: s.dbNum}
+	}
+	if n := s.getSlotNum(); m.SlotNum < n {
+		if m.DBNum != s.dbNum || n%m.SlotNum != 0 {
+			return errors.NotValidf("slot layout %d slots on %d databases, serving %d on %d", m.SlotNum, m.DBNum, n, s.dbNum)
 		}
+		//the count shrinks before the table so no request maps a key out of it
+		s.setSlotNum(m.SlotNum)
 	}
-}
 
-func (s *Server) Run() {
-	log.Info("listening on", s.addr)
-	listener, err := net.Listen("tcp", s.addr)
+	slots, err := s.loadSlots()
 	if err != nil {
-		log.Fatal(err)
+		return errors.Trace(err)
 	}
 
-	for {
-		conn, err := listener.Accept()
+	s.swapSlots(slots)
+	return nil
+}
+
+//split every slot into virtual slots of the same group, use it in lock. The
+//larger table is installed before the slot count so no request maps a key out
+//of the table.
+func (s *Server) OnSlotExpand(meta *models.SlotMeta) error {
+	log.Warningf("slots expanded %+v", meta)
+
+	n := s.getSlotNum()
+	if meta.SlotNum == n && meta.DBNum == s.dbNum { //applied from zk already
+		return nil
+	}
+	if !s.expandedLayout(meta) {
+		return errors.NotValidf("slot layout %d slots on %d databases, serving %d on %d", meta.SlotNum, meta.DBNum, n, s.dbNum)
+	}
+
+	updated := make(map[int]*Slot, meta.SlotNum-n)
+	for i := n; i < meta.SlotNum; i++ {
+		slot, err := s.loadSlot(i)
 		if err != nil {
-			log.Warning(errors.ErrorStack(err))
-			continue
+			return errors.Trace(err)
 		}
-		go s.handleConn(conn)
+		updated[i] = slot
 	}
+
+	s.installSlots(meta.SlotNum, updated)
+	s.setSlotNum(meta.SlotNum)
+	//cached replies are kept by the slot their key hashed to
+	if s.cache != nil {
+		s.cache.Flush()
+	}
+	return nil
 }
 
-func (s *Server) responseAction(seq int64) {
-	log.Info("send response", seq)
-	err := s.top.DoResponse(int(seq), &s.pi)
-	if err != nil {
-		log.Error(errors.ErrorStack(err))
+func (s *Server) OnGroupChange(groupId int) error {
+	log.Warning("group changed", groupId)
+
+	updated := make(map[int]*Slot)
+	for i, slot := range s.getSlots() {
+		if slot != nil && slot.slotInfo.GroupId == groupId {
+			slot, err := s.loadSlot(i)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			updated[i] = slot
+		}
 	}
+
+	s.swapSlots(updated)
+	return nil
+}
+
+func (s *Server) Run() {
+	newProxy(s.addr, s.netTimeout(), []*Server{s}).Run()
+}
+
+func (s *Server) responseAction(seq int64, actErr error) error {
+	log.Info("send response", seq)
+	return errors.Trace(s.top.DoResponse(int(seq), &s.pi, actErr))
 }
 
 func (s *Server) getProxyInfo() models.ProxyInfo {
@@ -436,50 +737,69 @@ func (s *Server) getProxyInfo() models.ProxyInfo {
 	return pi
 }
 
-func (s *Server) getActionObject(seq int, target interface{}) {
+func (s *Server) getActionObject(seq int, target interface{}) error {
 	act := &models.Action{Target: target}
 	err := s.top.GetActionWithSeqObject(int64(seq), act)
 	if err != nil {
-		log.Fatal(errors.ErrorStack(err))
+		return errors.Trace(err)
 	}
 
 	log.Infof("%+v", act)
+	return nil
 }
 
-func (s *Server) checkAndDoTopoChange(seq int) (needResponse bool) {
+//needResponse is set with err if the action was for us but failed to apply,
+//the failure is sent back to the sender instead
+func (s *Server) checkAndDoTopoChange(seq int) (needResponse bool, err error) {
 	act, err := s.top.GetActionWithSeq(int64(seq))
 	if err != nil {
-		log.Fatal(errors.ErrorStack(err), "action seq", seq)
+		return false, errors.Trace(err)
 	}
 
 	if !StringsContain(act.Receivers, s.pi.Id) { //no need to response
-		return false
+		return false, nil
 	}
 
 	switch act.Type {
 	case models.ACTION_TYPE_SLOT_MIGRATE, models.ACTION_TYPE_SLOT_CHANGED,
 		models.ACTION_TYPE_SLOT_PREMIGRATE:
 		slot := &models.Slot{}
-		s.getActionObject(seq, slot)
-		s.fillSlot(slot.Id, true)
+		if err = s.getActionObject(seq, slot); err == nil {
+			err = s.fillSlot(slot.Id, true)
+		}
 	case models.ACTION_TYPE_SERVER_GROUP_CHANGED:
 		serverGroup := &models.ServerGroup{}
-		s.getActionObject(seq, serverGroup)
-		s.OnGroupChange(serverGroup.Id)
+		if err = s.getActionObject(seq, serverGroup); err == nil {
+			err = s.OnGroupChange(serverGroup.Id)
+		}
 	case models.ACTION_TYPE_SERVER_GROUP_REMOVE:
 		//do not care
+	case models.ACTION_TYPE_USER_CHANGED:
+		//keep serving with the old users if reload failed
+		if err := s.loadUsers(); err != nil {
+			log.Error(errors.ErrorStack(err))
+		}
 	case models.ACTION_TYPE_MULTI_SLOT_CHANGED:
 		param := &models.SlotMultiSetParam{}
-		s.getActionObject(seq, param)
-		s.OnSlotRangeChange(param)
+		if err = s.getActionObject(seq, param); err == nil {
+			err = s.OnSlotRangeChange(param)
+		}
+	case models.ACTION_TYPE_SLOT_EXPAND:
+		meta := &models.SlotMeta{}
+		if err = s.getActionObject(seq, meta); err == nil {
+			err = s.OnSlotExpand(meta)
+		}
+	case models.ACTION_TYPE_ROLLBACK:
+		err = s.OnRollback()
 	default:
-		log.Fatalf("unknown action %+v", act)
+		err = errors.NotSupportedf("action %+v", act)
 	}
 
-	return true
+	return true, errors.Trace(err)
 }
 
 func (s *Server) handleMarkOffline() {
+	s.offline = true
 	s.top.Close(s.pi.Id)
 	if s.OnSuicide == nil {
 		s.OnSuicide = func() error {
@@ -491,15 +811,23 @@ func (s *Server) handleMarkOffline() {
 	s.OnSuicide()
 }
 
-func (s *Server) handleProxyCommand() {
-	pi, err := s.top.GetProxyInfo(s.pi.Id)
+//the watch of the proxy node is one-shot and fired by any write to it, e.g.
+//the applied config version, it is armed again with the read
+func (s *Server) handleProxyCommand() error {
+	data, err := s.top.WatchNode(path.Join(models.GetProxyPath(s.top.ProductName), s.pi.Id), s.evtbus)
 	if err != nil {
-		log.Fatal(errors.ErrorStack(err))
+		return errors.Trace(err)
+	}
+
+	var pi models.ProxyInfo
+	if err := json.Unmarshal(data, &pi); err != nil {
+		return errors.Trace(err)
 	}
 
 	if pi.State == models.PROXY_STATE_MARK_OFFLINE {
 		s.handleMarkOffline()
 	}
+	return nil
 }
 
 func (s *Server) processAction(e interface{}) {
@@ -511,26 +839,65 @@ func (s *Server) processAction(e interface{}) {
 		log.Warning("take too long to get lock")
 	}
 
+	if s.offline {
+		return
+	}
+
+	if s.top.IsClosingEvent(e) {
+		//watch of a replaced connection, resyncTopology watches the new one
+		log.Infof("zk watch closed, %+v", e)
+		return
+	}
+
+	if s.top.IsWatchLostEvent(e) {
+		//session expired, ephemeral node and watches are gone
+		log.Warningf("zk watch lost, %+v", e)
+		s.recoverTopology()
+		s.saveSnapshot()
+		return
+	}
+
+	if err := s.doProcessAction(e); err != nil {
+		log.Error(errors.ErrorStack(err))
+		s.recoverTopology()
+	}
+
+	s.saveSnapshot()
+}
+
+func (s *Server) doProcessAction(e interface{}) error {
 	actPath := GetEventPath(e)
+	if actPath == models.GetProxyConfigPath(s.top.ProductName) {
+		return errors.Trace(s.reloadProxyConfig())
+	}
+
 	if strings.Index(actPath, models.GetProxyPath(s.top.ProductName)) == 0 {
 		//proxy event, should be order for me to suicide
-		s.handleProxyCommand()
-		return
+		return errors.Trace(s.handleProxyCommand())
 	}
 
 	//re-watch
 	nodes, err := s.top.WatchChildren(models.GetWatchActionPath(s.top.ProductName), s.evtbus)
 	if err != nil {
-		log.Fatal(errors.ErrorStack(err))
+		return errors.Trace(err)
+	}
+
+	if !s.top.IsChildrenChangedEvent(e) {
+		return nil
 	}
 
+	return errors.Trace(s.replayActions(nodes))
+}
+
+//apply and respond to actions after lastActionSeq, use it in lock
+func (s *Server) replayActions(nodes []string) error {
 	seqs, err := models.ExtraSeqList(nodes)
 	if err != nil {
-		log.Fatal(errors.ErrorStack(err))
+		return errors.Trace(err)
 	}
 
-	if len(seqs) == 0 || !s.top.IsChildrenChangedEvent(e) {
-		return
+	if len(seqs) == 0 {
+		return nil
 	}
 
 	//get last pos
@@ -545,11 +912,11 @@ func (s *Server) processAction(e interface{}) {
 	if index < 0 {
 		log.Warningf("zookeeper restarted or actions were deleted ? lastActionSeq: %d", s.lastActionSeq)
 		if s.lastActionSeq > seqs[len(seqs)-1] {
-			log.Fatalf("unknown error, zookeeper restarted or actions were deleted ? lastActionSeq: %d, %v", s.lastActionSeq, nodes)
+			return errors.Errorf("unknown error, zookeeper restarted or actions were deleted ? lastActionSeq: %d, %v", s.lastActionSeq, nodes)
 		}
 
 		if s.lastActionSeq == seqs[len(seqs)-1] { //children change or delete event
-			return
+			return nil
 		}
 
 		//actions node was remove by someone, seems we can handle it
@@ -560,19 +927,33 @@ func (s *Server) processAction(e interface{}) {
 	for _, seq := range actions {
 		exist, err := s.top.Exist(path.Join(s.top.GetActionResponsePath(seq), s.pi.Id))
 		if err != nil {
-			log.Fatal(errors.ErrorStack(err))
+			return errors.Trace(err)
 		}
 
 		if exist {
+			s.lastActionSeq = seq
 			continue
 		}
 
-		if s.checkAndDoTopoChange(seq) {
-			s.responseAction(int64(seq))
+		needResponse, err := s.checkAndDoTopoChange(seq)
+		if err != nil && !needResponse {
+			return errors.Trace(err)
+		}
+		if err != nil {
+			//keep the old topology and let the sender roll back
+			log.Errorf("apply action %d failed, %s", seq, errors.ErrorStack(err))
+			s.counter.Add("ActionFailed", 1)
 		}
+		if needResponse {
+			if err := s.responseAction(int64(seq), err); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		s.lastActionSeq = seq
 	}
 
 	s.lastActionSeq = seqs[len(seqs)-1]
+	return nil
 }
 
 func (s *Server) handleTopoEvent() {
@@ -619,9 +1000,31 @@ func (s *Server) waitOnline() {
 }
 
 func (s *Server) FillSlots() {
-	s.slots = make([]*Slot, slot_num)
-	for i := 0; i < slot_num; i++ {
-		s.fillSlot(i, false)
+	slots, err := s.loadSlots()
+	if err != nil {
+		log.Fatal(errors.ErrorStack(err))
+	}
+	s.swapSlots(slots)
+}
+
+//slot layout in config must be the one of the product
+func (s *Server) checkSlotMeta() {
+	m, err := s.top.GetSlotMeta()
+	if err != nil {
+		log.Fatal(errors.ErrorStack(err))
+	}
+
+	n := s.getSlotNum()
+	if m == nil { //one database per slot
+		m = &models.SlotMeta{SlotNum: n, DBNum: n}
+	}
+
+	if s.expandedLayout(m) {
+		log.Warningf("product %s expanded to %d slots since slot_num %d of the config", s.top.ProductName, m.SlotNum, n)
+		s.setSlotNum(m.SlotNum)
+	} else if m.SlotNum != n || m.DBNum != s.dbNum {
+		log.Fatalf("invalid config: slot_num %d, db_num %d, but product %s has %d slots on %d databases",
+			n, s.dbNum, s.top.ProductName, m.SlotNum, m.DBNum)
 	}
 }
 
@@ -635,23 +1038,49 @@ func (s *Server) RegisterAndWait() {
 }
 
 func NewServer(addr string, debugVarAddr string, conf *Conf) *Server {
+	return newServer(addr, debugVarAddr, conf, stats.NewCounters("router"))
+}
+
+//all products served by one proxy share the same counter
+func newServer(addr string, debugVarAddr string, conf *Conf, counter *stats.Counters) *Server {
 	log.Infof("%+v", conf)
 	s := &Server{
-		evtbus:            make(chan interface{}, 100),
-		top:               topo.NewTopo(conf.productName, conf.zkAddr, conf.f),
-		net_timeout:       conf.net_timeout,
-		counter:           stats.NewCounters("router"),
-		lastActionSeq:     -1,
-		startAt:           time.Now(),
-		addr:              addr,
-		concurrentLimiter: tokenlimiter.NewTokenLimiter(100),
-		moper:             NewMultiOperator(addr),
-		pools:             cachepool.NewCachePool(),
+		evtbus:           make(chan interface{}, 100),
+		top:              topo.NewTopo(conf.productName, conf.zkAddr, conf.f),
+		netTimeoutSec:    int32(conf.net_timeout),
+		counter:          counter,
+		lastActionSeq:    -1,
+		startAt:          time.Now(),
+		addr:             addr,
+		conf:             conf,
+		internalPassword: newInternalPassword(),
+		audit:            conf.auditLog,
+		pools:            cachepool.NewCachePool(),
 	}
 
 	s.broker = conf.broker
+	s.migrator = newKeyMigrator(maxMigratedKeys, s.migrateKeys)
+	s.moper = NewMultiOperator(addr, s.internalPassword)
+	s.setConcurrentLimit(conf.concurrentLimit)
+	s.blackList.Store(blackListCommand)
+	s.password = conf.password
+	s.premigrateWaitMs = int32(conf.premigrateWait)
 
-	slot_num = conf.slot_num
+	if len(conf.coalesceCommands) > 0 {
+		s.coal = newCoalescer(conf.coalesceCommands, time.Duration(conf.coalesceWindow)*time.Millisecond)
+	}
+
+	if conf.readCache != nil {
+		s.cache = readcache.NewCache(conf.readCache)
+		stats.Publish(conf.statsName("readcache"), stats.StringFunc(func() string {
+			st := s.cache.Stats()
+			return fmt.Sprintf("keys:%d bytes:%d hits:%d misses:%d", st.Keys, st.Bytes, st.Hits, st.Misses)
+		}))
+	}
+
+	s.dbNum = conf.db_num
+	s.setSlotNum(conf.slot_num)
+	s.snapshotFile = conf.snapshotFile
 
 	s.mu.Lock()
 	s.pi.Id = conf.proxyId
@@ -666,15 +1095,45 @@ func NewServer(addr string, debugVarAddr string, conf *Conf) *Server {
 	s.mu.Unlock()
 	//todo:fill more field
 
-	stats.Publish("evtbus", stats.StringFunc(func() string {
-		return strconv.Itoa(len(s.evtbus))
+	stats.Publish(conf.statsName("slot_waiting"), stats.StringFunc(s.slotWaitingStats))
+	stats.Publish(conf.statsName("slot_ops"), stats.StringFunc(s.slotOpsStats))
+	stats.Publish(conf.statsName("zk_degraded"), stats.StringFunc(func() string {
+		return strconv.Itoa(int(atomic.LoadInt32(&s.degraded)))
 	}))
-	stats.Publish("startAt", stats.StringFunc(func() string {
-		return s.startAt.String()
+	stats.Publish(conf.statsName("stale"), stats.StringFunc(func() string {
+		return strconv.Itoa(int(atomic.LoadInt32(&s.stale)))
 	}))
+	stats.Publish(conf.statsName("evtbus"), stats.StringFunc(func() string {
+		return strconv.Itoa(len(s.evtbus))
+	}))
+	if !conf.multiTenant {
+		stats.Publish("startAt", stats.StringFunc(func() string {
+			return s.startAt.String()
+		}))
+	}
+
+	//zk may be down, serve from the last known topology
+	if conf.staleStart && len(s.snapshotFile) > 0 && s.startStale() {
+		go s.handleTopoEvent()
+		go s.watchProxies()
+		return s
+	}
+
+	s.checkSlotMeta()
+
+	s.mu.Lock()
+	err = s.reloadProxyConfig()
+	s.mu.Unlock()
+	if err != nil {
+		log.Fatal(errors.ErrorStack(err))
+	}
 
 	s.RegisterAndWait()
 
+	if err := s.loadUsers(); err != nil {
+		log.Fatal(errors.ErrorStack(err))
+	}
+
 	_, err = s.top.WatchChildren(models.GetWatchActionPath(conf.productName), s.evtbus)
 	if err != nil {
 		log.Fatal(errors.ErrorStack(err))
@@ -682,8 +1141,13 @@ func NewServer(addr string, debugVarAddr string, conf *Conf) *Server {
 
 	s.FillSlots()
 
+	s.mu.Lock()
+	s.saveSnapshot()
+	s.mu.Unlock()
+
 	//start event handler
 	go s.handleTopoEvent()
+	go s.watchProxies()
 
 	log.Info("proxy start ok")
 
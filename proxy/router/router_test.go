@@ -4,7 +4,11 @@
 package router
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
+	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -14,6 +18,7 @@ import (
 	"github.com/garyburd/redigo/redis"
 	"github.com/juju/errors"
 	"github.com/ledisdb/xcodis/models"
+	"github.com/ngaut/go-zookeeper/zk"
 	log "github.com/ngaut/logging"
 	"github.com/ngaut/zkhelper"
 )
@@ -39,6 +44,7 @@ func InitEnv() {
 			net_timeout: 5,
 			f:           func(string) (zkhelper.Conn, error) { return conn, nil },
 			slot_num:    16,
+			db_num:      16,
 			//broker:      LedisBroker,
 		}
 
@@ -134,6 +140,12 @@ func TestSingleKeyRedisCmd(t *testing.T) {
 	if got, err := redis.String(c.Do("get", "bar")); err != nil || got != "foo" {
 		t.Error("'bar' has the wrong value")
 	}
+
+	//requests are counted per slot for traffic based rebalance
+	slot := fmt.Sprintf("%d:", s.mapKey2Slot([]byte("foo")))
+	if stats := s.slotOpsStats(); !strings.HasPrefix(stats, slot) && !strings.Contains(stats, " "+slot) {
+		t.Errorf("slot ops %q, want %s", stats, slot)
+	}
 }
 
 func TestMultiKeyRedisCmd(t *testing.T) {
@@ -276,7 +288,205 @@ func TestInvalidRedisCmdEcho(t *testing.T) {
 
 }
 
+func TestActionNack(t *testing.T) {
+	InitEnv()
+
+	err := models.NewAction(conn, conf.productName, models.ActionType("unknown"), nil, "", true)
+	failed, ok := errors.Cause(err).(*models.ActionFailedError)
+	if !ok || len(failed.Errors[conf.proxyId]) == 0 {
+		t.Fatal("unknown action should be rejected", err)
+	}
+
+	//still serving
+	c, err := redis.Dial("tcp", "localhost:19000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Do("SET", "foo", "bar"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	InitEnv()
+
+	c := &models.ProxyConfig{}
+	for k, v := range map[string]string{"net_timeout": "7", "black_list": "strlen", "pool_size": "32"} {
+		if err := c.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := models.SetProxyConfig(conn, conf.productName, c); err != nil {
+		t.Fatal(err)
+	}
+
+	var pi *models.ProxyInfo
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if pi, _ = models.GetProxyInfo(conn, conf.productName, conf.proxyId); pi != nil && pi.ConfigVersion == c.Version {
+			break
+		}
+	}
+	if pi == nil || pi.ConfigVersion != c.Version {
+		t.Fatalf("config version not published, %+v", pi)
+	}
+	if s.netTimeout() != 7 || s.allowOp("STRLEN") || !s.allowOp("KEYS") {
+		t.Error("config not applied")
+	}
+
+	cli, err := redis.Dial("tcp", "localhost:19000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if _, err := cli.Do("SET", "foo", "bar"); err != nil {
+		t.Error(err)
+	}
+	if _, err := cli.Do("STRLEN", "foo"); err == nil {
+		t.Error("STRLEN should be denied")
+	}
+
+	//invalid config is not applied
+	data, _ := json.Marshal(models.ProxyConfig{Version: c.Version + 1, NetTimeout: -1})
+	if _, err := conn.Set(models.GetProxyConfigPath(conf.productName), data, -1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if s.netTimeout() != 7 || s.getProxyInfo().ConfigVersion != c.Version {
+		t.Error("invalid config applied")
+	}
+
+	//undecodable config is counted, the watch is kept
+	invalid := s.counter.Counts()["ProxyConfigInvalid"]
+	if _, err := conn.Set(models.GetProxyConfigPath(conf.productName), []byte("{"), -1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if s.netTimeout() != 7 || s.counter.Counts()["ProxyConfigInvalid"] != invalid+1 {
+		t.Error("undecodable config not counted")
+	}
+	data, _ = json.Marshal(models.ProxyConfig{Version: c.Version + 2, NetTimeout: 8})
+	if _, err := conn.Set(models.GetProxyConfigPath(conf.productName), data, -1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if s.netTimeout() != 8 {
+		t.Error("config not reloaded after an undecodable one")
+	}
+
+	//back to config file values once deleted
+	if err := conn.Delete(models.GetProxyConfigPath(conf.productName), -1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if s.netTimeout() != conf.net_timeout || !s.allowOp("STRLEN") {
+		t.Error("config file values not restored")
+	}
+}
+
 //this should be the last test
+func TestClusterCmd(t *testing.T) {
+	InitEnv()
+	c, err := redis.Dial("tcp", "localhost:19000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	slots, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 1 {
+		t.Fatalf("one proxy expected, got %v", slots)
+	}
+
+	var start, end int64
+	var node []interface{}
+	if _, err := redis.Scan(slots[0].([]interface{}), &start, &end, &node); err != nil {
+		t.Fatal(err)
+	}
+	if start != 0 || end != clusterSlotNum-1 || len(node) != 3 {
+		t.Errorf("invalid cluster slots %v", slots)
+	}
+
+	if n, err := redis.Int(c.Do("CLUSTER", "KEYSLOT", "{xxx}aa")); err != nil || n != s.mapKey2Slot([]byte("xxx")) {
+		t.Error("invalid keyslot", n, err)
+	}
+
+	if info, err := redis.String(c.Do("CLUSTER", "INFO")); err != nil || !strings.Contains(info, "cluster_state:ok") {
+		t.Error("invalid cluster info", info, err)
+	}
+
+	if _, err := c.Do("READONLY"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestZkSessionExpired(t *testing.T) {
+	InitEnv()
+
+	//the ephemeral node is removed with the expired session
+	proxyPath := path.Join(models.GetProxyPath(conf.productName), conf.proxyId)
+	if err := conn.Delete(proxyPath, -1); err != nil {
+		t.Fatal(err)
+	}
+	s.evtbus <- zk.Event{Type: zk.EventNotWatching, State: zk.StateDisconnected, Path: proxyPath, Err: zk.ErrSessionExpired}
+
+	var pi *models.ProxyInfo
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if pi, _ = models.GetProxyInfo(conn, conf.productName, conf.proxyId); pi != nil {
+			break
+		}
+	}
+	if pi == nil || pi.State != models.PROXY_STATE_ONLINE {
+		t.Fatalf("proxy not registered again, %+v", pi)
+	}
+
+	c, err := redis.Dial("tcp", "localhost:19000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Do("SET", "foo", "bar"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpandSlots(t *testing.T) {
+	InitEnv()
+
+	c, err := redis.Dial("tcp", "localhost:19000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Do("SET", "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	//applied by the proxy with the one action confirming it
+	old := &models.SlotMeta{SlotNum: conf.slot_num, DBNum: conf.db_num}
+	if err := models.ExpandSlots(conn, conf.productName, old, 2*conf.slot_num); err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+	proxyMutex.Lock()
+	n, slot := s.getSlotNum(), s.getSlot(2*conf.slot_num-1)
+	proxyMutex.Unlock()
+	if n != 2*conf.slot_num || slot == nil || slot.slotInfo.GroupId != 2 {
+		t.Fatalf("%d slots, last %+v", n, slot)
+	}
+
+	//keys stay in the database of their old slot
+	if v, err := redis.String(c.Do("GET", "foo")); err != nil || v != "bar" {
+		t.Error(v, err)
+	}
+}
+
 func TestMarkOffline(t *testing.T) {
 	InitEnv()
 
@@ -288,7 +498,17 @@ func TestMarkOffline(t *testing.T) {
 	}
 	proxyMutex.Unlock()
 
-	err := models.SetProxyStatus(conn, conf.productName, conf.proxyId, models.PROXY_STATE_MARK_OFFLINE)
+	//any write to the proxy node fires its watch, it must be armed again
+	pi, err := models.GetProxyInfo(conn, conf.productName, conf.proxyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := models.SetProxyConfigVersion(conn, conf.productName, conf.proxyId, pi.ConfigVersion); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	err = models.SetProxyStatus(conn, conf.productName, conf.proxyId, models.PROXY_STATE_MARK_OFFLINE)
 	if err != nil {
 		t.Fatal(errors.ErrorStack(err))
 	}
@@ -299,3 +519,40 @@ func TestMarkOffline(t *testing.T) {
 		t.Error("shoud be suicided")
 	}
 }
+
+func TestWaitSlotReady(t *testing.T) {
+	srv := &Server{dbNum: 1}
+	srv.setSlotNum(1)
+	srv.slots.Store([]*Slot{{
+		slotInfo: &models.Slot{State: models.SlotState{Status: models.SLOT_STATUS_PRE_MIGRATE}},
+		replaced: make(chan struct{}),
+	}})
+
+	if srv.waitSlotReady(0, time.Now().Add(20*time.Millisecond)) {
+		t.Fatal("should time out")
+	}
+
+	go func() {
+		for atomic.LoadInt64(&srv.counters().waiting[0]) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if srv.slotWaitingStats() != "0:1" {
+			t.Error("waiting sessions not counted")
+		}
+
+		srv.mu.Lock()
+		srv.swapSlots(map[int]*Slot{0: {slotInfo: &models.Slot{State: models.SlotState{Status: models.SLOT_STATUS_ONLINE}}}})
+		srv.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if !srv.waitSlotReady(0, time.Now().Add(5*time.Second)) {
+		t.Fatal("should be ready")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("not woken up by slot change")
+	}
+	if atomic.LoadInt64(&srv.counters().waiting[0]) != 0 {
+		t.Error("waiting sessions not released")
+	}
+}
@@ -17,6 +17,10 @@ type session struct {
 
 	CreateAt time.Time
 	Ops      int64
+
+	srv    *Server //product of this session, nil before AUTH
+	authed bool
+	user   string //empty if authenticated by password
 }
 
 //make sure all read using bufio.Reader
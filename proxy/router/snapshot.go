@@ -0,0 +1,215 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+
+	"github.com/juju/errors"
+	log "github.com/ngaut/logging"
+)
+
+// topoSnapshot is the last topology applied by the proxy, saved to a local
+// file so the proxy can start serving while zk is down.
+type topoSnapshot struct {
+	Product       string         `json:"product"`
+	SlotNum       int            `json:"slot_num"`
+	DBNum         int            `json:"db_num"`
+	LastActionSeq int            `json:"last_action_seq"`
+	Slots         []slotSnapshot `json:"slots"`
+	Users         []models.User  `json:"users"`
+	SavedAt       time.Time      `json:"saved_at"`
+}
+
+type slotSnapshot struct {
+	Slot        *models.Slot        `json:"slot"`
+	Group       *models.ServerGroup `json:"group"`
+	MigrateFrom *models.ServerGroup `json:"migrate_from,omitempty"`
+}
+
+//use it in lock
+func (s *Server) takeSnapshot() *topoSnapshot {
+	snap := &topoSnapshot{
+		Product:       s.top.ProductName,
+		SlotNum:       s.getSlotNum(),
+		DBNum:         s.dbNum,
+		LastActionSeq: s.lastActionSeq,
+		SavedAt:       time.Now(),
+	}
+
+	for _, slot := range s.getSlots() {
+		if slot == nil {
+			continue
+		}
+		snap.Slots = append(snap.Slots, slotSnapshot{
+			Slot:        slot.slotInfo,
+			Group:       slot.groupInfo,
+			MigrateFrom: slot.fromInfo,
+		})
+	}
+
+	m, _ := s.users.Load().(map[string]*models.User)
+	for _, u := range m {
+		snap.Users = append(snap.Users, *u)
+	}
+
+	return snap
+}
+
+// saveSnapshot writes the current topology to the snapshot file, errors are
+// only logged. Nothing is saved in stale mode. Use it in lock.
+func (s *Server) saveSnapshot() {
+	if len(s.snapshotFile) == 0 || atomic.LoadInt32(&s.stale) == 1 {
+		return
+	}
+
+	if err := writeSnapshot(s.snapshotFile, s.takeSnapshot()); err != nil {
+		log.Warning("save topology snapshot failed", errors.ErrorStack(err))
+		return
+	}
+
+	s.counter.Add("SnapshotSaved", 1)
+}
+
+func writeSnapshot(file string, snap *topoSnapshot) error {
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	//replace the old one atomically
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Trace(err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(os.Rename(f.Name(), file))
+}
+
+func readSnapshot(file string) (*topoSnapshot, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var snap topoSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &snap, nil
+}
+
+// restoreSnapshot installs the slot table and users of snap. Use it in lock.
+func (s *Server) restoreSnapshot(snap *topoSnapshot) error {
+	meta := &models.SlotMeta{SlotNum: snap.SlotNum, DBNum: snap.DBNum}
+	if snap.Product != s.top.ProductName || (!s.expandedLayout(meta) && (snap.SlotNum != s.getSlotNum() || snap.DBNum != s.dbNum)) {
+		return errors.Errorf("snapshot of product %s with %d slots on %d databases does not match config",
+			snap.Product, snap.SlotNum, snap.DBNum)
+	}
+
+	if len(snap.Slots) != snap.SlotNum {
+		return errors.Errorf("%d slots in snapshot, expect %d", len(snap.Slots), snap.SlotNum)
+	}
+
+	slots := make(map[int]*Slot, snap.SlotNum)
+	for _, ss := range snap.Slots {
+		if ss.Slot == nil || ss.Group == nil || ss.Slot.Id < 0 || ss.Slot.Id >= snap.SlotNum {
+			return errors.Errorf("invalid slot in snapshot, %+v", ss)
+		}
+		slots[ss.Slot.Id] = newSlot(ss.Slot, ss.Group, ss.MigrateFrom)
+	}
+
+	users := make(map[string]*models.User, len(snap.Users))
+	for i := range snap.Users {
+		users[snap.Users[i].Name] = &snap.Users[i]
+	}
+
+	//slots may be expanded since the config was written
+	s.installSlots(snap.SlotNum, slots)
+	s.setSlotNum(snap.SlotNum)
+	s.users.Store(users)
+	s.lastActionSeq = snap.LastActionSeq
+	return nil
+}
+
+// startStale serves from the snapshot file until zk state is read, it
+// returns false if there is no usable snapshot.
+func (s *Server) startStale() bool {
+	snap, err := readSnapshot(s.snapshotFile)
+	if err != nil {
+		log.Warning("can not start from topology snapshot", errors.ErrorStack(err))
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.restoreSnapshot(snap); err != nil {
+		log.Warning("can not start from topology snapshot", errors.ErrorStack(err))
+		return false
+	}
+
+	log.Warningf("stale mode, serving topology of %s saved at %v until zk is available", s.snapshotFile, snap.SavedAt)
+	atomic.StoreInt32(&s.stale, 1)
+	s.counter.Add("StaleStart", 1)
+	go s.leaveStale()
+	return true
+}
+
+// leaveStale switches to the authoritative zk state once zk is available.
+func (s *Server) leaveStale() {
+	backoff := recoverMinBackoff
+	for {
+		_, err := s.top.GetSlotMeta()
+		if err == nil {
+			break
+		}
+
+		log.Warning("zk not available, stay in stale mode", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > recoverMaxBackoff {
+			backoff = recoverMaxBackoff
+		}
+	}
+
+	s.checkSlotMeta()
+
+	s.mu.Lock()
+	if err := s.reloadProxyConfig(); err != nil {
+		log.Warning("load proxy config failed", errors.ErrorStack(err))
+	}
+	s.mu.Unlock()
+
+	//registered offline like any starting proxy, serving the snapshot until
+	//it is marked online
+	s.RegisterAndWait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recoverTopology()
+
+	atomic.StoreInt32(&s.stale, 0)
+	s.saveSnapshot()
+	log.Warning("leave stale mode, topology read from zk")
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+	"github.com/ledisdb/xcodis/proxy/router/topology"
+
+	stats "github.com/ngaut/gostats"
+	"github.com/ngaut/zkhelper"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g1 := &models.ServerGroup{Id: 1, ProductName: "test", Servers: []models.Server{{Type: models.SERVER_TYPE_MASTER, Addr: "127.0.0.1:6379", GroupId: 1}}}
+	g2 := &models.ServerGroup{Id: 2, ProductName: "test", Servers: []models.Server{{Type: models.SERVER_TYPE_MASTER, Addr: "127.0.0.1:6380", GroupId: 2}}}
+
+	slots := make(map[int]*Slot, 16)
+	for i := 0; i < 16; i++ {
+		info := models.NewSlot("test", i)
+		info.GroupId = 1
+		info.State.Status = models.SLOT_STATUS_ONLINE
+		slots[i] = newSlot(info, g1, nil)
+	}
+	migrating := models.NewSlot("test", 3)
+	migrating.GroupId = 2
+	migrating.State.Status = models.SLOT_STATUS_MIGRATE
+	migrating.State.MigrateStatus.From = 1
+	migrating.State.MigrateStatus.To = 2
+	slots[3] = newSlot(migrating, g2, g1)
+
+	src := &Server{top: &topology.Topology{ProductName: "test"}, slotNum: 16, dbNum: 16, lastActionSeq: 42}
+	src.swapSlots(slots)
+	src.users.Store(map[string]*models.User{"app": {Name: "app", ReadOnly: true}})
+
+	file := filepath.Join(dir, "topology.json")
+	if err := writeSnapshot(file, src.takeSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := readSnapshot(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &Server{top: &topology.Topology{ProductName: "test"}, slotNum: 16, dbNum: 16}
+	if err := dst.restoreSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.lastActionSeq != 42 {
+		t.Error("action seq not restored", dst.lastActionSeq)
+	}
+	if u := dst.getUser("app"); u == nil || !u.ReadOnly {
+		t.Error("users not restored", u)
+	}
+
+	slot := dst.getSlot(3)
+	if slot.slotInfo.State.Status != models.SLOT_STATUS_MIGRATE || slot.groupInfo.Id != 2 || slot.migrateFrom == nil {
+		t.Errorf("migrating slot not restored, %+v", slot)
+	}
+	if slot := dst.getSlot(0); slot.groupInfo.Id != 1 || slot.migrateFrom != nil {
+		t.Errorf("online slot not restored, %+v", slot)
+	}
+
+	//snapshot of another product or layout is rejected
+	other := &Server{top: &topology.Topology{ProductName: "other"}, slotNum: 16, dbNum: 16}
+	if err := other.restoreSnapshot(snap); err == nil {
+		t.Error("should fail")
+	}
+	virtual := &Server{top: &topology.Topology{ProductName: "test"}, slotNum: 16, dbNum: 4}
+	if err := virtual.restoreSnapshot(snap); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestLeaveStaleRegistersOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "topology.json")
+	g := &models.ServerGroup{Id: 1, ProductName: "stale", Servers: []models.Server{{Type: models.SERVER_TYPE_MASTER, Addr: "127.0.0.1:6379", GroupId: 1}}}
+	slots := make(map[int]*Slot, 16)
+	for i := 0; i < 16; i++ {
+		info := models.NewSlot("stale", i)
+		info.GroupId = 1
+		info.State.Status = models.SLOT_STATUS_ONLINE
+		slots[i] = newSlot(info, g, nil)
+	}
+	src := &Server{top: &topology.Topology{ProductName: "stale"}, slotNum: 16, dbNum: 16}
+	src.swapSlots(slots)
+	if err := writeSnapshot(file, src.takeSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeZkConn := zkhelper.NewConn()
+	s := &Server{
+		top:          topology.NewTopo("stale", "", func(string) (zkhelper.Conn, error) { return fakeZkConn, nil }),
+		snapshotFile: file,
+		slotNum:      16,
+		dbNum:        16,
+		counter:      stats.NewCounters(""),
+		evtbus:       make(chan interface{}, 100),
+	}
+	s.pi.Id = "proxy_stale"
+	s.pi.State = models.PROXY_STATE_OFFLINE
+	if !s.startStale() {
+		t.Fatal("should start from the snapshot")
+	}
+
+	//an operator has to mark it online, as for any starting proxy
+	var pi *models.ProxyInfo
+	for i := 0; i < 100 && pi == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		pi, _ = models.GetProxyInfo(fakeZkConn, "stale", s.pi.Id)
+	}
+	if pi == nil || pi.State != models.PROXY_STATE_OFFLINE {
+		t.Fatalf("proxy should register offline, %+v", pi)
+	}
+	if atomic.LoadInt32(&s.stale) != 1 {
+		t.Error("should stay stale until online")
+	}
+}
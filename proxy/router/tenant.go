@@ -0,0 +1,309 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ledisdb/xcodis/models"
+	"github.com/ledisdb/xcodis/proxy/parser"
+
+	"github.com/juju/errors"
+	stats "github.com/ngaut/gostats"
+	log "github.com/ngaut/logging"
+)
+
+// Proxy accepts client connections and dispatches every session to the
+// Server of its product. When products have passwords, the AUTH password
+// selects the product and sessions must authenticate before anything else.
+type Proxy struct {
+	addr        string
+	net_timeout int //seconds
+	conf        *Conf
+
+	products  map[string]*Server //product name -> server
+	passwords map[string]*Server //password -> server
+	def       *Server            //product of sessions not authenticated
+
+	counter *stats.Counters
+}
+
+// NewProxy loads every product in conf and blocks until all of them are online.
+func NewProxy(addr string, debugVarAddr string, conf *Conf) *Proxy {
+	if len(conf.zkRoot) > 0 {
+		if err := models.SetRootPath(conf.zkRoot); err != nil {
+			log.Fatal(errors.ErrorStack(err))
+		}
+	}
+
+	//acl denials go to main log if not set
+	if len(conf.auditLogFile) > 0 {
+		auditLog, err := openAuditLog(conf.auditLogFile)
+		if err != nil {
+			log.Fatal(errors.ErrorStack(err))
+		}
+		conf.auditLog = auditLog
+		for _, t := range conf.tenants {
+			t.auditLog = auditLog
+		}
+	}
+
+	if len(conf.tenants) == 0 {
+		p := newProxy(addr, conf.net_timeout, []*Server{NewServer(addr, debugVarAddr, conf)})
+		p.conf = conf
+		return p
+	}
+
+	counter := stats.NewCounters("router")
+	startAt := time.Now()
+	stats.Publish("startAt", stats.StringFunc(func() string {
+		return startAt.String()
+	}))
+
+	//every product waits to be set online on its own
+	servers := make([]*Server, len(conf.tenants))
+	var wg sync.WaitGroup
+	for i, t := range conf.tenants {
+		wg.Add(1)
+		go func(i int, t *Conf) {
+			defer wg.Done()
+			servers[i] = newServer(addr, debugVarAddr, t, counter)
+		}(i, t)
+	}
+	wg.Wait()
+
+	p := newProxy(addr, conf.net_timeout, servers)
+	p.conf = conf
+	return p
+}
+
+// ReloadConf re-reads the config file and applies its reloadable options,
+// changes of other options are logged and need a restart.
+func (p *Proxy) ReloadConf(configFile string) error {
+	conf, err := LoadConf(configFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if p.conf.file != nil {
+		for _, key := range conf.file.Changed(p.conf.file) {
+			if !conf.file.Reloadable(key) {
+				log.Warningf("config %s changed, restart to apply it", key)
+			}
+		}
+	}
+
+	tenants := conf.tenants
+	if len(tenants) == 0 {
+		tenants = []*Conf{conf}
+	}
+	for _, t := range tenants {
+		s, ok := p.products[t.productName]
+		if !ok {
+			continue
+		}
+		if err := s.reloadConf(t); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	p.conf = conf
+	log.Infof("config %s reloaded", configFile)
+	return nil
+}
+
+func newProxy(addr string, timeout int, servers []*Server) *Proxy {
+	p := &Proxy{
+		addr:        addr,
+		net_timeout: timeout,
+		products:    make(map[string]*Server),
+		passwords:   make(map[string]*Server),
+		counter:     servers[0].counter,
+	}
+
+	passwords := 0
+	for _, s := range servers {
+		p.products[s.top.ProductName] = s
+		if len(s.password) > 0 {
+			p.passwords[s.password] = s
+			passwords++
+		}
+		if len(s.internalPassword) > 0 {
+			p.passwords[s.internalPassword] = s
+		}
+	}
+
+	//a product with users still rejects sessions not authenticated
+	if passwords == 0 && len(servers) == 1 {
+		p.def = servers[0]
+	}
+
+	return p
+}
+
+func (p *Proxy) Run() {
+	log.Info("listening on", p.addr)
+	listener, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Warning(errors.ErrorStack(err))
+			continue
+		}
+		go p.handleConn(conn)
+	}
+}
+
+func (p *Proxy) handleConn(c net.Conn) {
+	log.Info("new connection", c.RemoteAddr())
+
+	p.counter.Add("connections", 1)
+	client := &session{
+		Conn:     c,
+		r:        bufio.NewReader(c),
+		CreateAt: time.Now(),
+	}
+
+	var err error
+
+	defer func() {
+		if err != nil { //todo: fix this ugly error check
+			if GetOriginError(err.(*errors.Err)).Error() != io.EOF.Error() {
+				log.Warningf("close connection %v, %+v, %v", c.RemoteAddr(), client, errors.ErrorStack(err))
+			} else {
+				log.Infof("close connection %v, %+v", c.RemoteAddr(), client)
+			}
+		} else {
+			log.Infof("close connection %v, %+v", c.RemoteAddr(), client)
+		}
+
+		c.Close()
+		p.counter.Add("connections", -1)
+	}()
+
+	for {
+		err = p.tunnel(client)
+		if err != nil {
+			return
+		}
+		client.Ops++
+	}
+}
+
+func (p *Proxy) tunnel(c *session) error {
+	resp, err := parser.Parse(c.r) // read client request
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	op, keys, err := resp.GetOpKeys()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	switch strings.ToUpper(string(op)) {
+	case "AUTH":
+		return p.handleAuth(c, keys)
+	case "QUIT":
+		if c.srv == nil {
+			writeReply2Client(c, OK_BYTES, p.net_timeout)
+			return errors.Trace(io.EOF)
+		}
+	}
+
+	if c.srv == nil {
+		if p.def == nil {
+			p.counter.Add("NoAuth", 1)
+			return errors.Trace(writeReply2Client(c, NOAUTH_BYTES, p.net_timeout))
+		}
+		c.srv = p.def
+	}
+
+	return c.srv.redisTunnel(c, resp, op, keys)
+}
+
+//AUTH <password>, AUTH <user> <password> or AUTH <product> <password>,
+//a user may be given as user@product if the name is used by several products
+func (p *Proxy) handleAuth(c *session, args [][]byte) error {
+	var s *Server
+	var user string
+	switch len(args) {
+	case 1:
+		s = p.passwords[string(args[0])]
+		if s == nil && p.def != nil && !p.def.authEnabled() {
+			//auth disabled, accept any password as before
+			s = p.def
+		}
+	case 2:
+		s, user = p.authUser(string(args[0]), string(args[1]))
+	default:
+		return errors.Trace(writeReply2Client(c,
+			[]byte("-ERR wrong number of arguments for 'auth' command\r\n"), p.net_timeout))
+	}
+
+	if s == nil {
+		p.counter.Add("AuthFailed", 1)
+		log.Warningf("auth failed, client: %s", c.RemoteAddr().String())
+		return errors.Trace(writeReply2Client(c, WRONGPASS_BYTES, p.net_timeout))
+	}
+
+	c.srv = s
+	c.user = user
+	c.authed = true
+	return errors.Trace(writeReply2Client(c, OK_BYTES, p.net_timeout))
+}
+
+func (p *Proxy) authUser(name string, password string) (*Server, string) {
+	candidates := make([]*Server, 0, len(p.products))
+	if pos := strings.LastIndex(name, "@"); pos >= 0 {
+		if s, ok := p.products[name[pos+1:]]; ok {
+			candidates = append(candidates, s)
+			name = name[:pos]
+		}
+	}
+	if len(candidates) == 0 {
+		for _, s := range p.products {
+			candidates = append(candidates, s)
+		}
+	}
+
+	//a user of several products with the same password must name one
+	var matched []*Server
+	for _, s := range candidates {
+		if u := s.getUser(name); u != nil && u.CheckPassword(password) {
+			matched = append(matched, s)
+		}
+	}
+	if len(matched) == 1 {
+		return matched[0], name
+	}
+	if len(matched) > 1 {
+		products := make([]string, 0, len(matched))
+		for _, s := range matched {
+			products = append(products, s.top.ProductName)
+		}
+		sort.Strings(products)
+		log.Warningf("user %s matches products %v, auth with user@product", name, products)
+		return nil, ""
+	}
+
+	//product name with product password
+	if s, ok := p.products[name]; ok && len(s.password) > 0 &&
+		subtle.ConstantTimeCompare([]byte(s.password), []byte(password)) == 1 {
+		return s, ""
+	}
+
+	return nil, ""
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package router
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ledisdb/xcodis/models"
+	"github.com/ledisdb/xcodis/proxy/cachepool"
+	topo "github.com/ledisdb/xcodis/proxy/router/topology"
+
+	stats "github.com/ngaut/gostats"
+)
+
+func TestProxyAuth(t *testing.T) {
+	counter := stats.NewCounters("")
+	foo := &Server{top: &topo.Topology{ProductName: "foo"}, password: "foopass", counter: counter}
+	bar := &Server{top: &topo.Topology{ProductName: "bar"}, password: "barpass", counter: counter}
+	p := newProxy(":0", 5, []*Server{foo, bar})
+	if p.def != nil {
+		t.Fatal("auth should be required")
+	}
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+	c := &session{Conn: srv, r: bufio.NewReader(srv)}
+	r := bufio.NewReader(cli)
+
+	tbl := []struct {
+		cmd    string
+		reply  string
+		server *Server
+	}{
+		{"GET a\r\n", string(NOAUTH_BYTES), nil},
+		{"AUTH wrong\r\n", string(WRONGPASS_BYTES), nil},
+		{"AUTH barpass\r\n", string(OK_BYTES), bar},
+		{"AUTH foo barpass\r\n", string(WRONGPASS_BYTES), bar},
+		{"AUTH foo foopass\r\n", string(OK_BYTES), foo},
+	}
+
+	for _, v := range tbl {
+		go cli.Write([]byte(v.cmd))
+		errc := make(chan error, 1)
+		go func() { errc <- p.tunnel(c) }()
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if line != v.reply {
+			t.Errorf("%q: expect %q, got %q", v.cmd, v.reply, line)
+		}
+		if c.srv != v.server {
+			t.Errorf("%q: session product not match", v.cmd)
+		}
+	}
+}
+
+func TestProxyAuthUser(t *testing.T) {
+	hash, err := models.HashPassword("apppass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := stats.NewCounters("")
+	foo := &Server{top: &topo.Topology{ProductName: "foo"}, password: "foopass", counter: counter}
+	bar := &Server{top: &topo.Topology{ProductName: "bar"}, password: "barpass", counter: counter}
+	foo.users.Store(map[string]*models.User{"app": {Name: "app", Password: hash}, "web": {Name: "web", Password: hash}})
+	bar.users.Store(map[string]*models.User{"app": {Name: "app", Password: hash}})
+	p := newProxy(":0", 5, []*Server{foo, bar})
+
+	tbl := []struct {
+		name   string
+		server *Server
+	}{
+		{"web", foo},
+		{"app", nil}, //ambiguous, same user and password in both
+		{"app@foo", foo},
+		{"app@bar", bar},
+	}
+	for _, v := range tbl {
+		if s, _ := p.authUser(v.name, "apppass"); s != v.server {
+			t.Errorf("%s: product not match", v.name)
+		}
+	}
+}
+
+func TestProxyNoAuth(t *testing.T) {
+	s := &Server{top: &topo.Topology{ProductName: "foo"}, counter: stats.NewCounters("")}
+	p := newProxy(":0", 5, []*Server{s})
+	if p.def != s {
+		t.Fatal("single product without password should be default")
+	}
+}
+
+func TestReloadConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.ini")
+	write := func(s string) {
+		if err := ioutil.WriteFile(file, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//errors of the file are reported, not replaced by defaults
+	write("zk=localhost:2181\nproduct=test\nproxy_id=p1\nnet_timeout=5d\n")
+	if _, err := LoadConf(file); err == nil {
+		t.Fatal("net_timeout=5d should be invalid")
+	}
+	write("zk=localhost:2181\nproxy_id=p1\nproducts=foo\n")
+	if _, err := LoadConf(file); err == nil {
+		t.Fatal("foo.password should be required")
+	}
+	write("zk=localhost:2181\nproxy_id=p1\n")
+	if _, err := LoadConf(file); err == nil {
+		t.Fatal("product should be required")
+	}
+
+	write("zk=localhost:2181\nproduct=test\nproxy_id=p1\nnet_timeout=5\nslot_num=8\n")
+	conf, err := LoadConf(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.net_timeout != 5 || conf.slot_num != 8 || conf.db_num != 8 || conf.premigrateWait != 3000 ||
+		conf.concurrentLimit != defaultConcurrentLimit || conf.broker != "ledisdb" {
+		t.Fatalf("%+v", conf)
+	}
+
+	s := &Server{top: &topo.Topology{ProductName: "test"}, conf: conf, pools: cachepool.NewCachePool(),
+		netTimeoutSec: 5, premigrateWaitMs: 3000, counter: stats.NewCounters("")}
+	s.setConcurrentLimit(conf.concurrentLimit)
+	p := newProxy(":0", 5, []*Server{s})
+	p.conf = conf
+
+	write("zk=localhost:2181\nproduct=test\nproxy_id=p1\nnet_timeout=7s\nslot_num=8\nconcurrent_limit=20\npremigrate_wait_ms=100\n")
+	if err := p.ReloadConf(file); err != nil {
+		t.Fatal(err)
+	}
+	if s.netTimeout() != 7 || s.concurrentLimit != 20 || atomic.LoadInt32(&s.premigrateWaitMs) != 100 {
+		t.Fatal(s.netTimeout(), s.concurrentLimit, s.premigrateWaitMs)
+	}
+
+	//proxy config in zk still wins
+	s.proxyConfig = &models.ProxyConfig{Version: 1, NetTimeout: 3}
+	write("zk=localhost:2181\nproduct=test\nproxy_id=p1\nnet_timeout=9\nslot_num=8\n")
+	if err := p.ReloadConf(file); err != nil {
+		t.Fatal(err)
+	}
+	if s.netTimeout() != 3 || s.concurrentLimit != defaultConcurrentLimit {
+		t.Fatal(s.netTimeout(), s.concurrentLimit)
+	}
+
+	//an invalid file keeps the running config
+	write("zk=localhost:2181\nproduct=test\nproxy_id=p1\nconcurrent_limit=x\n")
+	if err := p.ReloadConf(file); err == nil {
+		t.Fatal("concurrent_limit=x should be invalid")
+	}
+	if s.conf.net_timeout != 9 {
+		t.Fatal(s.conf.net_timeout)
+	}
+}
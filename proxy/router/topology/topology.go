@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"path"
+	"sync"
 
 	"github.com/ngaut/zkhelper"
 
@@ -27,20 +28,40 @@ type ZkFactory func(zkAddr string) (zkhelper.Conn, error)
 type Topology struct {
 	ProductName string
 	zkAddr      string
-	zkConn      zkhelper.Conn
 	fact        ZkFactory
+
+	mu     sync.RWMutex
+	zkConn zkhelper.Conn
+}
+
+func (top *Topology) conn() zkhelper.Conn {
+	top.mu.RLock()
+	defer top.mu.RUnlock()
+	return top.zkConn
 }
 
 func (top *Topology) GetGroup(groupId int) (*models.ServerGroup, error) {
-	return models.GetGroup(top.zkConn, top.ProductName, groupId)
+	return models.GetGroup(top.conn(), top.ProductName, groupId)
+}
+
+func (top *Topology) GetUsers() ([]models.User, error) {
+	return models.Users(top.conn(), top.ProductName)
+}
+
+func (top *Topology) GetSlotMeta() (*models.SlotMeta, error) {
+	return models.GetSlotMeta(top.conn(), top.ProductName)
+}
+
+func (top *Topology) GetProxyList(filter func(*models.ProxyInfo) bool) ([]models.ProxyInfo, error) {
+	return models.ProxyList(top.conn(), top.ProductName, filter)
 }
 
 func (top *Topology) Exist(path string) (bool, error) {
-	return zkhelper.NodeExists(top.zkConn, path)
+	return zkhelper.NodeExists(top.conn(), path)
 }
 
 func (top *Topology) GetSlotByIndex(i int) (*models.Slot, *models.ServerGroup, error) {
-	slot, err := models.GetSlot(top.zkConn, top.ProductName, i)
+	slot, err := models.GetSlot(top.conn(), top.ProductName, i)
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
@@ -50,7 +71,7 @@ func (top *Topology) GetSlotByIndex(i int) (*models.Slot, *models.ServerGroup, e
 		log.Errorf("slot not online, %+v", slot)
 	}
 
-	groupServer, err := models.GetGroup(top.zkConn, top.ProductName, slot.GroupId)
+	groupServer, err := models.GetGroup(top.conn(), top.ProductName, slot.GroupId)
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
@@ -68,35 +89,108 @@ func NewTopo(ProductName string, zkAddr string, f ZkFactory) *Topology {
 }
 
 func (top *Topology) InitZkConn() {
-	var err error
-	top.zkConn, err = top.fact(top.zkAddr)
+	conn, err := top.fact(top.zkAddr)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	top.mu.Lock()
+	top.zkConn = conn
+	top.mu.Unlock()
+}
+
+// Reconnect replaces the zk connection with a new one.
+func (top *Topology) Reconnect() error {
+	conn, err := top.fact(top.zkAddr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	top.mu.Lock()
+	old := top.zkConn
+	top.zkConn = conn
+	top.mu.Unlock()
+
+	if old != conn {
+		old.Close()
+	}
+	return nil
 }
 
 func (top *Topology) GetActionWithSeq(seq int64) (*models.Action, error) {
-	return models.GetActionWithSeq(top.zkConn, top.ProductName, seq)
+	return models.GetActionWithSeq(top.conn(), top.ProductName, seq)
 }
 
 func (top *Topology) GetActionWithSeqObject(seq int64, act *models.Action) error {
-	return models.GetActionObject(top.zkConn, top.ProductName, seq, act)
+	return models.GetActionObject(top.conn(), top.ProductName, seq, act)
 }
 
 func (top *Topology) GetActionSeqList(productName string) ([]int, error) {
-	return models.GetActionSeqList(top.zkConn, productName)
+	return models.GetActionSeqList(top.conn(), productName)
 }
 
 func (top *Topology) IsChildrenChangedEvent(e interface{}) bool {
 	return e.(topo.Event).Type == topo.EventNodeChildrenChanged
 }
 
+// IsClosingEvent reports if the watch ended with a connection replaced or
+// closed by us, the watch is set again on the new connection if needed.
+func (top *Topology) IsClosingEvent(e interface{}) bool {
+	return e.(topo.Event).Err == topo.ErrClosing
+}
+
+// IsWatchLostEvent reports if the watch was dropped by zk, e.g. session expired.
+func (top *Topology) IsWatchLostEvent(e interface{}) bool {
+	evt := e.(topo.Event)
+	if top.IsClosingEvent(e) {
+		return false
+	}
+
+	return evt.Type == topo.EventNotWatching || evt.State == topo.StateExpired
+}
+
 func (top *Topology) CreateProxyInfo(pi *models.ProxyInfo) (string, error) {
-	return models.CreateProxyInfo(top.zkConn, top.ProductName, pi)
+	return models.CreateProxyInfo(top.conn(), top.ProductName, pi)
 }
 
 func (top *Topology) GetProxyInfo(proxyName string) (*models.ProxyInfo, error) {
-	return models.GetProxyInfo(top.zkConn, top.ProductName, proxyName)
+	return models.GetProxyInfo(top.conn(), top.ProductName, proxyName)
+}
+
+func (top *Topology) SetProxyConfigVersion(proxyName string, version int) error {
+	return models.SetProxyConfigVersion(top.conn(), top.ProductName, proxyName, version)
+}
+
+// WatchProxyConfig returns the proxy config, nil if not set, and watches it
+// until it is changed, created or deleted. An undecodable config is a not
+// valid error, the watch is kept.
+func (top *Topology) WatchProxyConfig(evtbus chan interface{}) (*models.ProxyConfig, error) {
+	zkPath := models.GetProxyConfigPath(top.ProductName)
+	for {
+		data, _, evtch, err := top.conn().GetW(zkPath)
+		if err == nil {
+			go top.doWatch(evtch, evtbus)
+			var c models.ProxyConfig
+			if err := json.Unmarshal(data, &c); err != nil {
+				//still watched, a fixed config is reloaded
+				return nil, errors.NewNotValid(err, "undecodable proxy config")
+			}
+			return &c, nil
+		}
+		if !zkhelper.ZkErrorEqual(err, topo.ErrNoNode) {
+			return nil, errors.Trace(err)
+		}
+
+		exist, _, evtch, err := top.conn().ExistsW(zkPath)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !exist {
+			go top.doWatch(evtch, evtbus)
+			return nil, nil
+		}
+		//created meanwhile
+	}
 }
 
 func (top *Topology) GetActionResponsePath(seq int) string {
@@ -104,24 +198,29 @@ func (top *Topology) GetActionResponsePath(seq int) string {
 }
 
 func (top *Topology) SetProxyStatus(proxyName string, status string) error {
-	return models.SetProxyStatus(top.zkConn, top.ProductName, proxyName, status)
+	return models.SetProxyStatus(top.conn(), top.ProductName, proxyName, status)
 }
 
 func (top *Topology) Close(proxyName string) {
-	zkhelper.DeleteRecursive(top.zkConn, path.Join(models.GetProxyPath(top.ProductName), proxyName), -1)
-	top.zkConn.Close()
+	zkhelper.DeleteRecursive(top.conn(), path.Join(models.GetProxyPath(top.ProductName), proxyName), -1)
+	top.conn().Close()
 }
 
-func (top *Topology) DoResponse(seq int, pi *models.ProxyInfo) error {
+// DoResponse confirms action seq, with the error if the proxy failed to apply it.
+func (top *Topology) DoResponse(seq int, pi *models.ProxyInfo, actErr error) error {
 	//create response node
 	actionPath := top.GetActionResponsePath(seq)
 	//log.Debug("actionPath:", actionPath)
-	data, err := json.Marshal(pi)
+	resp := models.ActionResponse{ProxyInfo: *pi}
+	if actErr != nil {
+		resp.Error = actErr.Error()
+	}
+	data, err := json.Marshal(resp)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	_, err = top.zkConn.Create(path.Join(actionPath, pi.Id), data,
+	_, err = top.conn().Create(path.Join(actionPath, pi.Id), data,
 		0, zkhelper.DefaultACLs())
 
 	return err
@@ -130,9 +229,6 @@ func (top *Topology) DoResponse(seq int, pi *models.ProxyInfo) error {
 func (top *Topology) doWatch(evtch <-chan topo.Event, evtbus chan interface{}) {
 	e := <-evtch
 	log.Infof("topo event %+v", e)
-	if e.State == topo.StateExpired {
-		log.Fatalf("session expired: %+v", e)
-	}
 
 	switch e.Type {
 	//case topo.EventNodeCreated:
@@ -147,7 +243,7 @@ func (top *Topology) doWatch(evtch <-chan topo.Event, evtbus chan interface{}) {
 }
 
 func (top *Topology) WatchChildren(path string, evtbus chan interface{}) ([]string, error) {
-	content, _, evtch, err := top.zkConn.ChildrenW(path)
+	content, _, evtch, err := top.conn().ChildrenW(path)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -157,7 +253,7 @@ func (top *Topology) WatchChildren(path string, evtbus chan interface{}) ([]stri
 }
 
 func (top *Topology) WatchNode(path string, evtbus chan interface{}) ([]byte, error) {
-	content, _, evtch, err := top.zkConn.GetW(path)
+	content, _, evtch, err := top.conn().GetW(path)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
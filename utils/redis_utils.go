@@ -26,11 +26,16 @@ func SlotsInfo(addr string, fromSlot, toSlot int) (map[int]int, error) {
 		ret[i] = 0
 	}
 
-	var reply []string
-
-	//we use info keyspace
-	reply, err = redis.Strings(c.Do("info", "keyspace"))
-	for _, s := range reply {
+	//we use info keyspace, one dbN:keys=...,expires=... line per database
+	reply, err := redis.String(c.Do("info", "keyspace"))
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(reply, "\n") {
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, "db") {
+			continue
+		}
 		var index int
 		var number int
 		var extra string
@@ -4,14 +4,11 @@
 package utils
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
 
 	log "github.com/ngaut/logging"
 
-	"github.com/ngaut/zkhelper"
-
 	"github.com/c4pt0r/cfg"
 )
 
@@ -35,12 +32,6 @@ func InitConfigFromFile(filename string) (*cfg.Cfg, error) {
 	return ret, nil
 }
 
-func GetZkLock(zkConn zkhelper.Conn, productName string) zkhelper.ZLocker {
-	zkPath := fmt.Sprintf("/zk/codis/db_%s/LOCK", productName)
-	ret := zkhelper.CreateMutex(zkConn, zkPath)
-	return ret
-}
-
 func GetExecutorPath() string {
 	filedirectory := filepath.Dir(os.Args[0])
 	execPath, err := filepath.Abs(filedirectory)